@@ -0,0 +1,9 @@
+#!/bin/bash
+
+cd dev_utils || exit 1
+
+# Apply the pipeline specific additions to the sda-db schema
+for sql in db/*.sql; do
+    echo "Applying $sql"
+    docker exec -i db psql -U postgres -d lega -v ON_ERROR_STOP=1 < "$sql" || exit 1
+done
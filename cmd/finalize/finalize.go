@@ -3,226 +3,58 @@
 package main
 
 import (
-	"encoding/json"
-	"os"
-
 	"sda-pipeline/internal/broker"
 	"sda-pipeline/internal/config"
 	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/finalize"
+	"sda-pipeline/internal/tracing"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// finalize struct that holds the json message data
-type finalize struct {
-	Type               string      `json:"type"`
-	User               string      `json:"user"`
-	Filepath           string      `json:"filepath"`
-	AccessionID        string      `json:"accession_id"`
-	DecryptedChecksums []checksums `json:"decrypted_checksums"`
-}
-
-// Checksums is struct for the checksum type and value
-type checksums struct {
-	Type  string `json:"type"`
-	Value string `json:"value"`
-}
-
-// Completed is struct holding the full message data
-type completed struct {
-	User               string      `json:"user"`
-	Filepath           string      `json:"filepath"`
-	AccessionID        string      `json:"accession_id"`
-	DecryptedChecksums []checksums `json:"decrypted_checksums"`
-}
-
 func main() {
 	conf, err := config.NewConfig("finalize")
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := tracing.Setup(conf.Tracing); err != nil {
+		log.Fatal(err)
+	}
+	defer tracing.Shutdown()
 	mq, err := broker.NewMQ(conf.Broker)
 	if err != nil {
 		log.Fatal(err)
 	}
-	db, err := database.NewDB(conf.Database)
+	db, err := database.NewDatabase(conf.Database)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
+	defer mq.Close()
 	defer db.Close()
 
 	go func() {
-		connError := mq.ConnectionWatcher()
-		log.Error(connError)
-		os.Exit(1)
+		for event := range mq.Events() {
+			switch event.Type {
+			case broker.EventDisconnected:
+				log.Errorf("Lost connection to the broker: %v", event.Err)
+			case broker.EventReconnectFailed:
+				log.Errorf("Failed to reconnect to the broker (attempt: %d, error: %v)", event.Attempt, event.Err)
+			case broker.EventReconnected:
+				log.Infof("Reconnected to the broker after %d attempts", event.Attempt)
+			}
+		}
 	}()
 
 	forever := make(chan bool)
 
 	log.Info("Starting finalize service")
-	var message finalize
 
 	go func() {
-		messages, err := mq.GetMessages(conf.Broker.Queue)
+		err := mq.Consume(conf.Broker.Queue, conf.Broker.Workers, finalize.Handler(conf, mq, db))
 		if err != nil {
 			log.Fatal(err)
 		}
-		for delivered := range messages {
-			log.Debugf("Received a message (corr-id: %s, message: %s)",
-				delivered.CorrelationId,
-				delivered.Body)
-
-			err := mq.ValidateJSON(&delivered,
-				"ingestion-accession",
-				delivered.Body,
-				&message)
-
-			if err != nil {
-				log.Errorf("Validation of incoming message failed "+
-					"(corr-id: %s, error: %v)",
-					delivered.CorrelationId,
-					err)
-				continue
-			}
-
-			// we unmarshal the message in the validation step so this is safe to do
-			_ = json.Unmarshal(delivered.Body, &message)
-
-			log.Infof("Received work (corr-id: %s, "+
-				"filepath: %s, "+
-				"user: %s, "+
-				"accessionid: %s, "+
-				"decryptedChecksums: %v)",
-				delivered.CorrelationId,
-				message.Filepath,
-				message.User,
-				message.AccessionID,
-				message.DecryptedChecksums)
-
-			// Extract the sha256 from the message and use it for the database
-			var checksumSha256 string
-			for _, checksum := range message.DecryptedChecksums {
-				if checksum.Type == "sha256" {
-					checksumSha256 = checksum.Value
-				}
-			}
-
-			c := completed{
-				User:               message.User,
-				Filepath:           message.Filepath,
-				AccessionID:        message.AccessionID,
-				DecryptedChecksums: message.DecryptedChecksums,
-			}
-
-			completeMsg, _ := json.Marshal(&c)
-
-			err = mq.ValidateJSON(&delivered,
-				"ingestion-completion",
-				completeMsg,
-				new(completed))
-
-			if err != nil {
-				log.Errorf("Validation of outgoing message failed "+
-					"(corr-id: %s, "+
-					"filepath: %s, "+
-					"user: %s, "+
-					"accessionid: %s, "+
-					"decryptedChecksums: %v, error: %v)",
-					delivered.CorrelationId,
-					message.Filepath,
-					message.User,
-					message.AccessionID,
-					message.DecryptedChecksums,
-					err)
-
-				continue
-			}
-
-			if err := db.MarkReady(message.AccessionID, message.User, message.Filepath, checksumSha256); err != nil {
-				log.Errorf("MarkReady failed "+
-					"(corr-id: %s, "+
-					"filepath: %s, "+
-					"user: %s, "+
-					"accessionid: %s, "+
-					"decryptedChecksums: %v, error: %v)",
-					delivered.CorrelationId,
-					message.Filepath,
-					message.User,
-					message.AccessionID,
-					message.DecryptedChecksums,
-					err)
-
-				// nack the message but requeue until we fixed the SQL retry.
-				if e := delivered.Nack(false, true); e != nil {
-					log.Errorf("Failed to NAck because of MarkReady failed "+
-						"(corr-id: %s, "+
-						"filepath: %s, "+
-						"user: %s, "+
-						"accessionid: %s, "+
-						"decryptedChecksums: %v, error: %v)",
-						delivered.CorrelationId,
-						message.Filepath,
-						message.User,
-						message.AccessionID,
-						message.DecryptedChecksums,
-						e)
-				}
-				continue
-			}
-
-			log.Infof("Set accession id for file "+
-				"(corr-id: %s, "+
-				"filepath: %s, "+
-				"user: %s, "+
-				"accessionid: %s, "+
-				"decryptedChecksums: %v)",
-				delivered.CorrelationId,
-				message.Filepath,
-				message.User,
-				message.AccessionID,
-				message.DecryptedChecksums)
-
-			log.Debug("Mark ready")
-
-			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingKey, conf.Broker.Durable, completeMsg); err != nil {
-				// TODO fix resend mechanism
-				log.Errorf("Failed to send message for completed "+
-					"(corr-id: %s, "+
-					"filepath: %s, "+
-					"user: %s, "+
-					"accessionid: %s, "+
-					"decryptedChecksums: %v, error: %v)",
-					delivered.CorrelationId,
-					message.Filepath,
-					message.User,
-					message.AccessionID,
-					message.DecryptedChecksums,
-					err)
-
-				// Restart loop, do not ack
-				continue
-			}
-
-			if err := delivered.Ack(false); err != nil {
-
-				log.Errorf("Failed to ack message after work completed "+
-					"(corr-id: %s, "+
-					"filepath: %s, "+
-					"user: %s, "+
-					"accessionid: %s, "+
-					"decryptedChecksums: %v, error: %v)",
-					delivered.CorrelationId,
-					message.Filepath,
-					message.User,
-					message.AccessionID,
-					message.DecryptedChecksums,
-					err)
-
-			}
-		}
 	}()
 
 	<-forever
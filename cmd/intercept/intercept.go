@@ -6,12 +6,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 
 	"sda-pipeline/internal/broker"
 	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/tracing"
 
+	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
 )
 
 const (
@@ -19,25 +21,46 @@ const (
 	msgCancel    string = "cancel"
 	msgIngest    string = "ingest"
 	msgMapping   string = "mapping"
+	msgUnmapping string = "unmapping"
+	msgRelease   string = "release"
+	msgDeprecate string = "deprecate"
 )
 
+// relayError holds what is sent to the error queue for a message that can
+// not be relayed, in the format of the broker's validation errors
+type relayError struct {
+	Error          string `json:"error"`
+	Reason         string `json:"reason"`
+	OrginalMessage []byte `json:"orginal-message"`
+}
+
 func main() {
 	conf, err := config.NewConfig("intercept")
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := tracing.Setup(conf.Tracing); err != nil {
+		log.Fatal(err)
+	}
+	defer tracing.Shutdown()
 	mq, err := broker.NewMQ(conf.Broker)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
+	defer mq.Close()
 
 	go func() {
-		connError := mq.ConnectionWatcher()
-		log.Error(connError)
-		os.Exit(1)
+		for event := range mq.Events() {
+			switch event.Type {
+			case broker.EventDisconnected:
+				log.Errorf("Lost connection to the broker: %v", event.Err)
+			case broker.EventReconnectFailed:
+				log.Errorf("Failed to reconnect to the broker (attempt: %d, error: %v)", event.Attempt, event.Err)
+			case broker.EventReconnected:
+				log.Infof("Reconnected to the broker after %d attempts", event.Attempt)
+			}
+		}
 	}()
 
 	forever := make(chan bool)
@@ -50,72 +73,128 @@ func main() {
 			log.Fatal(err)
 		}
 		for delivered := range messages {
-			log.Debugf("Received a message: %s", delivered.Body)
-
-			msgType, err := typeFromMessage(delivered.Body)
-			if err != nil {
-				log.Errorf("Failed to get type for message "+
-					"(corr-id: %s, error: %v, message: %s)",
-					delivered.CorrelationId,
-					err,
-					delivered.Body)
-				continue
-			}
+			relay(conf, mq, delivered)
+		}
+	}()
 
-			schema, err := schemaNameFromType(msgType)
+	<-forever
+}
 
-			if err != nil {
+// relay validates a message from the federated service and routes it to
+// the local queue for its type. A message without a correlation id is
+// given one, so that it can be followed through the pipeline.
+func relay(conf *config.Config, mq broker.Broker, delivered amqp.Delivery) {
+	if delivered.CorrelationId == "" {
+		delivered.CorrelationId = uuid.New().String()
+		log.Infof("Message without correlation id given corr-id: %s", delivered.CorrelationId)
+	}
 
-				log.Errorf("Don't know schema for message type "+
-					"(corr-id: %s, msgType: %s, error: %v, message: %s)",
-					delivered.CorrelationId,
-					msgType,
-					err,
-					delivered.Body)
-				continue
-			}
+	span := tracing.StartDelivery("process "+conf.Broker.Queue, &delivered)
+	span.SetAttribute("messaging.destination.name", conf.Broker.Queue)
+	defer span.End(nil)
 
-			err = mq.ValidateJSON(&delivered, schema, delivered.Body, nil)
+	log.Debugf("Received a message: %s", delivered.Body)
 
-			if err != nil {
-				log.Errorf("Validation failed for message "+
-					"(corr-id: %s, error: %v, schema: %s, message: %s)",
-					delivered.CorrelationId,
-					err,
-					schema,
-					delivered.Body)
+	msgType, err := typeFromMessage(delivered.Body)
+	if err != nil {
+		log.Errorf("Failed to get type for message "+
+			"(corr-id: %s, error: %v, message: %s)",
+			delivered.CorrelationId,
+			err,
+			delivered.Body)
+		reject(conf, mq, delivered, err)
+
+		return
+	}
 
-				continue
-			}
+	schema, err := schemaNameFromType(msgType)
 
-			routing := map[string]string{
-				msgAccession: "accessionIDs",
-				msgIngest:    "ingest",
-				msgMapping:   "mappings",
-			}
+	if err != nil {
 
-			routingKey := routing[msgType]
+		log.Errorf("Don't know schema for message type "+
+			"(corr-id: %s, msgType: %s, error: %v, message: %s)",
+			delivered.CorrelationId,
+			msgType,
+			err,
+			delivered.Body)
+		reject(conf, mq, delivered, err)
 
-			if routingKey == "" {
-				continue
-			}
+		return
+	}
 
-			log.Infof("Routing message "+
-				"(corr-id: %s, routingkey: %s)",
-				delivered.CorrelationId,
-				routingKey)
+	err = mq.ValidateJSON(&delivered, schema, delivered.Body, nil)
 
-			if err := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, routingKey, conf.Broker.Durable, delivered.Body); err != nil {
-				// TODO fix resend mechanism
-				log.Errorln("We need to fix this resend stuff ...")
-			}
-			if err := delivered.Ack(false); err != nil {
-				log.Errorf("failed to ack message for reason: %v", err)
-			}
+	if err != nil {
+		log.Errorf("Validation failed for message "+
+			"(corr-id: %s, error: %v, schema: %s, message: %s)",
+			delivered.CorrelationId,
+			err,
+			schema,
+			delivered.Body)
+
+		return
+	}
+
+	routing := map[string]string{
+		msgAccession: "accessionIDs",
+		msgIngest:    "ingest",
+		msgMapping:   "mappings",
+		msgUnmapping: "mappings",
+		msgRelease:   "mappings",
+		msgDeprecate: "mappings",
+	}
+
+	routingKey := routing[msgType]
+
+	if routingKey == "" {
+		log.Errorf("No route for message type "+
+			"(corr-id: %s, msgType: %s)",
+			delivered.CorrelationId,
+			msgType)
+		reject(conf, mq, delivered, fmt.Errorf("messages of type %s are not relayed", msgType))
+
+		return
+	}
+
+	log.Infof("Routing message "+
+		"(corr-id: %s, routingkey: %s)",
+		delivered.CorrelationId,
+		routingKey)
+
+	if err := mq.RelayMessage(delivered, conf.Broker.Exchange, routingKey, conf.Broker.Durable); err != nil {
+		log.Errorf("Failed to route message "+
+			"(corr-id: %s, routingkey: %s, reason: %v)",
+			delivered.CorrelationId,
+			routingKey,
+			err)
+
+		// Retry the message so it is routed again
+		if e := mq.Retry(delivered, err); e != nil {
+			log.Errorf("failed to retry message for reason: %v", e)
 		}
-	}()
 
-	<-forever
+		return
+	}
+	if err := delivered.Ack(false); err != nil {
+		log.Errorf("failed to ack message for reason: %v", err)
+	}
+}
+
+// reject nacks a message that can not be relayed, retrying will not help,
+// and reports it on the error queue
+func reject(conf *config.Config, mq broker.Broker, delivered amqp.Delivery, reason error) {
+	if err := delivered.Nack(false, false); err != nil {
+		log.Errorf("Failed to Nack message (corr-id: %s, reason: %v)", delivered.CorrelationId, err)
+	}
+
+	body, _ := json.Marshal(relayError{
+		Error:          "Relaying of message failed",
+		Reason:         reason.Error(),
+		OrginalMessage: delivered.Body,
+	})
+	if err := mq.SendMessageFor(delivered, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); err != nil {
+		log.Errorf("Failed to publish message to error queue (corr-id: %s, reason: %v)", delivered.CorrelationId, err)
+	}
 }
 
 // schemaNameFromType returns the schema to use for messages of
@@ -126,6 +205,9 @@ func schemaNameFromType(msgType string) (string, error) {
 		msgCancel:    "ingestion-trigger",
 		msgIngest:    "ingestion-trigger",
 		msgMapping:   "dataset-mapping",
+		msgUnmapping: "dataset-unmapping",
+		msgRelease:   "dataset-release",
+		msgDeprecate: "dataset-deprecate",
 	}
 
 	if m[msgType] != "" {
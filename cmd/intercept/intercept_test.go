@@ -4,6 +4,10 @@ import (
 	"encoding/json"
 	"testing"
 
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/tracing"
+
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -130,6 +134,23 @@ func (suite *TestSuite) TestMessageSelection_Mapping() {
 	assert.Nil(suite.T(), err, "Unexpected error from schemaNameFromType")
 }
 
+func (suite *TestSuite) TestMessageSelection_Release() {
+	msg := mapping{
+		Type:      "release",
+		DatasetID: "EGAD12345678900",
+	}
+	message, _ := json.Marshal(&msg)
+
+	msgType, err := typeFromMessage(message)
+
+	assert.Nil(suite.T(), err, "Unexpected error from typeFromMessage")
+	assert.Equal(suite.T(), msgRelease, msgType, "message type from message does not match expected")
+
+	schema, err := schemaNameFromType(msgType)
+	assert.Equal(suite.T(), schema, "dataset-release")
+	assert.Nil(suite.T(), err, "Unexpected error from schemaNameFromType")
+}
+
 func (suite *TestSuite) TestMessageSelection_Notype() {
 	msg := missing{
 		User:     "foo",
@@ -146,3 +167,50 @@ func (suite *TestSuite) TestMessageSelection_Notype() {
 	assert.Error(suite.T(), err, "schemaNameFromType did not fail as expected")
 
 }
+
+func (suite *TestSuite) TestRelay_CorrelationID() {
+	conf := &config.Config{Broker: broker.MQConf{Exchange: "sda", Queue: "from_cega", SchemaType: "federated", MaxAttempts: 3}}
+	mq, err := broker.NewMemoryBroker(conf.Broker)
+	assert.NoError(suite.T(), err)
+	defer mq.Close()
+	mq.Bind("ingest", "sda", "ingest")
+
+	message, _ := json.Marshal(&ingest{Type: "ingest", User: "foo", FilePath: "/tmp/foo"})
+	assert.NoError(suite.T(), mq.SendMessage("", "", "from_cega", false, message))
+	messages, err := mq.GetMessages("from_cega")
+	assert.NoError(suite.T(), err)
+
+	relay(conf, mq, <-messages)
+
+	relayed, ok := mq.Get("ingest")
+	assert.True(suite.T(), ok)
+	assert.NotEmpty(suite.T(), relayed.CorrelationId)
+	assert.NotNil(suite.T(), relayed.Headers[tracing.TraceParentHeader])
+	assert.Equal(suite.T(), 0, mq.Unacked())
+}
+
+func (suite *TestSuite) TestRelay_Rejected() {
+	conf := &config.Config{Broker: broker.MQConf{Exchange: "sda", Queue: "from_cega", RoutingError: "error", SchemaType: "federated", MaxAttempts: 3}}
+	mq, err := broker.NewMemoryBroker(conf.Broker)
+	assert.NoError(suite.T(), err)
+	defer mq.Close()
+	mq.Bind("ingest", "sda", "ingest")
+	mq.Bind("error", "sda", "error")
+	messages, err := mq.GetMessages("from_cega")
+	assert.NoError(suite.T(), err)
+
+	cancel, _ := json.Marshal(&ingest{Type: "cancel", User: "foo", FilePath: "/tmp/foo"})
+	typeless, _ := json.Marshal(&missing{User: "foo", FilePath: "/tmp/foo"})
+	for _, message := range [][]byte{cancel, typeless, []byte(`{"type": "unknown"}`), []byte("not json")} {
+		assert.NoError(suite.T(), mq.SendMessage("corr-id", "", "from_cega", false, message))
+		relay(conf, mq, <-messages)
+
+		assert.Equal(suite.T(), 0, mq.Unacked(), string(message))
+		report, ok := mq.Get("error")
+		assert.True(suite.T(), ok, string(message))
+		var rejected relayError
+		assert.NoError(suite.T(), json.Unmarshal(report.Body, &rejected))
+		assert.Equal(suite.T(), message, rejected.OrginalMessage)
+	}
+	assert.Equal(suite.T(), 0, mq.Len("ingest"))
+}
@@ -1,120 +1,61 @@
 // The mapper service register mapping of accessionIDs
-// (IDs for files) to datasetIDs.
+// (IDs for files) to datasetIDs, and handles the release,
+// deprecation and unmapping of datasets.
 package main
 
 import (
-	"encoding/json"
-	"os"
-
 	"sda-pipeline/internal/broker"
 	"sda-pipeline/internal/config"
 	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/mapper"
+	"sda-pipeline/internal/tracing"
 
 	log "github.com/sirupsen/logrus"
 )
 
-type message struct {
-	Type         string   `json:"type"`
-	DatasetID    string   `json:"dataset_id"`
-	AccessionIDs []string `json:"accession_ids"`
-}
-
 func main() {
 	conf, err := config.NewConfig("mapper")
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := tracing.Setup(conf.Tracing); err != nil {
+		log.Fatal(err)
+	}
+	defer tracing.Shutdown()
 	mq, err := broker.NewMQ(conf.Broker)
 	if err != nil {
 		log.Fatal(err)
 	}
-	db, err := database.NewDB(conf.Database)
+	db, err := database.NewDatabase(conf.Database)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
+	defer mq.Close()
 	defer db.Close()
 
 	go func() {
-		connError := mq.ConnectionWatcher()
-		log.Error(connError)
-		os.Exit(1)
+		for event := range mq.Events() {
+			switch event.Type {
+			case broker.EventDisconnected:
+				log.Errorf("Lost connection to the broker: %v", event.Err)
+			case broker.EventReconnectFailed:
+				log.Errorf("Failed to reconnect to the broker (attempt: %d, error: %v)", event.Attempt, event.Err)
+			case broker.EventReconnected:
+				log.Infof("Reconnected to the broker after %d attempts", event.Attempt)
+			}
+		}
 	}()
 
 	forever := make(chan bool)
 
 	log.Info("Starting mapper service")
-	var mappings message
 
 	go func() {
-		messages, err := mq.GetMessages(conf.Broker.Queue)
+		err := mq.Consume(conf.Broker.Queue, conf.Broker.Workers, mapper.Handler(conf, mq, db))
 		if err != nil {
 			log.Fatalf("Failed to get message from mq (error: %v)", err)
 		}
-		for d := range messages {
-			log.Debugf("received a message: %s", d.Body)
-			err := mq.ValidateJSON(&d, "dataset-mapping", d.Body, &mappings)
-			if err != nil {
-				log.Errorf("Failed to validate message for work "+
-					"(corr-id: %s, "+
-					"message: %s, "+
-					"error: %v)",
-					d.CorrelationId,
-					d.Body,
-					err)
-
-				continue
-			}
-
-			if err := json.Unmarshal(d.Body, &mappings); err != nil {
-				log.Errorf("Failed to unmarshal message for work "+
-					"(corr-id: %s, "+
-					"message: %s, "+
-					"error: %v)",
-					d.CorrelationId,
-					d.Body,
-					err)
-
-				continue
-			}
-
-			if err := db.MapFilesToDataset(mappings.DatasetID, mappings.AccessionIDs); err != nil {
-				log.Errorf("MapFilesToDataset failed  "+
-					"(corr-id: %s, "+
-					"datasetid: %s, "+
-					"accessionids: %v, "+
-					"error: %v)",
-					d.CorrelationId,
-					mappings.DatasetID,
-					mappings.AccessionIDs,
-					err)
-			}
-
-			for _, aId := range mappings.AccessionIDs {
-				log.Infof("Mapped file to dataset "+
-					"(corr-id: %s, "+
-					"datasetid: %s, "+
-					"accessionid: %s)",
-					d.CorrelationId,
-					mappings.DatasetID,
-					aId)
-			}
-
-			if err := d.Ack(false); err != nil {
-				log.Errorf("Failed to ack message for work "+
-					"(corr-id: %s, "+
-					"datasetid: %s, "+
-					"accessionids: %v, "+
-					"error: %v)",
-					d.CorrelationId,
-					mappings.DatasetID,
-					mappings.AccessionIDs,
-					err)
-
-			}
-		}
 	}()
 
 	<-forever
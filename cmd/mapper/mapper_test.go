@@ -1,20 +0,0 @@
-package main
-
-import (
-	"testing"
-
-	"github.com/spf13/viper"
-	"github.com/stretchr/testify/suite"
-)
-
-type TestSuite struct {
-	suite.Suite
-}
-
-func TestConfigTestSuite(t *testing.T) {
-	suite.Run(t, new(TestSuite))
-}
-
-func (suite *TestSuite) SetupTest() {
-	viper.Set("log.level", "debug")
-}
@@ -0,0 +1,184 @@
+// The rotatekey command re-encrypts the crypt4gh headers stored in the
+// database from the configured keys to a new public key, the archived files
+// are never touched. Run with "verify" to check that all headers can be
+// decrypted with the configured keys once they have been replaced.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"sda-pipeline/internal/c4gh"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// batchSize is the number of files looked up at a time
+const batchSize = 100
+
+func main() {
+	mode := "rotate"
+	if len(os.Args) > 1 {
+		mode = os.Args[1]
+	}
+
+	conf, err := config.NewConfig("rotatekey")
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := database.NewDatabase(conf.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	keyring, err := config.GetC4GHKeyring()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var failed []int64
+	switch mode {
+	case "rotate":
+		publicKey, err := config.GetC4GHPublicKey("c4gh.rotatepubkey")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Infof("Re-encrypting headers to key %s", c4gh.KeyID(*publicKey))
+		var rotated int
+		rotated, failed, err = rotateHeaders(db, keyring, *publicKey)
+		if err != nil {
+			log.Fatalf("Key rotation stopped after %d headers, run again to resume (error: %v)", rotated, err)
+		}
+		log.Infof("Re-encrypted %d headers", rotated)
+	case "verify":
+		var verified int
+		verified, failed, err = verifyHeaders(db, keyring)
+		if err != nil {
+			log.Fatalf("Verification stopped after %d headers (error: %v)", verified, err)
+		}
+		log.Infof("Verified %d headers", verified)
+	default:
+		log.Fatalf("Unknown command %s, use rotate or verify", mode)
+	}
+
+	if len(failed) > 0 {
+		log.Errorf("Failed to handle the headers of %d files (fileids: %v)", len(failed), failed)
+		os.Exit(1)
+	}
+}
+
+// rotateHeaders re-encrypts every header that is not encrypted to publicKey
+// yet, headers that none of the keys in keyring can decrypt are left as they
+// are and returned. Rotated headers are recorded so that a stopped rotation is
+// resumed where it left off.
+func rotateHeaders(db database.Database, keyring c4gh.Keyring, publicKey [32]byte) (int, []int64, error) {
+	keyID := c4gh.KeyID(publicKey)
+
+	var (
+		rotated int
+		failed  []int64
+		afterID int64
+	)
+	for {
+		fileIDs, err := db.ListHeaderFiles(keyID, afterID, batchSize)
+		if err != nil {
+			return rotated, failed, err
+		}
+		if len(fileIDs) == 0 {
+			return rotated, failed, nil
+		}
+
+		for _, fileID := range fileIDs {
+			afterID = fileID
+
+			header, err := db.GetHeader(int(fileID))
+			if err != nil {
+				return rotated, failed, err
+			}
+
+			newHeader, err := reencryptHeader(header, keyring, publicKey)
+			if err != nil {
+				log.Errorf("Failed to re-encrypt header (fileid: %d, error: %v)", fileID, err)
+				failed = append(failed, fileID)
+
+				continue
+			}
+
+			if err := db.UpdateHeader(fileID, newHeader, keyID); err != nil {
+				return rotated, failed, err
+			}
+			log.Debugf("Re-encrypted header (fileid: %d)", fileID)
+			rotated++
+		}
+	}
+}
+
+// verifyHeaders checks that every header can be decrypted with a key in
+// keyring and is recorded as encrypted to that key, the files that fail are
+// returned
+func verifyHeaders(db database.Database, keyring c4gh.Keyring) (int, []int64, error) {
+	var (
+		verified int
+		failed   []int64
+		afterID  int64
+	)
+	for {
+		fileIDs, err := db.ListHeaderFiles("", afterID, batchSize)
+		if err != nil {
+			return verified, failed, err
+		}
+		if len(fileIDs) == 0 {
+			return verified, failed, nil
+		}
+
+		for _, fileID := range fileIDs {
+			afterID = fileID
+
+			if err := verifyHeader(db, fileID, keyring); err != nil {
+				log.Errorf("Failed to verify header (fileid: %d, error: %v)", fileID, err)
+				failed = append(failed, fileID)
+
+				continue
+			}
+			verified++
+		}
+	}
+}
+
+// verifyHeader checks the header of a single file
+func verifyHeader(db database.Database, fileID int64, keyring c4gh.Keyring) error {
+	header, err := db.GetHeader(int(fileID))
+	if err != nil {
+		return err
+	}
+
+	_, key, err := keyring.DecryptHeader(header)
+	if err != nil {
+		return err
+	}
+
+	recorded, err := db.GetHeaderKeyID(fileID)
+	if err != nil {
+		return err
+	}
+	if recorded != key.ID {
+		return fmt.Errorf("header is recorded as encrypted to key %q", recorded)
+	}
+
+	return nil
+}
+
+// reencryptHeader encrypts header to publicKey with the key in keyring that
+// decrypts it
+func reencryptHeader(header []byte, keyring c4gh.Keyring, publicKey [32]byte) ([]byte, error) {
+	_, key, err := keyring.DecryptHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return c4gh.ReencryptHeader(header, key.PrivateKey, publicKey)
+}
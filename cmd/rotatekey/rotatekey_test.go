@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sda-pipeline/internal/c4gh"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+
+	"github.com/elixir-oslo/crypt4gh/keys"
+	"github.com/elixir-oslo/crypt4gh/model/headers"
+	"github.com/elixir-oslo/crypt4gh/streaming"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type TestSuite struct {
+	suite.Suite
+	db      *database.SQLiteDB
+	dir     string
+	keyring c4gh.Keyring
+	header  []byte
+}
+
+func TestConfigTestSuite(t *testing.T) {
+	suite.Run(t, new(TestSuite))
+}
+
+func (suite *TestSuite) SetupTest() {
+	viper.Set("log.level", "debug")
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+
+	keyring, err := config.GetC4GHKeyring()
+	suite.Require().NoError(err)
+	suite.keyring = keyring
+
+	data, err := ioutil.ReadFile("../../dev_utils/dummy_data.c4gh")
+	suite.Require().NoError(err)
+	suite.header, err = headers.ReadHeader(bytes.NewReader(data))
+	suite.Require().NoError(err)
+
+	suite.dir, err = ioutil.TempDir("", "rotatekey")
+	suite.Require().NoError(err)
+	suite.db, err = database.NewSQLiteDB(filepath.Join(suite.dir, "sda.db"))
+	suite.Require().NoError(err)
+}
+
+func (suite *TestSuite) TearDownTest() {
+	suite.db.Close()
+	os.RemoveAll(suite.dir)
+}
+
+// ingest registers a file with header
+func (suite *TestSuite) ingest(name string, header []byte) int64 {
+	file := database.FileInfo{Checksum: sha256.New(), Size: 10, Path: name, DecryptedChecksum: sha256.New()}
+	_, _ = file.Checksum.Write([]byte(name))
+
+	fileID, err := suite.db.IngestFile("corr-id", "dummy", name, header, "", file)
+	suite.Require().NoError(err)
+
+	return fileID
+}
+
+func (suite *TestSuite) TestRotateHeaders() {
+	good := suite.ingest("/good.c4gh", suite.header)
+	broken := suite.ingest("/broken.c4gh", []byte("not a header"))
+
+	publicKey, privateKey, err := keys.GenerateKeyPair()
+	suite.Require().NoError(err)
+
+	rotated, failed, err := rotateHeaders(suite.db, suite.keyring, publicKey)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, rotated)
+	assert.Equal(suite.T(), []int64{broken}, failed)
+
+	keyID, err := suite.db.GetHeaderKeyID(good)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), c4gh.KeyID(publicKey), keyID)
+
+	// Running again only retries what is left
+	rotated, failed, err = rotateHeaders(suite.db, suite.keyring, publicKey)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, rotated)
+	assert.Equal(suite.T(), []int64{broken}, failed)
+
+	verified, failed, err := verifyHeaders(suite.db, c4gh.Keyring{c4gh.NewKey(privateKey, "")})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, verified)
+	assert.Equal(suite.T(), []int64{broken}, failed)
+
+	verified, failed, err = verifyHeaders(suite.db, suite.keyring)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, verified)
+	assert.Equal(suite.T(), []int64{good, broken}, failed)
+}
+
+// TestRotateHeaders_Keyring rotates a header encrypted to a key that is not
+// the first in the keyring
+func (suite *TestSuite) TestRotateHeaders_Keyring() {
+	oldPublicKey, oldPrivateKey, err := keys.GenerateKeyPair()
+	suite.Require().NoError(err)
+	_, writerKey, err := keys.GenerateKeyPair()
+	suite.Require().NoError(err)
+	var encrypted bytes.Buffer
+	w, err := streaming.NewCrypt4GHWriter(&encrypted, writerKey, oldPublicKey, nil)
+	suite.Require().NoError(err)
+	_, err = w.Write([]byte("data"))
+	suite.Require().NoError(err)
+	suite.Require().NoError(w.Close())
+	header, err := headers.ReadHeader(&encrypted)
+	suite.Require().NoError(err)
+	old := suite.ingest("/old.c4gh", header)
+
+	// The key of the header is not recorded before it is rotated
+	keyring := append(suite.keyring, c4gh.NewKey(oldPrivateKey, ""))
+	verified, failed, err := verifyHeaders(suite.db, keyring)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, verified)
+	assert.Equal(suite.T(), []int64{old}, failed)
+
+	publicKey, privateKey, err := keys.GenerateKeyPair()
+	suite.Require().NoError(err)
+	rotated, failed, err := rotateHeaders(suite.db, keyring, publicKey)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, rotated)
+	assert.Empty(suite.T(), failed)
+
+	verified, failed, err = verifyHeaders(suite.db, c4gh.Keyring{c4gh.NewKey(privateKey, "")})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, verified)
+	assert.Empty(suite.T(), failed)
+}
@@ -0,0 +1,119 @@
+// The schemas command prints the JSON schemas of the messages exchanged
+// through the broker, as they are embedded in the services. Run with "list"
+// to list the schemas, "print <type>/<version>/<name>" to print one of them
+// or "export <directory>" to write all of them to a directory.
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sda-pipeline/schemas"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const usage = "use list, print <type>/<version>/<name> or export <directory>"
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatalf("No command given, %s", usage)
+	}
+
+	var err error
+	switch mode := os.Args[1]; {
+	case mode == "list":
+		err = listSchemas(os.Stdout)
+	case mode == "print" && len(os.Args) == 3:
+		err = printSchema(os.Stdout, os.Args[2])
+	case mode == "export" && len(os.Args) == 3:
+		err = exportSchemas(os.Args[2])
+	default:
+		log.Fatalf("Unknown command %s, %s", strings.Join(os.Args[1:], " "), usage)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// schemaNames returns the paths of the schemas embedded for schemaType,
+// relative to the returned file system
+func schemaNames(schemaType string) (fs.FS, []string, error) {
+	fsys, err := schemas.Embedded(schemaType)
+	if err != nil {
+		return nil, nil, err
+	}
+	names, err := fs.Glob(fsys, "*/*.json")
+
+	return fsys, names, err
+}
+
+// listSchemas writes the names of the embedded schemas to w, one
+// <type>/<version>/<name> per line
+func listSchemas(w io.Writer) error {
+	for _, schemaType := range schemas.Types {
+		_, names, err := schemaNames(schemaType)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Fprintf(w, "%s/%s\n", schemaType, strings.TrimSuffix(name, ".json"))
+		}
+	}
+
+	return nil
+}
+
+// printSchema writes the embedded schema named <type>/<version>/<name> to w
+func printSchema(w io.Writer, schema string) error {
+	parts := strings.SplitN(schema, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("unknown schema %s", schema)
+	}
+	fsys, err := schemas.Embedded(parts[0])
+	if err != nil {
+		return err
+	}
+
+	data, err := fs.ReadFile(fsys, parts[1]+".json")
+	if err != nil {
+		return fmt.Errorf("unknown schema %s", schema)
+	}
+	_, err = w.Write(data)
+
+	return err
+}
+
+// exportSchemas writes the embedded schemas to dir, with one directory for
+// each schema type and version like in the source tree
+func exportSchemas(dir string) error {
+	for _, schemaType := range schemas.Types {
+		fsys, names, err := schemaNames(schemaType)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			data, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return err
+			}
+
+			file := filepath.Join(dir, schemaType, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(file, data, 0644); err != nil {
+				return err
+			}
+		}
+		log.Infof("Exported %d %s schemas to %s", len(names), schemaType, filepath.Join(dir, schemaType))
+	}
+
+	return nil
+}
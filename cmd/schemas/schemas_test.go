@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListSchemas(t *testing.T) {
+	var out bytes.Buffer
+	assert.NoError(t, listSchemas(&out))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 19)
+	assert.Contains(t, lines, "federated/v1/ingestion-trigger")
+	assert.Contains(t, lines, "isolated/v1/ingestion-completion")
+	assert.NotContains(t, lines, "isolated/v1/ingestion-trigger")
+}
+
+func TestPrintSchema(t *testing.T) {
+	var out bytes.Buffer
+	assert.NoError(t, printSchema(&out, "isolated/v1/ingestion-completion"))
+
+	source, err := ioutil.ReadFile("../../schemas/isolated/v1/ingestion-completion.json")
+	assert.NoError(t, err)
+	assert.Equal(t, source, out.Bytes())
+
+	assert.EqualError(t, printSchema(&out, "isolated/v1/ingestion-trigger"), "unknown schema isolated/v1/ingestion-trigger")
+	assert.EqualError(t, printSchema(&out, "central/v1/ingestion-trigger"), "unknown schema type central")
+}
+
+func TestExportSchemas(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, exportSchemas(dir))
+
+	for _, schemaType := range []string{"federated", "isolated"} {
+		source, err := filepath.Glob(filepath.Join("../../schemas", schemaType, "*", "*.json"))
+		assert.NoError(t, err)
+		exported, err := filepath.Glob(filepath.Join(dir, schemaType, "*", "*.json"))
+		assert.NoError(t, err)
+		assert.Len(t, exported, len(source))
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "federated", "v1", "ingestion-trigger.json"))
+	assert.NoError(t, err)
+	source, err := ioutil.ReadFile("../../schemas/federated/v1/ingestion-trigger.json")
+	assert.NoError(t, err)
+	assert.Equal(t, source, data)
+}
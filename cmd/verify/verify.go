@@ -3,57 +3,30 @@
 package main
 
 import (
-	"bytes"
-	"crypto/md5" // #nosec
-	"crypto/sha256"
-	"encoding/json"
-	"fmt"
-	"io"
-	"os"
-
 	"sda-pipeline/internal/broker"
 	"sda-pipeline/internal/config"
 	"sda-pipeline/internal/database"
 	"sda-pipeline/internal/storage"
-
-	"github.com/elixir-oslo/crypt4gh/streaming"
+	"sda-pipeline/internal/tracing"
+	"sda-pipeline/internal/verify"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// Message struct that holds the json message data
-type message struct {
-	FilePath           string      `json:"filepath"`
-	User               string      `json:"user"`
-	FileID             int         `json:"file_id"`
-	ArchivePath        string      `json:"archive_path"`
-	EncryptedChecksums []checksums `json:"encrypted_checksums"`
-	ReVerify           bool        `json:"re_verify"`
-}
-
-// Verified is struct holding the full message data
-type verified struct {
-	User               string      `json:"user"`
-	FilePath           string      `json:"filepath"`
-	DecryptedChecksums []checksums `json:"decrypted_checksums"`
-}
-
-// Checksums is struct for the checksum type and value
-type checksums struct {
-	Type  string `json:"type"`
-	Value string `json:"value"`
-}
-
 func main() {
 	conf, err := config.NewConfig("verify")
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := tracing.Setup(conf.Tracing); err != nil {
+		log.Fatal(err)
+	}
+	defer tracing.Shutdown()
 	mq, err := broker.NewMQ(conf.Broker)
 	if err != nil {
 		log.Fatal(err)
 	}
-	db, err := database.NewDB(conf.Database)
+	db, err := database.NewDatabase(conf.Database)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -63,19 +36,28 @@ func main() {
 		log.Fatal(err)
 	}
 
-	key, err := config.GetC4GHKey()
+	keyring, err := config.GetC4GHKeyring()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := config.CheckC4GHArchiveKey(keyring); err != nil {
+		log.Fatal(err)
+	}
 
-	defer mq.Channel.Close()
-	defer mq.Connection.Close()
+	defer mq.Close()
 	defer db.Close()
 
 	go func() {
-		connError := mq.ConnectionWatcher()
-		log.Error(connError)
-		os.Exit(1)
+		for event := range mq.Events() {
+			switch event.Type {
+			case broker.EventDisconnected:
+				log.Errorf("Lost connection to the broker: %v", event.Err)
+			case broker.EventReconnectFailed:
+				log.Errorf("Failed to reconnect to the broker (attempt: %d, error: %v)", event.Attempt, event.Err)
+			case broker.EventReconnected:
+				log.Infof("Reconnected to the broker after %d attempts", event.Attempt)
+			}
+		}
 	}()
 
 	forever := make(chan bool)
@@ -83,298 +65,11 @@ func main() {
 	log.Info("starting verify service")
 
 	go func() {
-		messages, err := mq.GetMessages(conf.Broker.Queue)
+		err := mq.Consume(conf.Broker.Queue, conf.Broker.Workers, verify.Handler(conf, mq, db, backend, keyring))
 		if err != nil {
 			log.Fatalf("Failed to get messages (error: %v) ",
 				err)
 		}
-		for delivered := range messages {
-			var message message
-			log.Debugf("Received a message (corr-id: %s, message: %s)",
-				delivered.CorrelationId,
-				delivered.Body)
-
-			err := mq.ValidateJSON(&delivered, "ingestion-verification", delivered.Body, &message)
-
-			if err != nil {
-				log.Errorf("Validation (ingestion-verifiation) of incoming message failed "+
-					"(corr-id: %s, error: %v, message: %s)",
-					delivered.CorrelationId,
-					err,
-					delivered.Body)
-
-				// Restart on new message
-				continue
-			}
-
-			// we unmarshal the message in the validation step so this is safe to do
-			_ = json.Unmarshal(delivered.Body, &message)
-
-			log.Infof("Received work "+
-				"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t)",
-				delivered.CorrelationId,
-				message.User,
-				message.FilePath,
-				message.FileID,
-				message.ArchivePath,
-				message.EncryptedChecksums,
-				message.ReVerify)
-
-			header, err := db.GetHeader(message.FileID)
-			if err != nil {
-				log.Errorf("GetHeader failed "+
-					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-					delivered.CorrelationId,
-					message.User,
-					message.FilePath,
-					message.FileID,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					err)
-
-				// Nack message so the server gets notified that something is wrong but don't requeue the message
-				if e := delivered.Nack(false, false); e != nil {
-					log.Errorf("Failed to nack following getheader error message "+
-						"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-						delivered.CorrelationId,
-						message.User,
-						message.FilePath,
-						message.FileID,
-						message.ArchivePath,
-						message.EncryptedChecksums,
-						message.ReVerify,
-						err)
-
-				}
-				// Send the message to an error queue so it can be analyzed.
-				if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, delivered.Body); e != nil {
-					log.Errorf("Failed to publish getheader error message "+
-						"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-						delivered.CorrelationId,
-						message.User,
-						message.FilePath,
-						message.FileID,
-						message.ArchivePath,
-						message.EncryptedChecksums,
-						message.ReVerify,
-						e)
-				}
-				continue
-			}
-
-			var file database.FileInfo
-
-			file.Size, err = backend.GetFileSize(message.ArchivePath)
-
-			if err != nil {
-				log.Errorf("Failed to get archvied file size "+
-					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-					delivered.CorrelationId,
-					message.User,
-					message.FilePath,
-					message.FileID,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					err)
-
-				continue
-			}
-
-			log.Infof("Got archived file size "+
-				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, archivedsize: %d)",
-				delivered.CorrelationId,
-				message.User,
-				message.FilePath,
-				message.ArchivePath,
-				message.EncryptedChecksums,
-				message.ReVerify,
-				file.Size)
-
-			archiveFileHash := sha256.New()
-
-			f, err := backend.NewFileReader(message.ArchivePath)
-			if err != nil {
-				log.Errorf("Failed to open archvied file "+
-					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-					delivered.CorrelationId,
-					message.User,
-					message.FilePath,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					err)
-
-				// Send the message to an error queue so it can be analyzed.
-				fileError := broker.FileError{
-					User:     message.User,
-					FilePath: message.FilePath,
-					Reason:   err.Error(),
-				}
-				body, _ := json.Marshal(fileError)
-				if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
-
-					log.Errorf("Failed to publish file open error message "+
-						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-						delivered.CorrelationId,
-						message.User,
-						message.FilePath,
-						message.ArchivePath,
-						message.EncryptedChecksums,
-						message.ReVerify,
-						e)
-
-				}
-				// Restart on new message
-				continue
-			}
-
-			hr := bytes.NewReader(header)
-			// Feed everything read from the archive file to archiveFileHash
-			mr := io.MultiReader(hr, io.TeeReader(f, archiveFileHash))
-
-			c4ghr, err := streaming.NewCrypt4GHReader(mr, *key, nil)
-			if err != nil {
-				log.Errorf("Failed to open c4gh decryptor stream "+
-					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-					delivered.CorrelationId,
-					message.User,
-					message.FilePath,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					err)
-
-				continue
-			}
-
-			md5hash := md5.New() // #nosec
-			sha256hash := sha256.New()
-
-			stream := io.TeeReader(c4ghr, md5hash)
-
-			if file.DecryptedSize, err = io.Copy(sha256hash, stream); err != nil {
-				log.Errorf("Failed to copy decrypted data to hash stream "+
-					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-					delivered.CorrelationId,
-					message.User,
-					message.FilePath,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					err)
-
-				continue
-			}
-
-			file.Checksum = archiveFileHash
-			file.DecryptedChecksum = sha256hash
-
-			log.Infof("Calculated decrypted hash "+
-				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, "+
-				"encryptedchecksums: %v, reverify: %t, decryptedsize: %d, "+
-				"decryptedchecksum: %x)",
-				delivered.CorrelationId,
-				message.User,
-				message.FilePath,
-				message.ArchivePath,
-				message.EncryptedChecksums,
-				message.ReVerify,
-				file.DecryptedSize,
-				file.DecryptedChecksum.Sum(nil))
-
-			//nolint:nestif
-			if !message.ReVerify {
-
-				c := verified{
-					User:     message.User,
-					FilePath: message.FilePath,
-					DecryptedChecksums: []checksums{
-						{"sha256", fmt.Sprintf("%x", sha256hash.Sum(nil))},
-						{"md5", fmt.Sprintf("%x", md5hash.Sum(nil))},
-					},
-				}
-
-				verifiedMessage, _ := json.Marshal(&c)
-
-				err = mq.ValidateJSON(&delivered,
-					"ingestion-accession-request",
-					verifiedMessage,
-					new(verified))
-
-				if err != nil {
-					log.Errorf("Validation (ingestion-accession-request) of outgoing message failed "+
-						"(corr-id: %s, error: %v, message: %s)",
-						delivered.CorrelationId,
-						err,
-						verifiedMessage)
-
-					// Logging is in ValidateJSON so just restart on new message
-					continue
-				}
-
-				// Mark file as "COMPLETED"
-				if e := db.MarkCompleted(file, message.FileID); e != nil {
-					log.Errorf("MarkCompleted failed "+
-						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-						delivered.CorrelationId,
-						message.User,
-						message.FilePath,
-						message.ArchivePath,
-						message.EncryptedChecksums,
-						message.ReVerify,
-						err)
-
-					continue
-					// this should really be hadled by the DB retry mechanism
-				}
-
-				log.Infof("File marked completed "+
-					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, decryptedchecksum: %x)",
-					delivered.CorrelationId,
-					message.User,
-					message.FilePath,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					file.DecryptedChecksum.Sum(nil))
-
-				// Send message to verified queue
-
-				if err := mq.SendMessage(delivered.CorrelationId,
-					conf.Broker.Exchange,
-					conf.Broker.RoutingKey,
-					conf.Broker.Durable,
-					verifiedMessage); err != nil {
-					// TODO fix resend mechanism
-
-					log.Errorf("Sending of message failed "+
-						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-						delivered.CorrelationId,
-						message.User,
-						message.FilePath,
-						message.ArchivePath,
-						message.EncryptedChecksums,
-						message.ReVerify,
-						err)
-					continue
-				}
-
-				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed acking completed work"+
-						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-						delivered.CorrelationId,
-						message.User,
-						message.FilePath,
-						message.ArchivePath,
-						message.EncryptedChecksums,
-						message.ReVerify,
-						err)
-				}
-
-			}
-		}
 	}()
 
 	<-forever
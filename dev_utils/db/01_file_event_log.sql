@@ -0,0 +1,19 @@
+-- Append-only log of the lifecycle events for files in the archive.
+-- Applied on top of the sda-db schema.
+
+CREATE TABLE IF NOT EXISTS local_ega.file_event_log (
+    id             SERIAL PRIMARY KEY,
+    file_id        INTEGER NOT NULL REFERENCES local_ega.main (id),
+    event          TEXT NOT NULL CHECK (event IN ('INIT', 'ARCHIVED', 'COMPLETED', 'READY', 'ERROR', 'DISABLED')),
+    correlation_id TEXT,
+    service        TEXT NOT NULL,
+    details        JSONB,
+    created_at     TIMESTAMP(6) WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+);
+
+CREATE INDEX IF NOT EXISTS file_event_log_file_id_idx ON local_ega.file_event_log (file_id);
+CREATE INDEX IF NOT EXISTS file_event_log_correlation_id_idx ON local_ega.file_event_log (correlation_id);
+
+GRANT SELECT, INSERT ON local_ega.file_event_log TO lega_in;
+GRANT USAGE, SELECT ON SEQUENCE local_ega.file_event_log_id_seq TO lega_in;
+GRANT SELECT ON local_ega.file_event_log TO lega_out;
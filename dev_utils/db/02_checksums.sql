@@ -0,0 +1,18 @@
+-- Checksums of the files in the archive, any number of algorithms can be
+-- stored for the inbox, archive and decrypted version of a file.
+-- Applied on top of the sda-db schema.
+
+CREATE TABLE IF NOT EXISTS local_ega.checksums (
+    id       SERIAL PRIMARY KEY,
+    file_id  INTEGER NOT NULL REFERENCES local_ega.main (id),
+    source   TEXT NOT NULL CHECK (source IN ('INBOX', 'ARCHIVE', 'DECRYPTED')),
+    type     TEXT NOT NULL CHECK (type IN ('md5', 'sha256', 'sha512', 'blake2b')),
+    checksum TEXT NOT NULL,
+    UNIQUE (file_id, source, type)
+);
+
+CREATE INDEX IF NOT EXISTS checksums_file_id_idx ON local_ega.checksums (file_id);
+
+GRANT SELECT, INSERT, UPDATE ON local_ega.checksums TO lega_in;
+GRANT USAGE, SELECT ON SEQUENCE local_ega.checksums_id_seq TO lega_in;
+GRANT SELECT ON local_ega.checksums TO lega_out;
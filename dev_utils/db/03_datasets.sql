@@ -0,0 +1,20 @@
+-- Status of the datasets that files are mapped to, a dataset is registered
+-- when files are first mapped to it and can then be released and deprecated.
+-- Applied on top of the sda-db schema.
+
+CREATE TABLE IF NOT EXISTS local_ega.datasets (
+    id            SERIAL PRIMARY KEY,
+    stable_id     TEXT NOT NULL UNIQUE,
+    status        TEXT NOT NULL DEFAULT 'registered' CHECK (status IN ('registered', 'released', 'deprecated')),
+    created_at    TIMESTAMP(6) WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+    last_modified TIMESTAMP(6) WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+);
+
+-- Register the datasets that files were mapped to before this table existed
+INSERT INTO local_ega.datasets (stable_id)
+SELECT DISTINCT dataset_stable_id FROM local_ega_ebi.filedataset
+ON CONFLICT DO NOTHING;
+
+GRANT SELECT, INSERT, UPDATE ON local_ega.datasets TO lega_out;
+GRANT USAGE, SELECT ON SEQUENCE local_ega.datasets_id_seq TO lega_out;
+GRANT DELETE ON local_ega_ebi.filedataset TO lega_out;
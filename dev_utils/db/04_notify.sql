@@ -0,0 +1,69 @@
+-- Notifications on the sda_events channel whenever a file or dataset
+-- changes status and when files are mapped to or removed from a dataset,
+-- the payload is a JSON object read by database.Listener.
+-- Applied on top of the sda-db schema.
+
+CREATE OR REPLACE FUNCTION local_ega.notify_file_status() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('sda_events', json_build_object(
+        'type', 'file',
+        'file_id', NEW.id,
+        'accession_id', NEW.stable_id,
+        'user', NEW.submission_user,
+        'filepath', NEW.submission_file_path,
+        'status', NEW.status,
+        'previous_status', CASE WHEN TG_OP = 'UPDATE' THEN OLD.status END
+    )::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS main_notify_status ON local_ega.main;
+CREATE TRIGGER main_notify_status
+    AFTER INSERT OR UPDATE OF status ON local_ega.main
+    FOR EACH ROW
+    EXECUTE PROCEDURE local_ega.notify_file_status();
+
+CREATE OR REPLACE FUNCTION local_ega.notify_dataset_mapping() RETURNS TRIGGER AS $$
+DECLARE
+    mapping RECORD;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        mapping := OLD;
+    ELSE
+        mapping := NEW;
+    END IF;
+
+    PERFORM pg_notify('sda_events', json_build_object(
+        'type', CASE WHEN TG_OP = 'DELETE' THEN 'unmapping' ELSE 'mapping' END,
+        'file_id', mapping.file_id,
+        'accession_id', (SELECT stable_id FROM local_ega.main WHERE id = mapping.file_id),
+        'dataset_id', mapping.dataset_stable_id
+    )::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER;
+
+DROP TRIGGER IF EXISTS filedataset_notify ON local_ega_ebi.filedataset;
+CREATE TRIGGER filedataset_notify
+    AFTER INSERT OR DELETE ON local_ega_ebi.filedataset
+    FOR EACH ROW
+    EXECUTE PROCEDURE local_ega.notify_dataset_mapping();
+
+CREATE OR REPLACE FUNCTION local_ega.notify_dataset_status() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('sda_events', json_build_object(
+        'type', 'dataset',
+        'dataset_id', NEW.stable_id,
+        'status', NEW.status,
+        'previous_status', CASE WHEN TG_OP = 'UPDATE' THEN OLD.status END
+    )::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS datasets_notify_status ON local_ega.datasets;
+CREATE TRIGGER datasets_notify_status
+    AFTER INSERT OR UPDATE OF status ON local_ega.datasets
+    FOR EACH ROW
+    EXECUTE PROCEDURE local_ega.notify_dataset_status();
@@ -0,0 +1,17 @@
+-- Messages the services have started or finished working on, used to skip
+-- messages the broker redelivers after the work was already done.
+-- Applied on top of the sda-db schema.
+
+CREATE TABLE IF NOT EXISTS local_ega.processed_messages (
+    correlation_id TEXT NOT NULL,
+    message_type   TEXT NOT NULL,
+    body_hash      TEXT NOT NULL,
+    status         TEXT NOT NULL DEFAULT 'processing' CHECK (status IN ('processing', 'done')),
+    attempts       INTEGER NOT NULL DEFAULT 1,
+    claimed_at     TIMESTAMP(6) WITH TIME ZONE NOT NULL DEFAULT clock_timestamp(),
+    completed_at   TIMESTAMP(6) WITH TIME ZONE,
+    PRIMARY KEY (correlation_id, message_type, body_hash)
+);
+
+GRANT SELECT, INSERT, UPDATE ON local_ega.processed_messages TO lega_in;
+GRANT SELECT, INSERT, UPDATE ON local_ega.processed_messages TO lega_out;
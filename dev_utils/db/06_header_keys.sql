@@ -0,0 +1,12 @@
+-- The key the stored header of a file is encrypted to, recorded when the
+-- header is re-encrypted to a new key. Files without a row still have the
+-- header that was submitted.
+-- Applied on top of the sda-db schema.
+
+CREATE TABLE IF NOT EXISTS local_ega.file_header_keys (
+    file_id       INTEGER PRIMARY KEY REFERENCES local_ega.main (id),
+    key_id        TEXT NOT NULL,
+    last_modified TIMESTAMP(6) WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON local_ega.file_header_keys TO lega_in;
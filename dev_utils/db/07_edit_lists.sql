@@ -0,0 +1,13 @@
+-- The crypt4gh data edit list of the files that were submitted with one,
+-- stored as a JSON array of the alternating skip and keep lengths so that
+-- the part of the file that is kept can be reported without the header
+-- being decrypted.
+-- Applied on top of the sda-db schema.
+
+CREATE TABLE IF NOT EXISTS local_ega.file_edit_lists (
+    file_id INTEGER PRIMARY KEY REFERENCES local_ega.main (id),
+    lengths JSONB NOT NULL
+);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON local_ega.file_edit_lists TO lega_in;
+GRANT SELECT ON local_ega.file_edit_lists TO lega_out;
@@ -1,12 +1,12 @@
 module sda-pipeline
 
-go 1.15
+go 1.16
 
 require (
 	github.com/DATA-DOG/go-sqlmock v1.5.0
 	github.com/aws/aws-sdk-go v1.36.19
 	github.com/elixir-oslo/crypt4gh v1.3.0
-	github.com/google/uuid v1.1.3
+	github.com/google/uuid v1.3.0
 	github.com/johannesboyne/gofakes3 v0.0.0-20200716060623-6b2b4cb092cc
 	github.com/lib/pq v1.9.0
 	github.com/pkg/errors v0.9.1
@@ -15,4 +15,5 @@ require (
 	github.com/streadway/amqp v1.0.0
 	github.com/stretchr/testify v1.6.1
 	github.com/xeipuuv/gojsonschema v1.2.0
+	modernc.org/sqlite v1.14.6
 )
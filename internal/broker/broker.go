@@ -6,8 +6,13 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"sync"
+	"time"
+
+	"sda-pipeline/internal/tracing"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/xeipuuv/gojsonschema"
@@ -18,20 +23,104 @@ import (
 // This is an internal helper variable to make testing easier
 var logFatalf = log.Fatalf
 
+// Broker is the message broker as used by the services, AMQPBroker talks to
+// an AMQP server and MemoryBroker keeps the messages in memory. Deliveries
+// are acknowledged and rejected with their own Ack and Nack methods.
+type Broker interface {
+	GetMessages(queue string) (<-chan amqp.Delivery, error)
+	Consume(queue string, workers int, handle func(amqp.Delivery)) error
+	SendMessage(corrID, exchange, routingKey string, reliable bool, body []byte) error
+	SendMessageFor(delivered amqp.Delivery, exchange, routingKey string, reliable bool, body []byte) error
+	RelayMessage(delivered amqp.Delivery, exchange, routingKey string, reliable bool) error
+	Retry(delivered amqp.Delivery, cause error) error
+	ValidateJSON(delivered *amqp.Delivery, messageType string, body []byte, dest interface{}) error
+	ValidateOutgoing(delivered *amqp.Delivery, messageType string, body []byte, dest interface{}) error
+	Events() <-chan Event
+	Close()
+}
+
 // The AMQPChannel interface gives access to the functions provided
 type AMQPChannel interface {
 	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
 	Confirm(noWait bool) error
 	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
 	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
 	Close() error
 }
 
-// AMQPBroker is a Broker that reads messages from an AMQP broker
+// AMQPBroker is a Broker that reads messages from an AMQP broker, a lost
+// connection is re-established in the background
 type AMQPBroker struct {
 	Connection *amqp.Connection
 	Channel    AMQPChannel
 	Conf       MQConf
+
+	// mu guards the connection and channel while they are replaced
+	mu        sync.RWMutex
+	confirms  *confirmTracker
+	consumers []*consumer
+	events    chan Event
+	done      chan struct{}
+	closeOnce sync.Once
+
+	schemas schemaCache
+}
+
+// Types of the events sent when the connection to the broker changes
+const (
+	// EventDisconnected is sent when the connection or channel is lost
+	EventDisconnected = "disconnected"
+	// EventReconnectFailed is sent for every failed attempt to reconnect
+	EventReconnectFailed = "reconnect_failed"
+	// EventReconnected is sent once the connection, channel and consumers
+	// have been re-established
+	EventReconnected = "reconnected"
+)
+
+// Event describes a change of the connection to the broker
+type Event struct {
+	Type string
+	// Err is the reason the connection was lost or an attempt failed
+	Err error
+	// Attempt is the number of reconnection attempts made so far
+	Attempt int
+}
+
+// reconnectMinWait and reconnectMaxWait bound the time waited between
+// attempts to reconnect, the wait is doubled after every failed attempt
+var (
+	reconnectMinWait = time.Second
+	reconnectMaxWait = time.Minute
+)
+
+// confirmTimeout is how long a reliable message may wait for the broker to
+// confirm it, publishing is attempted publishAttempts times with
+// publishRetryWait in between before SendMessage gives up
+var (
+	confirmTimeout   = 30 * time.Second
+	publishAttempts  = 5
+	publishRetryWait = time.Second
+)
+
+// confirmTracker matches the confirmations on a channel in confirm mode
+// with the messages waiting for them
+type confirmTracker struct {
+	mu      sync.Mutex
+	tag     uint64
+	pending map[uint64]chan amqp.Confirmation
+	closed  bool
+}
+
+// consumer hands the deliveries from a queue to a service, the deliveries
+// of a new channel are passed on source after a reconnection
+type consumer struct {
+	queue      string
+	deliveries chan amqp.Delivery
+	source     chan (<-chan amqp.Delivery)
 }
 
 // MQConf stores information about the message broker
@@ -53,7 +142,27 @@ type MQConf struct {
 	ClientKey          string
 	ServerName         string
 	Durable            bool
-	SchemasPath        string
+	// SchemasPath is a directory to load the message schemas from instead
+	// of the schemas embedded for SchemaType
+	SchemasPath string
+	// SchemaType selects the embedded schemas, federated or isolated
+	SchemaType string
+	// SchemaVersion is the schema version of the messages that are sent,
+	// the newest version when empty
+	SchemaVersion string
+	// Prefetch is the number of unacknowledged messages the broker hands
+	// out at a time, 0 means no limit
+	Prefetch int
+	// Workers is the number of messages handled at the same time
+	Workers int
+	// MaxAttempts is the number of times a message is tried before it is
+	// sent to the dead-letter queue
+	MaxAttempts int
+	// RetryDelay is the wait before a failed message is delivered again, it
+	// doubles with every attempt
+	RetryDelay time.Duration
+	// Topology is declared on the broker when connecting
+	Topology Topology
 }
 
 // jsonError struct for sending broken messages to analysis
@@ -70,9 +179,42 @@ type FileError struct {
 	Reason   string `json:"reason"`
 }
 
+// DatasetError struct for sending dataset error messages to analysis
+type DatasetError struct {
+	DatasetID string `json:"dataset_id"`
+	Reason    string `json:"reason"`
+	// AccessionIDs holds the reason for each accession id that failed
+	AccessionIDs map[string]string `json:"accession_ids,omitempty"`
+}
+
 // NewMQ creates a new Broker that can communicate with a backend
 // amqp server.
 func NewMQ(config MQConf) (*AMQPBroker, error) {
+	schemas, err := loadSchemas(config)
+	if err != nil {
+		return nil, err
+	}
+
+	connection, channel, err := dialBroker(config)
+	if err != nil {
+		return nil, err
+	}
+
+	broker := &AMQPBroker{
+		Connection: connection,
+		Channel:    channel,
+		Conf:       config,
+		events:     make(chan Event, 16),
+		done:       make(chan struct{}),
+		schemas:    schemaCache{set: schemas},
+	}
+	go broker.watch(connection.NotifyClose(make(chan *amqp.Error, 1)), channel.NotifyClose(make(chan *amqp.Error, 1)))
+
+	return broker, nil
+}
+
+// dialBroker connects to the broker and opens a channel on the connection
+func dialBroker(config MQConf) (*amqp.Connection, *amqp.Channel, error) {
 	brokerURI := buildMQURI(config.Host, config.User, config.Password, config.Vhost, config.Port, config.Ssl)
 
 	var Connection *amqp.Connection
@@ -84,19 +226,27 @@ func NewMQ(config MQConf) (*AMQPBroker, error) {
 		var tlsConfig *tls.Config
 		tlsConfig, err = TLSConfigBroker(config)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		Connection, err = amqp.DialTLS(brokerURI, tlsConfig)
 	} else {
 		Connection, err = amqp.Dial(brokerURI)
 	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	Channel, err = Connection.Channel()
 	if err != nil {
-		return nil, err
+		Connection.Close()
+
+		return nil, nil, err
+	}
+
+	if err = declareTopology(Channel, config); err != nil {
+		Connection.Close()
+
+		return nil, nil, err
 	}
 
 	// The queues already exists so we can safely do a passive declaration
@@ -109,15 +259,105 @@ func NewMQ(config MQConf) (*AMQPBroker, error) {
 		nil,          // arguments
 	)
 	if err != nil {
-		return nil, err
+		Connection.Close()
+
+		return nil, nil, err
 	}
 
-	return &AMQPBroker{Connection, Channel, config}, nil
+	return Connection, Channel, nil
 }
 
-// GetMessages reads messages from the queue
+// GetMessages reads messages from the queue, the returned channel keeps
+// delivering messages after the connection has been re-established and is
+// only closed when the broker is closed. Messages that were delivered before
+// a reconnection can no longer be acknowledged, the broker delivers them
+// again instead.
 func (broker *AMQPBroker) GetMessages(queue string) (<-chan amqp.Delivery, error) {
-	ch := broker.Channel
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	deliveries, err := consume(broker.Channel, queue, broker.Conf.Prefetch)
+	if err != nil {
+		return nil, err
+	}
+	if broker.done == nil {
+		// Not created by NewMQ, there is no connection to re-establish
+		return deliveries, nil
+	}
+
+	c := &consumer{
+		queue:      queue,
+		deliveries: make(chan amqp.Delivery),
+		source:     make(chan (<-chan amqp.Delivery), 1),
+	}
+	broker.consumers = append(broker.consumers, c)
+	go c.forward(deliveries, broker.done)
+
+	return c.deliveries, nil
+}
+
+// Consume hands the messages from queue to handle, running up to workers
+// handlers at the same time. The handler must acknowledge or reject the
+// delivery it is given, and only that delivery. A delivery whose handler
+// panics is requeued once and rejected if it panics again. Consume returns
+// when the broker is closed and the running handlers are done.
+func (broker *AMQPBroker) Consume(queue string, workers int, handle func(amqp.Delivery)) error {
+	deliveries, err := broker.GetMessages(queue)
+	if err != nil {
+		return err
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for delivered := range deliveries {
+				runHandler(queue, handle, delivered)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// runHandler calls handle and rejects the delivery if the handler panics,
+// the handling is traced as part of the trace the message was sent in
+func runHandler(queue string, handle func(amqp.Delivery), delivered amqp.Delivery) {
+	span := tracing.StartDelivery("process "+queue, &delivered)
+	span.SetAttribute("messaging.destination.name", queue)
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Handling of message failed "+
+				"(corr-id: %s, redelivered: %t, reason: %v)",
+				delivered.CorrelationId,
+				delivered.Redelivered,
+				r)
+			if err := delivered.Nack(false, !delivered.Redelivered); err != nil {
+				log.Errorf("Failed to Nack message (corr-id: %s, reason: %v)", delivered.CorrelationId, err)
+			}
+			span.End(fmt.Errorf("handler panicked: %v", r))
+
+			return
+		}
+		span.End(nil)
+	}()
+
+	handle(delivered)
+}
+
+// consume starts consuming queue on ch with at most prefetch
+// unacknowledged messages
+func consume(ch AMQPChannel, queue string, prefetch int) (<-chan amqp.Delivery, error) {
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		return nil, err
+	}
+
 	return ch.Consume(
 		queue, // queue
 		"",    // consumer
@@ -129,34 +369,231 @@ func (broker *AMQPBroker) GetMessages(queue string) (<-chan amqp.Delivery, error
 	)
 }
 
-// SendMessage sends a message to RabbitMQ
+// forward passes deliveries on until done is closed, moving on to the
+// deliveries of the next channel whenever the current one is closed
+func (c *consumer) forward(deliveries <-chan amqp.Delivery, done <-chan struct{}) {
+	defer close(c.deliveries)
+
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if ok {
+				select {
+				case c.deliveries <- d:
+				case <-done:
+					return
+				}
+
+				continue
+			}
+
+			// The channel is gone, wait for the broker to reconnect
+			select {
+			case deliveries = <-c.source:
+			case <-done:
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// SendMessage sends a message to RabbitMQ, a reliable message is only sent
+// once the broker has confirmed it. Failed attempts are retried a few times
+// before the error is returned, so that the caller can leave the message it
+// is working on unacknowledged.
 func (broker *AMQPBroker) SendMessage(corrID, exchange, routingKey string, reliable bool, body []byte) error {
+	return broker.send(exchange, routingKey, reliable, newPublishing(corrID, broker.schemas.publishVersion(broker.Conf), body))
+}
+
+// SendMessageFor sends a message like SendMessage as part of handling
+// delivered, with its correlation id and in its trace
+func (broker *AMQPBroker) SendMessageFor(delivered amqp.Delivery, exchange, routingKey string, reliable bool, body []byte) error {
+	msg := newPublishing(delivered.CorrelationId, broker.schemas.publishVersion(broker.Conf), body)
+	tracing.Inject(delivered, msg.Headers)
+
+	return broker.send(exchange, routingKey, reliable, msg)
+}
+
+// RelayMessage sends a delivered message on to routingKey like
+// SendMessageFor, but keeps the schema version the message was sent with
+func (broker *AMQPBroker) RelayMessage(delivered amqp.Delivery, exchange, routingKey string, reliable bool) error {
+	msg := newPublishing(delivered.CorrelationId, MessageVersion(delivered), delivered.Body)
+	tracing.Inject(delivered, msg.Headers)
+
+	return broker.send(exchange, routingKey, reliable, msg)
+}
+
+// newPublishing creates a message with body, labelled with the schema
+// version unless it is empty
+func newPublishing(corrID, version string, body []byte) amqp.Publishing {
+	msg := amqp.Publishing{
+		Headers:         amqp.Table{},
+		ContentEncoding: "UTF-8",
+		ContentType:     "application/json",
+		DeliveryMode:    amqp.Persistent, // 1=non-persistent, 2=persistent
+		CorrelationId:   corrID,
+		Priority:        0, // 0-9
+		Body:            body,
+		// a bunch of application/implementation-specific fields
+	}
+	if version != "" {
+		msg.Headers[SchemaVersionHeader] = version
+	}
+
+	return msg
+}
+
+// send publishes msg, retrying a few times if it fails
+func (broker *AMQPBroker) send(exchange, routingKey string, reliable bool, msg amqp.Publishing) error {
+	for attempt := 1; ; attempt++ {
+		err := broker.publish(exchange, routingKey, reliable, msg)
+		if err == nil || attempt >= publishAttempts {
+			return err
+		}
+
+		log.Warnf("Failed to publish message, retrying (corr-id: %s, attempt: %d, reason: %v)", msg.CorrelationId, attempt, err)
+		select {
+		case <-time.After(publishRetryWait):
+		case <-broker.done:
+			return err
+		}
+	}
+}
+
+// publish makes one attempt to send a message
+func (broker *AMQPBroker) publish(exchange, routingKey string, reliable bool, msg amqp.Publishing) error {
 	if reliable {
-		// Set channel
-		if e := broker.Channel.Confirm(false); e != nil {
-			logFatalf("channel could not be put into confirm mode: %s", e)
-		}
-		// Shouldn't this be setup once and for all?
-		confirms := broker.Channel.NotifyPublish(make(chan amqp.Confirmation, 100))
-		defer confirmOne(confirms)
-	}
-	err := broker.Channel.Publish(
-		exchange,
-		routingKey,
-		false, // mandatory
-		false, // immediate
-		amqp.Publishing{
-			Headers:         amqp.Table{},
-			ContentEncoding: "UTF-8",
-			ContentType:     "application/json",
-			DeliveryMode:    amqp.Persistent, // 1=non-persistent, 2=persistent
-			CorrelationId:   corrID,
-			Priority:        0, // 0-9
-			Body:            body,
-			// a bunch of application/implementation-specific fields
-		},
-	)
-	return err
+		if err := broker.enableConfirms(); err != nil {
+			return err
+		}
+	}
+
+	broker.mu.RLock()
+	tracker := broker.confirms
+	if tracker == nil {
+		defer broker.mu.RUnlock()
+
+		return broker.Channel.Publish(exchange, routingKey, false, false, msg)
+	}
+	tag, confirmed, err := tracker.publish(broker.Channel, exchange, routingKey, msg, reliable)
+	broker.mu.RUnlock()
+
+	if err != nil || !reliable {
+		return err
+	}
+
+	return tracker.wait(tag, confirmed)
+}
+
+// enableConfirms puts the channel into confirm mode unless it already is
+func (broker *AMQPBroker) enableConfirms() error {
+	broker.mu.RLock()
+	enabled := broker.confirms != nil
+	broker.mu.RUnlock()
+	if enabled {
+		return nil
+	}
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if broker.confirms != nil {
+		return nil
+	}
+
+	tracker, err := startConfirms(broker.Channel)
+	if err != nil {
+		return fmt.Errorf("channel could not be put into confirm mode: %v", err)
+	}
+	broker.confirms = tracker
+
+	return nil
+}
+
+// startConfirms puts ch into confirm mode and starts tracking the
+// confirmations sent by the broker
+func startConfirms(ch AMQPChannel) (*confirmTracker, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, err
+	}
+
+	tracker := &confirmTracker{pending: make(map[uint64]chan amqp.Confirmation)}
+	go tracker.dispatch(ch.NotifyPublish(make(chan amqp.Confirmation, 100)))
+
+	return tracker, nil
+}
+
+// dispatch hands every confirmation to the message waiting for it, the
+// messages still waiting when the channel is closed are told so by closing
+// their channels
+func (tracker *confirmTracker) dispatch(confirms <-chan amqp.Confirmation) {
+	for confirmed := range confirms {
+		tracker.mu.Lock()
+		waiting, ok := tracker.pending[confirmed.DeliveryTag]
+		delete(tracker.pending, confirmed.DeliveryTag)
+		tracker.mu.Unlock()
+
+		if ok {
+			waiting <- confirmed
+		}
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	for tag, waiting := range tracker.pending {
+		close(waiting)
+		delete(tracker.pending, tag)
+	}
+	tracker.closed = true
+}
+
+// publish publishes msg on ch and returns its delivery tag, a channel for
+// the confirmation is only returned when wait is set
+func (tracker *confirmTracker) publish(ch AMQPChannel, exchange, routingKey string, msg amqp.Publishing, wait bool) (uint64, chan amqp.Confirmation, error) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if tracker.closed {
+		return 0, nil, errors.New("channel is closed")
+	}
+	if err := ch.Publish(exchange, routingKey, false, false, msg); err != nil {
+		return 0, nil, err
+	}
+
+	// Delivery tags are counted per channel from the first publishing
+	// after the channel was put into confirm mode
+	tracker.tag++
+	if !wait {
+		return tracker.tag, nil, nil
+	}
+
+	confirmed := make(chan amqp.Confirmation, 1)
+	tracker.pending[tracker.tag] = confirmed
+
+	return tracker.tag, confirmed, nil
+}
+
+// wait waits for the broker to confirm the message with the delivery tag
+func (tracker *confirmTracker) wait(tag uint64, confirmed chan amqp.Confirmation) error {
+	select {
+	case confirmation, ok := <-confirmed:
+		if !ok {
+			return fmt.Errorf("channel closed before delivery tag %d was confirmed", tag)
+		}
+		if !confirmation.Ack {
+			return fmt.Errorf("broker nacked delivery tag %d", tag)
+		}
+		log.Debugf("confirmed delivery with delivery tag: %d", tag)
+
+		return nil
+	case <-time.After(confirmTimeout):
+		tracker.mu.Lock()
+		delete(tracker.pending, tag)
+		tracker.mu.Unlock()
+
+		return fmt.Errorf("delivery tag %d was not confirmed within %s", tag, confirmTimeout)
+	}
 }
 
 // buildMQURI builds the MQ connection URI
@@ -228,27 +665,156 @@ func TLSConfigBroker(config MQConf) (*tls.Config, error) {
 	return &tlsConfig, nil
 }
 
-// confirmOne accepts confirmation for a message sent with reliable.
-//
-// One would typically keep a channel of publishings, a sequence number, and a
-// set of unacknowledged sequence numbers and loop until the publishing channel
-// is closed.
-func confirmOne(confirms <-chan amqp.Confirmation) {
-	confirmed := <-confirms
-	if !confirmed.Ack {
-		log.Errorf("failed delivery of delivery tag: %d", confirmed.DeliveryTag)
+// Events returns the channel on which changes of the connection to the
+// broker are reported
+func (broker *AMQPBroker) Events() <-chan Event {
+	return broker.events
+}
+
+// Close stops reconnecting and closes the channel and the connection
+func (broker *AMQPBroker) Close() {
+	broker.closeOnce.Do(func() {
+		if broker.done != nil {
+			close(broker.done)
+		}
+
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		if broker.Channel != nil {
+			broker.Channel.Close()
+		}
+		if broker.Connection != nil {
+			broker.Connection.Close()
+		}
+	})
+}
+
+// notify sends an event without blocking the reconnection when nobody
+// reads the events
+func (broker *AMQPBroker) notify(event Event) {
+	select {
+	case broker.events <- event:
+	default:
+		log.Warnf("dropped broker event %s, the event channel is full", event.Type)
+	}
+}
+
+// watch waits for the connection or the channel to be closed and
+// reconnects until the broker is closed
+func (broker *AMQPBroker) watch(connectionClosed, channelClosed chan *amqp.Error) {
+	for {
+		var reason *amqp.Error
+		select {
+		case reason = <-connectionClosed:
+		case reason = <-channelClosed:
+		case <-broker.done:
+			return
+		}
+
+		select {
+		case <-broker.done:
+			return
+		default:
+		}
+
+		var err error = errors.New("closed by the server")
+		if reason != nil {
+			err = reason
+		}
+		broker.notify(Event{Type: EventDisconnected, Err: err})
+
+		// Only the channel may be closed, close the connection as well
+		// so that everything is set up again
+		broker.mu.RLock()
+		broker.Connection.Close()
+		broker.mu.RUnlock()
+
+		connectionClosed, channelClosed = broker.reconnect()
+		if connectionClosed == nil {
+			return
+		}
+	}
+}
+
+// reconnect connects to the broker again with an increasing wait between
+// attempts, nil is returned if the broker is closed before it succeeds
+func (broker *AMQPBroker) reconnect() (chan *amqp.Error, chan *amqp.Error) {
+	wait := reconnectMinWait
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(wait):
+		case <-broker.done:
+			return nil, nil
+		}
+
+		connectionClosed, channelClosed, err := broker.resume()
+		if err == nil {
+			broker.notify(Event{Type: EventReconnected, Attempt: attempt})
+
+			return connectionClosed, channelClosed
+		}
+
+		broker.notify(Event{Type: EventReconnectFailed, Err: err, Attempt: attempt})
+
+		if wait *= 2; wait > reconnectMaxWait {
+			wait = reconnectMaxWait
+		}
 	}
-	log.Debugf("confirmed delivery with delivery tag: %d", confirmed.DeliveryTag)
 }
 
-// ConnectionWatcher listens to events from the server
-func (broker *AMQPBroker) ConnectionWatcher() *amqp.Error {
-	amqpError := <-broker.Connection.NotifyClose(make(chan *amqp.Error))
-	return amqpError
+// resume opens a new connection and channel, restores confirm mode and
+// the consumers, and hands the new deliveries to the consumers
+func (broker *AMQPBroker) resume() (chan *amqp.Error, chan *amqp.Error, error) {
+	connection, channel, err := dialBroker(broker.Conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	connectionClosed := connection.NotifyClose(make(chan *amqp.Error, 1))
+	channelClosed := channel.NotifyClose(make(chan *amqp.Error, 1))
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	var tracker *confirmTracker
+	if broker.confirms != nil {
+		if tracker, err = startConfirms(channel); err != nil {
+			connection.Close()
+
+			return nil, nil, err
+		}
+	}
+
+	deliveries := make([]<-chan amqp.Delivery, len(broker.consumers))
+	for i, c := range broker.consumers {
+		if deliveries[i], err = consume(channel, c.queue, broker.Conf.Prefetch); err != nil {
+			connection.Close()
+
+			return nil, nil, err
+		}
+	}
+
+	broker.Connection = connection
+	broker.Channel = channel
+	broker.confirms = tracker
+	for i, c := range broker.consumers {
+		// Replace deliveries from an earlier attempt that were never picked up
+		select {
+		case <-c.source:
+		default:
+		}
+		c.source <- deliveries[i]
+	}
+
+	return connectionClosed, channelClosed, nil
 }
 
 // SendJSONError sends message on JSON error
 func (broker *AMQPBroker) SendJSONError(delivered *amqp.Delivery, originalBody []byte, reason string, conf MQConf) error {
+	return sendJSONError(broker, delivered, originalBody, reason, conf)
+}
+
+// sendJSONError sends message on JSON error through mq
+func sendJSONError(mq Broker, delivered *amqp.Delivery, originalBody []byte, reason string, conf MQConf) error {
 
 	jsonErrorMessage := jsonError{
 		Error:          "Validation of JSON message failed",
@@ -258,17 +824,45 @@ func (broker *AMQPBroker) SendJSONError(delivered *amqp.Delivery, originalBody [
 
 	body, _ := json.Marshal(jsonErrorMessage)
 
-	return broker.SendMessage(delivered.CorrelationId, conf.Exchange, conf.RoutingError, conf.Durable, body)
+	return mq.SendMessageFor(*delivered, conf.Exchange, conf.RoutingError, conf.Durable, body)
 }
 
 // ValidateJSON validates JSON in body, verifying that it's valid JSON as well
-// as conforming to the schema specified by messageType. It also optionally
-// verifies that the message can be decoded into the supplied data structure dest
+// as conforming to the schema specified by messageType, in the schema
+// version of delivered. It also optionally verifies that the message can be
+// decoded into the supplied data structure dest
 func (broker *AMQPBroker) ValidateJSON(delivered *amqp.Delivery,
 	messageType string,
 	body []byte,
 	dest interface{}) error {
-	res, err := validateJSON(messageType, broker.Conf.SchemasPath, body)
+	return validateMessage(broker, broker.Conf, &broker.schemas, delivered, MessageVersion(*delivered), messageType, body, dest)
+}
+
+// ValidateOutgoing validates a message that is about to be sent like
+// ValidateJSON, against the schema version that SendMessage labels it with.
+// Failures are reported for delivered, the message being handled.
+func (broker *AMQPBroker) ValidateOutgoing(delivered *amqp.Delivery,
+	messageType string,
+	body []byte,
+	dest interface{}) error {
+	return validateMessage(broker, broker.Conf, &broker.schemas, delivered, "", messageType, body, dest)
+}
+
+// validateMessage is the common part of ValidateJSON and ValidateOutgoing,
+// messages that fail validation are rejected and reported through mq
+func validateMessage(mq Broker,
+	conf MQConf,
+	schemas *schemaCache,
+	delivered *amqp.Delivery,
+	version string,
+	messageType string,
+	body []byte,
+	dest interface{}) error {
+	var res *gojsonschema.Result
+	set, err := schemas.load(conf)
+	if err == nil {
+		res, err = set.validate(version, messageType, body)
+	}
 
 	if err != nil {
 		log.Errorf("JSON error while validating "+
@@ -279,12 +873,14 @@ func (broker *AMQPBroker) ValidateJSON(delivered *amqp.Delivery,
 
 		// Nack message so the server gets notified that something is wrong but don't requeue the message
 		if e := delivered.Nack(false, false); e != nil {
-			log.Errorln("Failed to Nack message "+
-				"(corr-id: %s, errror: %v) ", e)
+			log.Errorf("Failed to Nack message "+
+				"(corr-id: %s, error: %v)",
+				delivered.CorrelationId,
+				e)
 		}
 		// Send the message to an error queue so it can be analyzed.
-		if e := broker.SendJSONError(delivered, body, err.Error(), broker.Conf); e != nil {
-			log.Error("Failed to publish JSON decode error message "+
+		if e := sendJSONError(mq, delivered, body, err.Error(), conf); e != nil {
+			log.Errorf("Failed to publish JSON decode error message "+
 				"(corr-id: %s, error: %v)",
 				delivered.CorrelationId,
 				e)
@@ -308,14 +904,14 @@ func (broker *AMQPBroker) ValidateJSON(delivered *amqp.Delivery,
 		log.Error("Validation failed")
 		// Nack message so the server gets notified that something is wrong but don't requeue the message
 		if e := delivered.Nack(false, false); e != nil {
-			log.Errorln("Failed to Nack message "+
+			log.Errorf("Failed to Nack message "+
 				"(corr-id: %s, error: %v)",
 				delivered.CorrelationId,
 				e)
 		}
 		// Send the message to an error queue so it can be analyzed.
-		if e := broker.SendJSONError(delivered, body, errorString, broker.Conf); e != nil {
-			log.Error("Failed to publish JSON validity error message "+
+		if e := sendJSONError(mq, delivered, body, errorString, conf); e != nil {
+			log.Errorf("Failed to publish JSON validity error message "+
 				"(corr-id: %s, error: %v)",
 				delivered.CorrelationId,
 				e)
@@ -342,15 +938,32 @@ func (broker *AMQPBroker) ValidateJSON(delivered *amqp.Delivery,
 			delivered.CorrelationId,
 			err,
 			body)
+
+		// Nack message so the server gets notified that something is wrong but don't requeue the message
+		if e := delivered.Nack(false, false); e != nil {
+			log.Errorf("Failed to Nack message "+
+				"(corr-id: %s, error: %v)",
+				delivered.CorrelationId,
+				e)
+		}
+		// Send the message to an error queue so it can be analyzed.
+		if e := sendJSONError(mq, delivered, body, err.Error(), conf); e != nil {
+			log.Errorf("Failed to publish JSON unmarshal error message "+
+				"(corr-id: %s, error: %v)",
+				delivered.CorrelationId,
+				e)
+		}
 	}
 
 	return err
 }
 
 // validateJSON is a helper function for ValidateJson
-func validateJSON(messageType string, schemasPath string, body []byte) (*gojsonschema.Result, error) {
+func validateJSON(schemas map[string]*gojsonschema.Schema, messageType string, body []byte) (*gojsonschema.Result, error) {
+	schema, ok := schemas[messageType]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema %s", messageType)
+	}
 
-	schema := gojsonschema.NewReferenceLoader(schemasPath + "/" + messageType + ".json")
-	res, err := gojsonschema.Validate(schema, gojsonschema.NewBytesLoader(body))
-	return res, err
+	return schema.Validate(gojsonschema.NewBytesLoader(body))
 }
@@ -21,6 +21,7 @@ const readableFile = "broker.go"
 
 func TestMain(m *testing.M) {
 	logFatalf = testLogFatalf
+	publishRetryWait = time.Millisecond
 	code := m.Run()
 
 	os.Exit(code)
@@ -34,13 +35,106 @@ func testLogFatalf(f string, args ...interface{}) {
 type mockChannel struct {
 	failConfirm    bool
 	failPublish    bool
+	nack           bool
+	noConfirm      bool
 	confirmChannel chan amqp.Confirmation
+	tag            uint64
+	deliveries     chan amqp.Delivery
+	prefetch       int
+	failDeclare    bool
+	declared       map[string]amqp.Table
+	exchanges      map[string]string
+	bindings       []mockBinding
+	published      []mockPublishing
+}
+
+// mockBinding is a queue binding made on the mock channel
+type mockBinding struct {
+	queue    string
+	exchange string
+	key      string
+}
+
+// mockPublishing is a message published on the mock channel
+type mockPublishing struct {
+	exchange string
+	key      string
+	msg      amqp.Publishing
 }
 
 func (c *mockChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	if c.deliveries != nil {
+		return c.deliveries, nil
+	}
+
 	return nil, fmt.Errorf("error")
 }
 
+func (c *mockChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if c.failDeclare {
+		return amqp.Queue{}, fmt.Errorf("failDeclare")
+	}
+	if c.declared == nil {
+		c.declared = make(map[string]amqp.Table)
+	}
+	c.declared[name] = args
+
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *mockChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	if c.failDeclare {
+		return fmt.Errorf("failDeclare")
+	}
+	if c.exchanges == nil {
+		c.exchanges = make(map[string]string)
+	}
+	c.exchanges[name] = kind
+
+	return nil
+}
+
+func (c *mockChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	c.bindings = append(c.bindings, mockBinding{name, exchange, key})
+
+	return nil
+}
+
+func (c *mockChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	c.prefetch = prefetchCount
+
+	return nil
+}
+
+// mockAcknowledger records how deliveries were settled
+type mockAcknowledger struct {
+	mu      sync.Mutex
+	acked   []uint64
+	nacked  []uint64
+	requeue []bool
+}
+
+func (a *mockAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acked = append(a.acked, tag)
+
+	return nil
+}
+
+func (a *mockAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.nacked = append(a.nacked, tag)
+	a.requeue = append(a.requeue, requeue)
+
+	return nil
+}
+
+func (a *mockAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
 func (c *mockChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
 	return amqp.Queue{}, fmt.Errorf("error")
 }
@@ -60,15 +154,21 @@ func (c *mockChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Co
 }
 
 func (c *mockChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
-
-	go func() {
-		time.Sleep(10000)
-		c.confirmChannel <- amqp.Confirmation{}
-	}()
-
 	if c.failPublish {
 		return fmt.Errorf("failPublish")
 	}
+	c.published = append(c.published, mockPublishing{exchange, key, msg})
+
+	if c.confirmChannel != nil {
+		c.tag++
+		confirmation := amqp.Confirmation{DeliveryTag: c.tag, Ack: !c.nack}
+		if !c.noConfirm {
+			go func(confirms chan amqp.Confirmation) {
+				time.Sleep(10000)
+				confirms <- confirmation
+			}(c.confirmChannel)
+		}
+	}
 
 	return nil
 }
@@ -143,7 +243,14 @@ var tMqconf = MQConf{"127.0.0.1",
 	"../../dev_utils/certs/client-key.pem",
 	"servername",
 	true,
-	"file://../../schemas/federated/"}
+	"",
+	"federated",
+	"",
+	2,
+	2,
+	3,
+	10 * time.Second,
+	Topology{}}
 
 func TestBuildMqURI(t *testing.T) {
 	amqps := buildMQURI("localhost", "user", "pass", "/vhost", 5555, true)
@@ -200,6 +307,75 @@ func TestNewMQ(t *testing.T) {
 
 }
 
+// consumeOnce accepts a connection, opens a channel and lets the client
+// set the prefetch and consume a queue
+func consumeOnce(s chan *commonServer, sessions chan *commonServer) {
+	session := <-s
+	session.connectionOpen()
+	session.recv(1, &channelOpen{})
+	session.send(1, &channelOpenOk{})
+	session.recv(1, &queueDeclare{})
+	session.send(1, &queueDeclareOk{})
+
+	session.recv(1, &basicQos{})
+	session.send(1, &basicQosOk{})
+
+	consume := basicConsume{}
+	session.recv(1, &consume)
+	session.send(1, &basicConsumeOk{ConsumerTag: consume.ConsumerTag})
+
+	sessions <- session
+}
+
+func TestReconnect(t *testing.T) {
+	reconnectMinWait = 10 * time.Millisecond
+
+	s := startServer(t, 5557)
+
+	conf := tMqconf
+	conf.Ssl = false
+	conf.VerifyPeer = false
+	conf.Port = 5557
+
+	sessions := make(chan *commonServer, 1)
+	go consumeOnce(s.Sessions, sessions)
+
+	b, err := NewMQ(conf)
+	assert.NoError(t, err)
+
+	deliveries, err := b.GetMessages(conf.Queue)
+	assert.NoError(t, err)
+	first := <-sessions
+
+	go consumeOnce(s.Sessions, sessions)
+	first.S.Close()
+
+	event := <-b.Events()
+	assert.Equal(t, EventDisconnected, event.Type)
+	assert.Error(t, event.Err)
+
+	event = <-b.Events()
+	assert.Equal(t, EventReconnected, event.Type)
+	assert.Equal(t, 1, event.Attempt)
+	second := <-sessions
+
+	select {
+	case _, ok := <-deliveries:
+		assert.True(t, ok, "deliveries were closed on reconnection")
+	default:
+	}
+
+	// Attempts to reconnect fail once the server is gone
+	s.Close()
+	second.S.Close()
+	event = <-b.Events()
+	assert.Equal(t, EventDisconnected, event.Type)
+
+	b.Close()
+	_, ok := <-deliveries
+	assert.False(t, ok, "deliveries were not closed with the broker")
+}
+
 func CatchNewMQPanic(t *testing.T, conf MQConf) (err error) {
 	// Recover if NewMQ panics
 	// Allow both panic and error return here, so use a custom function rather
@@ -312,23 +488,112 @@ func TestTLSConfigBroker(t *testing.T) {
 
 }
 
-func TestConfirmOne(t *testing.T) {
+func TestConsume(t *testing.T) {
+	b := AMQPBroker{Conf: tMqconf}
+	c := mockChannel{deliveries: make(chan amqp.Delivery, 3)}
+	b.Channel = &c
+	a := mockAcknowledger{}
 
+	for tag := uint64(1); tag <= 3; tag++ {
+		c.deliveries <- amqp.Delivery{Acknowledger: &a, DeliveryTag: tag}
+	}
+	close(c.deliveries)
+
+	// Every handler waits until all three run at the same time
+	var started sync.WaitGroup
+	started.Add(3)
+	err := b.Consume("queue", 3, func(delivered amqp.Delivery) {
+		started.Done()
+		started.Wait()
+		assert.NoError(t, delivered.Ack(false))
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, tMqconf.Prefetch, c.prefetch)
+	assert.ElementsMatch(t, []uint64{1, 2, 3}, a.acked)
+	assert.Empty(t, a.nacked)
+}
+
+func TestConsume_Panic(t *testing.T) {
 	var str bytes.Buffer
 	log.SetOutput(&str)
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	c := make(chan amqp.Confirmation)
-	go func(c <-chan amqp.Confirmation) {
-		confirmOne(c)
-		assert.NotZero(t, str.Len(), "Expected warnings were missing")
-		assert.Contains(t, str.String(), "failed delivery of delivery tag")
-		wg.Done()
-	}(c)
-	c <- amqp.Confirmation{}
-
-	wg.Wait()
+	b := AMQPBroker{}
+	c := mockChannel{deliveries: make(chan amqp.Delivery, 2)}
+	b.Channel = &c
+	a := mockAcknowledger{}
+
+	c.deliveries <- amqp.Delivery{Acknowledger: &a, DeliveryTag: 1}
+	c.deliveries <- amqp.Delivery{Acknowledger: &a, DeliveryTag: 2, Redelivered: true}
+	close(c.deliveries)
+
+	err := b.Consume("queue", 1, func(delivered amqp.Delivery) {
+		panic("broken handler")
+	})
+	assert.NoError(t, err)
+
+	// Requeued the first time, rejected when it fails again
+	assert.Equal(t, []uint64{1, 2}, a.nacked)
+	assert.Equal(t, []bool{true, false}, a.requeue)
+	assert.Contains(t, str.String(), "broken handler")
+}
+
+func TestConsume_Error(t *testing.T) {
+	b := AMQPBroker{}
+	b.Channel = &mockChannel{}
+
+	err := b.Consume("queue", 1, func(delivered amqp.Delivery) {})
+	assert.Error(t, err)
+}
+
+func TestSendMessage_Nack(t *testing.T) {
+	attempts := publishAttempts
+	publishAttempts = 2
+	defer func() { publishAttempts = attempts }()
+
+	b := AMQPBroker{}
+	c := mockChannel{nack: true}
+	b.Channel = &c
+
+	err := b.SendMessage("corrID1", "exchange", "routingkey", true, []byte("Message"))
+	assert.EqualError(t, err, "broker nacked delivery tag 2")
+
+	// Messages that are not reliable do not wait for the broker
+	err = b.SendMessage("corrID1", "exchange", "routingkey", false, []byte("Message"))
+	assert.NoError(t, err)
+}
+
+func TestSendMessage_Timeout(t *testing.T) {
+	attempts := publishAttempts
+	publishAttempts = 1
+	defer func() { publishAttempts = attempts }()
+	timeout := confirmTimeout
+	confirmTimeout = 10 * time.Millisecond
+	defer func() { confirmTimeout = timeout }()
+
+	b := AMQPBroker{}
+	c := mockChannel{noConfirm: true}
+	b.Channel = &c
+
+	err := b.SendMessage("corrID1", "exchange", "routingkey", true, []byte("Message"))
+	assert.EqualError(t, err, "delivery tag 1 was not confirmed within 10ms")
+	assert.Empty(t, b.confirms.pending)
+}
+
+func TestConfirmTracker_Closed(t *testing.T) {
+	c := mockChannel{noConfirm: true}
+	tracker, err := startConfirms(&c)
+	assert.NoError(t, err)
+
+	tag, confirmed, err := tracker.publish(&c, "exchange", "routingkey", amqp.Publishing{}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), tag)
+
+	close(c.confirmChannel)
+	assert.EqualError(t, tracker.wait(tag, confirmed), "channel closed before delivery tag 1 was confirmed")
+
+	_, _, err = tracker.publish(&c, "exchange", "routingkey", amqp.Publishing{}, true)
+	assert.EqualError(t, err, "channel is closed")
 }
 
 func TestValidateJSON(t *testing.T) {
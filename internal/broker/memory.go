@@ -0,0 +1,366 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"sda-pipeline/internal/tracing"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/streadway/amqp"
+)
+
+// MemoryBroker is a Broker that keeps its queues in memory, so that the
+// services can be run together in one process without an AMQP server.
+// Messages sent to the default exchange go to the queue named by the routing
+// key, messages sent to other exchanges go to the queues bound to the
+// exchange and routing key with Bind. Queues are created on first use.
+type MemoryBroker struct {
+	Conf MQConf
+
+	mu sync.Mutex
+	// ready is signalled when a message is queued or the broker is closed
+	ready    *sync.Cond
+	queues   map[string][]amqp.Delivery
+	bindings map[memoryBinding][]string
+	unacked  map[uint64]unackedDelivery
+	tag      uint64
+	events   chan Event
+	done     chan struct{}
+	closed   bool
+	schemas  schemaCache
+}
+
+// memoryBinding is the exchange and routing key messages are routed by
+type memoryBinding struct {
+	exchange   string
+	routingKey string
+}
+
+// unackedDelivery is a delivery that was handed out but not acknowledged
+type unackedDelivery struct {
+	queue     string
+	delivered amqp.Delivery
+}
+
+// NewMemoryBroker creates a MemoryBroker, the schemas are compiled from
+// config like for NewMQ and the queues of config.Topology are bound like
+// with Bind. Routing keys are matched exactly, whatever the exchange type.
+func NewMemoryBroker(config MQConf) (*MemoryBroker, error) {
+	schemas, err := loadSchemas(config)
+	if err != nil {
+		return nil, err
+	}
+
+	broker := &MemoryBroker{
+		Conf:     config,
+		queues:   make(map[string][]amqp.Delivery),
+		bindings: make(map[memoryBinding][]string),
+		unacked:  make(map[uint64]unackedDelivery),
+		events:   make(chan Event),
+		done:     make(chan struct{}),
+		schemas:  schemaCache{set: schemas},
+	}
+	broker.ready = sync.NewCond(&broker.mu)
+
+	for _, queue := range config.Topology.Queues {
+		broker.queues[queue.Name] = nil
+		for _, binding := range queue.Bindings {
+			broker.Bind(queue.Name, binding.Exchange, binding.RoutingKey)
+		}
+	}
+
+	return broker, nil
+}
+
+// Bind routes the messages sent to exchange with routingKey to queue
+func (broker *MemoryBroker) Bind(queue, exchange, routingKey string) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	key := memoryBinding{exchange, routingKey}
+	broker.bindings[key] = append(broker.bindings[key], queue)
+	if _, ok := broker.queues[queue]; !ok {
+		broker.queues[queue] = nil
+	}
+}
+
+// Get takes the first message from queue without waiting for one, the
+// message does not have to be acknowledged
+func (broker *MemoryBroker) Get(queue string) (amqp.Delivery, bool) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	if len(broker.queues[queue]) == 0 {
+		return amqp.Delivery{}, false
+	}
+	delivered := broker.queues[queue][0]
+	broker.queues[queue] = broker.queues[queue][1:]
+
+	return delivered, true
+}
+
+// Len returns the number of messages waiting in queue
+func (broker *MemoryBroker) Len(queue string) int {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	return len(broker.queues[queue])
+}
+
+// Unacked returns the number of messages that were delivered but not yet
+// acknowledged or rejected
+func (broker *MemoryBroker) Unacked() int {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	return len(broker.unacked)
+}
+
+// GetMessages reads messages from the queue, the returned channel is closed
+// when the broker is closed
+func (broker *MemoryBroker) GetMessages(queue string) (<-chan amqp.Delivery, error) {
+	deliveries := make(chan amqp.Delivery)
+	go func() {
+		defer close(deliveries)
+		for {
+			delivered, ok := broker.next(queue)
+			if !ok {
+				return
+			}
+			select {
+			case deliveries <- delivered:
+			case <-broker.done:
+				return
+			}
+		}
+	}()
+
+	return deliveries, nil
+}
+
+// Consume hands the messages from queue to handle like AMQPBroker.Consume
+func (broker *MemoryBroker) Consume(queue string, workers int, handle func(amqp.Delivery)) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				delivered, ok := broker.next(queue)
+				if !ok {
+					return
+				}
+				runHandler(queue, handle, delivered)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// next waits for a message on queue and hands it out, false is returned
+// once the broker is closed
+func (broker *MemoryBroker) next(queue string) (amqp.Delivery, bool) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	for len(broker.queues[queue]) == 0 && !broker.closed {
+		broker.ready.Wait()
+	}
+	if broker.closed {
+		return amqp.Delivery{}, false
+	}
+
+	delivered := broker.queues[queue][0]
+	broker.queues[queue] = broker.queues[queue][1:]
+	broker.tag++
+	delivered.DeliveryTag = broker.tag
+	broker.unacked[broker.tag] = unackedDelivery{queue, delivered}
+
+	return delivered, true
+}
+
+// SendMessage routes a message to the queues bound to exchange and
+// routingKey, there is nothing to confirm so reliable makes no difference
+func (broker *MemoryBroker) SendMessage(corrID, exchange, routingKey string, reliable bool, body []byte) error {
+	return broker.publish(exchange, routingKey, newPublishing(corrID, broker.schemas.publishVersion(broker.Conf), body))
+}
+
+// SendMessageFor sends a message like SendMessage as part of handling
+// delivered, with its correlation id and in its trace
+func (broker *MemoryBroker) SendMessageFor(delivered amqp.Delivery, exchange, routingKey string, reliable bool, body []byte) error {
+	msg := newPublishing(delivered.CorrelationId, broker.schemas.publishVersion(broker.Conf), body)
+	tracing.Inject(delivered, msg.Headers)
+
+	return broker.publish(exchange, routingKey, msg)
+}
+
+// RelayMessage sends a delivered message on to routingKey like
+// SendMessageFor, but keeps the schema version the message was sent with
+func (broker *MemoryBroker) RelayMessage(delivered amqp.Delivery, exchange, routingKey string, reliable bool) error {
+	msg := newPublishing(delivered.CorrelationId, MessageVersion(delivered), delivered.Body)
+	tracing.Inject(delivered, msg.Headers)
+
+	return broker.publish(exchange, routingKey, msg)
+}
+
+// publish queues msg on the queues it is routed to, a message that is not
+// routed anywhere is dropped
+func (broker *MemoryBroker) publish(exchange, routingKey string, msg amqp.Publishing) error {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	if broker.closed {
+		return errors.New("broker is closed")
+	}
+
+	queues := broker.bindings[memoryBinding{exchange, routingKey}]
+	if exchange == "" {
+		queues = []string{routingKey}
+	}
+	if len(queues) == 0 {
+		log.Warnf("Dropped unroutable message (corr-id: %s, exchange: %s, routingkey: %s)", msg.CorrelationId, exchange, routingKey)
+
+		return nil
+	}
+
+	for _, queue := range queues {
+		headers := amqp.Table{}
+		for k, v := range msg.Headers {
+			headers[k] = v
+		}
+		broker.queues[queue] = append(broker.queues[queue], amqp.Delivery{
+			Acknowledger:    broker,
+			Headers:         headers,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			Exchange:        exchange,
+			RoutingKey:      routingKey,
+			Body:            msg.Body,
+		})
+	}
+	broker.ready.Broadcast()
+
+	return nil
+}
+
+// Retry puts a message that could not be handled back on its queue right
+// away, or on the dead-letter queue once Conf.MaxAttempts attempts have
+// failed. The message is not delayed like with AMQPBroker.Retry.
+func (broker *MemoryBroker) Retry(delivered amqp.Delivery, cause error) error {
+	broker.mu.Lock()
+	pending, ok := broker.unacked[delivered.DeliveryTag]
+	broker.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown delivery tag %d", delivered.DeliveryTag)
+	}
+
+	attempts := Attempts(delivered) + 1
+	msg := newPublishing(delivered.CorrelationId, "", delivered.Body)
+	for k, v := range delivered.Headers {
+		msg.Headers[k] = v
+	}
+	msg.Headers[AttemptsHeader] = int32(attempts)
+	msg.Headers[LastErrorHeader] = "unknown error"
+	if cause != nil {
+		msg.Headers[LastErrorHeader] = cause.Error()
+	}
+
+	queue := pending.queue
+	if attempts >= broker.Conf.MaxAttempts {
+		queue += ".dead-letter"
+	}
+	if err := broker.publish("", queue, msg); err != nil {
+		if e := delivered.Nack(false, true); e != nil {
+			log.Errorf("Failed to Nack message (retry failed) (corr-id: %s, reason: %v)", delivered.CorrelationId, e)
+		}
+
+		return fmt.Errorf("failed to publish message to %s: %v", queue, err)
+	}
+
+	return delivered.Ack(false)
+}
+
+// ValidateJSON validates a delivered message like AMQPBroker.ValidateJSON
+func (broker *MemoryBroker) ValidateJSON(delivered *amqp.Delivery, messageType string, body []byte, dest interface{}) error {
+	return validateMessage(broker, broker.Conf, &broker.schemas, delivered, MessageVersion(*delivered), messageType, body, dest)
+}
+
+// ValidateOutgoing validates a message that is about to be sent like
+// AMQPBroker.ValidateOutgoing
+func (broker *MemoryBroker) ValidateOutgoing(delivered *amqp.Delivery, messageType string, body []byte, dest interface{}) error {
+	return validateMessage(broker, broker.Conf, &broker.schemas, delivered, "", messageType, body, dest)
+}
+
+// Ack acknowledges a delivery, it implements amqp.Acknowledger
+func (broker *MemoryBroker) Ack(tag uint64, multiple bool) error {
+	return broker.settle(tag, multiple, false)
+}
+
+// Nack rejects a delivery, it implements amqp.Acknowledger
+func (broker *MemoryBroker) Nack(tag uint64, multiple bool, requeue bool) error {
+	return broker.settle(tag, multiple, requeue)
+}
+
+// Reject rejects a delivery, it implements amqp.Acknowledger
+func (broker *MemoryBroker) Reject(tag uint64, requeue bool) error {
+	return broker.settle(tag, false, requeue)
+}
+
+// settle removes the delivery tag, and every earlier one if multiple is
+// set, from the unacknowledged deliveries and requeues them if asked to
+func (broker *MemoryBroker) settle(tag uint64, multiple, requeue bool) error {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	if _, ok := broker.unacked[tag]; !ok {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+
+	for t, pending := range broker.unacked {
+		if t != tag && (!multiple || t > tag) {
+			continue
+		}
+		delete(broker.unacked, t)
+		if requeue {
+			pending.delivered.Redelivered = true
+			broker.queues[pending.queue] = append([]amqp.Delivery{pending.delivered}, broker.queues[pending.queue]...)
+		}
+	}
+	if requeue {
+		broker.ready.Broadcast()
+	}
+
+	return nil
+}
+
+// Events returns a channel without events, the broker has no connection
+// to lose
+func (broker *MemoryBroker) Events() <-chan Event {
+	return broker.events
+}
+
+// Close stops the consumers, messages that were not acknowledged are lost
+func (broker *MemoryBroker) Close() {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	if broker.closed {
+		return
+	}
+	broker.closed = true
+	close(broker.done)
+	close(broker.events)
+	broker.ready.Broadcast()
+}
@@ -0,0 +1,294 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"sda-pipeline/internal/tracing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryConf is the configuration of the memory brokers in the tests
+var memoryConf = MQConf{
+	Exchange:     "sda",
+	RoutingError: "error",
+	SchemaType:   "federated",
+	MaxAttempts:  3,
+}
+
+func TestMemoryBroker_Route(t *testing.T) {
+	b, err := NewMemoryBroker(memoryConf)
+	assert.NoError(t, err)
+	defer b.Close()
+
+	b.Bind("archived", "sda", "archived")
+	b.Bind("completed", "sda", "completed")
+	b.Bind("audit", "sda", "completed")
+
+	assert.NoError(t, b.SendMessage("corrID1", "sda", "completed", true, []byte(`{"n": 1}`)))
+	assert.NoError(t, b.SendMessage("corrID2", "", "archived", true, []byte(`{"n": 2}`)))
+	assert.NoError(t, b.SendMessage("corrID3", "sda", "unbound", true, []byte(`{"n": 3}`)))
+
+	assert.Equal(t, 1, b.Len("completed"))
+	assert.Equal(t, 1, b.Len("audit"))
+	delivered, ok := b.Get("archived")
+	assert.True(t, ok)
+	assert.Equal(t, "corrID2", delivered.CorrelationId)
+	assert.Equal(t, "v1", MessageVersion(delivered))
+
+	delivered, ok = b.Get("audit")
+	assert.True(t, ok)
+	assert.Equal(t, "corrID1", delivered.CorrelationId)
+	assert.Equal(t, "sda", delivered.Exchange)
+	assert.Equal(t, "completed", delivered.RoutingKey)
+
+	_, ok = b.Get("archived")
+	assert.False(t, ok)
+
+	b.Close()
+	assert.EqualError(t, b.SendMessage("corrID4", "", "archived", true, []byte(`{}`)), "broker is closed")
+}
+
+func TestMemoryBroker_Topology(t *testing.T) {
+	conf := memoryConf
+	conf.Topology = Topology{Queues: []Queue{{Name: "verified", Bindings: []Binding{{Exchange: "sda", RoutingKey: "verified"}}}}}
+	b, err := NewMemoryBroker(conf)
+	assert.NoError(t, err)
+	defer b.Close()
+
+	assert.NoError(t, b.SendMessage("corrID1", "sda", "verified", true, []byte(`{}`)))
+	assert.Equal(t, 1, b.Len("verified"))
+}
+
+func TestMemoryBroker_Consume(t *testing.T) {
+	b, err := NewMemoryBroker(memoryConf)
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, b.SendMessage("corrID", "", "queue", false, []byte(`{}`)))
+	}
+
+	handled := make(chan amqp.Delivery, 10)
+	done := make(chan error)
+	go func() {
+		done <- b.Consume("queue", 2, func(delivered amqp.Delivery) {
+			if !delivered.Redelivered {
+				// Requeued deliveries are handed out again
+				assert.NoError(t, delivered.Nack(false, true))
+
+				return
+			}
+			handled <- delivered
+			assert.NoError(t, delivered.Ack(false))
+		})
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case delivered := <-handled:
+			assert.True(t, delivered.Redelivered)
+		case <-time.After(5 * time.Second):
+			t.Fatal("messages were not consumed")
+		}
+	}
+	assert.Eventually(t, func() bool { return b.Unacked() == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, 0, b.Len("queue"))
+
+	b.Close()
+	assert.NoError(t, <-done)
+}
+
+func TestMemoryBroker_Trace(t *testing.T) {
+	b, err := NewMemoryBroker(memoryConf)
+	assert.NoError(t, err)
+
+	assert.NoError(t, b.SendMessage("corrID1", "", "queue", false, []byte(`{}`)))
+	delivered, _ := b.Get("queue")
+	assert.Nil(t, delivered.Headers[tracing.TraceParentHeader], "no trace for a message sent on its own")
+
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	assert.NoError(t, b.publish("", "queue", amqp.Publishing{CorrelationId: "corrID1", Headers: amqp.Table{tracing.TraceParentHeader: traceParent}}))
+
+	done := make(chan error)
+	go func() {
+		done <- b.Consume("queue", 1, func(delivered amqp.Delivery) {
+			assert.NoError(t, b.SendMessageFor(delivered, "", "next", false, []byte(`{}`)))
+			assert.NoError(t, delivered.Ack(false))
+		})
+	}()
+	assert.Eventually(t, func() bool { return b.Len("next") == 1 }, 5*time.Second, time.Millisecond)
+	b.Close()
+	assert.NoError(t, <-done)
+
+	sent, _ := b.Get("next")
+	value, ok := sent.Headers[tracing.TraceParentHeader].(string)
+	assert.True(t, ok)
+	// The trace continues with the span of the handler as parent
+	assert.Equal(t, traceParent[:36], value[:36])
+	assert.NotEqual(t, traceParent, value)
+}
+
+func TestMemoryBroker_GetMessages(t *testing.T) {
+	b, err := NewMemoryBroker(memoryConf)
+	assert.NoError(t, err)
+
+	messages, err := b.GetMessages("queue")
+	assert.NoError(t, err)
+	assert.NoError(t, b.SendMessage("corrID1", "", "queue", false, []byte(`{}`)))
+
+	delivered := <-messages
+	assert.Equal(t, "corrID1", delivered.CorrelationId)
+	assert.Equal(t, 1, b.Unacked())
+	assert.NoError(t, delivered.Ack(false))
+	assert.EqualError(t, delivered.Ack(false), "unknown delivery tag 1")
+	assert.Equal(t, 0, b.Unacked())
+
+	b.Close()
+	_, open := <-messages
+	assert.False(t, open)
+}
+
+func TestMemoryBroker_Retry(t *testing.T) {
+	b, err := NewMemoryBroker(memoryConf)
+	assert.NoError(t, err)
+	defer b.Close()
+
+	assert.NoError(t, b.SendMessage("corrID1", "", "queue", false, []byte(`{}`)))
+	for attempt := 1; attempt <= 3; attempt++ {
+		delivered, ok := b.next("queue")
+		assert.True(t, ok)
+		assert.Equal(t, attempt-1, Attempts(delivered))
+		assert.NoError(t, b.Retry(delivered, errors.New("failed")))
+	}
+
+	assert.Equal(t, 0, b.Len("queue"))
+	assert.Equal(t, 0, b.Unacked())
+	delivered, ok := b.Get("queue.dead-letter")
+	assert.True(t, ok)
+	assert.Equal(t, 3, Attempts(delivered))
+	assert.Equal(t, "failed", delivered.Headers[LastErrorHeader])
+	assert.Equal(t, "v1", MessageVersion(delivered))
+
+	assert.EqualError(t, b.Retry(delivered, nil), "unknown delivery tag 0")
+}
+
+func TestMemoryBroker_Validate(t *testing.T) {
+	b, err := NewMemoryBroker(memoryConf)
+	assert.NoError(t, err)
+	defer b.Close()
+	b.Bind("errors", "sda", "error")
+
+	assert.NoError(t, b.SendMessage("corrID1", "", "queue", false, []byte(`{"user": "test"}`)))
+	delivered, ok := b.next("queue")
+	assert.True(t, ok)
+
+	assert.Error(t, b.ValidateJSON(&delivered, "ingestion-user-error", delivered.Body, nil))
+	assert.Equal(t, 0, b.Unacked())
+	assert.Equal(t, 0, b.Len("queue"))
+
+	report, ok := b.Get("errors")
+	assert.True(t, ok)
+	assert.Equal(t, "corrID1", report.CorrelationId)
+	assert.Contains(t, string(report.Body), "Validation of JSON message failed")
+
+	// A valid message that does not fit dest is rejected as well
+	assert.NoError(t, b.SendMessage("corrID2", "", "queue", false, []byte(`{"user": "test", "filepath": "file.c4gh", "reason": "failed"}`)))
+	delivered, ok = b.next("queue")
+	assert.True(t, ok)
+	assert.Error(t, b.ValidateJSON(&delivered, "ingestion-user-error", delivered.Body, new(struct{ User string })))
+	assert.Equal(t, 0, b.Unacked())
+	assert.Equal(t, 1, b.Len("errors"))
+}
+
+// TestMemoryBroker_Consume_Failed retries the messages a handler fails on
+// until they are dead-lettered, while the worker goes on with the others
+func TestMemoryBroker_Consume_Failed(t *testing.T) {
+	b, err := NewMemoryBroker(memoryConf)
+	assert.NoError(t, err)
+
+	assert.NoError(t, b.SendMessage("failing", "", "queue", false, []byte(`{}`)))
+	assert.NoError(t, b.SendMessage("working", "", "queue", false, []byte(`{}`)))
+
+	done := make(chan error)
+	go func() {
+		done <- b.Consume("queue", 1, func(delivered amqp.Delivery) {
+			if delivered.CorrelationId == "failing" {
+				assert.NoError(t, b.Retry(delivered, errors.New("failed")))
+
+				return
+			}
+			assert.NoError(t, delivered.Ack(false))
+		})
+	}()
+
+	assert.Eventually(t, func() bool {
+		return b.Len("queue.dead-letter") == 1 && b.Len("queue") == 0 && b.Unacked() == 0
+	}, 5*time.Second, time.Millisecond)
+	b.Close()
+	assert.NoError(t, <-done)
+}
+
+// TestMemoryBroker_Pipeline chains two services through the broker and
+// follows a message from the first queue to the last
+func TestMemoryBroker_Pipeline(t *testing.T) {
+	b, err := NewMemoryBroker(memoryConf)
+	assert.NoError(t, err)
+	b.Bind("inbox", "sda", "inbox")
+	b.Bind("accessionIDs", "sda", "accessionIDs")
+	b.Bind("completed", "sda", "completed")
+
+	type accession struct {
+		Type               string              `json:"type"`
+		User               string              `json:"user"`
+		FilePath           string              `json:"filepath"`
+		AccessionID        string              `json:"accession_id"`
+		DecryptedChecksums []map[string]string `json:"decrypted_checksums"`
+	}
+
+	checksum := "82e4e60e7beb3db2e06a00a079788f7d71f75b61a4b75f28c4c942703dabb6d6"
+
+	// The first service hands out accession ids for the files in the inbox
+	go func() {
+		_ = b.Consume("inbox", 1, func(delivered amqp.Delivery) {
+			var message struct {
+				User     string `json:"user"`
+				FilePath string `json:"filepath"`
+			}
+			if json.Unmarshal(delivered.Body, &message) != nil {
+				_ = delivered.Nack(false, false)
+
+				return
+			}
+			body, _ := json.Marshal(accession{"accession", message.User, message.FilePath, "EGAF00000000001", []map[string]string{{"type": "sha256", "value": checksum}}})
+			if b.ValidateOutgoing(&delivered, "ingestion-accession", body, nil) != nil {
+				return
+			}
+			assert.NoError(t, b.SendMessage(delivered.CorrelationId, "sda", "accessionIDs", true, body))
+			assert.NoError(t, delivered.Ack(false))
+		})
+	}()
+
+	// The second service completes them
+	go func() {
+		_ = b.Consume("accessionIDs", 2, func(delivered amqp.Delivery) {
+			var message accession
+			if b.ValidateJSON(&delivered, "ingestion-accession", delivered.Body, &message) != nil {
+				return
+			}
+			assert.NoError(t, b.SendMessage(delivered.CorrelationId, "sda", "completed", true, delivered.Body))
+			assert.NoError(t, delivered.Ack(false))
+		})
+	}()
+
+	assert.NoError(t, b.SendMessage("corrID1", "sda", "inbox", true, []byte(`{"user": "test", "filepath": "file.c4gh"}`)))
+	assert.Eventually(t, func() bool { return b.Len("completed") == 1 }, 5*time.Second, time.Millisecond)
+	b.Close()
+
+	completed, _ := b.Get("completed")
+	assert.Equal(t, "corrID1", completed.CorrelationId)
+	assert.JSONEq(t, `{"type": "accession", "user": "test", "filepath": "file.c4gh", "accession_id": "EGAF00000000001", "decrypted_checksums": [{"type": "sha256", "value": "`+checksum+`"}]}`, string(completed.Body))
+}
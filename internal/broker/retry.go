@@ -0,0 +1,139 @@
+package broker
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers used to keep track of messages that are retried
+const (
+	// AttemptsHeader counts the failed attempts to handle a message
+	AttemptsHeader = "sda-attempts"
+	// LastErrorHeader holds the reason the last attempt failed
+	LastErrorHeader = "sda-last-error"
+)
+
+// Retry hands a message that could not be handled back to the broker. It is
+// published to a delay queue and delivered on the consumed queue again once
+// the delay has passed, the delay doubles with every attempt. When
+// Conf.MaxAttempts attempts have failed the message goes to the dead-letter
+// queue instead. The delivery is acknowledged once the message has been
+// published, if publishing fails it is requeued and the error returned.
+func (broker *AMQPBroker) Retry(delivered amqp.Delivery, cause error) error {
+	attempts := Attempts(delivered) + 1
+
+	headers := amqp.Table{}
+	for k, v := range delivered.Headers {
+		headers[k] = v
+	}
+	headers[AttemptsHeader] = int32(attempts)
+	headers[LastErrorHeader] = "unknown error"
+	if cause != nil {
+		headers[LastErrorHeader] = cause.Error()
+	}
+
+	queue, args := retryQueue(broker.Conf, broker.Conf.Queue, attempts)
+	err := broker.declareQueue(queue, args)
+	if err == nil {
+		err = broker.send("", queue, true, amqp.Publishing{
+			Headers:         headers,
+			ContentEncoding: delivered.ContentEncoding,
+			ContentType:     delivered.ContentType,
+			DeliveryMode:    amqp.Persistent,
+			CorrelationId:   delivered.CorrelationId,
+			Body:            delivered.Body,
+		})
+	}
+	if err != nil {
+		if e := delivered.Nack(false, true); e != nil {
+			log.Errorf("Failed to Nack message (retry failed) "+
+				"(corr-id: %s, reason: %v)",
+				delivered.CorrelationId,
+				e)
+		}
+
+		return fmt.Errorf("failed to publish message to %s: %v", queue, err)
+	}
+
+	if args == nil {
+		log.Errorf("Message sent to dead-letter queue "+
+			"(corr-id: %s, attempts: %d, queue: %s, reason: %s)",
+			delivered.CorrelationId,
+			attempts,
+			queue,
+			headers[LastErrorHeader])
+	} else {
+		log.Infof("Message scheduled for retry "+
+			"(corr-id: %s, attempts: %d, queue: %s, reason: %s)",
+			delivered.CorrelationId,
+			attempts,
+			queue,
+			headers[LastErrorHeader])
+	}
+
+	return delivered.Ack(false)
+}
+
+// Attempts returns the number of failed attempts to handle a delivery
+func Attempts(delivered amqp.Delivery) int {
+	switch v := delivered.Headers[AttemptsHeader].(type) {
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+// Redelivered reports whether a delivery is a retry or redelivery of a
+// message, i.e. an earlier delivery of it was given up
+func Redelivered(delivered amqp.Delivery) bool {
+	return delivered.Redelivered || Attempts(delivered) > 0
+}
+
+// retryQueue names the queue a message from queue goes to after attempts
+// failed attempts, with the arguments to declare it with. The delay queues
+// dead-letter their messages back to queue when they expire.
+func retryQueue(config MQConf, queue string, attempts int) (string, amqp.Table) {
+	if attempts >= config.MaxAttempts {
+		return queue + ".dead-letter", nil
+	}
+
+	delay := config.RetryDelay << (attempts - 1)
+
+	return fmt.Sprintf("%s.retry.%d", queue, attempts), amqp.Table{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": queue,
+	}
+}
+
+// declareQueue makes sure a durable queue exists
+func (broker *AMQPBroker) declareQueue(queue string, args amqp.Table) error {
+	broker.mu.RLock()
+	defer broker.mu.RUnlock()
+
+	return declareDurable(broker.Channel, queue, args)
+}
+
+// declareDurable declares a durable queue on ch
+func declareDurable(ch AMQPChannel, queue string, args amqp.Table) error {
+	_, err := ch.QueueDeclare(
+		queue, // name
+		true,  // durable
+		false, // auto-deleted
+		false, // exclusive
+		false, // noWait
+		args,  // arguments
+	)
+
+	return err
+}
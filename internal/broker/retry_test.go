@@ -0,0 +1,102 @@
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetry(t *testing.T) {
+	var str bytes.Buffer
+	log.SetOutput(&str)
+
+	b := AMQPBroker{Conf: tMqconf}
+	c := mockChannel{}
+	b.Channel = &c
+	a := mockAcknowledger{}
+
+	delivered := amqp.Delivery{
+		Acknowledger:  &a,
+		DeliveryTag:   1,
+		Headers:       amqp.Table{"other": "kept"},
+		ContentType:   "application/json",
+		CorrelationId: "corrID1",
+		Body:          []byte("Message"),
+	}
+	err := b.Retry(delivered, errors.New("database down"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, amqp.Table{
+		"x-message-ttl":             int64(10000),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": "queue",
+	}, c.declared["queue.retry.1"])
+	assert.Len(t, c.published, 1)
+	assert.Equal(t, "", c.published[0].exchange)
+	assert.Equal(t, "queue.retry.1", c.published[0].key)
+	assert.Equal(t, "corrID1", c.published[0].msg.CorrelationId)
+	assert.Equal(t, []byte("Message"), c.published[0].msg.Body)
+	assert.Equal(t, amqp.Table{
+		"other":         "kept",
+		AttemptsHeader:  int32(1),
+		LastErrorHeader: "database down",
+	}, c.published[0].msg.Headers)
+	assert.Equal(t, []uint64{1}, a.acked)
+
+	// The delay doubles with every attempt
+	delivered.DeliveryTag = 2
+	delivered.Headers = c.published[0].msg.Headers
+	assert.NoError(t, b.Retry(delivered, errors.New("database down")))
+	assert.Equal(t, "queue.retry.2", c.published[1].key)
+	assert.Equal(t, int64(20000), c.declared["queue.retry.2"]["x-message-ttl"])
+	assert.Equal(t, int32(2), c.published[1].msg.Headers[AttemptsHeader])
+
+	// The last attempt goes to the dead-letter queue
+	delivered.DeliveryTag = 3
+	delivered.Headers = c.published[1].msg.Headers
+	assert.NoError(t, b.Retry(delivered, errors.New("still down")))
+	assert.Equal(t, "queue.dead-letter", c.published[2].key)
+	assert.Nil(t, c.declared["queue.dead-letter"])
+	assert.Equal(t, "still down", c.published[2].msg.Headers[LastErrorHeader])
+	assert.Equal(t, []uint64{1, 2, 3}, a.acked)
+	assert.Contains(t, str.String(), "Message sent to dead-letter queue")
+}
+
+func TestRetry_Error(t *testing.T) {
+	b := AMQPBroker{Conf: tMqconf}
+	c := mockChannel{failDeclare: true}
+	b.Channel = &c
+	a := mockAcknowledger{}
+
+	err := b.Retry(amqp.Delivery{Acknowledger: &a, DeliveryTag: 1}, errors.New("database down"))
+	assert.EqualError(t, err, "failed to publish message to queue.retry.1: failDeclare")
+	assert.Empty(t, c.published)
+	assert.Empty(t, a.acked)
+	assert.Equal(t, []uint64{1}, a.nacked)
+	assert.Equal(t, []bool{true}, a.requeue)
+}
+
+func TestAttempts(t *testing.T) {
+	assert.Equal(t, 0, Attempts(amqp.Delivery{}))
+	assert.Equal(t, 0, Attempts(amqp.Delivery{Headers: amqp.Table{AttemptsHeader: "2"}}))
+	assert.Equal(t, 2, Attempts(amqp.Delivery{Headers: amqp.Table{AttemptsHeader: int32(2)}}))
+	assert.Equal(t, 3, Attempts(amqp.Delivery{Headers: amqp.Table{AttemptsHeader: int64(3)}}))
+}
+
+func TestRetryQueue(t *testing.T) {
+	conf := tMqconf
+	conf.RetryDelay = time.Second
+
+	queue, args := retryQueue(conf, "queue", 2)
+	assert.Equal(t, "queue.retry.2", queue)
+	assert.Equal(t, int64(2000), args["x-message-ttl"])
+
+	queue, args = retryQueue(conf, "queue", 3)
+	assert.Equal(t, "queue.dead-letter", queue)
+	assert.Nil(t, args)
+}
@@ -0,0 +1,195 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"sda-pipeline/schemas"
+
+	"github.com/streadway/amqp"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// SchemaVersionHeader holds the schema version of a published message
+const SchemaVersionHeader = "sda-schema-version"
+
+// UnversionedSchema is the schema version of messages without a
+// SchemaVersionHeader, as sent by services that predate schema versions
+const UnversionedSchema = "v1"
+
+// schemaSet holds the compiled schemas of each message version
+type schemaSet struct {
+	versions map[string]map[string]*gojsonschema.Schema
+	// publish is the schema version of the messages the service sends
+	publish string
+}
+
+// LoadSchemas compiles the JSON schemas in the version directories, v1, v2
+// and so on, at the root of fsys. The schemas are returned by version and
+// each schema is named after its file without the .json extension. An error
+// is returned if fsys holds no schemas or if any of them is invalid.
+func LoadSchemas(fsys fs.FS) (map[string]map[string]*gojsonschema.Schema, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	versions := make(map[string]map[string]*gojsonschema.Schema)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if versionNumber(entry.Name()) == 0 {
+			return nil, fmt.Errorf("invalid schema version %s", entry.Name())
+		}
+
+		compiled, err := compileSchemas(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		versions[entry.Name()] = compiled
+	}
+	if len(versions) == 0 {
+		return nil, errors.New("no schemas found")
+	}
+
+	return versions, nil
+}
+
+// compileSchemas compiles the JSON schemas of one version
+func compileSchemas(fsys fs.FS, version string) (map[string]*gojsonschema.Schema, error) {
+	files, err := fs.Glob(fsys, path.Join(version, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no schemas found in %s", version)
+	}
+
+	compiled := make(map[string]*gojsonschema.Schema, len(files))
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile schema %s: %v", file, err)
+		}
+		compiled[strings.TrimSuffix(path.Base(file), ".json")] = schema
+	}
+
+	return compiled, nil
+}
+
+// versionNumber returns the number of a schema version named v<number>, or
+// 0 if version is not named like that
+func versionNumber(version string) int {
+	if !strings.HasPrefix(version, "v") {
+		return 0
+	}
+	n, err := strconv.Atoi(version[1:])
+	if err != nil || n < 1 {
+		return 0
+	}
+
+	return n
+}
+
+// loadSchemas compiles the schemas embedded for config.SchemaType, unless
+// config.SchemasPath points to a directory to load them from instead. The
+// service sends config.SchemaVersion messages, or messages of the newest
+// version if it is not set.
+func loadSchemas(config MQConf) (*schemaSet, error) {
+	var versions map[string]map[string]*gojsonschema.Schema
+	if config.SchemasPath != "" {
+		var err error
+		versions, err = LoadSchemas(os.DirFS(config.SchemasPath))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load schemas from %s: %v", config.SchemasPath, err)
+		}
+	} else {
+		fsys, err := schemas.Embedded(config.SchemaType)
+		if err != nil {
+			return nil, err
+		}
+		versions, err = LoadSchemas(fsys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	set := &schemaSet{versions: versions, publish: config.SchemaVersion}
+	if set.publish == "" {
+		for version := range versions {
+			if versionNumber(version) > versionNumber(set.publish) {
+				set.publish = version
+			}
+		}
+	}
+	if _, ok := versions[set.publish]; !ok {
+		return nil, fmt.Errorf("unknown schema version %s", set.publish)
+	}
+
+	return set, nil
+}
+
+// validate validates body against the messageType schema of version, an
+// empty version means the version of the messages the service sends
+func (set *schemaSet) validate(version, messageType string, body []byte) (*gojsonschema.Result, error) {
+	if version == "" {
+		version = set.publish
+	}
+	compiled, ok := set.versions[version]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema version %s", version)
+	}
+
+	return validateJSON(compiled, messageType, body)
+}
+
+// schemaCache holds the schemas of a broker, compiled when the broker is
+// created or otherwise on first use
+type schemaCache struct {
+	set  *schemaSet
+	err  error
+	once sync.Once
+}
+
+// load returns the schemas compiled for config
+func (cache *schemaCache) load(config MQConf) (*schemaSet, error) {
+	cache.once.Do(func() {
+		if cache.set == nil {
+			cache.set, cache.err = loadSchemas(config)
+		}
+	})
+
+	return cache.set, cache.err
+}
+
+// publishVersion returns the schema version of the messages the service
+// sends, or an empty string if the schemas could not be loaded
+func (cache *schemaCache) publishVersion(config MQConf) string {
+	set, err := cache.load(config)
+	if err != nil {
+		return ""
+	}
+
+	return set.publish
+}
+
+// MessageVersion returns the schema version of a delivery
+func MessageVersion(delivered amqp.Delivery) string {
+	if version, ok := delivered.Headers[SchemaVersionHeader].(string); ok && version != "" {
+		return version
+	}
+
+	return UnversionedSchema
+}
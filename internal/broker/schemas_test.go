@@ -0,0 +1,170 @@
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sda-pipeline/schemas"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeSchemas writes the schemas, keyed by version/name, to dir
+func writeSchemas(t *testing.T, dir string, files map[string]string) {
+	for name, schema := range files {
+		file := filepath.Join(dir, name+".json")
+		assert.NoError(t, os.MkdirAll(filepath.Dir(file), 0755))
+		assert.NoError(t, ioutil.WriteFile(file, []byte(schema), 0600))
+	}
+}
+
+func TestLoadSchemas(t *testing.T) {
+	fsys, err := schemas.Embedded("federated")
+	assert.NoError(t, err)
+	versions, err := LoadSchemas(fsys)
+	assert.NoError(t, err)
+	assert.Contains(t, versions, "v1")
+	assert.Len(t, versions["v1"], 13)
+	assert.Contains(t, versions["v1"], "ingestion-trigger")
+
+	fsys, err = schemas.Embedded("isolated")
+	assert.NoError(t, err)
+	versions, err = LoadSchemas(fsys)
+	assert.NoError(t, err)
+	assert.Len(t, versions["v1"], 6)
+	assert.NotContains(t, versions["v1"], "ingestion-trigger")
+
+	_, err = LoadSchemas(os.DirFS(doesNotExist))
+	assert.EqualError(t, err, "no schemas found")
+}
+
+func TestLoadSchemas_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	writeSchemas(t, dir, map[string]string{"v1/valid": `{"type": "object"}`, "v1/broken": `{"type": 12}`})
+
+	_, err := LoadSchemas(os.DirFS(dir))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to compile schema v1/broken.json")
+
+	dir = t.TempDir()
+	writeSchemas(t, dir, map[string]string{"latest/valid": `{"type": "object"}`})
+	_, err = LoadSchemas(os.DirFS(dir))
+	assert.EqualError(t, err, "invalid schema version latest")
+
+	dir = t.TempDir()
+	writeSchemas(t, dir, map[string]string{"v1/valid": `{"type": "object"}`})
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "v2"), 0755))
+	_, err = LoadSchemas(os.DirFS(dir))
+	assert.EqualError(t, err, "no schemas found in v2")
+}
+
+func TestLoadSchemas_Override(t *testing.T) {
+	dir := t.TempDir()
+	writeSchemas(t, dir, map[string]string{"v1/experiment": `{"type": "object"}`})
+
+	set, err := loadSchemas(MQConf{SchemasPath: dir, SchemaType: "federated"})
+	assert.NoError(t, err)
+	assert.Len(t, set.versions["v1"], 1)
+	assert.Contains(t, set.versions["v1"], "experiment")
+
+	_, err = loadSchemas(MQConf{SchemasPath: doesNotExist})
+	assert.EqualError(t, err, "failed to load schemas from /does/not/exist: no schemas found")
+
+	set, err = loadSchemas(MQConf{SchemaType: "isolated"})
+	assert.NoError(t, err)
+	assert.Len(t, set.versions["v1"], 6)
+
+	_, err = loadSchemas(MQConf{SchemaType: "central"})
+	assert.EqualError(t, err, "unknown schema type central")
+}
+
+func TestLoadSchemas_PublishVersion(t *testing.T) {
+	dir := t.TempDir()
+	writeSchemas(t, dir, map[string]string{
+		"v1/message":  `{"type": "object"}`,
+		"v2/message":  `{"type": "object"}`,
+		"v10/message": `{"type": "object"}`,
+	})
+
+	set, err := loadSchemas(MQConf{SchemasPath: dir})
+	assert.NoError(t, err)
+	assert.Equal(t, "v10", set.publish)
+
+	set, err = loadSchemas(MQConf{SchemasPath: dir, SchemaVersion: "v2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", set.publish)
+
+	_, err = loadSchemas(MQConf{SchemasPath: dir, SchemaVersion: "v3"})
+	assert.EqualError(t, err, "unknown schema version v3")
+}
+
+func TestValidateJSON_Compiled(t *testing.T) {
+	set, err := loadSchemas(tMqconf)
+	assert.NoError(t, err)
+	compiled := set.versions["v1"]
+
+	res, err := validateJSON(compiled, "ingestion-user-error", []byte(`{"user": "test", "filepath": "file.c4gh", "reason": "checksum mismatch"}`))
+	assert.NoError(t, err)
+	assert.True(t, res.Valid())
+
+	res, err = validateJSON(compiled, "ingestion-user-error", []byte(`{"user": "test"}`))
+	assert.NoError(t, err)
+	assert.False(t, res.Valid())
+
+	_, err = validateJSON(compiled, "notfound", []byte(`{}`))
+	assert.EqualError(t, err, "unknown schema notfound")
+}
+
+func TestValidateJSON_Versions(t *testing.T) {
+	dir := t.TempDir()
+	writeSchemas(t, dir, map[string]string{
+		"v1/message": `{"type": "object", "required": ["user"]}`,
+		"v2/message": `{"type": "object", "required": ["username"]}`,
+	})
+
+	b := AMQPBroker{Conf: MQConf{SchemasPath: dir, SchemaVersion: "v1"}, Channel: &mockChannel{}}
+	v1 := []byte(`{"user": "test"}`)
+	v2 := []byte(`{"username": "test"}`)
+
+	// Messages without a version are validated as the first version
+	delivered := amqp.Delivery{Acknowledger: &mockAcknowledger{}, Body: v1}
+	assert.NoError(t, b.ValidateJSON(&delivered, "message", v1, nil))
+
+	delivered = amqp.Delivery{Acknowledger: &mockAcknowledger{}, Headers: amqp.Table{SchemaVersionHeader: "v2"}, Body: v2}
+	assert.NoError(t, b.ValidateJSON(&delivered, "message", v2, nil))
+	assert.Error(t, b.ValidateJSON(&delivered, "message", v1, nil))
+
+	// Outgoing messages are validated as the version they are sent as
+	assert.NoError(t, b.ValidateOutgoing(&delivered, "message", v1, nil))
+	assert.Error(t, b.ValidateOutgoing(&delivered, "message", v2, nil))
+
+	delivered = amqp.Delivery{Acknowledger: &mockAcknowledger{}, Headers: amqp.Table{SchemaVersionHeader: "v3"}, Body: v2}
+	assert.EqualError(t, b.ValidateJSON(&delivered, "message", v2, nil), "unknown schema version v3")
+}
+
+func TestSendMessage_Version(t *testing.T) {
+	c := mockChannel{}
+	b := AMQPBroker{Conf: tMqconf, Channel: &c}
+
+	assert.NoError(t, b.SendMessage("corrID1", "exchange", "routingkey", false, []byte("{}")))
+	assert.Equal(t, "v1", c.published[0].msg.Headers[SchemaVersionHeader])
+
+	delivered := amqp.Delivery{CorrelationId: "corrID2", Headers: amqp.Table{SchemaVersionHeader: "v7"}, Body: []byte("{}")}
+	assert.NoError(t, b.RelayMessage(delivered, "exchange", "routingkey", false))
+	assert.Equal(t, "v7", c.published[1].msg.Headers[SchemaVersionHeader])
+	assert.Equal(t, "corrID2", c.published[1].msg.CorrelationId)
+
+	// Messages are not labelled with a version if the schemas can not be loaded
+	b = AMQPBroker{Conf: MQConf{SchemasPath: doesNotExist}, Channel: &c}
+	assert.NoError(t, b.SendMessage("corrID3", "exchange", "routingkey", false, []byte("{}")))
+	assert.NotContains(t, c.published[2].msg.Headers, SchemaVersionHeader)
+}
+
+func TestMessageVersion(t *testing.T) {
+	assert.Equal(t, "v1", MessageVersion(amqp.Delivery{}))
+	assert.Equal(t, "v1", MessageVersion(amqp.Delivery{Headers: amqp.Table{SchemaVersionHeader: int32(2)}}))
+	assert.Equal(t, "v2", MessageVersion(amqp.Delivery{Headers: amqp.Table{SchemaVersionHeader: "v2"}}))
+}
@@ -222,6 +222,8 @@ func handleOneConnection(s chan *commonServer, failChannel, failDeclare bool) {
 
 	if failChannel == true {
 		session.send(1, &channelClose{ReplyCode: 506, ReplyText: "Something", MethodID: 10, ClassID: 20})
+		session.recv(1, &channelCloseOk{})
+		session.connectionClose()
 		return
 	} else {
 		session.send(1, &channelOpenOk{})
@@ -233,6 +235,8 @@ func handleOneConnection(s chan *commonServer, failChannel, failDeclare bool) {
 	if failDeclare == true {
 		session.send(1, &channelClose{ReplyCode: 506,
 			ReplyText: "Something", MethodID: 10, ClassID: 50})
+		session.recv(1, &channelCloseOk{})
+		session.connectionClose()
 	} else {
 		session.send(1, &queueDeclareOk{})
 	}
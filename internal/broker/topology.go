@@ -0,0 +1,87 @@
+package broker
+
+import (
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// Topology lists the exchanges and queues to declare on the broker, so that
+// a broker can be set up by the services themselves. Declarations are
+// idempotent, but fail if an exchange or queue exists with other settings.
+type Topology struct {
+	Exchanges []Exchange
+	Queues    []Queue
+}
+
+// Exchange is a durable exchange to declare
+type Exchange struct {
+	Name string
+	// Type is the kind of exchange, topic if not set
+	Type string
+}
+
+// Queue is a durable queue to declare with the bindings that route messages
+// to it
+type Queue struct {
+	Name     string
+	Bindings []Binding
+	// Retry also declares the delay queues and the dead-letter queue used by
+	// Retry for the messages of the queue, with the retry settings of the
+	// service that declares them
+	Retry bool
+}
+
+// Binding routes the messages sent to Exchange with RoutingKey to a queue
+type Binding struct {
+	Exchange   string
+	RoutingKey string
+}
+
+// declareTopology declares config.Topology on ch, exchanges first so that
+// the queues can be bound to them
+func declareTopology(ch AMQPChannel, config MQConf) error {
+	for _, exchange := range config.Topology.Exchanges {
+		kind := exchange.Type
+		if kind == "" {
+			kind = amqp.ExchangeTopic
+		}
+
+		err := ch.ExchangeDeclare(
+			exchange.Name, // name
+			kind,          // type
+			true,          // durable
+			false,         // auto-deleted
+			false,         // internal
+			false,         // noWait
+			nil,           // arguments
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare exchange %s: %v", exchange.Name, err)
+		}
+	}
+
+	for _, queue := range config.Topology.Queues {
+		if err := declareDurable(ch, queue.Name, nil); err != nil {
+			return fmt.Errorf("failed to declare queue %s: %v", queue.Name, err)
+		}
+
+		for _, binding := range queue.Bindings {
+			if err := ch.QueueBind(queue.Name, binding.RoutingKey, binding.Exchange, false, nil); err != nil {
+				return fmt.Errorf("failed to bind queue %s to %s with %s: %v", queue.Name, binding.Exchange, binding.RoutingKey, err)
+			}
+		}
+
+		if !queue.Retry {
+			continue
+		}
+		for attempts := 1; attempts <= config.MaxAttempts; attempts++ {
+			name, args := retryQueue(config, queue.Name, attempts)
+			if err := declareDurable(ch, name, args); err != nil {
+				return fmt.Errorf("failed to declare queue %s: %v", name, err)
+			}
+		}
+	}
+
+	return nil
+}
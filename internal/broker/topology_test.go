@@ -0,0 +1,45 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeclareTopology(t *testing.T) {
+	conf := tMqconf
+	conf.MaxAttempts = 3
+	conf.RetryDelay = time.Second
+	conf.Topology = Topology{
+		Exchanges: []Exchange{{Name: "sda"}, {Name: "localega", Type: "direct"}},
+		Queues: []Queue{
+			{Name: "archived", Retry: true, Bindings: []Binding{{Exchange: "sda", RoutingKey: "archived"}}},
+			{Name: "error", Bindings: []Binding{{Exchange: "sda", RoutingKey: "error"}, {Exchange: "localega", RoutingKey: "error"}}},
+		},
+	}
+
+	c := mockChannel{}
+	assert.NoError(t, declareTopology(&c, conf))
+	assert.Equal(t, map[string]string{"sda": "topic", "localega": "direct"}, c.exchanges)
+	assert.Equal(t, []mockBinding{{"archived", "sda", "archived"}, {"error", "sda", "error"}, {"error", "localega", "error"}}, c.bindings)
+
+	assert.Len(t, c.declared, 5)
+	assert.Contains(t, c.declared, "archived")
+	assert.Contains(t, c.declared, "error")
+	assert.Equal(t, int64(2000), c.declared["archived.retry.2"]["x-message-ttl"])
+	assert.Equal(t, "archived", c.declared["archived.retry.2"]["x-dead-letter-routing-key"])
+	assert.Contains(t, c.declared, "archived.dead-letter")
+	assert.NotContains(t, c.declared, "archived.retry.3")
+
+	// The topology is optional
+	c = mockChannel{}
+	assert.NoError(t, declareTopology(&c, tMqconf))
+	assert.Empty(t, c.declared)
+
+	c = mockChannel{failDeclare: true}
+	assert.EqualError(t, declareTopology(&c, conf), "failed to declare exchange sda: failDeclare")
+
+	conf.Topology.Exchanges = nil
+	assert.EqualError(t, declareTopology(&c, conf), "failed to declare queue archived: failDeclare")
+}
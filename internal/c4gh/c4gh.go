@@ -0,0 +1,145 @@
+// Package c4gh provides functionalities for handling the crypt4gh headers
+// of the archived files
+package c4gh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/elixir-oslo/crypt4gh/keys"
+	"github.com/elixir-oslo/crypt4gh/model/headers"
+)
+
+// ErrNoMatchingKey is returned when none of the keys in a keyring can
+// decrypt a header
+var ErrNoMatchingKey = errors.New("none of the configured keys can decrypt the header")
+
+// Key is a private key together with the identifier recorded for the
+// headers it decrypts
+type Key struct {
+	ID         string
+	PrivateKey [32]byte
+}
+
+// NewKey returns a Key for privateKey, the id defaults to the KeyID of the
+// matching public key when empty
+func NewKey(privateKey [32]byte, id string) Key {
+	if id == "" {
+		id = KeyID(keys.DerivePublicKey(privateKey))
+	}
+
+	return Key{ID: id, PrivateKey: privateKey}
+}
+
+// Keyring holds the private keys that are tried, in order, when decrypting
+// headers
+type Keyring []Key
+
+// DecryptHeader decrypts header with the first key in the keyring that can
+// decrypt it and returns that key, ErrNoMatchingKey is returned if the
+// header is well formed but no key matches
+func (k Keyring) DecryptHeader(header []byte) (*headers.Header, Key, error) {
+	if _, err := headers.ReadHeader(bytes.NewReader(header)); err != nil {
+		return nil, Key{}, err
+	}
+
+	for _, key := range k {
+		h, err := headers.NewHeader(bytes.NewReader(header), key.PrivateKey)
+		if err != nil {
+			continue
+		}
+		if err := checkHeader(h); err != nil {
+			return nil, Key{}, err
+		}
+
+		return h, key, nil
+	}
+
+	return nil, Key{}, ErrNoMatchingKey
+}
+
+// KeyID returns the identifier stored with the headers encrypted to
+// publicKey, the hex encoded sha256 checksum of the key
+func KeyID(publicKey [32]byte) string {
+	sum := sha256.Sum256(publicKey[:])
+
+	return hex.EncodeToString(sum[:])
+}
+
+// DecryptHeader decrypts header with privateKey and checks that it holds
+// the parameters needed to decrypt the file
+func DecryptHeader(header []byte, privateKey [32]byte) (*headers.Header, error) {
+	h, err := headers.NewHeader(bytes.NewReader(header), privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHeader(h); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// checkHeader checks that a decrypted header holds the parameters needed
+// to decrypt the file and at most one data edit list
+func checkHeader(h *headers.Header) error {
+	for _, packet := range h.HeaderPackets {
+		if packet.EncryptedHeaderPacket == nil {
+			return errors.New("header holds a packet of unknown type")
+		}
+	}
+
+	if _, err := h.GetDataEncryptionParameterHeaderPackets(); err != nil {
+		return err
+	}
+
+	editLists := 0
+	for _, packet := range h.HeaderPackets {
+		if packet.EncryptedHeaderPacket.GetPacketType() == headers.DataEditList {
+			editLists++
+		}
+	}
+	if editLists > 1 {
+		return errors.New("header holds more than one data edit list")
+	}
+
+	return nil
+}
+
+// EditList returns the lengths in the data edit list of a decrypted header,
+// alternately the number of bytes to skip and to keep, nil is returned when
+// the header has no edit list
+func EditList(h *headers.Header) []uint64 {
+	editList := h.GetDataEditListHeaderPacket()
+	if editList == nil {
+		return nil
+	}
+
+	return append([]uint64{}, editList.Lengths...)
+}
+
+// ReencryptHeader decrypts header with privateKey and encrypts the same
+// header packets to publicKey, only the header is changed so the file it
+// belongs to can be read with the new header as before
+func ReencryptHeader(header []byte, privateKey, publicKey [32]byte) ([]byte, error) {
+	h, err := DecryptHeader(header, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	_, writerPrivateKey, err := keys.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range h.HeaderPackets {
+		h.HeaderPackets[i].WriterPrivateKey = writerPrivateKey
+		h.HeaderPackets[i].ReaderPublicKey = publicKey
+		h.HeaderPackets[i].HeaderEncryptionMethod = headers.X25519ChaCha20IETFPoly1305
+		h.HeaderPackets[i].Nonce = nil
+	}
+
+	return h.MarshalBinary()
+}
@@ -0,0 +1,199 @@
+package c4gh
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/elixir-oslo/crypt4gh/keys"
+	"github.com/elixir-oslo/crypt4gh/model/headers"
+	"github.com/elixir-oslo/crypt4gh/streaming"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const passphrase = "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm"
+
+// readTestFile returns the key and the header and body of the dummy file
+func readTestFile(t *testing.T) ([32]byte, []byte, []byte) {
+	keyFile, err := os.Open("../../dev_utils/c4gh.sec.pem")
+	require.NoError(t, err)
+	defer keyFile.Close()
+
+	key, err := keys.ReadPrivateKey(keyFile, []byte(passphrase))
+	require.NoError(t, err)
+
+	data, err := os.ReadFile("../../dev_utils/dummy_data.c4gh")
+	require.NoError(t, err)
+
+	header, err := headers.ReadHeader(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	return key, header, data[len(header):]
+}
+
+func TestKeyID(t *testing.T) {
+	publicKey, _, err := keys.GenerateKeyPair()
+	require.NoError(t, err)
+
+	assert.Len(t, KeyID(publicKey), 64)
+	assert.Equal(t, KeyID(publicKey), KeyID(publicKey))
+
+	otherKey, _, err := keys.GenerateKeyPair()
+	require.NoError(t, err)
+	assert.NotEqual(t, KeyID(publicKey), KeyID(otherKey))
+}
+
+func TestReencryptHeader(t *testing.T) {
+	key, header, body := readTestFile(t)
+
+	publicKey, privateKey, err := keys.GenerateKeyPair()
+	require.NoError(t, err)
+
+	newHeader, err := ReencryptHeader(header, key, publicKey)
+	require.NoError(t, err)
+
+	_, err = DecryptHeader(newHeader, key)
+	assert.Error(t, err, "the old key can still decrypt the header")
+
+	decrypted, err := DecryptHeader(newHeader, privateKey)
+	require.NoError(t, err)
+	original, err := DecryptHeader(header, key)
+	require.NoError(t, err)
+	newParams, _ := decrypted.GetDataEncryptionParameterHeaderPackets()
+	oldParams, _ := original.GetDataEncryptionParameterHeaderPackets()
+	assert.Equal(t, oldParams, newParams)
+
+	// The body decrypts the same with either header
+	expected := decryptFile(t, append(header, body...), key)
+	assert.Equal(t, expected, decryptFile(t, append(newHeader, body...), privateKey))
+}
+
+func TestReencryptHeader_wrongKey(t *testing.T) {
+	_, header, _ := readTestFile(t)
+
+	publicKey, privateKey, err := keys.GenerateKeyPair()
+	require.NoError(t, err)
+
+	_, err = ReencryptHeader(header, privateKey, publicKey)
+	assert.Error(t, err)
+
+	_, err = ReencryptHeader([]byte("not a header"), privateKey, publicKey)
+	assert.EqualError(t, err, "not a Crypt4GH file")
+}
+
+func decryptFile(t *testing.T, file []byte, key [32]byte) []byte {
+	r, err := streaming.NewCrypt4GHReader(bytes.NewReader(file), key, nil)
+	require.NoError(t, err)
+
+	plain, err := io.ReadAll(r)
+	require.NoError(t, err)
+
+	return plain
+}
+
+func TestKeyring(t *testing.T) {
+	key, header, _ := readTestFile(t)
+
+	_, otherKey, err := keys.GenerateKeyPair()
+	require.NoError(t, err)
+
+	assert.Equal(t, KeyID(keys.DerivePublicKey(key)), NewKey(key, "").ID)
+
+	keyring := Keyring{NewKey(otherKey, "other"), NewKey(key, "node")}
+	h, found, err := keyring.DecryptHeader(header)
+	assert.NoError(t, err)
+	assert.NotNil(t, h)
+	assert.Equal(t, "node", found.ID)
+	assert.Equal(t, key, found.PrivateKey)
+
+	_, _, err = Keyring{NewKey(otherKey, "other")}.DecryptHeader(header)
+	assert.Equal(t, ErrNoMatchingKey, err)
+
+	_, _, err = keyring.DecryptHeader([]byte("not a header"))
+	assert.EqualError(t, err, "not a Crypt4GH file")
+}
+
+// editedFile returns a crypt4gh file encrypted to publicKey that holds a data
+// edit list keeping five bytes after skipping the first three
+func editedFile(t *testing.T, publicKey [32]byte) []byte {
+	_, writerKey, err := keys.GenerateKeyPair()
+	require.NoError(t, err)
+
+	var file bytes.Buffer
+	w, err := streaming.NewCrypt4GHWriter(&file, writerKey, publicKey, &headers.DataEditListHeaderPacket{
+		PacketType:    headers.PacketType{PacketType: headers.DataEditList},
+		NumberLengths: 2,
+		Lengths:       []uint64{3, 5},
+	})
+	require.NoError(t, err)
+	_, err = w.Write([]byte("0123456789abcdef"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	return file.Bytes()
+}
+
+func TestEditList(t *testing.T) {
+	key, header, _ := readTestFile(t)
+
+	h, err := DecryptHeader(header, key)
+	require.NoError(t, err)
+	assert.Nil(t, EditList(h))
+
+	publicKey, privateKey, err := keys.GenerateKeyPair()
+	require.NoError(t, err)
+	file := editedFile(t, publicKey)
+	editedHeader, err := headers.ReadHeader(bytes.NewReader(file))
+	require.NoError(t, err)
+
+	h, err = DecryptHeader(editedHeader, privateKey)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{3, 5}, EditList(h))
+	assert.Equal(t, []byte("34567"), decryptFile(t, file, privateKey))
+
+	// The edit list is kept when the header is re-encrypted
+	newPublicKey, newPrivateKey, err := keys.GenerateKeyPair()
+	require.NoError(t, err)
+	newHeader, err := ReencryptHeader(editedHeader, privateKey, newPublicKey)
+	require.NoError(t, err)
+
+	h, err = DecryptHeader(newHeader, newPrivateKey)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{3, 5}, EditList(h))
+	assert.Equal(t, []byte("34567"), decryptFile(t, append(newHeader, file[len(editedHeader):]...), newPrivateKey))
+}
+
+func TestDecryptHeader_twoEditLists(t *testing.T) {
+	publicKey, privateKey, err := keys.GenerateKeyPair()
+	require.NoError(t, err)
+	header, err := headers.ReadHeader(bytes.NewReader(editedFile(t, publicKey)))
+	require.NoError(t, err)
+
+	h, err := DecryptHeader(header, privateKey)
+	require.NoError(t, err)
+	for _, packet := range h.HeaderPackets {
+		if packet.EncryptedHeaderPacket.GetPacketType() == headers.DataEditList {
+			h.HeaderPackets = append(h.HeaderPackets, packet)
+			h.HeaderPacketCount++
+
+			break
+		}
+	}
+	_, writerKey, err := keys.GenerateKeyPair()
+	require.NoError(t, err)
+	for i := range h.HeaderPackets {
+		h.HeaderPackets[i].WriterPrivateKey = writerKey
+		h.HeaderPackets[i].ReaderPublicKey = publicKey
+		h.HeaderPackets[i].Nonce = nil
+	}
+	header, err = h.MarshalBinary()
+	require.NoError(t, err)
+
+	_, err = DecryptHeader(header, privateKey)
+	assert.EqualError(t, err, "header holds more than one data edit list")
+
+	_, _, err = Keyring{NewKey(privateKey, "")}.DecryptHeader(header)
+	assert.EqualError(t, err, "header holds more than one data edit list")
+}
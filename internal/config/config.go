@@ -12,8 +12,10 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/c4gh"
 	"sda-pipeline/internal/database"
 	"sda-pipeline/internal/storage"
+	"sda-pipeline/internal/tracing"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
@@ -21,6 +23,7 @@ import (
 
 const POSIX = "posix"
 const S3 = "s3"
+const SQLite = "sqlite"
 
 var requiredConfVars []string
 
@@ -31,6 +34,7 @@ type Config struct {
 	Inbox    storage.Conf
 	Backup   storage.Conf
 	Database database.DBConf
+	Tracing  tracing.Conf
 }
 
 // NewConfig initializes and parses the config file and/or environment using
@@ -68,11 +72,24 @@ func NewConfig(app string) (*Config, error) {
 	case "mapper":
 		// Mapper does not require broker.routingkey thus we remove it
 		requiredConfVars = []string{
-			"broker.host", "broker.port", "broker.user", "broker.password", "broker.queue", "db.host", "db.port", "db.user", "db.password", "db.database",
+			"broker.host", "broker.port", "broker.user", "broker.password", "broker.queue",
+		}
+	case "rotatekey":
+		// Key rotation only works on the database
+		requiredConfVars = []string{
+			"c4gh.filepath", "c4gh.passphrase",
 		}
 	default:
 		requiredConfVars = []string{
-			"broker.host", "broker.port", "broker.user", "broker.password", "broker.queue", "broker.routingkey", "db.host", "db.port", "db.user", "db.password", "db.database",
+			"broker.host", "broker.port", "broker.user", "broker.password", "broker.queue", "broker.routingkey",
+		}
+	}
+
+	if app != "intercept" {
+		if viper.GetString("db.type") == SQLite {
+			requiredConfVars = append(requiredConfVars, []string{"db.path"}...)
+		} else {
+			requiredConfVars = append(requiredConfVars, []string{"db.host", "db.port", "db.user", "db.password", "db.database"}...)
 		}
 	}
 
@@ -118,6 +135,9 @@ func NewConfig(app string) (*Config, error) {
 	}
 	viper.SetDefault("schema.type", "federated")
 	c.configSchemas()
+	if err := c.configTracing(app); err != nil {
+		return nil, err
+	}
 	switch app {
 	case "ingest":
 		c.configInbox()
@@ -153,7 +173,7 @@ func NewConfig(app string) (*Config, error) {
 			return nil, err
 		}
 		return c, nil
-	case "mapper":
+	case "mapper", "rotatekey":
 		err = c.configDatabase()
 		if err != nil {
 			return nil, err
@@ -164,14 +184,51 @@ func NewConfig(app string) (*Config, error) {
 	return nil, fmt.Errorf("application '%s' doesn't exist", app)
 }
 
-// configSchemas configures the schemas to load depending on
-// the type IDs of connection Federated EGA or isolate (stand-alone)
+// configSchemas selects the embedded schemas depending on the type IDs of
+// connection Federated EGA or isolate (stand-alone), schema.path can point
+// to a directory holding schema sets to use instead of the embedded ones.
+// schema.version pins the schema version of the messages that are sent.
 func (c *Config) configSchemas() {
 	if viper.GetString("schema.type") == "federated" {
-		c.Broker.SchemasPath = "file://schemas/federated/"
+		c.Broker.SchemaType = "federated"
 	} else {
-		c.Broker.SchemasPath = "file://schemas/isolated/"
+		c.Broker.SchemaType = "isolated"
+	}
+
+	if viper.IsSet("schema.path") {
+		c.Broker.SchemasPath = path.Join(viper.GetString("schema.path"), c.Broker.SchemaType)
 	}
+	if viper.IsSet("schema.version") {
+		c.Broker.SchemaVersion = viper.GetString("schema.version")
+	}
+}
+
+// configTracing sets where the spans of the traces are exported, to an
+// OTLP/HTTP endpoint with tracing.exporter set to otlp or to a file with it
+// set to file. The spans are reported under the name of the app unless
+// tracing.service is set.
+func (c *Config) configTracing(app string) error {
+	c.Tracing.Service = app
+	if viper.IsSet("tracing.service") {
+		c.Tracing.Service = viper.GetString("tracing.service")
+	}
+
+	c.Tracing.Exporter = viper.GetString("tracing.exporter")
+	switch c.Tracing.Exporter {
+	case "":
+	case "otlp":
+		viper.SetDefault("tracing.endpoint", "http://localhost:4318/v1/traces")
+		c.Tracing.Endpoint = viper.GetString("tracing.endpoint")
+	case "file":
+		if !viper.IsSet("tracing.file") {
+			return fmt.Errorf("tracing.file not set")
+		}
+		c.Tracing.File = viper.GetString("tracing.file")
+	default:
+		return fmt.Errorf("tracing.exporter %s is not supported", c.Tracing.Exporter)
+	}
+
+	return nil
 }
 
 // configS3Storage populates and returns a S3Conf from the
@@ -265,6 +322,41 @@ func (c *Config) configBroker() error {
 	if viper.IsSet("broker.routingerror") {
 		broker.RoutingError = viper.GetString("broker.routingerror")
 	}
+
+	// Handle one message at a time unless told otherwise, and let the
+	// broker hand out one message per worker
+	broker.Workers = 1
+	if viper.IsSet("broker.workers") {
+		broker.Workers = viper.GetInt("broker.workers")
+		if broker.Workers < 1 {
+			return errors.New("broker.workers must be at least 1")
+		}
+	}
+	broker.Prefetch = broker.Workers
+	if viper.IsSet("broker.prefetch") {
+		broker.Prefetch = viper.GetInt("broker.prefetch")
+		if broker.Prefetch < 0 {
+			return errors.New("broker.prefetch can not be negative")
+		}
+	}
+
+	// Failed messages are retried after 10s, 20s, 40s and 80s before they
+	// are given up on
+	broker.MaxAttempts = 5
+	if viper.IsSet("broker.maxattempts") {
+		broker.MaxAttempts = viper.GetInt("broker.maxattempts")
+		if broker.MaxAttempts < 1 {
+			return errors.New("broker.maxattempts must be at least 1")
+		}
+	}
+	broker.RetryDelay = 10 * time.Second
+	if viper.IsSet("broker.retrydelay") {
+		broker.RetryDelay = viper.GetDuration("broker.retrydelay")
+		if broker.RetryDelay <= 0 {
+			return errors.New("broker.retrydelay must be a positive duration")
+		}
+	}
+
 	if viper.IsSet("broker.vhost") {
 		if strings.HasPrefix(viper.GetString("broker.vhost"), "/") {
 			broker.Vhost = viper.GetString("broker.vhost")
@@ -298,15 +390,53 @@ func (c *Config) configBroker() error {
 		broker.CACert = viper.GetString("broker.cacert")
 	}
 
+	if viper.IsSet("broker.topology") {
+		if err := viper.UnmarshalKey("broker.topology", &broker.Topology); err != nil {
+			return fmt.Errorf("broker.topology is not valid: %v", err)
+		}
+		if err := checkTopology(broker.Topology); err != nil {
+			return err
+		}
+	}
+
 	c.Broker = broker
 
 	return nil
 }
 
+// checkTopology makes sure that everything in the topology is named
+func checkTopology(topology broker.Topology) error {
+	for _, exchange := range topology.Exchanges {
+		if exchange.Name == "" {
+			return errors.New("broker.topology exchanges need a name")
+		}
+	}
+	for _, queue := range topology.Queues {
+		if queue.Name == "" {
+			return errors.New("broker.topology queues need a name")
+		}
+		for _, binding := range queue.Bindings {
+			if binding.Exchange == "" {
+				return fmt.Errorf("broker.topology binding of queue %s needs an exchange", queue.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
 // configDatabase provides configuration for the database
 func (c *Config) configDatabase() error {
 	db := database.DBConf{}
 
+	if viper.GetString("db.type") == SQLite {
+		db.Type = SQLite
+		db.Path = viper.GetString("db.path")
+		c.Database = db
+
+		return nil
+	}
+
 	// All these are required
 	db.Host = viper.GetString("db.host")
 	db.Port = viper.GetInt("db.port")
@@ -355,3 +485,109 @@ func GetC4GHKey() (*[32]byte, error) {
 	keyFile.Close()
 	return &key, nil
 }
+
+// keyConf is an entry in the c4gh.keys list
+type keyConf struct {
+	Filepath   string `mapstructure:"filepath"`
+	Passphrase string `mapstructure:"passphrase"`
+	ID         string `mapstructure:"id"`
+}
+
+// GetC4GHKeyring reads and decrypts the c4gh keys that can be used to
+// decrypt headers, the key in c4gh.filepath comes first followed by the
+// keys listed in c4gh.keys
+func GetC4GHKeyring() (c4gh.Keyring, error) {
+	var keyConfs []keyConf
+	if viper.IsSet("c4gh.filepath") {
+		keyConfs = append(keyConfs, keyConf{
+			Filepath:   viper.GetString("c4gh.filepath"),
+			Passphrase: viper.GetString("c4gh.passphrase"),
+			ID:         viper.GetString("c4gh.id"),
+		})
+	}
+
+	var listed []keyConf
+	if err := viper.UnmarshalKey("c4gh.keys", &listed); err != nil {
+		return nil, fmt.Errorf("failed to read c4gh.keys: %v", err)
+	}
+	keyConfs = append(keyConfs, listed...)
+
+	if len(keyConfs) == 0 {
+		return nil, errors.New("no c4gh keys configured, set c4gh.filepath or c4gh.keys")
+	}
+
+	var keyring c4gh.Keyring
+	ids := make(map[string]bool)
+	for _, k := range keyConfs {
+		keyFile, err := os.Open(k.Filepath)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := keys.ReadPrivateKey(keyFile, []byte(k.Passphrase))
+		keyFile.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key %s: %v", k.Filepath, err)
+		}
+
+		entry := c4gh.NewKey(key, k.ID)
+		if ids[entry.ID] {
+			return nil, fmt.Errorf("c4gh key id %s is used more than once", entry.ID)
+		}
+		ids[entry.ID] = true
+		keyring = append(keyring, entry)
+	}
+
+	return keyring, nil
+}
+
+// GetC4GHPublicKey reads and returns the c4gh public key in the file given
+// by the configuration variable name
+func GetC4GHPublicKey(name string) (*[32]byte, error) {
+	keyPath := viper.GetString(name)
+	if keyPath == "" {
+		return nil, fmt.Errorf("%s not set", name)
+	}
+
+	keyFile, err := os.Open(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer keyFile.Close()
+
+	key, err := keys.ReadPublicKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// GetC4GHArchiveKey returns the public key set in c4gh.archivepubkey that
+// headers are re-encrypted to before they are stored, nil is returned when
+// it is not set
+func GetC4GHArchiveKey() (*[32]byte, error) {
+	if !viper.IsSet("c4gh.archivepubkey") {
+		return nil, nil
+	}
+
+	return GetC4GHPublicKey("c4gh.archivepubkey")
+}
+
+// CheckC4GHArchiveKey makes sure that one of the keys in keyring belongs to
+// the public key set in c4gh.archivepubkey, so that the headers archived by
+// ingest can be decrypted. Nothing is checked when it is not set.
+func CheckC4GHArchiveKey(keyring c4gh.Keyring) error {
+	archiveKey, err := GetC4GHArchiveKey()
+	if err != nil || archiveKey == nil {
+		return err
+	}
+
+	for _, key := range keyring {
+		if keys.DerivePublicKey(key.PrivateKey) == *archiveKey {
+			return nil
+		}
+	}
+
+	return errors.New("none of the c4gh keys matches c4gh.archivepubkey, archived headers can not be decrypted")
+}
@@ -3,9 +3,17 @@ package config
 import (
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/c4gh"
+	"sda-pipeline/internal/tracing"
+
+	"github.com/elixir-oslo/crypt4gh/keys"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
@@ -217,6 +225,137 @@ func (suite *TestSuite) TestConfigBroker() {
 	assert.Equal(suite.T(), "/", config.Broker.Vhost)
 }
 
+func (suite *TestSuite) TestConfigBrokerWorkers() {
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, config.Broker.Workers)
+	assert.Equal(suite.T(), 1, config.Broker.Prefetch)
+
+	viper.Set("broker.workers", 4)
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 4, config.Broker.Workers)
+	assert.Equal(suite.T(), 4, config.Broker.Prefetch)
+
+	viper.Set("broker.prefetch", 10)
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 10, config.Broker.Prefetch)
+
+	viper.Set("broker.prefetch", -1)
+	_, err = NewConfig("verify")
+	assert.EqualError(suite.T(), err, "broker.prefetch can not be negative")
+
+	viper.Set("broker.workers", 0)
+	_, err = NewConfig("verify")
+	assert.EqualError(suite.T(), err, "broker.workers must be at least 1")
+}
+
+func (suite *TestSuite) TestConfigBrokerTopology() {
+	config, err := NewConfig("sync")
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), config.Broker.Topology.Queues)
+
+	viper.SetConfigType("yaml")
+	assert.NoError(suite.T(), viper.MergeConfig(strings.NewReader(`
+broker:
+  topology:
+    exchanges:
+      - name: "sda"
+    queues:
+      - name: "archived"
+        retry: true
+        bindings:
+          - exchange: "sda"
+            routingKey: "archived"
+`)))
+	config, err = NewConfig("sync")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), broker.Topology{
+		Exchanges: []broker.Exchange{{Name: "sda"}},
+		Queues:    []broker.Queue{{Name: "archived", Retry: true, Bindings: []broker.Binding{{Exchange: "sda", RoutingKey: "archived"}}}},
+	}, config.Broker.Topology)
+
+	viper.Set("broker.topology.queues", []map[string]interface{}{{"name": "archived", "bindings": []map[string]interface{}{{"routingKey": "archived"}}}})
+	_, err = NewConfig("sync")
+	assert.EqualError(suite.T(), err, "broker.topology binding of queue archived needs an exchange")
+
+	viper.Set("broker.topology.queues", []map[string]interface{}{{"retry": true}})
+	_, err = NewConfig("sync")
+	assert.EqualError(suite.T(), err, "broker.topology queues need a name")
+}
+
+func (suite *TestSuite) TestConfigBrokerRetry() {
+	config, err := NewConfig("sync")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 5, config.Broker.MaxAttempts)
+	assert.Equal(suite.T(), 10*time.Second, config.Broker.RetryDelay)
+
+	viper.Set("broker.maxattempts", 3)
+	viper.Set("broker.retrydelay", "1m")
+	config, err = NewConfig("sync")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 3, config.Broker.MaxAttempts)
+	assert.Equal(suite.T(), time.Minute, config.Broker.RetryDelay)
+
+	viper.Set("broker.retrydelay", "0s")
+	_, err = NewConfig("sync")
+	assert.EqualError(suite.T(), err, "broker.retrydelay must be a positive duration")
+
+	viper.Set("broker.maxattempts", 0)
+	_, err = NewConfig("sync")
+	assert.EqualError(suite.T(), err, "broker.maxattempts must be at least 1")
+}
+
+func (suite *TestSuite) TestConfigSchemas() {
+	config, err := NewConfig("ingest")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "federated", config.Broker.SchemaType)
+	assert.Equal(suite.T(), "", config.Broker.SchemasPath)
+
+	viper.Set("schema.type", "isolated")
+	config, err = NewConfig("ingest")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "isolated", config.Broker.SchemaType)
+	assert.Equal(suite.T(), "", config.Broker.SchemasPath)
+
+	viper.Set("schema.path", "/opt/sda/schemas")
+	config, err = NewConfig("ingest")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "/opt/sda/schemas/isolated", config.Broker.SchemasPath)
+	assert.Equal(suite.T(), "", config.Broker.SchemaVersion)
+
+	viper.Set("schema.version", "v1")
+	config, err = NewConfig("ingest")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "v1", config.Broker.SchemaVersion)
+}
+
+func (suite *TestSuite) TestConfigTracing() {
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), tracing.Conf{Service: "verify"}, config.Tracing)
+
+	viper.Set("tracing.exporter", "otlp")
+	viper.Set("tracing.service", "sda-verify")
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), tracing.Conf{Exporter: "otlp", Endpoint: "http://localhost:4318/v1/traces", Service: "sda-verify"}, config.Tracing)
+
+	viper.Set("tracing.exporter", "file")
+	_, err = NewConfig("verify")
+	assert.EqualError(suite.T(), err, "tracing.file not set")
+
+	viper.Set("tracing.file", "/tmp/traces.json")
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "/tmp/traces.json", config.Tracing.File)
+
+	viper.Set("tracing.exporter", "zipkin")
+	_, err = NewConfig("verify")
+	assert.EqualError(suite.T(), err, "tracing.exporter zipkin is not supported")
+}
+
 func (suite *TestSuite) TestConfigDatabase() {
 	viper.Set("db.sslmode", "verify-full")
 	_, err := NewConfig("ingest")
@@ -234,6 +373,32 @@ func (suite *TestSuite) TestConfigDatabase() {
 	assert.Equal(suite.T(), "test", config.Database.CACert)
 }
 
+func (suite *TestSuite) TestConfigSQLiteDatabase() {
+	viper.Reset()
+	viper.Set("broker.host", "test")
+	viper.Set("broker.port", 123)
+	viper.Set("broker.user", "test")
+	viper.Set("broker.password", "test")
+	viper.Set("broker.queue", "test")
+	viper.Set("broker.routingkey", "test")
+	viper.Set("db.type", "sqlite")
+	viper.Set("inbox.location", "/inbox")
+	viper.Set("archive.location", "/archive")
+	viper.Set("c4gh.filepath", "/keys/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "test")
+
+	_, err := NewConfig("verify")
+	assert.EqualError(suite.T(), err, "db.path not set")
+
+	viper.Set("db.path", "/tmp/sda.db")
+	config, err := NewConfig("mapper")
+	assert.NotNil(suite.T(), config)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), SQLite, config.Database.Type)
+	assert.Equal(suite.T(), "/tmp/sda.db", config.Database.Path)
+	assert.Equal(suite.T(), "", config.Database.Host)
+}
+
 func (suite *TestSuite) TestMapperConfiguration() {
 	config, err := NewConfig("mapper")
 	assert.NotNil(suite.T(), config)
@@ -500,3 +665,107 @@ func (suite *TestSuite) TestGetC4GHKey_passError() {
 	assert.Nil(suite.T(), key)
 	assert.EqualError(suite.T(), err, "chacha20poly1305: message authentication failed")
 }
+
+func (suite *TestSuite) TestGetC4GHPublicKey() {
+	_, err := GetC4GHPublicKey("c4gh.rotatepubkey")
+	assert.EqualError(suite.T(), err, "c4gh.rotatepubkey not set")
+
+	viper.Set("c4gh.rotatepubkey", "/doesnotexist")
+	_, err = GetC4GHPublicKey("c4gh.rotatepubkey")
+	assert.EqualError(suite.T(), err, "open /doesnotexist: no such file or directory")
+
+	viper.Set("c4gh.rotatepubkey", "../../dev_utils/c4gh.pub.pem")
+	key, err := GetC4GHPublicKey("c4gh.rotatepubkey")
+	assert.NoError(suite.T(), err)
+	assert.NotNil(suite.T(), key)
+}
+
+func (suite *TestSuite) TestGetC4GHArchiveKey() {
+	key, err := GetC4GHArchiveKey()
+	assert.NoError(suite.T(), err)
+	assert.Nil(suite.T(), key)
+
+	viper.Set("c4gh.archivepubkey", "/doesnotexist")
+	_, err = GetC4GHArchiveKey()
+	assert.Error(suite.T(), err)
+
+	viper.Set("c4gh.archivepubkey", "../../dev_utils/c4gh.pub.pem")
+	key, err = GetC4GHArchiveKey()
+	assert.NoError(suite.T(), err)
+	assert.NotNil(suite.T(), key)
+}
+
+func (suite *TestSuite) TestCheckC4GHArchiveKey() {
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+	keyring, err := GetC4GHKeyring()
+	suite.Require().NoError(err)
+
+	assert.NoError(suite.T(), CheckC4GHArchiveKey(keyring))
+
+	viper.Set("c4gh.archivepubkey", "../../dev_utils/c4gh.pub.pem")
+	assert.NoError(suite.T(), CheckC4GHArchiveKey(keyring))
+
+	// The archive key is not the inbox key
+	publicKey, privateKey, err := keys.GenerateKeyPair()
+	suite.Require().NoError(err)
+	keyPath := filepath.Join(suite.T().TempDir(), "archive.pub.pem")
+	keyFile, err := os.Create(keyPath)
+	suite.Require().NoError(err)
+	suite.Require().NoError(keys.WriteCrypt4GHX25519PublicKey(keyFile, publicKey))
+	keyFile.Close()
+	viper.Set("c4gh.archivepubkey", keyPath)
+	assert.EqualError(suite.T(), CheckC4GHArchiveKey(keyring), "none of the c4gh keys matches c4gh.archivepubkey, archived headers can not be decrypted")
+
+	assert.NoError(suite.T(), CheckC4GHArchiveKey(append(keyring, c4gh.NewKey(privateKey, "archive"))))
+
+	viper.Set("c4gh.archivepubkey", "/doesnotexist")
+	assert.Error(suite.T(), CheckC4GHArchiveKey(keyring))
+}
+
+func (suite *TestSuite) TestRotateKeyConfiguration() {
+	_, err := NewConfig("rotatekey")
+	assert.EqualError(suite.T(), err, "c4gh.filepath not set")
+
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "test")
+	viper.Set("broker.host", nil)
+	config, err := NewConfig("rotatekey")
+	assert.NoError(suite.T(), err)
+	if assert.NotNil(suite.T(), config) {
+		assert.Equal(suite.T(), "test", config.Database.Host)
+	}
+}
+
+func (suite *TestSuite) TestGetC4GHKeyring() {
+	_, err := GetC4GHKeyring()
+	assert.EqualError(suite.T(), err, "no c4gh keys configured, set c4gh.filepath or c4gh.keys")
+
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+	keyring, err := GetC4GHKeyring()
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), keyring, 1)
+
+	viper.Set("c4gh.keys", []map[string]interface{}{
+		{"filepath": "../../dev_utils/c4gh.sec.pem", "passphrase": "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm", "id": "previous"},
+	})
+	keyring, err = GetC4GHKeyring()
+	assert.NoError(suite.T(), err)
+	if assert.Len(suite.T(), keyring, 2) {
+		assert.Equal(suite.T(), "previous", keyring[1].ID)
+		assert.Equal(suite.T(), keyring[0].PrivateKey, keyring[1].PrivateKey)
+	}
+
+	viper.Set("c4gh.keys", []map[string]interface{}{
+		{"filepath": "../../dev_utils/c4gh.sec.pem", "passphrase": "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm"},
+	})
+	_, err = GetC4GHKeyring()
+	assert.EqualError(suite.T(), err, fmt.Sprintf("c4gh key id %s is used more than once", keyring[0].ID))
+
+	viper.Set("c4gh.keys", []map[string]interface{}{
+		{"filepath": "../../dev_utils/c4gh.sec.pem", "passphrase": "wrong", "id": "previous"},
+	})
+	_, err = GetC4GHKeyring()
+	assert.EqualError(suite.T(), err, "failed to read key ../../dev_utils/c4gh.sec.pem: chacha20poly1305: message authentication failed")
+}
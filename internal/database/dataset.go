@@ -0,0 +1,270 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Dataset statuses, a dataset is registered when files are first mapped to
+// it and can then be released and finally deprecated
+const (
+	DatasetRegistered = "registered"
+	DatasetReleased   = "released"
+	DatasetDeprecated = "deprecated"
+)
+
+// datasetTransitions lists the statuses a dataset is allowed to move to
+// from each status
+var datasetTransitions = map[string][]string{
+	DatasetRegistered: {DatasetReleased, DatasetDeprecated},
+	DatasetReleased:   {DatasetDeprecated},
+	DatasetDeprecated: {},
+}
+
+const (
+	registerDatasetQuery = "INSERT INTO local_ega.datasets(stable_id, status) VALUES($1, 'registered') " +
+		"ON CONFLICT (stable_id) DO NOTHING;"
+	lockDatasetQuery = "SELECT status FROM local_ega.datasets WHERE stable_id = $1 FOR UPDATE;"
+)
+
+// DatasetTransitionError is returned when a dataset is moved to a status
+// that is not allowed from its current status, From is empty when the
+// dataset does not exist
+type DatasetTransitionError struct {
+	DatasetID string
+	From      string
+	To        string
+}
+
+// Error returns a description of the illegal transition
+func (e *DatasetTransitionError) Error() string {
+	if e.From == "" {
+		return fmt.Sprintf("illegal status transition for dataset %s to %s, dataset does not exist", e.DatasetID, e.To)
+	}
+
+	return fmt.Sprintf("illegal status transition for dataset %s from %s to %s", e.DatasetID, e.From, e.To)
+}
+
+// ValidDatasetTransition reports whether a dataset may move from status from
+// to status to
+func ValidDatasetTransition(from, to string) bool {
+	for _, s := range datasetTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetDatasetStatus returns the status of a dataset
+func (dbs *SQLdb) GetDatasetStatus(datasetID string) (string, error) {
+	var (
+		status string = ""
+		err    error  = nil
+		count  int    = 0
+	)
+
+	for count == 0 || (err != nil && err != sql.ErrNoRows && count < dbRetryTimes) {
+		status, err = dbs.getDatasetStatus(datasetID)
+		count++
+	}
+	return status, err
+}
+
+// getDatasetStatus is the actual function performing work for
+// GetDatasetStatus
+func (dbs *SQLdb) getDatasetStatus(datasetID string) (string, error) {
+	db := dbs.checkAndReconnectIfNeeded()
+	const query = "SELECT status FROM local_ega.datasets WHERE stable_id = $1;"
+
+	var status string
+	if err := db.QueryRow(query, datasetID).Scan(&status); err != nil {
+		return "", err
+	}
+
+	return status, nil
+}
+
+// UpdateDatasetStatus moves a dataset to status, a DatasetTransitionError is
+// returned if the dataset can not move to status from its current status.
+// Nothing is done if the dataset already has status.
+func (dbs *SQLdb) UpdateDatasetStatus(datasetID, status string) error {
+	var (
+		err   error = nil
+		count int   = 0
+	)
+
+	for count == 0 || (err != nil && !IsTransitionError(err) && count < dbRetryTimes) {
+		err = dbs.updateDatasetStatus(datasetID, status)
+		count++
+	}
+	return err
+}
+
+// updateDatasetStatus performs actual work for UpdateDatasetStatus
+func (dbs *SQLdb) updateDatasetStatus(datasetID, status string) error {
+	db := dbs.checkAndReconnectIfNeeded()
+	const update = "UPDATE local_ega.datasets SET status = $1, last_modified = now() WHERE stable_id = $2;"
+
+	transaction, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var from string
+	err = transaction.QueryRow(lockDatasetQuery, datasetID).Scan(&from)
+	if err := checkDatasetTransition(datasetID, from, status, err); err != nil {
+		rollback(transaction)
+		if sameDatasetStatus(err) {
+			return nil
+		}
+		return err
+	}
+
+	if _, err := transaction.Exec(update, status, datasetID); err != nil {
+		rollback(transaction)
+		return err
+	}
+	return transaction.Commit()
+}
+
+// UnmapFilesFromDataset removes files from a dataset, the dataset is left
+// untouched and a MappingError returned unless the dataset is registered and
+// all files are mapped to it
+func (dbs *SQLdb) UnmapFilesFromDataset(datasetID string, accessionIDs []string) error {
+	var (
+		err   error = nil
+		count int   = 0
+	)
+
+	for count == 0 || (err != nil && !errors.As(err, new(*MappingError)) && count < dbRetryTimes) {
+		err = dbs.unmapFilesFromDataset(datasetID, accessionIDs)
+		count++
+	}
+	return err
+}
+
+// unmapFilesFromDataset performs actual work for UnmapFilesFromDataset
+func (dbs *SQLdb) unmapFilesFromDataset(datasetID string, accessionIDs []string) error {
+	db := dbs.checkAndReconnectIfNeeded()
+	const getMapped = "SELECT f.stable_id, f.id FROM local_ega_ebi.filedataset fd " +
+		"JOIN local_ega.files f ON f.id = fd.file_id " +
+		"WHERE fd.dataset_stable_id = $1 and f.stable_id = ANY($2);"
+	const unmap = "DELETE FROM local_ega_ebi.filedataset WHERE dataset_stable_id = $1 and file_id = ANY($2);"
+
+	transaction, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := lockDatasetRegistered(transaction, datasetID); err != nil {
+		rollback(transaction)
+		return err
+	}
+
+	rows, err := transaction.Query(getMapped, datasetID, pq.Array(accessionIDs))
+	if err != nil {
+		rollback(transaction)
+		return err
+	}
+
+	fileIDs, failed, err := mappedFiles(rows, accessionIDs)
+	rows.Close()
+	if err != nil {
+		rollback(transaction)
+		return err
+	}
+	if len(failed) > 0 {
+		rollback(transaction)
+		return &MappingError{DatasetID: datasetID, Failed: failed}
+	}
+
+	if _, err := transaction.Exec(unmap, datasetID, pq.Array(fileIDs)); err != nil {
+		rollback(transaction)
+		return err
+	}
+	return transaction.Commit()
+}
+
+// lockDatasetRegistered locks the dataset for the remainder of the
+// transaction and verifies that its files may still be changed
+func lockDatasetRegistered(transaction *sql.Tx, datasetID string) error {
+	var status string
+	err := transaction.QueryRow(lockDatasetQuery, datasetID).Scan(&status)
+
+	return checkDatasetRegistered(datasetID, status, err)
+}
+
+// checkDatasetRegistered turns the outcome of looking up the status of a
+// dataset into a MappingError unless the dataset is registered
+func checkDatasetRegistered(datasetID, status string, err error) error {
+	switch {
+	case err == sql.ErrNoRows:
+		return &MappingError{DatasetID: datasetID, Reason: "dataset does not exist"}
+	case err != nil:
+		return err
+	case status != DatasetRegistered:
+		return &MappingError{DatasetID: datasetID, Reason: fmt.Sprintf("dataset is %s", status)}
+	}
+
+	return nil
+}
+
+// checkDatasetTransition turns the outcome of looking up the status of a
+// dataset into a DatasetTransitionError unless it may move to status to
+func checkDatasetTransition(datasetID, from, to string, err error) error {
+	switch {
+	case err == sql.ErrNoRows:
+		return &DatasetTransitionError{DatasetID: datasetID, To: to}
+	case err != nil:
+		return err
+	case !ValidDatasetTransition(from, to):
+		return &DatasetTransitionError{DatasetID: datasetID, From: from, To: to}
+	}
+
+	return nil
+}
+
+// sameDatasetStatus reports whether err is a DatasetTransitionError for a
+// dataset that already has the status it was to be moved to, e.g. a release
+// message that is redelivered
+func sameDatasetStatus(err error) bool {
+	var transitionError *DatasetTransitionError
+
+	return errors.As(err, &transitionError) && transitionError.From == transitionError.To
+}
+
+// mappedFiles reads rows holding accession id and file id of the files
+// mapped to a dataset and returns the file ids, together with a reason for
+// every accession id that is not mapped
+func mappedFiles(rows *sql.Rows, accessionIDs []string) ([]int64, map[string]string, error) {
+	mapped := make(map[string]bool)
+	var fileIDs []int64
+	for rows.Next() {
+		var (
+			accessionID string
+			fileID      int64
+		)
+		if err := rows.Scan(&accessionID, &fileID); err != nil {
+			return nil, nil, err
+		}
+		mapped[accessionID] = true
+		fileIDs = append(fileIDs, fileID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	failed := make(map[string]string)
+	for _, accessionID := range accessionIDs {
+		if !mapped[accessionID] {
+			failed[accessionID] = "not mapped to dataset"
+		}
+	}
+
+	return fileIDs, failed, nil
+}
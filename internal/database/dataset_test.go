@@ -0,0 +1,161 @@
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const lockDataset = "SELECT status FROM local_ega.datasets WHERE stable_id = \\$1 FOR UPDATE;"
+
+func TestValidDatasetTransition(t *testing.T) {
+	assert.True(t, ValidDatasetTransition(DatasetRegistered, DatasetReleased))
+	assert.True(t, ValidDatasetTransition(DatasetReleased, DatasetDeprecated))
+	assert.True(t, ValidDatasetTransition(DatasetRegistered, DatasetDeprecated))
+	assert.False(t, ValidDatasetTransition(DatasetReleased, DatasetRegistered))
+	assert.False(t, ValidDatasetTransition(DatasetDeprecated, DatasetReleased))
+	assert.False(t, ValidDatasetTransition(DatasetReleased, DatasetReleased))
+}
+
+func TestGetDatasetStatus(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery("SELECT status FROM local_ega.datasets WHERE stable_id = \\$1;").
+			WithArgs("dataset1").
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(DatasetReleased))
+
+		status, err := testDb.GetDatasetStatus("dataset1")
+
+		assert.Equal(t, DatasetReleased, status, "did not get expected status")
+
+		return err
+	})
+
+	assert.Nil(t, r, "GetDatasetStatus failed unexpectedly")
+}
+
+func TestUpdateDatasetStatus(t *testing.T) {
+	const update = "UPDATE local_ega.datasets SET status = \\$1, last_modified = now\\(\\) WHERE stable_id = \\$2;"
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockDataset).WithArgs("dataset1").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(DatasetRegistered))
+		mock.ExpectExec(update).WithArgs(DatasetReleased, "dataset1").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		return testDb.UpdateDatasetStatus("dataset1", DatasetReleased)
+	})
+
+	assert.Nil(t, r, "UpdateDatasetStatus failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockDataset).WithArgs("dataset1").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(DatasetDeprecated))
+		mock.ExpectRollback()
+
+		return testDb.UpdateDatasetStatus("dataset1", DatasetReleased)
+	})
+
+	assert.True(t, IsTransitionError(r), "UpdateDatasetStatus did not refuse to release a deprecated dataset")
+	assert.EqualError(t, r, "illegal status transition for dataset dataset1 from deprecated to released")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockDataset).WithArgs("dataset2").WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+
+		return testDb.UpdateDatasetStatus("dataset2", DatasetReleased)
+	})
+
+	assert.True(t, IsTransitionError(r), "UpdateDatasetStatus did not refuse a missing dataset")
+
+	// A dataset that already is released is left as it is
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockDataset).WithArgs("dataset1").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(DatasetReleased))
+		mock.ExpectRollback()
+
+		return testDb.UpdateDatasetStatus("dataset1", DatasetReleased)
+	})
+
+	assert.Nil(t, r, "UpdateDatasetStatus refused a dataset that already is released")
+}
+
+func TestUnmapFilesFromDataset(t *testing.T) {
+	const getMapped = "SELECT f.stable_id, f.id FROM local_ega_ebi.filedataset fd " +
+		"JOIN local_ega.files f ON f.id = fd.file_id " +
+		"WHERE fd.dataset_stable_id = \\$1 and f.stable_id = ANY\\(\\$2\\);"
+	const unmap = "DELETE FROM local_ega_ebi.filedataset WHERE dataset_stable_id = \\$1 and file_id = ANY\\(\\$2\\);"
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockDataset).WithArgs("dataset1").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(DatasetRegistered))
+		mock.ExpectQuery(getMapped).
+			WithArgs("dataset1", pq.Array([]string{"aid1", "aid2"})).
+			WillReturnRows(sqlmock.NewRows([]string{"stable_id", "id"}).AddRow("aid1", 1).AddRow("aid2", 2))
+		mock.ExpectExec(unmap).WithArgs("dataset1", pq.Array([]int64{1, 2})).WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+
+		return testDb.UnmapFilesFromDataset("dataset1", []string{"aid1", "aid2"})
+	})
+
+	assert.Nil(t, r, "UnmapFilesFromDataset failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockDataset).WithArgs("dataset1").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(DatasetRegistered))
+		mock.ExpectQuery(getMapped).
+			WithArgs("dataset1", pq.Array([]string{"aid1", "aid3"})).
+			WillReturnRows(sqlmock.NewRows([]string{"stable_id", "id"}).AddRow("aid1", 1))
+		mock.ExpectRollback()
+
+		return testDb.UnmapFilesFromDataset("dataset1", []string{"aid1", "aid3"})
+	})
+
+	var mappingError *MappingError
+	if assert.True(t, errors.As(r, &mappingError), "UnmapFilesFromDataset did not reject the request") {
+		assert.Equal(t, map[string]string{"aid3": "not mapped to dataset"}, mappingError.Failed)
+	}
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockDataset).WithArgs("dataset1").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(DatasetReleased))
+		mock.ExpectRollback()
+
+		return testDb.UnmapFilesFromDataset("dataset1", []string{"aid1"})
+	})
+
+	assert.EqualError(t, r, "dataset dataset1 can not be mapped: dataset is released")
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockDataset).WithArgs("dataset1").WillReturnError(fmt.Errorf("error for testing"))
+		mock.ExpectRollback()
+
+		return testDb.UnmapFilesFromDataset("dataset1", []string{"aid1"})
+	})
+
+	assert.NotNil(t, r, "UnmapFilesFromDataset did not fail as expected")
+	assert.False(t, errors.As(r, &mappingError), "database failure reported as a mapping error")
+
+	log.SetOutput(os.Stdout)
+}
@@ -5,32 +5,82 @@ package database
 import (
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
-
-	// Needed implicitly to enable Postgres driver
-	_ "github.com/lib/pq"
 )
 
 // Database defines methods to be implemented by SQLdb
 type Database interface {
 	GetHeader(fileID int) ([]byte, error)
-	MarkCompleted(checksum string, fileID int) error
-	MarkReady(accessionID, user, filepath, checksum string) error
-	GetArchived(user, filepath, checksum string) (string, int, error)
+	IngestFile(corrID, user, filename string, header []byte, keyID string, file FileInfo) (int64, error)
+	MarkCompleted(corrID string, file FileInfo, fileID int) error
+	MarkReady(corrID, accessionID string, fileID int64) error
+	SetError(fileID int64, corrID, service, reason string) error
+	GetArchived(fileID int64) (string, int, error)
+	GetFileIDByChecksums(user, filepath string, checksums []Checksum) (int64, error)
+	AddChecksums(fileID int64, source string, checksums []Checksum) error
+	GetChecksums(fileID int64, source string) ([]Checksum, error)
+	ListFiles(filter FileFilter) ([]FileSummary, error)
+	ListStaleFiles(statuses []string, age time.Duration) ([]FileSummary, error)
+	MapFilesToDataset(datasetID string, accessionIDs []string) error
+	UnmapFilesFromDataset(datasetID string, accessionIDs []string) error
+	GetDatasetStatus(datasetID string) (string, error)
+	UpdateDatasetStatus(datasetID, status string) error
+	UpdateFileEventLog(fileID int64, event, corrID, service string, details map[string]string) error
+	GetFileEventLog(fileID int64) ([]FileEvent, error)
+	ClaimMessage(corrID, msgType string, body []byte, redelivered bool) (bool, error)
+	MarkMessageDone(corrID, msgType string, body []byte) error
+	ListHeaderFiles(keyID string, afterID int64, limit int) ([]int64, error)
+	GetHeaderKeyID(fileID int64) (string, error)
+	UpdateHeader(fileID int64, header []byte, keyID string) error
+	GetEditList(fileID int64) ([]uint64, error)
 	Close()
 }
 
+// Events recorded in the file event log, these follow the statuses
+// a file goes through in the pipeline
+const (
+	FileInit      = "INIT"
+	FileArchived  = "ARCHIVED"
+	FileCompleted = "COMPLETED"
+	FileReady     = "READY"
+	FileError     = "ERROR"
+	FileDisabled  = "DISABLED"
+)
+
+// Sources of the checksums stored for a file, the inbox checksum is
+// calculated over the uploaded file, the archive checksum over the file
+// stored in the archive and the decrypted checksum over the plain text
+const (
+	SourceInbox     = "INBOX"
+	SourceArchive   = "ARCHIVE"
+	SourceDecrypted = "DECRYPTED"
+)
+
+// checksumTypes are the algorithms that can be stored in the checksums table
+var checksumTypes = map[string]bool{
+	"md5":     true,
+	"sha256":  true,
+	"sha512":  true,
+	"blake2b": true,
+}
+
 // SQLdb struct that acts as a receiver for the DB update methods
 type SQLdb struct {
 	DB       *sql.DB
 	ConnInfo string
+	// mu keeps concurrent workers from reconnecting at the same time
+	mu sync.Mutex
 }
 
 // DBConf stores information about the database backend
@@ -44,6 +94,10 @@ type DBConf struct {
 	SslMode    string
 	ClientCert string
 	ClientKey  string
+	// Type is either "postgres" (the default) or "sqlite"
+	Type string
+	// Path is the database file when Type is "sqlite"
+	Path string
 }
 
 // FileInfo is used by ingest for file metadata (path, size, checksum)
@@ -53,6 +107,26 @@ type FileInfo struct {
 	Path              string
 	DecryptedChecksum hash.Hash
 	DecryptedSize     int64
+	// EditList is the crypt4gh data edit list of the submitted header, nil
+	// when it has none
+	EditList []uint64
+}
+
+// Checksum holds a checksum and the algorithm used to calculate it, the
+// algorithm is named as in the broker messages
+type Checksum struct {
+	Type  string
+	Value string
+}
+
+// FileEvent is an entry in the file event log
+type FileEvent struct {
+	FileID        int64
+	Event         string
+	CorrelationID string
+	Service       string
+	Details       map[string]string
+	Timestamp     time.Time
 }
 
 // dbRetryTimes is the number of times to retry the same function if it fails
@@ -64,6 +138,37 @@ var dbReconnectTimeout = 5 * time.Minute
 // dbReconnectSleep is how long to wait between attempts to connect to the database
 var dbReconnectSleep = 5 * time.Second
 
+// Statements shared by the single step functions and the ingestion
+// transaction
+const (
+	insertFileQuery = "INSERT INTO local_ega.main(submission_file_path, " +
+		"submission_file_extension, " +
+		"submission_user, " +
+		"status, " +
+		"encryption_method) " +
+		"VALUES($1, $2, $3,'INIT', 'CRYPT4GH') RETURNING id;"
+	storeHeaderQuery = "UPDATE local_ega.files SET header = $1 WHERE id = $2;"
+	headerKeyQuery   = "INSERT INTO local_ega.file_header_keys(file_id, key_id) VALUES($1, $2) " +
+		"ON CONFLICT (file_id) DO UPDATE SET key_id = EXCLUDED.key_id, last_modified = now();"
+	setArchivedQuery = "UPDATE local_ega.files SET status = 'ARCHIVED', " +
+		"archive_path = $1, " +
+		"archive_filesize = $2, " +
+		"inbox_file_checksum = $3, " +
+		"inbox_file_checksum_type = $4 " +
+		"WHERE id = $5;"
+	fileEventQuery = "INSERT INTO local_ega.file_event_log(file_id, event, correlation_id, service, details) " +
+		"VALUES($1, $2, $3, $4, $5);"
+	addChecksumQuery = "INSERT INTO local_ega.checksums(file_id, source, type, checksum) " +
+		"VALUES($1, $2, $3, $4) ON CONFLICT (file_id, source, type) " +
+		"DO UPDATE SET checksum = EXCLUDED.checksum;"
+)
+
+// execer is implemented by both *sql.DB and *sql.Tx so that statements can
+// be run on their own or as part of a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
 // sqlOpen is an internal variable to ease testing
 var sqlOpen = sql.Open
 
@@ -76,6 +181,16 @@ func hashType(h hash.Hash) string {
 	return "SHA256"
 }
 
+// NewDatabase opens the database of the type given in config
+func NewDatabase(config DBConf) (Database, error) {
+	switch config.Type {
+	case "sqlite":
+		return NewSQLiteDB(config.Path)
+	default:
+		return NewDB(config)
+	}
+}
+
 // NewDB creates a new DB connection
 func NewDB(config DBConf) (*SQLdb, error) {
 	connInfo := buildConnInfo(config)
@@ -118,8 +233,11 @@ func buildConnInfo(config DBConf) string {
 }
 
 // checkAndReconnectIfNeeded validates the current connection with a ping
-// and tries to reconnect if necessary
-func (dbs *SQLdb) checkAndReconnectIfNeeded() {
+// and tries to reconnect if necessary, the connection to use is returned
+func (dbs *SQLdb) checkAndReconnectIfNeeded() *sql.DB {
+	dbs.mu.Lock()
+	defer dbs.mu.Unlock()
+
 	start := time.Now()
 
 	for dbs.DB.Ping() != nil {
@@ -134,6 +252,7 @@ func (dbs *SQLdb) checkAndReconnectIfNeeded() {
 		dbs.DB, _ = sqlOpen("postgres", dbs.ConnInfo)
 	}
 
+	return dbs.DB
 }
 
 // GetHeader retrieves the file header
@@ -153,9 +272,7 @@ func (dbs *SQLdb) GetHeader(fileID int) ([]byte, error) {
 
 // getHeader is the actual function performing work for GetHeader
 func (dbs *SQLdb) getHeader(fileID int) ([]byte, error) {
-	dbs.checkAndReconnectIfNeeded()
-
-	db := dbs.DB
+	db := dbs.checkAndReconnectIfNeeded()
 	const query = "SELECT header from local_ega.files WHERE id = $1"
 
 	var hexString string
@@ -171,25 +288,25 @@ func (dbs *SQLdb) getHeader(fileID int) ([]byte, error) {
 	return header, nil
 }
 
-// MarkCompleted marks the file as "COMPLETED"
-func (dbs *SQLdb) MarkCompleted(file FileInfo, fileID int) error {
+// MarkCompleted marks the file as "COMPLETED" and logs the event, a
+// TransitionError is returned if the file is not "ARCHIVED". Nothing is done
+// if the file already is "COMPLETED".
+func (dbs *SQLdb) MarkCompleted(corrID string, file FileInfo, fileID int) error {
 	var (
 		err   error = nil
 		count int   = 0
 	)
 
-	for count == 0 || (err != nil && count < dbRetryTimes) {
-		err = dbs.markCompleted(file, fileID)
+	for count == 0 || (err != nil && !IsTransitionError(err) && count < dbRetryTimes) {
+		err = dbs.markCompleted(corrID, file, fileID)
 		count++
 	}
 	return err
 }
 
 // markCompleted performs actual work for MarkCompleted
-func (dbs *SQLdb) markCompleted(file FileInfo, fileID int) error {
-	dbs.checkAndReconnectIfNeeded()
-
-	db := dbs.DB
+func (dbs *SQLdb) markCompleted(corrID string, file FileInfo, fileID int) error {
+	db := dbs.checkAndReconnectIfNeeded()
 	const completed = "UPDATE local_ega.files SET status = 'COMPLETED', " +
 		"archive_filesize = $2, " +
 		"archive_file_checksum = $3, " +
@@ -198,7 +315,19 @@ func (dbs *SQLdb) markCompleted(file FileInfo, fileID int) error {
 		"decrypted_file_checksum = $6, " +
 		"decrypted_file_checksum_type = $7 " +
 		"WHERE id = $1;"
-	result, err := db.Exec(completed,
+
+	transaction, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := lockFileStatus(transaction, int64(fileID), FileCompleted); err != nil {
+		rollback(transaction)
+		if sameStatus(err) {
+			return nil
+		}
+		return err
+	}
+	result, err := transaction.Exec(completed,
 		fileID,
 		file.Size,
 		fmt.Sprintf("%x", file.Checksum.Sum(nil)),
@@ -207,12 +336,18 @@ func (dbs *SQLdb) markCompleted(file FileInfo, fileID int) error {
 		fmt.Sprintf("%x", file.DecryptedChecksum.Sum(nil)),
 		hashType(file.DecryptedChecksum))
 	if err != nil {
+		rollback(transaction)
 		return err
 	}
 	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		rollback(transaction)
 		return errors.New("something went wrong with the query zero rows were changed")
 	}
-	return nil
+	if err := logFileEvent(transaction, int64(fileID), FileCompleted, corrID, "verify", map[string]string{"decrypted_checksum": fmt.Sprintf("%x", file.DecryptedChecksum.Sum(nil))}); err != nil {
+		rollback(transaction)
+		return err
+	}
+	return transaction.Commit()
 }
 
 // InsertFile inserts a file in the database
@@ -232,19 +367,12 @@ func (dbs *SQLdb) InsertFile(filename, user string) (int64, error) {
 
 // insertFile performs actual work for InsertFile
 func (dbs *SQLdb) insertFile(filename, user string) (int64, error) {
-	dbs.checkAndReconnectIfNeeded()
+	db := dbs.checkAndReconnectIfNeeded()
 
 	// Not really idempotent, but close enough for us
 
-	db := dbs.DB
-	const query = "INSERT INTO local_ega.main(submission_file_path, " +
-		"submission_file_extension, " +
-		"submission_user, " +
-		"status, " +
-		"encryption_method) " +
-		"VALUES($1, $2, $3,'INIT', 'CRYPT4GH') RETURNING id;"
 	var fileID int64
-	err := db.QueryRow(query, filename, strings.Replace(filepath.Ext(filename), ".", "", -1), user).Scan(&fileID)
+	err := db.QueryRow(insertFileQuery, filename, strings.Replace(filepath.Ext(filename), ".", "", -1), user).Scan(&fileID)
 	if err != nil {
 		return 0, err
 	}
@@ -267,11 +395,8 @@ func (dbs *SQLdb) StoreHeader(header []byte, id int64) error {
 
 // storeHeader performs actual work for StoreHeader
 func (dbs *SQLdb) storeHeader(header []byte, id int64) error {
-	dbs.checkAndReconnectIfNeeded()
-
-	db := dbs.DB
-	const query = "UPDATE local_ega.files SET header = $1 WHERE id = $2;"
-	result, err := db.Exec(query, hex.EncodeToString(header), id)
+	db := dbs.checkAndReconnectIfNeeded()
+	result, err := db.Exec(storeHeaderQuery, hex.EncodeToString(header), id)
 	if err != nil {
 		return err
 	}
@@ -281,14 +406,15 @@ func (dbs *SQLdb) storeHeader(header []byte, id int64) error {
 	return nil
 }
 
-// SetArchived marks the file as 'ARCHIVED'
+// SetArchived marks the file as 'ARCHIVED', a TransitionError is returned
+// if the file is not 'INIT' or 'ERROR'
 func (dbs *SQLdb) SetArchived(file FileInfo, id int64) error {
 	var (
 		err   error = nil
 		count int   = 0
 	)
 
-	for count == 0 || (err != nil && count < dbRetryTimes) {
+	for count == 0 || (err != nil && !IsTransitionError(err) && count < dbRetryTimes) {
 		err = dbs.setArchived(file, id)
 		count++
 	}
@@ -297,70 +423,309 @@ func (dbs *SQLdb) SetArchived(file FileInfo, id int64) error {
 
 // setArchived performs actual work for SetArchived
 func (dbs *SQLdb) setArchived(file FileInfo, id int64) error {
-	dbs.checkAndReconnectIfNeeded()
-
-	db := dbs.DB
-	const query = "UPDATE local_ega.files SET status = 'ARCHIVED', " +
-		"archive_path = $1, " +
-		"archive_filesize = $2, " +
-		"inbox_file_checksum = $3, " +
-		"inbox_file_checksum_type = $4 " +
-		"WHERE id = $5;"
-	result, err := db.Exec(query,
+	db := dbs.checkAndReconnectIfNeeded()
+	transaction, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := lockFileStatus(transaction, id, FileArchived); err != nil {
+		rollback(transaction)
+		return err
+	}
+	result, err := transaction.Exec(setArchivedQuery,
 		file.Path,
 		file.Size,
 		fmt.Sprintf("%x", file.Checksum.Sum(nil)),
 		hashType(file.Checksum),
 		id)
 	if err != nil {
+		rollback(transaction)
 		return err
 	}
 	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		rollback(transaction)
 		return errors.New("something went wrong with the query zero rows were changed")
 	}
-	return nil
+	return transaction.Commit()
 }
 
-// MarkReady marks the file as "READY"
-func (dbs *SQLdb) MarkReady(accessionID, user, filepath, checksum string) error {
+// IngestFile registers a file, stores its header and marks it as 'ARCHIVED'
+// in a single transaction. A file is identified by the submission user, the
+// inbox path and the checksum of the encrypted file. Ingesting a file that
+// has been registered before reuses the earlier entry unless it has already
+// been verified, in which case that entry is disabled and replaced. The id
+// of the key that decrypts the header is recorded when keyID is not empty.
+func (dbs *SQLdb) IngestFile(corrID, user, filename string, header []byte, keyID string, file FileInfo) (int64, error) {
+	var (
+		fileID int64 = 0
+		err    error = nil
+		count  int   = 0
+	)
+
+	for count == 0 || (err != nil && !IsTransitionError(err) && count < dbRetryTimes) {
+		fileID, err = dbs.ingestFile(corrID, user, filename, header, keyID, file)
+		count++
+	}
+	return fileID, err
+}
+
+// ingestFile performs actual work for IngestFile
+func (dbs *SQLdb) ingestFile(corrID, user, filename string, header []byte, keyID string, file FileInfo) (int64, error) {
+	db := dbs.checkAndReconnectIfNeeded()
+	// Concurrent ingestions of the same upload are serialized on the key
+	const lockKey = "SELECT pg_advisory_xact_lock(hashtext($1));"
+	const previous = "SELECT id, status from local_ega.files WHERE " +
+		"elixir_id = $1 and inbox_path = $2 and inbox_file_checksum = $3 and status != 'DISABLED' " +
+		"ORDER BY id DESC LIMIT 1;"
+	const disable = "UPDATE local_ega.files SET status = 'DISABLED' WHERE id = $1;"
+	const forgetHeaderKey = "DELETE FROM local_ega.file_header_keys WHERE file_id = $1;"
+	const editList = "INSERT INTO local_ega.file_edit_lists(file_id, lengths) VALUES($1, $2) " +
+		"ON CONFLICT (file_id) DO UPDATE SET lengths = EXCLUDED.lengths;"
+	const forgetEditList = "DELETE FROM local_ega.file_edit_lists WHERE file_id = $1;"
+
+	checksum := fmt.Sprintf("%x", file.Checksum.Sum(nil))
+
+	transaction, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := transaction.Exec(lockKey, user+":"+filename+":"+checksum); err != nil {
+		rollback(transaction)
+		return 0, err
+	}
+
+	var (
+		fileID int64
+		status string
+	)
+	err = transaction.QueryRow(previous, user, filename, checksum).Scan(&fileID, &status)
+	switch {
+	case err == sql.ErrNoRows:
+		fileID = 0
+	case err != nil:
+		rollback(transaction)
+		return 0, err
+	case status == FileCompleted || status == FileReady:
+		// The earlier upload has been verified, supersede it
+		if err := lockFileStatus(transaction, fileID, FileDisabled); err != nil {
+			rollback(transaction)
+			return 0, err
+		}
+		if _, err := transaction.Exec(disable, fileID); err != nil {
+			rollback(transaction)
+			return 0, err
+		}
+		if err := logFileEvent(transaction, fileID, FileDisabled, corrID, "ingest", map[string]string{"reason": "superseded by new ingestion"}); err != nil {
+			rollback(transaction)
+			return 0, err
+		}
+		fileID = 0
+	case status != FileArchived:
+		// Reuse the earlier entry
+		if err := lockFileStatus(transaction, fileID, FileArchived); err != nil {
+			rollback(transaction)
+			return 0, err
+		}
+	}
+
+	reused := fileID != 0
+	if !reused {
+		err = transaction.QueryRow(insertFileQuery, filename, strings.Replace(filepath.Ext(filename), ".", "", -1), user).Scan(&fileID)
+		if err != nil {
+			rollback(transaction)
+			return 0, err
+		}
+		if err := logFileEvent(transaction, fileID, FileInit, corrID, "ingest", map[string]string{"filepath": filename}); err != nil {
+			rollback(transaction)
+			return 0, err
+		}
+	}
+
+	if _, err := transaction.Exec(storeHeaderQuery, hex.EncodeToString(header), fileID); err != nil {
+		rollback(transaction)
+		return 0, err
+	}
+
+	// The submitted header replaces any re-encrypted one of a reused entry
+	if err := recordHeaderKey(transaction, headerKeyQuery, forgetHeaderKey, fileID, keyID, reused); err != nil {
+		rollback(transaction)
+		return 0, err
+	}
+	if err := recordEditList(transaction, editList, forgetEditList, fileID, file.EditList, reused); err != nil {
+		rollback(transaction)
+		return 0, err
+	}
+
+	result, err := transaction.Exec(setArchivedQuery,
+		file.Path,
+		file.Size,
+		checksum,
+		hashType(file.Checksum),
+		fileID)
+	if err != nil {
+		rollback(transaction)
+		return 0, err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		rollback(transaction)
+		return 0, errors.New("something went wrong with the query zero rows were changed")
+	}
+
+	if err := addChecksums(transaction, fileID, SourceInbox, []Checksum{{"sha256", checksum}}); err != nil {
+		rollback(transaction)
+		return 0, err
+	}
+
+	if err := logFileEvent(transaction, fileID, FileArchived, corrID, "ingest", map[string]string{"archive_path": file.Path}); err != nil {
+		rollback(transaction)
+		return 0, err
+	}
+
+	if err := transaction.Commit(); err != nil {
+		return 0, err
+	}
+	return fileID, nil
+}
+
+// MarkReady sets the accession id of the file, marks it as "READY" and logs
+// the event, a TransitionError is returned if the file is not "COMPLETED".
+// Nothing is done if the file already is "READY" with accessionID.
+func (dbs *SQLdb) MarkReady(corrID, accessionID string, fileID int64) error {
 
 	var (
 		err   error = nil
 		count int   = 0
 	)
 
-	for count == 0 || (err != nil && count < dbRetryTimes) {
-		err = dbs.markReady(accessionID, user, filepath, checksum)
+	for count == 0 || (err != nil && !IsTransitionError(err) && count < dbRetryTimes) {
+		err = dbs.markReady(corrID, accessionID, fileID)
 		count++
 	}
 	return err
 }
 
-// MarkReady marks the file as "READY"
-func (dbs *SQLdb) markReady(accessionID, user, filepath, checksum string) error {
-	dbs.checkAndReconnectIfNeeded()
+// markReady performs actual work for MarkReady
+func (dbs *SQLdb) markReady(corrID, accessionID string, fileID int64) error {
+	db := dbs.checkAndReconnectIfNeeded()
+	const ready = "UPDATE local_ega.files SET status = 'READY', stable_id = $1 WHERE id = $2;"
+	const stableID = "SELECT stable_id FROM local_ega.files WHERE id = $1;"
 
-	db := dbs.DB
-	const ready = "UPDATE local_ega.files SET status = 'READY', stable_id = $1 WHERE " +
-		"elixir_id = $2 and inbox_path = $3 and decrypted_file_checksum = $4 and status = 'COMPLETED';"
-	result, err := db.Exec(ready, accessionID, user, filepath, checksum)
+	transaction, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	if err := lockFileStatus(transaction, fileID, FileReady); err != nil {
+		if sameStatus(err) {
+			var current sql.NullString
+			if e := transaction.QueryRow(stableID, fileID).Scan(&current); e == nil && current.String == accessionID {
+				rollback(transaction)
+				return nil
+			}
+		}
+		rollback(transaction)
+		return err
+	}
+	result, err := transaction.Exec(ready, accessionID, fileID)
+	if err != nil {
+		rollback(transaction)
+		return err
+	}
 	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		rollback(transaction)
 		return errors.New("something went wrong with the query zero rows were changed")
 	}
-	return nil
+	if err := logFileEvent(transaction, fileID, FileReady, corrID, "finalize", map[string]string{"accession_id": accessionID}); err != nil {
+		rollback(transaction)
+		return err
+	}
+	return transaction.Commit()
+}
+
+// SetError marks the file as "ERROR" and logs reason in its event log, a
+// TransitionError is returned if the file is "READY" or "DISABLED". Nothing
+// is done if the file already is "ERROR".
+func (dbs *SQLdb) SetError(fileID int64, corrID, service, reason string) error {
+	var (
+		err   error = nil
+		count int   = 0
+	)
+
+	for count == 0 || (err != nil && !IsTransitionError(err) && count < dbRetryTimes) {
+		err = dbs.setError(fileID, corrID, service, reason)
+		count++
+	}
+	return err
 }
 
-// MapFilesToDataset maps a set of files to a dataset in the database
+// setError performs actual work for SetError
+func (dbs *SQLdb) setError(fileID int64, corrID, service, reason string) error {
+	db := dbs.checkAndReconnectIfNeeded()
+	const setError = "UPDATE local_ega.files SET status = 'ERROR' WHERE id = $1;"
+
+	transaction, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := lockFileStatus(transaction, fileID, FileError); err != nil {
+		rollback(transaction)
+		if sameStatus(err) {
+			return nil
+		}
+		return err
+	}
+	if _, err := transaction.Exec(setError, fileID); err != nil {
+		rollback(transaction)
+		return err
+	}
+	if err := logFileEvent(transaction, fileID, FileError, corrID, service, map[string]string{"reason": reason}); err != nil {
+		rollback(transaction)
+		return err
+	}
+	return transaction.Commit()
+}
+
+// MappingError is returned when the files of a dataset can not be changed
+// since the dataset is no longer registered, or since some of the files do
+// not exist or are not ready
+type MappingError struct {
+	DatasetID string
+	// Reason is set when the dataset as a whole is refused
+	Reason string
+	// Failed holds the reason for each accession id that could not be mapped
+	Failed map[string]string
+}
+
+// Error lists the accession ids that could not be mapped
+func (e *MappingError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("dataset %s can not be mapped: %s", e.DatasetID, e.Reason)
+	}
+
+	ids := make([]string, 0, len(e.Failed))
+	for id := range e.Failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	reasons := make([]string, 0, len(ids))
+	for _, id := range ids {
+		reasons = append(reasons, fmt.Sprintf("%s (%s)", id, e.Failed[id]))
+	}
+
+	return fmt.Sprintf("dataset %s can not be mapped: %s", e.DatasetID, strings.Join(reasons, ", "))
+}
+
+// MapFilesToDataset maps a set of files to a dataset in the database,
+// registering the dataset if needed. The dataset is rejected with a
+// MappingError unless it is registered and all files are "READY"
 func (dbs *SQLdb) MapFilesToDataset(datasetID string, accessionIDs []string) error {
 	var (
 		err   error = nil
 		count int   = 0
 	)
 
-	for count == 0 || (err != nil && count < dbRetryTimes) {
+	for count == 0 || (err != nil && !errors.As(err, new(*MappingError)) && count < dbRetryTimes) {
 		err = dbs.mapFilesToDataset(datasetID, accessionIDs)
 		count++
 	}
@@ -369,38 +734,99 @@ func (dbs *SQLdb) MapFilesToDataset(datasetID string, accessionIDs []string) err
 
 // mapFilesToDataset performs the real work of MapFilesToDataset
 func (dbs *SQLdb) mapFilesToDataset(datasetID string, accessionIDs []string) error {
-	dbs.checkAndReconnectIfNeeded()
+	db := dbs.checkAndReconnectIfNeeded()
 
-	const getID = "SELECT file_id FROM local_ega.archive_files WHERE stable_id = $1"
+	const getFiles = "SELECT stable_id, id, status FROM local_ega.files WHERE stable_id = ANY($1);"
 	const mapping = "INSERT INTO local_ega_ebi.filedataset (file_id, dataset_stable_id) " +
 		"VALUES ($1, $2) ON CONFLICT " +
 		"DO NOTHING;"
-	db := dbs.DB
-	var fileID int64
-	transaction, _ := db.Begin()
+
+	transaction, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := transaction.Exec(registerDatasetQuery, datasetID); err != nil {
+		rollback(transaction)
+		return err
+	}
+	if err := lockDatasetRegistered(transaction, datasetID); err != nil {
+		rollback(transaction)
+		return err
+	}
+
+	rows, err := transaction.Query(getFiles, pq.Array(accessionIDs))
+	if err != nil {
+		log.Errorf("something went wrong with the DB query: %s", err)
+		rollback(transaction)
+		return err
+	}
+
+	fileIDs, failed, err := readyFiles(rows, accessionIDs)
+	rows.Close()
+	if err != nil {
+		rollback(transaction)
+		return err
+	}
+	if len(failed) > 0 {
+		rollback(transaction)
+		return &MappingError{DatasetID: datasetID, Failed: failed}
+	}
+
 	for _, accessionID := range accessionIDs {
-		err := db.QueryRow(getID, accessionID).Scan(&fileID)
-		if err != nil {
-			log.Errorf("something went wrong with the DB query: %s", err)
-			if e := transaction.Rollback(); e != nil {
-				log.Errorf("failed to rollback the transaction: %s", e)
-			}
-			return err
-		}
-		_, err = transaction.Exec(mapping, fileID, datasetID)
+		_, err = transaction.Exec(mapping, fileIDs[accessionID], datasetID)
 		if err != nil {
 			log.Errorf("something went wrong with the DB query: %s", err)
-			if e := transaction.Rollback(); e != nil {
-				log.Errorf("failed to rollback the transaction: %s", e)
-			}
+			rollback(transaction)
 			return err
 		}
 	}
 	return transaction.Commit()
 }
 
+// readyFiles reads rows holding accession id, file id and status and returns
+// the id of the "READY" file for each accession id, together with the reason
+// for every accession id that has no such file
+func readyFiles(rows *sql.Rows, accessionIDs []string) (map[string]int64, map[string]string, error) {
+	fileIDs := make(map[string]int64)
+	statuses := make(map[string]string)
+	for rows.Next() {
+		var (
+			accessionID string
+			fileID      int64
+			status      string
+		)
+		if err := rows.Scan(&accessionID, &fileID, &status); err != nil {
+			return nil, nil, err
+		}
+		// an accession id may have been reused by disabled files
+		if status == FileReady {
+			fileIDs[accessionID] = fileID
+		} else if _, ok := statuses[accessionID]; !ok {
+			statuses[accessionID] = status
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	failed := make(map[string]string)
+	for _, accessionID := range accessionIDs {
+		if _, ok := fileIDs[accessionID]; ok {
+			continue
+		}
+		if status, ok := statuses[accessionID]; ok {
+			failed[accessionID] = fmt.Sprintf("status is %s", status)
+		} else {
+			failed[accessionID] = "not found"
+		}
+	}
+
+	return fileIDs, failed, nil
+}
+
 // GetArchived retrieves the location and size of archive
-func (dbs *SQLdb) GetArchived(user, filepath, checksum string) (string, int, error) {
+func (dbs *SQLdb) GetArchived(fileID int64) (string, int, error) {
 	var (
 		filePath string = ""
 		fileSize int    = 0
@@ -409,29 +835,311 @@ func (dbs *SQLdb) GetArchived(user, filepath, checksum string) (string, int, err
 	)
 
 	for count == 0 || (err != nil && count < dbRetryTimes) {
-		filePath, fileSize, err = dbs.getArchived(user, filepath, checksum)
+		filePath, fileSize, err = dbs.getArchived(fileID)
 		count++
 	}
 	return filePath, fileSize, err
 }
 
 // getArchived is the actual function performing work for GetArchived
-func (dbs *SQLdb) getArchived(user, filepath, checksum string) (string, int, error) {
-	dbs.checkAndReconnectIfNeeded()
-
-	db := dbs.DB
+func (dbs *SQLdb) getArchived(fileID int64) (string, int, error) {
+	db := dbs.checkAndReconnectIfNeeded()
 	const query = "SELECT archive_path, archive_filesize from local_ega.files WHERE " +
-		"elixir_id = $1 and inbox_path = $2 and decrypted_file_checksum = $3 and status = 'COMPLETED';"
+		"id = $1 and status in ('COMPLETED', 'READY');"
 
 	var filePath string
 	var fileSize int
-	if err := db.QueryRow(query, user, filepath, checksum).Scan(&filePath, &fileSize); err != nil {
+	if err := db.QueryRow(query, fileID).Scan(&filePath, &fileSize); err != nil {
 		return "", 0, err
 	}
 
 	return filePath, fileSize, nil
 }
 
+// GetFileIDByChecksums retrieves the id of the latest file submitted by user
+// with the given inbox path whose decrypted checksums agree with checksums.
+// At least one of the given checksums must have been stored for the file.
+func (dbs *SQLdb) GetFileIDByChecksums(user, filepath string, checksums []Checksum) (int64, error) {
+	var (
+		fileID int64 = 0
+		err    error = nil
+		count  int   = 0
+	)
+
+	for count == 0 || (err != nil && err != sql.ErrNoRows && count < dbRetryTimes) {
+		fileID, err = dbs.getFileIDByChecksums(user, filepath, checksums)
+		count++
+	}
+	return fileID, err
+}
+
+// getFileIDByChecksums is the actual function performing work for
+// GetFileIDByChecksums
+func (dbs *SQLdb) getFileIDByChecksums(user, filepath string, checksums []Checksum) (int64, error) {
+	db := dbs.checkAndReconnectIfNeeded()
+	const query = "SELECT f.id, c.type, c.checksum from local_ega.files f " +
+		"JOIN local_ega.checksums c ON c.file_id = f.id WHERE " +
+		"f.elixir_id = $1 and f.inbox_path = $2 and c.source = 'DECRYPTED' " +
+		"ORDER BY f.id DESC;"
+
+	rows, err := db.Query(query, user, filepath)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	return matchChecksums(rows, checksums)
+}
+
+// matchChecksums picks the first file in rows, holding file id, checksum
+// type and checksum ordered by file, whose checksums agree with checksums.
+// sql.ErrNoRows is returned when no file matches.
+func matchChecksums(rows *sql.Rows, checksums []Checksum) (int64, error) {
+	stored := make(map[int64]map[string]string)
+	var order []int64
+	for rows.Next() {
+		var (
+			fileID       int64
+			checksumType string
+			value        string
+		)
+		if err := rows.Scan(&fileID, &checksumType, &value); err != nil {
+			return 0, err
+		}
+		if _, ok := stored[fileID]; !ok {
+			stored[fileID] = make(map[string]string)
+			order = append(order, fileID)
+		}
+		stored[fileID][checksumType] = value
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, fileID := range order {
+		matched := 0
+		for _, c := range checksums {
+			value, ok := stored[fileID][c.Type]
+			if !ok {
+				continue
+			}
+			if value != c.Value {
+				matched = 0
+
+				break
+			}
+			matched++
+		}
+		if matched > 0 {
+			return fileID, nil
+		}
+	}
+
+	return 0, sql.ErrNoRows
+}
+
+// AddChecksums stores checksums of the given source for a file, replacing
+// any earlier checksum of the same source and type
+func (dbs *SQLdb) AddChecksums(fileID int64, source string, checksums []Checksum) error {
+	if err := validateChecksums(checksums); err != nil {
+		return err
+	}
+
+	var (
+		err   error = nil
+		count int   = 0
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		err = dbs.addChecksums(fileID, source, checksums)
+		count++
+	}
+	return err
+}
+
+// addChecksums performs actual work for AddChecksums
+func (dbs *SQLdb) addChecksums(fileID int64, source string, checksums []Checksum) error {
+	db := dbs.checkAndReconnectIfNeeded()
+
+	transaction, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := addChecksums(transaction, fileID, source, checksums); err != nil {
+		rollback(transaction)
+		return err
+	}
+	return transaction.Commit()
+}
+
+// validateChecksums verifies that all checksums use a supported algorithm
+func validateChecksums(checksums []Checksum) error {
+	for _, c := range checksums {
+		if !checksumTypes[c.Type] {
+			return fmt.Errorf("unsupported checksum type %s", c.Type)
+		}
+	}
+
+	return nil
+}
+
+// addChecksums inserts the checksums of a file using e
+func addChecksums(e execer, fileID int64, source string, checksums []Checksum) error {
+	return insertChecksums(e, addChecksumQuery, fileID, source, checksums)
+}
+
+// insertChecksums runs query once for each checksum
+func insertChecksums(e execer, query string, fileID int64, source string, checksums []Checksum) error {
+	for _, c := range checksums {
+		if _, err := e.Exec(query, fileID, source, c.Type, c.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetChecksums retrieves the checksums of the given source for a file
+func (dbs *SQLdb) GetChecksums(fileID int64, source string) ([]Checksum, error) {
+	var (
+		checksums []Checksum = nil
+		err       error      = nil
+		count     int        = 0
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		checksums, err = dbs.getChecksums(fileID, source)
+		count++
+	}
+	return checksums, err
+}
+
+// getChecksums is the actual function performing work for GetChecksums
+func (dbs *SQLdb) getChecksums(fileID int64, source string) ([]Checksum, error) {
+	db := dbs.checkAndReconnectIfNeeded()
+	const query = "SELECT type, checksum from local_ega.checksums WHERE " +
+		"file_id = $1 and source = $2 ORDER BY type;"
+
+	rows, err := db.Query(query, fileID, source)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanChecksums(rows)
+}
+
+// scanChecksums reads the rows of a checksum query
+func scanChecksums(rows *sql.Rows) ([]Checksum, error) {
+	var checksums []Checksum
+	for rows.Next() {
+		var c Checksum
+		if err := rows.Scan(&c.Type, &c.Value); err != nil {
+			return nil, err
+		}
+		checksums = append(checksums, c)
+	}
+
+	return checksums, rows.Err()
+}
+
+// UpdateFileEventLog appends an event to the event log of a file
+func (dbs *SQLdb) UpdateFileEventLog(fileID int64, event, corrID, service string, details map[string]string) error {
+	var (
+		err   error = nil
+		count int   = 0
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		err = dbs.updateFileEventLog(fileID, event, corrID, service, details)
+		count++
+	}
+	return err
+}
+
+// updateFileEventLog performs actual work for UpdateFileEventLog
+func (dbs *SQLdb) updateFileEventLog(fileID int64, event, corrID, service string, details map[string]string) error {
+	return logFileEvent(dbs.checkAndReconnectIfNeeded(), fileID, event, corrID, service, details)
+}
+
+// logFileEvent inserts an entry in the file event log using e
+func logFileEvent(e execer, fileID int64, event, corrID, service string, details map[string]string) error {
+	return insertFileEvent(e, fileEventQuery, fileID, event, corrID, service, details)
+}
+
+// insertFileEvent runs query, inserting an event in the file event log
+func insertFileEvent(e execer, query string, fileID int64, event, corrID, service string, details map[string]string) error {
+	if details == nil {
+		details = map[string]string{}
+	}
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+
+	result, err := e.Exec(query, fileID, event, corrID, service, string(detailsJSON))
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("something went wrong with the query zero rows were changed")
+	}
+	return nil
+}
+
+// GetFileEventLog retrieves all events logged for a file, oldest first
+func (dbs *SQLdb) GetFileEventLog(fileID int64) ([]FileEvent, error) {
+	var (
+		events []FileEvent = nil
+		err    error       = nil
+		count  int         = 0
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		events, err = dbs.getFileEventLog(fileID)
+		count++
+	}
+	return events, err
+}
+
+// getFileEventLog is the actual function performing work for GetFileEventLog
+func (dbs *SQLdb) getFileEventLog(fileID int64) ([]FileEvent, error) {
+	db := dbs.checkAndReconnectIfNeeded()
+	const query = "SELECT file_id, event, correlation_id, service, details, created_at " +
+		"from local_ega.file_event_log WHERE file_id = $1 ORDER BY created_at, id;"
+
+	rows, err := db.Query(query, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanFileEvents(rows)
+}
+
+// scanFileEvents reads the rows of a file event log query
+func scanFileEvents(rows *sql.Rows) ([]FileEvent, error) {
+	var events []FileEvent
+	for rows.Next() {
+		var (
+			e       FileEvent
+			corrID  sql.NullString
+			details []byte
+		)
+		if err := rows.Scan(&e.FileID, &e.Event, &corrID, &e.Service, &details, &e.Timestamp); err != nil {
+			return nil, err
+		}
+		e.CorrelationID = corrID.String
+		if len(details) > 0 {
+			if err := json.Unmarshal(details, &e.Details); err != nil {
+				return nil, err
+			}
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
 // Close terminates the connection to the database
 func (dbs *SQLdb) Close() {
 	db := dbs.DB
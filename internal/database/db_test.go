@@ -7,11 +7,11 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"strconv"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -31,7 +31,12 @@ var testPgconf = DBConf{"localhost",
 	"cacert",
 	"verify-full",
 	"clientcert",
-	"clientkey"}
+	"clientkey",
+	"postgres",
+	""}
+
+// lockStatus is the query used to lock a file before changing its status
+const lockStatus = "SELECT status FROM local_ega.main WHERE id = \\$1 FOR UPDATE;"
 
 const testConnInfo = "host=localhost port=42 user=user password=password dbname=database sslmode=verify-full sslrootcert=cacert sslcert=clientcert sslkey=clientkey"
 
@@ -75,12 +80,17 @@ func TestCheckAndReconnect(t *testing.T) {
 
 	mock.ExpectPing().WillReturnError(fmt.Errorf("ping fail for testing bad conn"))
 
-	err := CatchPanicCheckAndReconnect(SQLdb{db, ""})
+	// Reconnecting keeps giving the failing database
+	sqlOpen = func(_ string, _ string) (*sql.DB, error) {
+		return db, nil
+	}
+
+	err := CatchPanicCheckAndReconnect(&SQLdb{DB: db})
 	assert.Error(t, err, "Should have received error from checkAndReconnectOnNeeded fataling")
 
 }
 
-func CatchPanicCheckAndReconnect(db SQLdb) (err error) {
+func CatchPanicCheckAndReconnect(db *SQLdb) (err error) {
 	defer func() {
 		r := recover()
 		if r != nil {
@@ -190,7 +200,7 @@ func sqlTesterHelper(t *testing.T, f func(sqlmock.Sqlmock, *SQLdb) error) error
 }
 
 func TestMarkCompleted(t *testing.T) {
-	file := FileInfo{sha256.New(), 46, "/somepath", sha256.New(), 48}
+	file := FileInfo{sha256.New(), 46, "/somepath", sha256.New(), 48, nil}
 
 	_, err := file.Checksum.Write([]byte("checksum"))
 
@@ -204,18 +214,26 @@ func TestMarkCompleted(t *testing.T) {
 		return
 	}
 
+	const completed = "UPDATE local_ega.files SET status = 'COMPLETED', " +
+		"archive_filesize = \\$2, " +
+		"archive_file_checksum = \\$3, " +
+		"archive_file_checksum_type = \\$4, " +
+		"decrypted_file_size = \\$5, " +
+		"decrypted_file_checksum = \\$6, " +
+		"decrypted_file_checksum_type = \\$7 " +
+		"WHERE id = \\$1;"
+	const event = "INSERT INTO local_ega.file_event_log\\(file_id, event, correlation_id, service, details\\) " +
+		"VALUES\\(\\$1, \\$2, \\$3, \\$4, \\$5\\);"
+
 	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
 		r := sqlmock.NewResult(10, 1)
 
-		mock.ExpectExec("UPDATE local_ega.files SET status = 'COMPLETED', "+
-			"archive_filesize = \\$2, "+
-			"archive_file_checksum = \\$3, "+
-			"archive_file_checksum_type = \\$4, "+
-			"decrypted_file_size = \\$5, "+
-			"decrypted_file_checksum = \\$6, "+
-			"decrypted_file_checksum_type = \\$7 "+
-			"WHERE id = \\$1;").WithArgs(
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockStatus).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileArchived))
+		mock.ExpectExec(completed).WithArgs(
 			10,
 			file.Size,
 			"96fa8f226d3801741e807533552bc4b177ac4544d834073b6a5298934d34b40b",
@@ -223,8 +241,12 @@ func TestMarkCompleted(t *testing.T) {
 			file.DecryptedSize,
 			"b353d3058b350466bb75a4e5e2263c73a7b900e2c48804780c6dd820b8b151ba",
 			"SHA256").WillReturnResult(r)
+		mock.ExpectExec(event).
+			WithArgs(10, FileCompleted, "corr-id", "verify", `{"decrypted_checksum":"b353d3058b350466bb75a4e5e2263c73a7b900e2c48804780c6dd820b8b151ba"}`).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
 
-		return testDb.MarkCompleted(file, 10)
+		return testDb.MarkCompleted("corr-id", file, 10)
 	})
 
 	assert.Nil(t, r, "MarkCompleted failed unexpectedly")
@@ -235,14 +257,11 @@ func TestMarkCompleted(t *testing.T) {
 	buf.Reset()
 	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
-		mock.ExpectExec("UPDATE local_ega.files SET status = 'COMPLETED', "+
-			"archive_filesize = \\$2, "+
-			"archive_file_checksum = \\$3, "+
-			"archive_file_checksum_type = \\$4, "+
-			"decrypted_file_size = \\$5, "+
-			"decrypted_file_checksum = \\$6, "+
-			"decrypted_file_checksum_type = \\$7 "+
-			"WHERE id = \\$1;").
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockStatus).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileArchived))
+		mock.ExpectExec(completed).
 			WithArgs(10,
 				file.Size,
 				"96fa8f226d3801741e807533552bc4b177ac4544d834073b6a5298934d34b40b",
@@ -251,12 +270,40 @@ func TestMarkCompleted(t *testing.T) {
 				"b353d3058b350466bb75a4e5e2263c73a7b900e2c48804780c6dd820b8b151ba",
 				"SHA256").
 			WillReturnError(fmt.Errorf("error for testing"))
+		mock.ExpectRollback()
 
-		return testDb.MarkCompleted(file, 10)
+		return testDb.MarkCompleted("corr-id", file, 10)
 	})
 
 	assert.NotNil(t, r, "MarkCompleted did not fail as expected")
 
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockStatus).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileInit))
+		mock.ExpectRollback()
+
+		return testDb.MarkCompleted("corr-id", file, 10)
+	})
+
+	assert.True(t, IsTransitionError(r), "MarkCompleted did not refuse a file that is not archived")
+
+	// A file that already is completed is left as it is
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockStatus).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileCompleted))
+		mock.ExpectRollback()
+
+		return testDb.MarkCompleted("corr-id", file, 10)
+	})
+
+	assert.Nil(t, r, "MarkCompleted refused a file that already is completed")
+
 	log.SetOutput(os.Stdout)
 }
 
@@ -330,24 +377,31 @@ func TestStoreHeader(t *testing.T) {
 
 func TestSetArchived(t *testing.T) {
 
-	file := FileInfo{sha256.New(), 1000, "/tmp/file.c4gh", sha256.New(), -1}
+	file := FileInfo{sha256.New(), 1000, "/tmp/file.c4gh", sha256.New(), -1, nil}
 	_, err := file.Checksum.Write([]byte("checksum"))
 
 	if err != nil {
 		return
 	}
 
+	const archived = "UPDATE local_ega.files SET status = 'ARCHIVED', archive_path = \\$1, archive_filesize = \\$2, inbox_file_checksum = \\$3, inbox_file_checksum_type = \\$4 WHERE id = \\$5;"
+
 	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
 		r := sqlmock.NewResult(10, 1)
 
-		mock.ExpectExec("UPDATE local_ega.files SET status = 'ARCHIVED', archive_path = \\$1, archive_filesize = \\$2, inbox_file_checksum = \\$3, inbox_file_checksum_type = \\$4 WHERE id = \\$5;").
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockStatus).
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileInit))
+		mock.ExpectExec(archived).
 			WithArgs(file.Path,
 				file.Size,
 				"96fa8f226d3801741e807533552bc4b177ac4544d834073b6a5298934d34b40b",
 				"SHA256",
 				42).
 			WillReturnResult(r)
+		mock.ExpectCommit()
 
 		return testDb.SetArchived(file, 42)
 	})
@@ -361,36 +415,205 @@ func TestSetArchived(t *testing.T) {
 
 	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
-		mock.ExpectExec("UPDATE local_ega.files SET status = 'ARCHIVED', archive_path = \\$1, archive_filesize = \\$2, inbox_file_checksum = \\$3, inbox_file_checksum_type = \\$4 WHERE id = \\$5;").
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockStatus).
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileInit))
+		mock.ExpectExec(archived).
 			WithArgs(file.Path,
 				file.Size,
 				"96fa8f226d3801741e807533552bc4b177ac4544d834073b6a5298934d34b40b",
 				"SHA256", 42).
 			WillReturnError(fmt.Errorf("error for testing"))
+		mock.ExpectRollback()
 
 		return testDb.SetArchived(file, 42)
 	})
 
 	assert.NotNil(t, r, "SetArchived did not fail correctly")
 
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockStatus).
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileReady))
+		mock.ExpectRollback()
+
+		return testDb.SetArchived(file, 42)
+	})
+
+	assert.Equal(t, &TransitionError{42, FileReady, FileArchived}, r, "SetArchived did not refuse a ready file")
+
+	log.SetOutput(os.Stdout)
+}
+
+func TestIngestFile(t *testing.T) {
+	file := FileInfo{sha256.New(), 1000, "archive-uuid", nil, -1, nil}
+	_, err := file.Checksum.Write([]byte("checksum"))
+
+	if err != nil {
+		return
+	}
+
+	const checksum = "96fa8f226d3801741e807533552bc4b177ac4544d834073b6a5298934d34b40b"
+	const lockKey = "SELECT pg_advisory_xact_lock\\(hashtext\\(\\$1\\)\\);"
+	const previous = "SELECT id, status from local_ega.files WHERE " +
+		"elixir_id = \\$1 and inbox_path = \\$2 and inbox_file_checksum = \\$3 and status != 'DISABLED' " +
+		"ORDER BY id DESC LIMIT 1;"
+	const insert = "INSERT INTO local_ega.main\\(submission_file_path, submission_file_extension, submission_user, status, encryption_method\\) VALUES\\(\\$1, \\$2, \\$3,'INIT', 'CRYPT4GH'\\) RETURNING id;"
+	const event = "INSERT INTO local_ega.file_event_log\\(file_id, event, correlation_id, service, details\\) " +
+		"VALUES\\(\\$1, \\$2, \\$3, \\$4, \\$5\\);"
+	const header = "UPDATE local_ega.files SET header = \\$1 WHERE id = \\$2;"
+	const headerKey = "INSERT INTO local_ega.file_header_keys\\(file_id, key_id\\) VALUES\\(\\$1, \\$2\\) " +
+		"ON CONFLICT \\(file_id\\) DO UPDATE SET key_id = EXCLUDED.key_id, last_modified = now\\(\\);"
+	const editList = "INSERT INTO local_ega.file_edit_lists\\(file_id, lengths\\) VALUES\\(\\$1, \\$2\\) " +
+		"ON CONFLICT \\(file_id\\) DO UPDATE SET lengths = EXCLUDED.lengths;"
+	const archived = "UPDATE local_ega.files SET status = 'ARCHIVED', archive_path = \\$1, archive_filesize = \\$2, inbox_file_checksum = \\$3, inbox_file_checksum_type = \\$4 WHERE id = \\$5;"
+	const addChecksum = "INSERT INTO local_ega.checksums\\(file_id, source, type, checksum\\) " +
+		"VALUES\\(\\$1, \\$2, \\$3, \\$4\\) ON CONFLICT \\(file_id, source, type\\) " +
+		"DO UPDATE SET checksum = EXCLUDED.checksum;"
+
+	success := sqlmock.NewResult(1, 1)
+
+	// A new upload gets a new entry
+	edited := file
+	edited.EditList = []uint64{5, 10}
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectExec(lockKey).WithArgs("nobody:/tmp/file.c4gh:" + checksum).WillReturnResult(success)
+		mock.ExpectQuery(previous).
+			WithArgs("nobody", "/tmp/file.c4gh", checksum).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "status"}))
+		mock.ExpectQuery(insert).
+			WithArgs("/tmp/file.c4gh", "c4gh", "nobody").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+		mock.ExpectExec(event).WithArgs(5, FileInit, "corr-id", "ingest", `{"filepath":"/tmp/file.c4gh"}`).WillReturnResult(success)
+		mock.ExpectExec(header).WithArgs("0f40", 5).WillReturnResult(success)
+		mock.ExpectExec(headerKey).WithArgs(5, "key1").WillReturnResult(success)
+		mock.ExpectExec(editList).WithArgs(5, "[5,10]").WillReturnResult(success)
+		mock.ExpectExec(archived).WithArgs(file.Path, file.Size, checksum, "SHA256", 5).WillReturnResult(success)
+		mock.ExpectExec(addChecksum).WithArgs(5, SourceInbox, "sha256", checksum).WillReturnResult(success)
+		mock.ExpectExec(event).WithArgs(5, FileArchived, "corr-id", "ingest", `{"archive_path":"archive-uuid"}`).WillReturnResult(success)
+		mock.ExpectCommit()
+
+		fileID, err := testDb.IngestFile("corr-id", "nobody", "/tmp/file.c4gh", []byte{15, 64}, "key1", edited)
+		assert.Equal(t, int64(5), fileID, "did not get expected file id")
+
+		return err
+	})
+
+	assert.Nil(t, r, "IngestFile failed unexpectedly")
+
+	// A redelivered upload reuses the earlier entry
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectExec(lockKey).WithArgs("nobody:/tmp/file.c4gh:" + checksum).WillReturnResult(success)
+		mock.ExpectQuery(previous).
+			WithArgs("nobody", "/tmp/file.c4gh", checksum).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "status"}).AddRow(5, FileError))
+		mock.ExpectQuery(lockStatus).
+			WithArgs(5).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileError))
+		mock.ExpectExec(header).WithArgs("0f40", 5).WillReturnResult(success)
+		mock.ExpectExec("DELETE FROM local_ega.file_header_keys WHERE file_id = \\$1;").WithArgs(5).WillReturnResult(success)
+		mock.ExpectExec("DELETE FROM local_ega.file_edit_lists WHERE file_id = \\$1;").WithArgs(5).WillReturnResult(success)
+		mock.ExpectExec(archived).WithArgs(file.Path, file.Size, checksum, "SHA256", 5).WillReturnResult(success)
+		mock.ExpectExec(addChecksum).WithArgs(5, SourceInbox, "sha256", checksum).WillReturnResult(success)
+		mock.ExpectExec(event).WithArgs(5, FileArchived, "corr-id", "ingest", `{"archive_path":"archive-uuid"}`).WillReturnResult(success)
+		mock.ExpectCommit()
+
+		fileID, err := testDb.IngestFile("corr-id", "nobody", "/tmp/file.c4gh", []byte{15, 64}, "", file)
+		assert.Equal(t, int64(5), fileID, "did not reuse earlier entry")
+
+		return err
+	})
+
+	assert.Nil(t, r, "IngestFile failed unexpectedly")
+
+	// A verified upload is superseded by a new entry
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectExec(lockKey).WithArgs("nobody:/tmp/file.c4gh:" + checksum).WillReturnResult(success)
+		mock.ExpectQuery(previous).
+			WithArgs("nobody", "/tmp/file.c4gh", checksum).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "status"}).AddRow(5, FileReady))
+		mock.ExpectQuery(lockStatus).
+			WithArgs(5).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileReady))
+		mock.ExpectExec("UPDATE local_ega.files SET status = 'DISABLED' WHERE id = \\$1;").WithArgs(5).WillReturnResult(success)
+		mock.ExpectExec(event).WithArgs(5, FileDisabled, "corr-id", "ingest", `{"reason":"superseded by new ingestion"}`).WillReturnResult(success)
+		mock.ExpectQuery(insert).
+			WithArgs("/tmp/file.c4gh", "c4gh", "nobody").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(6))
+		mock.ExpectExec(event).WithArgs(6, FileInit, "corr-id", "ingest", `{"filepath":"/tmp/file.c4gh"}`).WillReturnResult(success)
+		mock.ExpectExec(header).WithArgs("0f40", 6).WillReturnResult(success)
+		mock.ExpectExec(archived).WithArgs(file.Path, file.Size, checksum, "SHA256", 6).WillReturnResult(success)
+		mock.ExpectExec(addChecksum).WithArgs(6, SourceInbox, "sha256", checksum).WillReturnResult(success)
+		mock.ExpectExec(event).WithArgs(6, FileArchived, "corr-id", "ingest", `{"archive_path":"archive-uuid"}`).WillReturnResult(success)
+		mock.ExpectCommit()
+
+		fileID, err := testDb.IngestFile("corr-id", "nobody", "/tmp/file.c4gh", []byte{15, 64}, "", file)
+		assert.Equal(t, int64(6), fileID, "did not supersede earlier entry")
+
+		return err
+	})
+
+	assert.Nil(t, r, "IngestFile failed unexpectedly")
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+
+	// Nothing is kept when a step fails
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectExec(lockKey).WithArgs("nobody:/tmp/file.c4gh:" + checksum).WillReturnResult(success)
+		mock.ExpectQuery(previous).
+			WithArgs("nobody", "/tmp/file.c4gh", checksum).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "status"}))
+		mock.ExpectQuery(insert).
+			WithArgs("/tmp/file.c4gh", "c4gh", "nobody").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+		mock.ExpectExec(event).WithArgs(5, FileInit, "corr-id", "ingest", `{"filepath":"/tmp/file.c4gh"}`).WillReturnResult(success)
+		mock.ExpectExec(header).WithArgs("0f40", 5).WillReturnError(fmt.Errorf("error for testing"))
+		mock.ExpectRollback()
+
+		_, err := testDb.IngestFile("corr-id", "nobody", "/tmp/file.c4gh", []byte{15, 64}, "", file)
+
+		return err
+	})
+
+	assert.NotNil(t, r, "IngestFile did not fail as expected")
+
 	log.SetOutput(os.Stdout)
 }
 
 func TestMarkReady(t *testing.T) {
+	const ready = "UPDATE local_ega.files SET status = 'READY', stable_id = \\$1 WHERE id = \\$2;"
+	const event = "INSERT INTO local_ega.file_event_log\\(file_id, event, correlation_id, service, details\\) " +
+		"VALUES\\(\\$1, \\$2, \\$3, \\$4, \\$5\\);"
+
 	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
 		r := sqlmock.NewResult(10, 1)
 
-		mock.ExpectExec("UPDATE local_ega.files SET status = 'READY', "+
-			"stable_id = \\$1 WHERE "+
-			"elixir_id = \\$2 and "+
-			"inbox_path = \\$3 and "+
-			"decrypted_file_checksum = \\$4 and "+
-			"status = 'COMPLETED';").
-			WithArgs("accessionId", "nobody", "/tmp/file.c4gh", "checksum").
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockStatus).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileCompleted))
+		mock.ExpectExec(ready).
+			WithArgs("accessionId", 10).
 			WillReturnResult(r)
+		mock.ExpectExec(event).
+			WithArgs(10, FileReady, "corr-id", "finalize", `{"accession_id":"accessionId"}`).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
 
-		return testDb.MarkReady("accessionId", "nobody", "/tmp/file.c4gh", "checksum")
+		return testDb.MarkReady("corr-id", "accessionId", 10)
 	})
 
 	assert.Nil(t, r, "MarkReady failed unexpectedly")
@@ -400,102 +623,409 @@ func TestMarkReady(t *testing.T) {
 
 	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
-		mock.ExpectExec("UPDATE local_ega.files SET status = 'READY', "+
-			"stable_id = \\$1 WHERE "+
-			"elixir_id = \\$2 and "+
-			"inbox_path = \\$3 and "+
-			"decrypted_file_checksum = \\$4 and "+
-			"status = 'COMPLETED';").
-			WithArgs("accessionId", "nobody", "/tmp/file.c4gh", "checksum").
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockStatus).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileCompleted))
+		mock.ExpectExec(ready).
+			WithArgs("accessionId", 10).
 			WillReturnError(fmt.Errorf("error for testing"))
+		mock.ExpectRollback()
 
-		return testDb.MarkReady("accessionId", "nobody", "/tmp/file.c4gh", "checksum")
+		return testDb.MarkReady("corr-id", "accessionId", 10)
 	})
 
 	assert.NotNil(t, r, "MarkReady did not fail as expected")
 
+	// The file is not made ready if its event can not be logged
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockStatus).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileCompleted))
+		mock.ExpectExec(ready).
+			WithArgs("accessionId", 10).
+			WillReturnResult(sqlmock.NewResult(10, 1))
+		mock.ExpectExec(event).
+			WithArgs(10, FileReady, "corr-id", "finalize", `{"accession_id":"accessionId"}`).
+			WillReturnError(fmt.Errorf("error for testing"))
+		mock.ExpectRollback()
+
+		return testDb.MarkReady("corr-id", "accessionId", 10)
+	})
+
+	assert.NotNil(t, r, "MarkReady did not fail as expected")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockStatus).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileArchived))
+		mock.ExpectRollback()
+
+		return testDb.MarkReady("corr-id", "accessionId", 10)
+	})
+
+	assert.True(t, IsTransitionError(r), "MarkReady did not refuse a file that is not completed")
+
+	const stableID = "SELECT stable_id FROM local_ega.files WHERE id = \\$1;"
+
+	// A file that already is ready with the accession id is left as it is
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockStatus).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileReady))
+		mock.ExpectQuery(stableID).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"stable_id"}).AddRow("accessionId"))
+		mock.ExpectRollback()
+
+		return testDb.MarkReady("corr-id", "accessionId", 10)
+	})
+
+	assert.Nil(t, r, "MarkReady refused a file that already is ready")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockStatus).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileReady))
+		mock.ExpectQuery(stableID).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"stable_id"}).AddRow("otherAccessionId"))
+		mock.ExpectRollback()
+
+		return testDb.MarkReady("corr-id", "accessionId", 10)
+	})
+
+	assert.True(t, IsTransitionError(r), "MarkReady did not refuse a file that is ready with another accession id")
+
 	log.SetOutput(os.Stdout)
 }
+
 func TestMapFilesToDataset(t *testing.T) {
+	const getFiles = "SELECT stable_id, id, status FROM local_ega.files WHERE stable_id = ANY\\(\\$1\\);"
+	const mapping = "INSERT INTO local_ega_ebi.filedataset " +
+		"\\(file_id, dataset_stable_id\\) VALUES \\(\\$1, \\$2\\) " +
+		"ON CONFLICT " +
+		"DO NOTHING;"
+
+	const register = "INSERT INTO local_ega.datasets\\(stable_id, status\\) VALUES\\(\\$1, 'registered'\\) " +
+		"ON CONFLICT \\(stable_id\\) DO NOTHING;"
+	const lockDataset = "SELECT status FROM local_ega.datasets WHERE stable_id = \\$1 FOR UPDATE;"
+
+	success := sqlmock.NewResult(1, 1)
+
 	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
-		// Set up a few file sets with different accession ids.
-		accessions := []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "0"}
+		mock.ExpectBegin()
+		mock.ExpectExec(register).WithArgs("dataset1").WillReturnResult(success)
+		mock.ExpectQuery(lockDataset).WithArgs("dataset1").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(DatasetRegistered))
+		mock.ExpectQuery(getFiles).
+			WithArgs(pq.Array([]string{"aid1", "aid2"})).
+			WillReturnRows(sqlmock.NewRows([]string{"stable_id", "id", "status"}).
+				AddRow("aid1", 1, FileDisabled).
+				AddRow("aid1", 3, FileReady).
+				AddRow("aid2", 2, FileReady))
+		mock.ExpectExec(mapping).WithArgs(3, "dataset1").WillReturnResult(success)
+		mock.ExpectExec(mapping).WithArgs(2, "dataset1").WillReturnResult(success)
+		mock.ExpectCommit()
+
+		return testDb.MapFilesToDataset("dataset1", []string{"aid1", "aid2"})
+	})
 
-		diSet := map[string][]string{"dataset1": accessions[0:3],
-			"dataset2": accessions[4:5],
-			"dataset3": accessions[6:8],
-			"dataset4": accessions[9:9]}
+	assert.Nil(t, r, "MapFilesToDataset failed unexpectedly")
+
+	// The whole dataset is rejected if any file is missing or not ready
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
-		success := sqlmock.NewResult(1, 1)
+		mock.ExpectBegin()
+		mock.ExpectExec(register).WithArgs("dataset1").WillReturnResult(success)
+		mock.ExpectQuery(lockDataset).WithArgs("dataset1").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(DatasetRegistered))
+		mock.ExpectQuery(getFiles).
+			WithArgs(pq.Array([]string{"aid1", "aid2", "aid3"})).
+			WillReturnRows(sqlmock.NewRows([]string{"stable_id", "id", "status"}).
+				AddRow("aid1", 1, FileReady).
+				AddRow("aid2", 2, FileDisabled))
+		mock.ExpectRollback()
+
+		return testDb.MapFilesToDataset("dataset1", []string{"aid1", "aid2", "aid3"})
+	})
 
-		for di, acs := range diSet {
-			mock.ExpectBegin()
-			for _, aID := range acs {
-				r := sqlmock.NewRows([]string{"file_id"})
+	var mappingError *MappingError
+	if assert.True(t, errors.As(r, &mappingError), "MapFilesToDataset did not reject the dataset") {
+		assert.Equal(t, map[string]string{"aid2": "status is DISABLED", "aid3": "not found"}, mappingError.Failed)
+		assert.EqualError(t, r, "dataset dataset1 can not be mapped: aid2 (status is DISABLED), aid3 (not found)")
+	}
 
-				fileID, _ := strconv.Atoi(aID)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
 
-				r.AddRow(fileID)
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
-				mock.ExpectQuery("SELECT file_id FROM local_ega.archive_files WHERE stable_id = \\$1").
-					WithArgs(aID).WillReturnRows(r)
+		mock.ExpectBegin()
+		mock.ExpectExec(register).WithArgs("dataset").WillReturnResult(success)
+		mock.ExpectQuery(lockDataset).WithArgs("dataset").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(DatasetRegistered))
+		mock.ExpectQuery(getFiles).
+			WithArgs(pq.Array([]string{"aid1"})).
+			WillReturnRows(sqlmock.NewRows([]string{"stable_id", "id", "status"}).AddRow("aid1", 100, FileReady))
+		mock.ExpectExec(mapping).WithArgs(100, "dataset").WillReturnError(fmt.Errorf("error for testing"))
+		mock.ExpectRollback().WillReturnError(fmt.Errorf("error again"))
 
-				mock.ExpectExec("INSERT INTO local_ega_ebi.filedataset "+
-					"\\(file_id, dataset_stable_id\\) VALUES \\(\\$1, \\$2\\) "+
-					"ON CONFLICT "+
-					"DO NOTHING;").
-					WithArgs(fileID, di).WillReturnResult(success)
+		return testDb.MapFilesToDataset("dataset", []string{"aid1"})
+	})
 
-			}
-			mock.ExpectCommit()
+	assert.NotZero(t, buf.Len(), "Expected warning missing")
+	assert.NotNil(t, r, "MapFilesToDataset did not fail as expected")
 
-			err := testDb.MapFilesToDataset(di, acs)
+	// Files can not be added to a released dataset
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
-			if !assert.Nil(t, err, "MapFilesToDataset failed unexpectedly") {
-				return err
-			}
-		}
+		mock.ExpectBegin()
+		mock.ExpectExec(register).WithArgs("dataset1").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(lockDataset).WithArgs("dataset1").WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(DatasetReleased))
+		mock.ExpectRollback()
+
+		return testDb.MapFilesToDataset("dataset1", []string{"aid1"})
+	})
+
+	assert.EqualError(t, r, "dataset dataset1 can not be mapped: dataset is released")
+
+	log.SetOutput(os.Stdout)
+}
+
+func TestGetArchived(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery("SELECT archive_path, archive_filesize from local_ega.files WHERE " +
+			"id = \\$1 and status in \\('COMPLETED', 'READY'\\);").
+			WithArgs(12).
+			WillReturnRows(sqlmock.NewRows([]string{"archive_path", "archive_filesize"}).AddRow("archive-uuid", 1000))
+
+		filePath, fileSize, err := testDb.GetArchived(12)
+
+		assert.Equal(t, "archive-uuid", filePath, "did not get expected archive path")
+		assert.Equal(t, 1000, fileSize, "did not get expected archive size")
+
+		return err
+	})
+
+	assert.Nil(t, r, "GetArchived failed unexpectedly")
+}
+
+func TestGetFileIDByChecksums(t *testing.T) {
+	const query = "SELECT f.id, c.type, c.checksum from local_ega.files f " +
+		"JOIN local_ega.checksums c ON c.file_id = f.id WHERE " +
+		"f.elixir_id = \\$1 and f.inbox_path = \\$2 and c.source = 'DECRYPTED' " +
+		"ORDER BY f.id DESC;"
+
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "type", "checksum"}).
+			AddRow(14, "sha256", "newer").
+			AddRow(14, "md5", "newer-md5").
+			AddRow(12, "sha256", "checksum").
+			AddRow(12, "md5", "checksum-md5")
+	}
+
+	// Only the algorithms stored for a file are compared
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery(query).
+			WithArgs("nobody", "/tmp/file.c4gh").
+			WillReturnRows(rows())
+
+		fileID, err := testDb.GetFileIDByChecksums("nobody", "/tmp/file.c4gh", []Checksum{{"sha256", "checksum"}, {"sha512", "unknown"}})
+
+		assert.Equal(t, int64(12), fileID, "did not get expected file id")
 
-		var buf bytes.Buffer
-		log.SetOutput(&buf)
+		return err
+	})
+
+	assert.Nil(t, r, "GetFileIDByChecksums failed unexpectedly")
+
+	// A single mismatching checksum rules out the file
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery(query).
+			WithArgs("nobody", "/tmp/file.c4gh").
+			WillReturnRows(rows())
+
+		_, err := testDb.GetFileIDByChecksums("nobody", "/tmp/file.c4gh", []Checksum{{"sha256", "checksum"}, {"md5", "newer-md5"}})
+
+		return err
+	})
+
+	assert.Equal(t, sql.ErrNoRows, r, "GetFileIDByChecksums did not fail as expected")
+
+	// Checksums of algorithms not stored do not identify a file
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery(query).
+			WithArgs("nobody", "/tmp/file.c4gh").
+			WillReturnRows(rows())
+
+		_, err := testDb.GetFileIDByChecksums("nobody", "/tmp/file.c4gh", []Checksum{{"sha512", "checksum"}})
+
+		return err
+	})
+
+	assert.Equal(t, sql.ErrNoRows, r, "GetFileIDByChecksums did not fail as expected")
+}
+
+func TestAddChecksums(t *testing.T) {
+	const add = "INSERT INTO local_ega.checksums\\(file_id, source, type, checksum\\) " +
+		"VALUES\\(\\$1, \\$2, \\$3, \\$4\\) ON CONFLICT \\(file_id, source, type\\) " +
+		"DO UPDATE SET checksum = EXCLUDED.checksum;"
+
+	success := sqlmock.NewResult(1, 1)
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
 		mock.ExpectBegin()
-		mock.ExpectQuery("SELECT file_id FROM local_ega.archive_files WHERE stable_id = \\$1").
-			WithArgs("aid1").WillReturnError(fmt.Errorf("error for testing"))
-		mock.ExpectRollback().WillReturnError(fmt.Errorf("error again"))
+		mock.ExpectExec(add).WithArgs(12, SourceDecrypted, "sha256", "checksum").WillReturnResult(success)
+		mock.ExpectExec(add).WithArgs(12, SourceDecrypted, "md5", "checksum-md5").WillReturnResult(success)
+		mock.ExpectCommit()
+
+		return testDb.AddChecksums(12, SourceDecrypted, []Checksum{{"sha256", "checksum"}, {"md5", "checksum-md5"}})
+	})
+
+	assert.Nil(t, r, "AddChecksums failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		return testDb.AddChecksums(12, SourceDecrypted, []Checksum{{"crc32", "checksum"}})
+	})
+
+	assert.EqualError(t, r, "unsupported checksum type crc32")
+}
+
+func TestGetChecksums(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery("SELECT type, checksum from local_ega.checksums WHERE "+
+			"file_id = \\$1 and source = \\$2 ORDER BY type;").
+			WithArgs(12, SourceArchive).
+			WillReturnRows(sqlmock.NewRows([]string{"type", "checksum"}).AddRow("sha256", "checksum"))
 
-		err := testDb.MapFilesToDataset("dataset", []string{"aid1"})
+		checksums, err := testDb.GetChecksums(12, SourceArchive)
 
-		assert.NotZero(t, buf.Len(), "Expected warning missing")
-		assert.NotNil(t, err, "MapFilesToDataset did not fail as expected")
+		assert.Equal(t, []Checksum{{"sha256", "checksum"}}, checksums, "did not get expected checksums")
 
-		buf.Reset()
+		return err
+	})
+
+	assert.Nil(t, r, "GetChecksums failed unexpectedly")
+}
+
+func TestSetError(t *testing.T) {
+	const setError = "UPDATE local_ega.files SET status = 'ERROR' WHERE id = \\$1;"
+	const event = "INSERT INTO local_ega.file_event_log\\(file_id, event, correlation_id, service, details\\) " +
+		"VALUES\\(\\$1, \\$2, \\$3, \\$4, \\$5\\);"
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
 		mock.ExpectBegin()
-		mock.ExpectQuery("SELECT file_id FROM local_ega.archive_files WHERE stable_id = \\$1").
-			WithArgs("aid1").WillReturnRows(sqlmock.NewRows([]string{"file_id"}).AddRow(100))
+		mock.ExpectQuery(lockStatus).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileArchived))
+		mock.ExpectExec(setError).
+			WithArgs(10).
+			WillReturnResult(sqlmock.NewResult(10, 1))
+		mock.ExpectExec(event).
+			WithArgs(10, FileError, "corr-id", "verify", `{"reason":"decryption failed"}`).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		return testDb.SetError(10, "corr-id", "verify", "decryption failed")
+	})
 
-		mock.ExpectExec("INSERT INTO local_ega_ebi.filedataset "+
-			"\\(file_id, dataset_stable_id\\) "+
-			"VALUES \\(\\$1, \\$2\\) "+
-			"ON CONFLICT "+
-			"DO NOTHING;").
-			WithArgs(100, "dataset").WillReturnError(fmt.Errorf("error for testing"))
+	assert.Nil(t, r, "SetError failed unexpectedly")
 
-		mock.ExpectRollback().WillReturnError(fmt.Errorf("error again"))
+	// A file that already is errored is left as it is
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
-		err = testDb.MapFilesToDataset("dataset", []string{"aid1"})
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockStatus).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileError))
+		mock.ExpectRollback()
 
-		assert.NotZero(t, buf.Len(), "Expected warning missing")
-		assert.NotNil(t, err, "MapFilesToDataset did not fail as expected")
+		return testDb.SetError(10, "corr-id", "verify", "decryption failed")
+	})
 
-		log.SetOutput(os.Stdout)
+	assert.Nil(t, r, "SetError refused a file that already is errored")
 
-		return nil
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockStatus).
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(FileReady))
+		mock.ExpectRollback()
+
+		return testDb.SetError(10, "corr-id", "verify", "decryption failed")
+	})
+
+	assert.True(t, IsTransitionError(r), "SetError did not refuse a ready file")
+
+	log.SetOutput(os.Stdout)
+}
+
+func TestUpdateFileEventLog(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectExec("INSERT INTO local_ega.file_event_log\\(file_id, event, correlation_id, service, details\\) "+
+			"VALUES\\(\\$1, \\$2, \\$3, \\$4, \\$5\\);").
+			WithArgs(42, FileArchived, "corr-id", "ingest", `{"archive_path":"uuid"}`).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+
+		return testDb.UpdateFileEventLog(42, FileArchived, "corr-id", "ingest", map[string]string{"archive_path": "uuid"})
+	})
+
+	assert.Nil(t, r, "UpdateFileEventLog failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectExec("INSERT INTO local_ega.file_event_log\\(file_id, event, correlation_id, service, details\\) "+
+			"VALUES\\(\\$1, \\$2, \\$3, \\$4, \\$5\\);").
+			WithArgs(42, FileInit, "corr-id", "ingest", "{}").
+			WillReturnError(fmt.Errorf("error for testing"))
+
+		return testDb.UpdateFileEventLog(42, FileInit, "corr-id", "ingest", nil)
+	})
+
+	assert.NotNil(t, r, "UpdateFileEventLog did not fail as expected")
+}
+
+func TestGetFileEventLog(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		now := time.Now()
+		mock.ExpectQuery("SELECT file_id, event, correlation_id, service, details, created_at " +
+			"from local_ega.file_event_log WHERE file_id = \\$1 ORDER BY created_at, id;").
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"file_id", "event", "correlation_id", "service", "details", "created_at"}).
+				AddRow(42, FileInit, "corr-id", "ingest", []byte("{}"), now).
+				AddRow(42, FileArchived, nil, "ingest", []byte(`{"archive_path":"uuid"}`), now))
+
+		events, err := testDb.GetFileEventLog(42)
+
+		assert.Len(t, events, 2, "did not get expected number of events")
+		assert.Equal(t, FileEvent{42, FileInit, "corr-id", "ingest", map[string]string{}, now}, events[0])
+		assert.Equal(t, FileEvent{42, FileArchived, "", "ingest", map[string]string{"archive_path": "uuid"}, now}, events[1])
+
+		return err
 	})
 
-	assert.Nil(t, r, "Tests for MapFilesToDataset failed unexpectedly")
+	assert.Nil(t, r, "GetFileEventLog failed unexpectedly")
 }
 
 func TestClose(t *testing.T) {
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+// GetEditList returns the crypt4gh data edit list recorded for a file, nil
+// is returned for files without one
+func (dbs *SQLdb) GetEditList(fileID int64) ([]uint64, error) {
+	var (
+		editList []uint64 = nil
+		err      error    = nil
+		count    int      = 0
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		editList, err = dbs.getEditList(fileID)
+		count++
+	}
+	return editList, err
+}
+
+// getEditList performs actual work for GetEditList
+func (dbs *SQLdb) getEditList(fileID int64) ([]uint64, error) {
+	db := dbs.checkAndReconnectIfNeeded()
+	const query = "SELECT lengths FROM local_ega.file_edit_lists WHERE file_id = $1;"
+
+	return scanEditList(db.QueryRow(query, fileID))
+}
+
+// scanEditList reads an edit list stored as a JSON array, a missing edit
+// list is returned as nil
+func scanEditList(row *sql.Row) ([]uint64, error) {
+	var lengths string
+	err := row.Scan(&lengths)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	var editList []uint64
+	if err := json.Unmarshal([]byte(lengths), &editList); err != nil {
+		return nil, err
+	}
+
+	return editList, nil
+}
+
+// recordEditList records the edit list of the header just stored for a
+// file, the edit list of a reused entry is removed when the new header has
+// none
+func recordEditList(e execer, editListQuery, forgetQuery string, fileID int64, editList []uint64, reused bool) error {
+	switch {
+	case editList != nil:
+		lengths, err := json.Marshal(editList)
+		if err != nil {
+			return err
+		}
+		_, err = e.Exec(editListQuery, fileID, string(lengths))
+
+		return err
+	case reused:
+		_, err := e.Exec(forgetQuery, fileID)
+
+		return err
+	}
+
+	return nil
+}
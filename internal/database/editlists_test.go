@@ -0,0 +1,43 @@
+package database
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetEditList(t *testing.T) {
+	const query = "SELECT lengths FROM local_ega.file_edit_lists WHERE file_id = \\$1;"
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery(query).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"lengths"}).AddRow("[5, 10]"))
+		mock.ExpectQuery(query).WithArgs(2).WillReturnError(sql.ErrNoRows)
+
+		editList, err := testDb.GetEditList(1)
+		assert.Equal(t, []uint64{5, 10}, editList, "did not get expected edit list")
+		if err != nil {
+			return err
+		}
+
+		editList, err = testDb.GetEditList(2)
+		assert.Nil(t, editList, "got edit list for file without one")
+
+		return err
+	})
+
+	assert.Nil(t, r, "GetEditList failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery(query).WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"lengths"}).AddRow("not json"))
+
+		_, err := testDb.GetEditList(3)
+
+		return err
+	})
+
+	assert.NotNil(t, r, "GetEditList did not fail on a broken edit list")
+}
@@ -0,0 +1,169 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// EventChannel is the channel the database notifies events on, see
+// dev_utils/db/04_notify.sql
+const EventChannel = "sda_events"
+
+// Types of the events sent by the database
+const (
+	// EventFile is sent when a file is registered or changes status
+	EventFile = "file"
+	// EventDataset is sent when a dataset is registered or changes status
+	EventDataset = "dataset"
+	// EventMapping is sent for every file mapped to a dataset
+	EventMapping = "mapping"
+	// EventUnmapping is sent for every file removed from a dataset
+	EventUnmapping = "unmapping"
+	// EventReconnected is sent after the connection to the database has
+	// been re-established, events sent while disconnected are lost so
+	// consumers should look up the current state again
+	EventReconnected = "reconnected"
+)
+
+// Event is a change in the database as sent on EventChannel, fields that
+// do not apply to the type of event are left empty
+type Event struct {
+	Type           string `json:"type"`
+	FileID         int64  `json:"file_id,omitempty"`
+	AccessionID    string `json:"accession_id,omitempty"`
+	User           string `json:"user,omitempty"`
+	Filepath       string `json:"filepath,omitempty"`
+	DatasetID      string `json:"dataset_id,omitempty"`
+	Status         string `json:"status,omitempty"`
+	PreviousStatus string `json:"previous_status,omitempty"`
+}
+
+// notifier is implemented by *pq.Listener, it is an interface so that the
+// event loop can be tested without a database
+type notifier interface {
+	Listen(channel string) error
+	NotificationChannel() <-chan *pq.Notification
+	Ping() error
+	Close() error
+}
+
+// listenerMinReconnect and listenerMaxReconnect bound the time waited
+// between attempts to re-establish a lost connection
+var (
+	listenerMinReconnect = 10 * time.Second
+	listenerMaxReconnect = time.Minute
+)
+
+// listenerPing is how often an idle connection is checked
+var listenerPing = 90 * time.Second
+
+// Listener receives the events notified by the database
+type Listener struct {
+	events   chan Event
+	notifier notifier
+	done     chan struct{}
+	once     sync.Once
+}
+
+// newNotifier is an internal variable to ease testing
+var newNotifier = func(connInfo string) notifier {
+	return pq.NewListener(connInfo, listenerMinReconnect, listenerMaxReconnect, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventDisconnected:
+			log.Errorf("Lost connection to the database while listening for events: %v", err)
+		case pq.ListenerEventReconnected:
+			log.Infoln("Reconnected to the database, listening for events again")
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.Errorf("Failed to connect to the database to listen for events: %v", err)
+		}
+	})
+}
+
+// NewListener connects to the database and starts listening for events,
+// connections that are lost are re-established until Close is called.
+// Events are only sent by Postgres.
+func NewListener(config DBConf) (*Listener, error) {
+	if config.Type == "sqlite" {
+		return nil, errors.New("database events are not available with sqlite")
+	}
+
+	n := newNotifier(buildConnInfo(config))
+	if err := n.Listen(EventChannel); err != nil {
+		n.Close()
+
+		return nil, err
+	}
+
+	l := &Listener{events: make(chan Event), notifier: n, done: make(chan struct{})}
+	go l.run()
+
+	return l, nil
+}
+
+// Events returns the channel events are delivered on, it is closed when
+// the listener is closed
+func (l *Listener) Events() <-chan Event {
+	return l.events
+}
+
+// Close stops listening for events, closing it again does nothing
+func (l *Listener) Close() {
+	l.once.Do(func() {
+		close(l.done)
+		if err := l.notifier.Close(); err != nil {
+			log.Errorf("failed to close the event listener: %v", err)
+		}
+	})
+}
+
+// run delivers notifications as events until the listener is closed
+func (l *Listener) run() {
+	defer close(l.events)
+
+	ticker := time.NewTicker(listenerPing)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case n := <-l.notifier.NotificationChannel():
+			event, err := parseEvent(n)
+			if err != nil {
+				log.Errorf("failed to parse database event %s: %v", n.Extra, err)
+
+				continue
+			}
+
+			select {
+			case l.events <- event:
+			case <-l.done:
+				return
+			}
+		case <-ticker.C:
+			// A ping makes a connection that is silently gone be noticed
+			// and re-established
+			if err := l.notifier.Ping(); err != nil {
+				log.Errorf("database event listener ping failed: %v", err)
+			}
+		}
+	}
+}
+
+// parseEvent reads the JSON payload of a notification, a nil notification
+// is sent by pq after the connection has been re-established
+func parseEvent(n *pq.Notification) (Event, error) {
+	if n == nil {
+		return Event{Type: EventReconnected}, nil
+	}
+
+	var event Event
+	err := json.Unmarshal([]byte(n.Extra), &event)
+
+	return event, err
+}
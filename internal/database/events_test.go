@@ -0,0 +1,86 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeNotifier struct {
+	channel       string
+	notifications chan *pq.Notification
+	closed        bool
+}
+
+func (f *fakeNotifier) Listen(channel string) error {
+	f.channel = channel
+
+	return nil
+}
+
+func (f *fakeNotifier) NotificationChannel() <-chan *pq.Notification {
+	return f.notifications
+}
+
+func (f *fakeNotifier) Ping() error {
+	return nil
+}
+
+func (f *fakeNotifier) Close() error {
+	f.closed = true
+
+	return nil
+}
+
+func TestParseEvent(t *testing.T) {
+	event, err := parseEvent(&pq.Notification{Channel: EventChannel, Extra: `{"type": "file", "file_id": 1, ` +
+		`"accession_id": null, "user": "dummy", "filepath": "/file.c4gh", "status": "READY", "previous_status": "COMPLETED"}`})
+	assert.NoError(t, err)
+	assert.Equal(t, Event{Type: EventFile, FileID: 1, User: "dummy", Filepath: "/file.c4gh", Status: FileReady, PreviousStatus: FileCompleted}, event)
+
+	event, err = parseEvent(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, EventReconnected, event.Type)
+
+	_, err = parseEvent(&pq.Notification{Channel: EventChannel, Extra: "not json"})
+	assert.Error(t, err)
+}
+
+func TestListener(t *testing.T) {
+	fake := &fakeNotifier{notifications: make(chan *pq.Notification, 3)}
+	original := newNotifier
+	newNotifier = func(connInfo string) notifier { return fake }
+	defer func() { newNotifier = original }()
+
+	l, err := NewListener(DBConf{Host: "localhost", Port: 5432, SslMode: "disable"})
+	require.NoError(t, err)
+	assert.Equal(t, EventChannel, fake.channel)
+
+	fake.notifications <- &pq.Notification{Extra: `{"type": "mapping", "file_id": 2, "accession_id": "EGAF00000000002", "dataset_id": "EGAD00000000001"}`}
+	fake.notifications <- &pq.Notification{Extra: "broken"}
+	fake.notifications <- nil
+
+	for _, expected := range []Event{
+		{Type: EventMapping, FileID: 2, AccessionID: "EGAF00000000002", DatasetID: "EGAD00000000001"},
+		{Type: EventReconnected},
+	} {
+		select {
+		case event := <-l.Events():
+			assert.Equal(t, expected, event)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+	}
+
+	l.Close()
+	assert.True(t, fake.closed)
+	for range l.Events() {
+	}
+	assert.NotPanics(t, l.Close, "closing the listener twice panicked")
+
+	_, err = NewListener(DBConf{Type: "sqlite", Path: "/tmp/sda.db"})
+	assert.Error(t, err)
+}
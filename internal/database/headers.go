@@ -0,0 +1,163 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/hex"
+)
+
+// ListHeaderFiles returns, ordered by id, the ids of up to limit files
+// after afterID that have a header which is not recorded as encrypted to
+// the key identified by keyID. An empty keyID lists all files with a header.
+func (dbs *SQLdb) ListHeaderFiles(keyID string, afterID int64, limit int) ([]int64, error) {
+	var (
+		ids   []int64 = nil
+		err   error   = nil
+		count int     = 0
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		ids, err = dbs.listHeaderFiles(keyID, afterID, limit)
+		count++
+	}
+	return ids, err
+}
+
+// listHeaderFiles performs actual work for ListHeaderFiles
+func (dbs *SQLdb) listHeaderFiles(keyID string, afterID int64, limit int) ([]int64, error) {
+	db := dbs.checkAndReconnectIfNeeded()
+	const query = "SELECT f.id FROM local_ega.files f " +
+		"LEFT JOIN local_ega.file_header_keys k ON k.file_id = f.id " +
+		"WHERE f.header IS NOT NULL and f.id > $1 and (k.key_id IS NULL or k.key_id <> $2) " +
+		"ORDER BY f.id LIMIT $3;"
+
+	rows, err := db.Query(query, afterID, keyID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanIDs(rows)
+}
+
+// scanIDs reads rows holding a single id
+func scanIDs(rows *sql.Rows) ([]int64, error) {
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// GetHeaderKeyID returns the identifier of the key the header of a file is
+// encrypted to, an empty string is returned if no key has been recorded
+func (dbs *SQLdb) GetHeaderKeyID(fileID int64) (string, error) {
+	var (
+		keyID string = ""
+		err   error  = nil
+		count int    = 0
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		keyID, err = dbs.getHeaderKeyID(fileID)
+		count++
+	}
+	return keyID, err
+}
+
+// getHeaderKeyID performs actual work for GetHeaderKeyID
+func (dbs *SQLdb) getHeaderKeyID(fileID int64) (string, error) {
+	db := dbs.checkAndReconnectIfNeeded()
+	const query = "SELECT key_id FROM local_ega.file_header_keys WHERE file_id = $1;"
+
+	return scanKeyID(db.QueryRow(query, fileID))
+}
+
+// scanKeyID reads a key id, a missing key id is returned as empty
+func scanKeyID(row *sql.Row) (string, error) {
+	var keyID string
+	err := row.Scan(&keyID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return keyID, err
+}
+
+// UpdateHeader replaces the header of a file and records the identifier of
+// the key the new header is encrypted to
+func (dbs *SQLdb) UpdateHeader(fileID int64, header []byte, keyID string) error {
+	var (
+		err   error = nil
+		count int   = 0
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		err = dbs.updateHeader(fileID, header, keyID)
+		count++
+	}
+	return err
+}
+
+// updateHeader performs actual work for UpdateHeader
+func (dbs *SQLdb) updateHeader(fileID int64, header []byte, keyID string) error {
+	db := dbs.checkAndReconnectIfNeeded()
+	transaction, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := storeHeaderKey(transaction, storeHeaderQuery, headerKeyQuery, fileID, header, keyID); err != nil {
+		rollback(transaction)
+		return err
+	}
+	return transaction.Commit()
+}
+
+// storeHeaderKey stores header and keyID for a file using the given
+// statements
+func storeHeaderKey(e execer, headerQuery, keyQuery string, fileID int64, header []byte, keyID string) error {
+	result, err := e.Exec(headerQuery, hex.EncodeToString(header), fileID)
+	if err != nil {
+		return err
+	}
+	if err := checkRowsAffected(result); err != nil {
+		return err
+	}
+
+	_, err = e.Exec(keyQuery, fileID, keyID)
+
+	return err
+}
+
+// recordHeaderKey records keyID for the header just stored for a file, the
+// recorded key of a reused entry is removed when keyID is empty
+func recordHeaderKey(e execer, keyQuery, forgetQuery string, fileID int64, keyID string, reused bool) error {
+	var err error
+	switch {
+	case keyID != "":
+		_, err = e.Exec(keyQuery, fileID, keyID)
+	case reused:
+		_, err = e.Exec(forgetQuery, fileID)
+	}
+
+	return err
+}
+
+// checkRowsAffected returns sql.ErrNoRows if the statement did not change
+// any rows
+func checkRowsAffected(result sql.Result) error {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListHeaderFiles(t *testing.T) {
+	const query = "SELECT f.id FROM local_ega.files f " +
+		"LEFT JOIN local_ega.file_header_keys k ON k.file_id = f.id " +
+		"WHERE f.header IS NOT NULL and f.id > \\$1 and \\(k.key_id IS NULL or k.key_id <> \\$2\\) " +
+		"ORDER BY f.id LIMIT \\$3;"
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery(query).
+			WithArgs(10, "key1", 2).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(11).AddRow(14))
+
+		ids, err := testDb.ListHeaderFiles("key1", 10, 2)
+
+		assert.Equal(t, []int64{11, 14}, ids, "did not get expected file ids")
+
+		return err
+	})
+
+	assert.Nil(t, r, "ListHeaderFiles failed unexpectedly")
+}
+
+func TestGetHeaderKeyID(t *testing.T) {
+	const query = "SELECT key_id FROM local_ega.file_header_keys WHERE file_id = \\$1;"
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery(query).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"key_id"}).AddRow("key1"))
+		mock.ExpectQuery(query).WithArgs(2).WillReturnError(sql.ErrNoRows)
+
+		keyID, err := testDb.GetHeaderKeyID(1)
+		assert.Equal(t, "key1", keyID, "did not get expected key id")
+		if err != nil {
+			return err
+		}
+
+		keyID, err = testDb.GetHeaderKeyID(2)
+		assert.Equal(t, "", keyID, "got key id for file without one")
+
+		return err
+	})
+
+	assert.Nil(t, r, "GetHeaderKeyID failed unexpectedly")
+}
+
+func TestUpdateHeader(t *testing.T) {
+	const header = "UPDATE local_ega.files SET header = \\$1 WHERE id = \\$2;"
+	const key = "INSERT INTO local_ega.file_header_keys\\(file_id, key_id\\) VALUES\\(\\$1, \\$2\\) " +
+		"ON CONFLICT \\(file_id\\) DO UPDATE SET key_id = EXCLUDED.key_id, last_modified = now\\(\\);"
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectExec(header).WithArgs("0f40", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(key).WithArgs(1, "key1").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		return testDb.UpdateHeader(1, []byte{15, 64}, "key1")
+	})
+
+	assert.Nil(t, r, "UpdateHeader failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		mock.ExpectExec(header).WithArgs("0f40", 2).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		return testDb.UpdateHeader(2, []byte{15, 64}, "key1")
+	})
+
+	assert.Equal(t, sql.ErrNoRows, r, "UpdateHeader did not fail for a missing file")
+}
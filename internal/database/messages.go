@@ -0,0 +1,106 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+)
+
+// Statuses of a claimed message, a message is processing from the moment
+// it is claimed until it is marked done
+const (
+	MessageProcessing = "processing"
+	MessageDone       = "done"
+)
+
+// claimLease is how long a claimed message is left to the service that
+// claimed it before a copy of the message may be claimed again
+var claimLease = time.Hour
+
+// messageHash returns the hash a message body is stored under
+func messageHash(body []byte) string {
+	h := sha256.Sum256(body)
+
+	return hex.EncodeToString(h[:])
+}
+
+// ClaimMessage records that a service has started working on a message,
+// false is returned if the same message has already been processed to the
+// end or is being worked on. A message is identified by its correlation id,
+// msgType, which names the kind of work done such as the service handling
+// it, and its body. A message that was claimed but never marked done is
+// only claimed again when redelivered is set, since the broker only retries
+// or redelivers a message once the earlier delivery is given up, or once
+// the claim is older than claimLease, e.g. because the service crashed.
+// Copies of a message that are published more than once are skipped while
+// the first one is worked on.
+func (dbs *SQLdb) ClaimMessage(corrID, msgType string, body []byte, redelivered bool) (bool, error) {
+	var (
+		claimed bool  = false
+		err     error = nil
+		count   int   = 0
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		claimed, err = dbs.claimMessage(corrID, msgType, body, redelivered)
+		count++
+	}
+	return claimed, err
+}
+
+// claimMessage performs actual work for ClaimMessage
+func (dbs *SQLdb) claimMessage(corrID, msgType string, body []byte, redelivered bool) (bool, error) {
+	db := dbs.checkAndReconnectIfNeeded()
+	const query = "INSERT INTO local_ega.processed_messages(correlation_id, message_type, body_hash) " +
+		"VALUES($1, $2, $3) ON CONFLICT (correlation_id, message_type, body_hash) " +
+		"DO UPDATE SET attempts = processed_messages.attempts + 1, claimed_at = now() " +
+		"WHERE processed_messages.status = 'processing' " +
+		"and ($4 or processed_messages.claimed_at < now() - $5 * interval '1 second') RETURNING attempts;"
+
+	return claim(db.QueryRow(query, corrID, msgType, messageHash(body), redelivered, claimLease.Seconds()))
+}
+
+// claim reads the outcome of a claim, no row is returned when the message
+// is already done
+func claim(row *sql.Row) (bool, error) {
+	var attempts int
+	err := row.Scan(&attempts)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	return true, nil
+}
+
+// MarkMessageDone records that the work for a claimed message is finished
+// so that redeliveries of it are skipped
+func (dbs *SQLdb) MarkMessageDone(corrID, msgType string, body []byte) error {
+	var (
+		err   error = nil
+		count int   = 0
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		err = dbs.markMessageDone(corrID, msgType, body)
+		count++
+	}
+	return err
+}
+
+// markMessageDone performs actual work for MarkMessageDone
+func (dbs *SQLdb) markMessageDone(corrID, msgType string, body []byte) error {
+	db := dbs.checkAndReconnectIfNeeded()
+	const query = "UPDATE local_ega.processed_messages SET status = 'done', completed_at = now() " +
+		"WHERE correlation_id = $1 and message_type = $2 and body_hash = $3;"
+
+	result, err := db.Exec(query, corrID, msgType, messageHash(body))
+	if err != nil {
+		return err
+	}
+
+	return checkRowsAffected(result)
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+const claimMessage = "INSERT INTO local_ega.processed_messages\\(correlation_id, message_type, body_hash\\) " +
+	"VALUES\\(\\$1, \\$2, \\$3\\) ON CONFLICT \\(correlation_id, message_type, body_hash\\) " +
+	"DO UPDATE SET attempts = processed_messages.attempts \\+ 1, claimed_at = now\\(\\) " +
+	"WHERE processed_messages.status = 'processing' " +
+	"and \\(\\$4 or processed_messages.claimed_at < now\\(\\) - \\$5 \\* interval '1 second'\\) RETURNING attempts;"
+
+func TestClaimMessage(t *testing.T) {
+	body := []byte(`{"type": "ingest"}`)
+	hash := "8b70b08bcef4df97a8e89d57089eabff1077b7509a9f201cf9647cd974704079"
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery(claimMessage).
+			WithArgs("corr-id", "ingestion-trigger", hash, false, claimLease.Seconds()).
+			WillReturnRows(sqlmock.NewRows([]string{"attempts"}).AddRow(1))
+
+		claimed, err := testDb.ClaimMessage("corr-id", "ingestion-trigger", body, false)
+
+		assert.True(t, claimed, "message was not claimed")
+
+		return err
+	})
+
+	assert.Nil(t, r, "ClaimMessage failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery(claimMessage).
+			WithArgs("corr-id", "ingestion-trigger", hash, false, claimLease.Seconds()).
+			WillReturnRows(sqlmock.NewRows([]string{"attempts"}))
+
+		claimed, err := testDb.ClaimMessage("corr-id", "ingestion-trigger", body, false)
+
+		assert.False(t, claimed, "processed or claimed message was claimed again")
+
+		return err
+	})
+
+	assert.Nil(t, r, "ClaimMessage failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery(claimMessage).
+			WithArgs("corr-id", "ingestion-trigger", hash, true, claimLease.Seconds()).
+			WillReturnRows(sqlmock.NewRows([]string{"attempts"}).AddRow(2))
+
+		claimed, err := testDb.ClaimMessage("corr-id", "ingestion-trigger", body, true)
+
+		assert.True(t, claimed, "redelivered message was not claimed")
+
+		return err
+	})
+
+	assert.Nil(t, r, "ClaimMessage failed unexpectedly")
+}
+
+func TestMarkMessageDone(t *testing.T) {
+	const markDone = "UPDATE local_ega.processed_messages SET status = 'done', completed_at = now\\(\\) " +
+		"WHERE correlation_id = \\$1 and message_type = \\$2 and body_hash = \\$3;"
+	body := []byte(`{"type": "ingest"}`)
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectExec(markDone).
+			WithArgs("corr-id", "ingestion-trigger", messageHash(body)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		return testDb.MarkMessageDone("corr-id", "ingestion-trigger", body)
+	})
+
+	assert.Nil(t, r, "MarkMessageDone failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectExec(markDone).
+			WithArgs("corr-id", "ingestion-trigger", messageHash(body)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		return testDb.MarkMessageDone("corr-id", "ingestion-trigger", body)
+	})
+
+	assert.Equal(t, sql.ErrNoRows, r, "MarkMessageDone did not fail for an unclaimed message")
+}
@@ -0,0 +1,164 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// FileFilter selects the files returned by ListFiles, zero valued fields
+// are not used for filtering
+type FileFilter struct {
+	User          string
+	Statuses      []string
+	Dataset       string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+	// Limit is the maximum number of files returned, 0 means no limit
+	Limit  int
+	Offset int
+}
+
+// FileSummary describes a file in the archive as returned by ListFiles
+type FileSummary struct {
+	ID           int64
+	User         string
+	InboxPath    string
+	Status       string
+	AccessionID  string
+	ArchivePath  string
+	CreatedAt    time.Time
+	LastModified time.Time
+}
+
+// ListFiles returns the files matching filter ordered by id
+func (dbs *SQLdb) ListFiles(filter FileFilter) ([]FileSummary, error) {
+	var (
+		files []FileSummary = nil
+		err   error         = nil
+		count int           = 0
+	)
+
+	for count == 0 || (err != nil && count < dbRetryTimes) {
+		files, err = dbs.listFiles(filter)
+		count++
+	}
+	return files, err
+}
+
+// listFiles is the actual function performing work for ListFiles
+func (dbs *SQLdb) listFiles(filter FileFilter) ([]FileSummary, error) {
+	db := dbs.checkAndReconnectIfNeeded()
+	query, args := buildListFilesQuery(filter, postgresFiles)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanFileSummaries(rows)
+}
+
+// scanFileSummaries reads the rows of a ListFiles query
+func scanFileSummaries(rows *sql.Rows) ([]FileSummary, error) {
+	var files []FileSummary
+	for rows.Next() {
+		var (
+			f           FileSummary
+			accessionID sql.NullString
+			archivePath sql.NullString
+		)
+		if err := rows.Scan(&f.ID, &f.User, &f.InboxPath, &f.Status, &accessionID, &archivePath, &f.CreatedAt, &f.LastModified); err != nil {
+			return nil, err
+		}
+		f.AccessionID = accessionID.String
+		f.ArchivePath = archivePath.String
+		files = append(files, f)
+	}
+
+	return files, rows.Err()
+}
+
+// ListStaleFiles returns the files that have been in one of statuses
+// without being updated for longer than age, e.g. files stuck in INIT
+func (dbs *SQLdb) ListStaleFiles(statuses []string, age time.Duration) ([]FileSummary, error) {
+	return dbs.ListFiles(FileFilter{Statuses: statuses, UpdatedBefore: time.Now().Add(-age)})
+}
+
+// filesDialect holds what differs between the databases when listing files
+type filesDialect struct {
+	files       string
+	filedataset string
+	// statusIn is a condition matching any of the statuses given as the
+	// argument returned by statusArg
+	statusIn  string
+	statusArg func(statuses []string) interface{}
+	timeArg   func(t time.Time) interface{}
+}
+
+var postgresFiles = filesDialect{
+	files:       "local_ega.files",
+	filedataset: "local_ega_ebi.filedataset",
+	statusIn:    "f.status = ANY($%d)",
+	statusArg:   func(statuses []string) interface{} { return pq.Array(statuses) },
+	timeArg:     func(t time.Time) interface{} { return t },
+}
+
+// buildListFilesQuery returns the query and arguments for filter
+func buildListFilesQuery(filter FileFilter, dialect filesDialect) (string, []interface{}) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.User != "" {
+		add("f.elixir_id = $%d", filter.User)
+	}
+	if len(filter.Statuses) > 0 {
+		add(dialect.statusIn, dialect.statusArg(filter.Statuses))
+	}
+	if filter.Dataset != "" {
+		add("f.id IN (SELECT file_id FROM "+dialect.filedataset+" WHERE dataset_stable_id = $%d)", filter.Dataset)
+	}
+	if !filter.CreatedAfter.IsZero() {
+		add("f.created_at >= $%d", dialect.timeArg(filter.CreatedAfter))
+	}
+	if !filter.CreatedBefore.IsZero() {
+		add("f.created_at < $%d", dialect.timeArg(filter.CreatedBefore))
+	}
+	if !filter.UpdatedAfter.IsZero() {
+		add("f.last_modified >= $%d", dialect.timeArg(filter.UpdatedAfter))
+	}
+	if !filter.UpdatedBefore.IsZero() {
+		add("f.last_modified < $%d", dialect.timeArg(filter.UpdatedBefore))
+	}
+
+	query := "SELECT f.id, f.elixir_id, f.inbox_path, f.status, f.stable_id, f.archive_path, " +
+		"f.created_at, f.last_modified from " + dialect.files + " f"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " and ")
+	}
+	query += " ORDER BY f.id"
+
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if filter.Offset > 0 {
+		args = append(args, filter.Offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+
+	return query + ";", args
+}
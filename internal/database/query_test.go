@@ -0,0 +1,79 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+const listFiles = "SELECT f.id, f.elixir_id, f.inbox_path, f.status, f.stable_id, f.archive_path, " +
+	"f.created_at, f.last_modified from local_ega.files f"
+
+func TestBuildListFilesQuery(t *testing.T) {
+	query, args := buildListFilesQuery(FileFilter{}, postgresFiles)
+
+	assert.Equal(t, listFiles+" ORDER BY f.id;", query)
+	assert.Empty(t, args)
+
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	updated := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	query, args = buildListFilesQuery(FileFilter{
+		User:          "nobody",
+		Statuses:      []string{FileInit, FileArchived},
+		Dataset:       "dataset1",
+		CreatedAfter:  created,
+		UpdatedBefore: updated,
+		Limit:         10,
+		Offset:        20,
+	}, postgresFiles)
+
+	assert.Equal(t, listFiles+" WHERE f.elixir_id = $1 and f.status = ANY($2) and "+
+		"f.id IN (SELECT file_id FROM local_ega_ebi.filedataset WHERE dataset_stable_id = $3) and "+
+		"f.created_at >= $4 and f.last_modified < $5 ORDER BY f.id LIMIT $6 OFFSET $7;", query)
+	assert.Equal(t, []interface{}{"nobody", pq.Array([]string{FileInit, FileArchived}), "dataset1", created, updated, 10, 20}, args)
+}
+
+func TestListFiles(t *testing.T) {
+	now := time.Now()
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery(listFiles+" WHERE f.elixir_id = \\$1 ORDER BY f.id LIMIT \\$2;").
+			WithArgs("nobody", 2).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "elixir_id", "inbox_path", "status", "stable_id", "archive_path", "created_at", "last_modified"}).
+				AddRow(1, "nobody", "/tmp/file1.c4gh", FileReady, "EGAF00000000001", "archive-uuid", now, now).
+				AddRow(2, "nobody", "/tmp/file2.c4gh", FileInit, nil, nil, now, now))
+
+		files, err := testDb.ListFiles(FileFilter{User: "nobody", Limit: 2})
+
+		assert.Equal(t, []FileSummary{
+			{1, "nobody", "/tmp/file1.c4gh", FileReady, "EGAF00000000001", "archive-uuid", now, now},
+			{2, "nobody", "/tmp/file2.c4gh", FileInit, "", "", now, now},
+		}, files)
+
+		return err
+	})
+
+	assert.Nil(t, r, "ListFiles failed unexpectedly")
+}
+
+func TestListStaleFiles(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery(listFiles+" WHERE f.status = ANY\\(\\$1\\) and f.last_modified < \\$2 ORDER BY f.id;").
+			WithArgs(pq.Array([]string{FileInit, FileArchived}), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "elixir_id", "inbox_path", "status", "stable_id", "archive_path", "created_at", "last_modified"}))
+
+		files, err := testDb.ListStaleFiles([]string{FileInit, FileArchived}, time.Hour)
+
+		assert.Empty(t, files)
+
+		return err
+	})
+
+	assert.Nil(t, r, "ListStaleFiles failed unexpectedly")
+}
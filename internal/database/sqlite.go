@@ -0,0 +1,719 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	// Needed implicitly to enable SQLite driver
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteDB implements Database on a single SQLite file, for isolated
+// installations and tests that can not run the sda-db Postgres image. Only
+// the parts of the sda-db schema used by the pipeline are created.
+type SQLiteDB struct {
+	DB   *sql.DB
+	Path string
+}
+
+// sqliteSchema creates the tables used by the pipeline, the columns follow
+// the names in the sda-db views so that the statements stay recognisable
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS files (
+	id                           INTEGER PRIMARY KEY AUTOINCREMENT,
+	stable_id                    TEXT,
+	elixir_id                    TEXT NOT NULL,
+	inbox_path                   TEXT NOT NULL,
+	inbox_file_extension         TEXT,
+	status                       TEXT NOT NULL DEFAULT 'INIT' CHECK (status IN ('INIT', 'ARCHIVED', 'COMPLETED', 'READY', 'ERROR', 'DISABLED')),
+	header                       TEXT,
+	archive_path                 TEXT,
+	archive_filesize             INTEGER,
+	inbox_file_checksum          TEXT,
+	inbox_file_checksum_type     TEXT,
+	archive_file_checksum        TEXT,
+	archive_file_checksum_type   TEXT,
+	decrypted_file_size          INTEGER,
+	decrypted_file_checksum      TEXT,
+	decrypted_file_checksum_type TEXT,
+	created_at                   DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+	last_modified                DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+CREATE INDEX IF NOT EXISTS files_inbox_idx ON files (elixir_id, inbox_path);
+CREATE INDEX IF NOT EXISTS files_stable_id_idx ON files (stable_id);
+CREATE TRIGGER IF NOT EXISTS files_last_modified AFTER UPDATE ON files BEGIN
+	UPDATE files SET last_modified = strftime('%Y-%m-%d %H:%M:%f', 'now') WHERE id = NEW.id;
+END;
+
+CREATE TABLE IF NOT EXISTS file_event_log (
+	id             INTEGER PRIMARY KEY AUTOINCREMENT,
+	file_id        INTEGER NOT NULL REFERENCES files (id),
+	event          TEXT NOT NULL CHECK (event IN ('INIT', 'ARCHIVED', 'COMPLETED', 'READY', 'ERROR', 'DISABLED')),
+	correlation_id TEXT,
+	service        TEXT NOT NULL,
+	details        TEXT,
+	created_at     DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+CREATE INDEX IF NOT EXISTS file_event_log_file_id_idx ON file_event_log (file_id);
+
+CREATE TABLE IF NOT EXISTS checksums (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	file_id  INTEGER NOT NULL REFERENCES files (id),
+	source   TEXT NOT NULL CHECK (source IN ('INBOX', 'ARCHIVE', 'DECRYPTED')),
+	type     TEXT NOT NULL CHECK (type IN ('md5', 'sha256', 'sha512', 'blake2b')),
+	checksum TEXT NOT NULL,
+	UNIQUE (file_id, source, type)
+);
+
+CREATE TABLE IF NOT EXISTS datasets (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	stable_id     TEXT NOT NULL UNIQUE,
+	status        TEXT NOT NULL DEFAULT 'registered' CHECK (status IN ('registered', 'released', 'deprecated')),
+	created_at    DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+	last_modified DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE TABLE IF NOT EXISTS filedataset (
+	id                INTEGER PRIMARY KEY AUTOINCREMENT,
+	file_id           INTEGER NOT NULL REFERENCES files (id),
+	dataset_stable_id TEXT NOT NULL,
+	UNIQUE (file_id, dataset_stable_id)
+);
+
+CREATE TABLE IF NOT EXISTS file_header_keys (
+	file_id       INTEGER PRIMARY KEY REFERENCES files (id),
+	key_id        TEXT NOT NULL,
+	last_modified DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE TABLE IF NOT EXISTS file_edit_lists (
+	file_id INTEGER PRIMARY KEY REFERENCES files (id),
+	lengths TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS processed_messages (
+	correlation_id TEXT NOT NULL,
+	message_type   TEXT NOT NULL,
+	body_hash      TEXT NOT NULL,
+	status         TEXT NOT NULL DEFAULT 'processing' CHECK (status IN ('processing', 'done')),
+	attempts       INTEGER NOT NULL DEFAULT 1,
+	claimed_at     DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+	completed_at   DATETIME,
+	PRIMARY KEY (correlation_id, message_type, body_hash)
+);
+`
+
+// sqliteTimeFormat is the layout of the timestamps stored by SQLite
+const sqliteTimeFormat = "2006-01-02 15:04:05.000"
+
+const (
+	sqliteFileEventQuery = "INSERT INTO file_event_log(file_id, event, correlation_id, service, details) " +
+		"VALUES($1, $2, $3, $4, $5);"
+	sqliteAddChecksumQuery = "INSERT INTO checksums(file_id, source, type, checksum) " +
+		"VALUES($1, $2, $3, $4) ON CONFLICT (file_id, source, type) " +
+		"DO UPDATE SET checksum = excluded.checksum;"
+	sqliteLockDatasetQuery = "SELECT status FROM datasets WHERE stable_id = $1;"
+	sqliteStoreHeaderQuery = "UPDATE files SET header = $1 WHERE id = $2;"
+	sqliteHeaderKeyQuery   = "INSERT INTO file_header_keys(file_id, key_id) VALUES($1, $2) " +
+		"ON CONFLICT (file_id) DO UPDATE SET key_id = excluded.key_id, " +
+		"last_modified = strftime('%Y-%m-%d %H:%M:%f', 'now');"
+)
+
+var sqliteFiles = filesDialect{
+	files:       "files",
+	filedataset: "filedataset",
+	statusIn:    "f.status IN (SELECT value FROM json_each($%d))",
+	statusArg:   func(statuses []string) interface{} { return jsonArray(statuses) },
+	timeArg:     func(t time.Time) interface{} { return t.UTC().Format(sqliteTimeFormat) },
+}
+
+// NewSQLiteDB opens, and creates if needed, the SQLite database in path
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	log.Debugf("Opening SQLite database %s", path)
+
+	// Transactions take the write lock up front so that the status checks
+	// and the updates that follow can not be interleaved with other writers
+	dsn := path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+	db, err := sqlOpen("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+
+		return nil, err
+	}
+
+	return &SQLiteDB{DB: db, Path: path}, nil
+}
+
+// jsonArray encodes values so that they can be expanded with json_each
+func jsonArray(values []string) string {
+	b, _ := json.Marshal(values)
+
+	return string(b)
+}
+
+// lockStatus verifies that the file may be moved to status to, the
+// transaction already holds the write lock
+func (dbs *SQLiteDB) lockStatus(transaction *sql.Tx, fileID int64, to string) error {
+	const query = "SELECT status FROM files WHERE id = $1;"
+
+	var from string
+	if err := transaction.QueryRow(query, fileID).Scan(&from); err != nil {
+		return err
+	}
+
+	if !ValidTransition(from, to) {
+		return &TransitionError{FileID: fileID, From: from, To: to}
+	}
+
+	return nil
+}
+
+// GetHeader retrieves the file header
+func (dbs *SQLiteDB) GetHeader(fileID int) ([]byte, error) {
+	const query = "SELECT header from files WHERE id = $1;"
+
+	var hexString string
+	if err := dbs.DB.QueryRow(query, fileID).Scan(&hexString); err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(hexString)
+}
+
+// IngestFile registers a file, stores its header and marks it as 'ARCHIVED'
+// in a single transaction, following the same rules as SQLdb.IngestFile
+func (dbs *SQLiteDB) IngestFile(corrID, user, filename string, header []byte, keyID string, file FileInfo) (int64, error) {
+	const previous = "SELECT id, status from files WHERE " +
+		"elixir_id = $1 and inbox_path = $2 and inbox_file_checksum = $3 and status != 'DISABLED' " +
+		"ORDER BY id DESC LIMIT 1;"
+	const disable = "UPDATE files SET status = 'DISABLED' WHERE id = $1;"
+	const insert = "INSERT INTO files(inbox_path, inbox_file_extension, elixir_id, status) " +
+		"VALUES($1, $2, $3, 'INIT');"
+	const forgetHeaderKey = "DELETE FROM file_header_keys WHERE file_id = $1;"
+	const editList = "INSERT INTO file_edit_lists(file_id, lengths) VALUES($1, $2) " +
+		"ON CONFLICT (file_id) DO UPDATE SET lengths = excluded.lengths;"
+	const forgetEditList = "DELETE FROM file_edit_lists WHERE file_id = $1;"
+	const archived = "UPDATE files SET status = 'ARCHIVED', header = $1, archive_path = $2, " +
+		"archive_filesize = $3, inbox_file_checksum = $4, inbox_file_checksum_type = $5 WHERE id = $6;"
+
+	checksum := fmt.Sprintf("%x", file.Checksum.Sum(nil))
+
+	transaction, err := dbs.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		fileID int64
+		status string
+	)
+	err = transaction.QueryRow(previous, user, filename, checksum).Scan(&fileID, &status)
+	switch {
+	case err == sql.ErrNoRows:
+		fileID = 0
+	case err != nil:
+		rollback(transaction)
+		return 0, err
+	case status == FileCompleted || status == FileReady:
+		// The earlier upload has been verified, supersede it
+		if err := dbs.lockStatus(transaction, fileID, FileDisabled); err != nil {
+			rollback(transaction)
+			return 0, err
+		}
+		if _, err := transaction.Exec(disable, fileID); err != nil {
+			rollback(transaction)
+			return 0, err
+		}
+		if err := insertFileEvent(transaction, sqliteFileEventQuery, fileID, FileDisabled, corrID, "ingest", map[string]string{"reason": "superseded by new ingestion"}); err != nil {
+			rollback(transaction)
+			return 0, err
+		}
+		fileID = 0
+	case status != FileArchived:
+		// Reuse the earlier entry
+		if err := dbs.lockStatus(transaction, fileID, FileArchived); err != nil {
+			rollback(transaction)
+			return 0, err
+		}
+	}
+
+	reused := fileID != 0
+	if !reused {
+		result, err := transaction.Exec(insert, filename, strings.Replace(filepath.Ext(filename), ".", "", -1), user)
+		if err != nil {
+			rollback(transaction)
+			return 0, err
+		}
+		if fileID, err = result.LastInsertId(); err != nil {
+			rollback(transaction)
+			return 0, err
+		}
+		if err := insertFileEvent(transaction, sqliteFileEventQuery, fileID, FileInit, corrID, "ingest", map[string]string{"filepath": filename}); err != nil {
+			rollback(transaction)
+			return 0, err
+		}
+	}
+
+	if _, err := transaction.Exec(archived, hex.EncodeToString(header), file.Path, file.Size, checksum, hashType(file.Checksum), fileID); err != nil {
+		rollback(transaction)
+		return 0, err
+	}
+
+	// The submitted header replaces any re-encrypted one of a reused entry
+	if err := recordHeaderKey(transaction, sqliteHeaderKeyQuery, forgetHeaderKey, fileID, keyID, reused); err != nil {
+		rollback(transaction)
+		return 0, err
+	}
+	if err := recordEditList(transaction, editList, forgetEditList, fileID, file.EditList, reused); err != nil {
+		rollback(transaction)
+		return 0, err
+	}
+
+	if err := insertChecksums(transaction, sqliteAddChecksumQuery, fileID, SourceInbox, []Checksum{{"sha256", checksum}}); err != nil {
+		rollback(transaction)
+		return 0, err
+	}
+
+	if err := insertFileEvent(transaction, sqliteFileEventQuery, fileID, FileArchived, corrID, "ingest", map[string]string{"archive_path": file.Path}); err != nil {
+		rollback(transaction)
+		return 0, err
+	}
+
+	if err := transaction.Commit(); err != nil {
+		return 0, err
+	}
+	return fileID, nil
+}
+
+// MarkCompleted marks the file as "COMPLETED" and logs the event, a
+// TransitionError is returned if the file is not "ARCHIVED". Nothing is done
+// if the file already is "COMPLETED".
+func (dbs *SQLiteDB) MarkCompleted(corrID string, file FileInfo, fileID int) error {
+	const completed = "UPDATE files SET status = 'COMPLETED', " +
+		"archive_filesize = $2, " +
+		"archive_file_checksum = $3, " +
+		"archive_file_checksum_type = $4, " +
+		"decrypted_file_size = $5, " +
+		"decrypted_file_checksum = $6, " +
+		"decrypted_file_checksum_type = $7 " +
+		"WHERE id = $1;"
+
+	transaction, err := dbs.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := dbs.lockStatus(transaction, int64(fileID), FileCompleted); err != nil {
+		rollback(transaction)
+		if sameStatus(err) {
+			return nil
+		}
+		return err
+	}
+	if _, err := transaction.Exec(completed,
+		fileID,
+		file.Size,
+		fmt.Sprintf("%x", file.Checksum.Sum(nil)),
+		hashType(file.Checksum),
+		file.DecryptedSize,
+		fmt.Sprintf("%x", file.DecryptedChecksum.Sum(nil)),
+		hashType(file.DecryptedChecksum)); err != nil {
+		rollback(transaction)
+		return err
+	}
+	if err := insertFileEvent(transaction, sqliteFileEventQuery, int64(fileID), FileCompleted, corrID, "verify", map[string]string{"decrypted_checksum": fmt.Sprintf("%x", file.DecryptedChecksum.Sum(nil))}); err != nil {
+		rollback(transaction)
+		return err
+	}
+	return transaction.Commit()
+}
+
+// MarkReady sets the accession id of the file, marks it as "READY" and logs
+// the event, a TransitionError is returned if the file is not "COMPLETED".
+// Nothing is done if the file already is "READY" with accessionID.
+func (dbs *SQLiteDB) MarkReady(corrID, accessionID string, fileID int64) error {
+	const ready = "UPDATE files SET status = 'READY', stable_id = $1 WHERE id = $2;"
+	const stableID = "SELECT stable_id FROM files WHERE id = $1;"
+
+	transaction, err := dbs.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := dbs.lockStatus(transaction, fileID, FileReady); err != nil {
+		if sameStatus(err) {
+			var current sql.NullString
+			if e := transaction.QueryRow(stableID, fileID).Scan(&current); e == nil && current.String == accessionID {
+				rollback(transaction)
+				return nil
+			}
+		}
+		rollback(transaction)
+		return err
+	}
+	if _, err := transaction.Exec(ready, accessionID, fileID); err != nil {
+		rollback(transaction)
+		return err
+	}
+	if err := insertFileEvent(transaction, sqliteFileEventQuery, fileID, FileReady, corrID, "finalize", map[string]string{"accession_id": accessionID}); err != nil {
+		rollback(transaction)
+		return err
+	}
+	return transaction.Commit()
+}
+
+// SetError marks the file as "ERROR" and logs reason in its event log, a
+// TransitionError is returned if the file is "READY" or "DISABLED". Nothing
+// is done if the file already is "ERROR".
+func (dbs *SQLiteDB) SetError(fileID int64, corrID, service, reason string) error {
+	const setError = "UPDATE files SET status = 'ERROR' WHERE id = $1;"
+
+	transaction, err := dbs.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := dbs.lockStatus(transaction, fileID, FileError); err != nil {
+		rollback(transaction)
+		if sameStatus(err) {
+			return nil
+		}
+		return err
+	}
+	if _, err := transaction.Exec(setError, fileID); err != nil {
+		rollback(transaction)
+		return err
+	}
+	if err := insertFileEvent(transaction, sqliteFileEventQuery, fileID, FileError, corrID, service, map[string]string{"reason": reason}); err != nil {
+		rollback(transaction)
+		return err
+	}
+	return transaction.Commit()
+}
+
+// GetArchived retrieves the location and size of archive
+func (dbs *SQLiteDB) GetArchived(fileID int64) (string, int, error) {
+	const query = "SELECT archive_path, archive_filesize from files WHERE " +
+		"id = $1 and status in ('COMPLETED', 'READY');"
+
+	var filePath string
+	var fileSize int
+	if err := dbs.DB.QueryRow(query, fileID).Scan(&filePath, &fileSize); err != nil {
+		return "", 0, err
+	}
+
+	return filePath, fileSize, nil
+}
+
+// GetFileIDByChecksums retrieves the id of the latest file submitted by user
+// with the given inbox path whose decrypted checksums agree with checksums
+func (dbs *SQLiteDB) GetFileIDByChecksums(user, filepath string, checksums []Checksum) (int64, error) {
+	const query = "SELECT f.id, c.type, c.checksum from files f " +
+		"JOIN checksums c ON c.file_id = f.id WHERE " +
+		"f.elixir_id = $1 and f.inbox_path = $2 and c.source = 'DECRYPTED' " +
+		"ORDER BY f.id DESC;"
+
+	rows, err := dbs.DB.Query(query, user, filepath)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	return matchChecksums(rows, checksums)
+}
+
+// AddChecksums stores checksums of the given source for a file, replacing
+// any earlier checksum of the same source and type
+func (dbs *SQLiteDB) AddChecksums(fileID int64, source string, checksums []Checksum) error {
+	if err := validateChecksums(checksums); err != nil {
+		return err
+	}
+
+	transaction, err := dbs.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := insertChecksums(transaction, sqliteAddChecksumQuery, fileID, source, checksums); err != nil {
+		rollback(transaction)
+		return err
+	}
+	return transaction.Commit()
+}
+
+// GetChecksums retrieves the checksums of the given source for a file
+func (dbs *SQLiteDB) GetChecksums(fileID int64, source string) ([]Checksum, error) {
+	const query = "SELECT type, checksum from checksums WHERE " +
+		"file_id = $1 and source = $2 ORDER BY type;"
+
+	rows, err := dbs.DB.Query(query, fileID, source)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanChecksums(rows)
+}
+
+// ListFiles returns the files matching filter ordered by id
+func (dbs *SQLiteDB) ListFiles(filter FileFilter) ([]FileSummary, error) {
+	query, args := buildListFilesQuery(filter, sqliteFiles)
+
+	rows, err := dbs.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanFileSummaries(rows)
+}
+
+// ListStaleFiles returns the files that have been in one of statuses
+// without being updated for longer than age
+func (dbs *SQLiteDB) ListStaleFiles(statuses []string, age time.Duration) ([]FileSummary, error) {
+	return dbs.ListFiles(FileFilter{Statuses: statuses, UpdatedBefore: time.Now().Add(-age)})
+}
+
+// MapFilesToDataset maps a set of files to a dataset, following the same
+// rules as SQLdb.MapFilesToDataset
+func (dbs *SQLiteDB) MapFilesToDataset(datasetID string, accessionIDs []string) error {
+	const register = "INSERT INTO datasets(stable_id, status) VALUES($1, 'registered') " +
+		"ON CONFLICT (stable_id) DO NOTHING;"
+	const getFiles = "SELECT stable_id, id, status FROM files WHERE stable_id IN (SELECT value FROM json_each($1));"
+	const mapping = "INSERT INTO filedataset (file_id, dataset_stable_id) " +
+		"VALUES ($1, $2) ON CONFLICT DO NOTHING;"
+
+	transaction, err := dbs.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := transaction.Exec(register, datasetID); err != nil {
+		rollback(transaction)
+		return err
+	}
+	var status string
+	err = transaction.QueryRow(sqliteLockDatasetQuery, datasetID).Scan(&status)
+	if err := checkDatasetRegistered(datasetID, status, err); err != nil {
+		rollback(transaction)
+		return err
+	}
+
+	rows, err := transaction.Query(getFiles, jsonArray(accessionIDs))
+	if err != nil {
+		rollback(transaction)
+		return err
+	}
+	fileIDs, failed, err := readyFiles(rows, accessionIDs)
+	rows.Close()
+	if err != nil {
+		rollback(transaction)
+		return err
+	}
+	if len(failed) > 0 {
+		rollback(transaction)
+		return &MappingError{DatasetID: datasetID, Failed: failed}
+	}
+
+	for _, accessionID := range accessionIDs {
+		if _, err := transaction.Exec(mapping, fileIDs[accessionID], datasetID); err != nil {
+			rollback(transaction)
+			return err
+		}
+	}
+	return transaction.Commit()
+}
+
+// UnmapFilesFromDataset removes files from a dataset, following the same
+// rules as SQLdb.UnmapFilesFromDataset
+func (dbs *SQLiteDB) UnmapFilesFromDataset(datasetID string, accessionIDs []string) error {
+	const getMapped = "SELECT f.stable_id, f.id FROM filedataset fd " +
+		"JOIN files f ON f.id = fd.file_id " +
+		"WHERE fd.dataset_stable_id = $1 and f.stable_id IN (SELECT value FROM json_each($2));"
+	const unmap = "DELETE FROM filedataset WHERE dataset_stable_id = $1 and file_id = $2;"
+
+	transaction, err := dbs.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	var status string
+	err = transaction.QueryRow(sqliteLockDatasetQuery, datasetID).Scan(&status)
+	if err := checkDatasetRegistered(datasetID, status, err); err != nil {
+		rollback(transaction)
+		return err
+	}
+
+	rows, err := transaction.Query(getMapped, datasetID, jsonArray(accessionIDs))
+	if err != nil {
+		rollback(transaction)
+		return err
+	}
+	fileIDs, failed, err := mappedFiles(rows, accessionIDs)
+	rows.Close()
+	if err != nil {
+		rollback(transaction)
+		return err
+	}
+	if len(failed) > 0 {
+		rollback(transaction)
+		return &MappingError{DatasetID: datasetID, Failed: failed}
+	}
+
+	for _, fileID := range fileIDs {
+		if _, err := transaction.Exec(unmap, datasetID, fileID); err != nil {
+			rollback(transaction)
+			return err
+		}
+	}
+	return transaction.Commit()
+}
+
+// GetDatasetStatus returns the status of a dataset
+func (dbs *SQLiteDB) GetDatasetStatus(datasetID string) (string, error) {
+	var status string
+	if err := dbs.DB.QueryRow(sqliteLockDatasetQuery, datasetID).Scan(&status); err != nil {
+		return "", err
+	}
+
+	return status, nil
+}
+
+// UpdateDatasetStatus moves a dataset to status, a DatasetTransitionError is
+// returned if the dataset can not move to status from its current status.
+// Nothing is done if the dataset already has status.
+func (dbs *SQLiteDB) UpdateDatasetStatus(datasetID, status string) error {
+	const update = "UPDATE datasets SET status = $1, last_modified = strftime('%Y-%m-%d %H:%M:%f', 'now') WHERE stable_id = $2;"
+
+	transaction, err := dbs.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	var from string
+	err = transaction.QueryRow(sqliteLockDatasetQuery, datasetID).Scan(&from)
+	if err := checkDatasetTransition(datasetID, from, status, err); err != nil {
+		rollback(transaction)
+		if sameDatasetStatus(err) {
+			return nil
+		}
+		return err
+	}
+
+	if _, err := transaction.Exec(update, status, datasetID); err != nil {
+		rollback(transaction)
+		return err
+	}
+	return transaction.Commit()
+}
+
+// UpdateFileEventLog appends an event to the log of a file
+func (dbs *SQLiteDB) UpdateFileEventLog(fileID int64, event, corrID, service string, details map[string]string) error {
+	return insertFileEvent(dbs.DB, sqliteFileEventQuery, fileID, event, corrID, service, details)
+}
+
+// GetFileEventLog retrieves all events logged for a file, oldest first
+func (dbs *SQLiteDB) GetFileEventLog(fileID int64) ([]FileEvent, error) {
+	const query = "SELECT file_id, event, correlation_id, service, details, created_at " +
+		"from file_event_log WHERE file_id = $1 ORDER BY created_at, id;"
+
+	rows, err := dbs.DB.Query(query, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanFileEvents(rows)
+}
+
+// ClaimMessage records that a service has started working on a message,
+// false is returned if the same message has already been processed or is
+// being worked on, like SQLdb.ClaimMessage
+func (dbs *SQLiteDB) ClaimMessage(corrID, msgType string, body []byte, redelivered bool) (bool, error) {
+	const query = "INSERT INTO processed_messages(correlation_id, message_type, body_hash) " +
+		"VALUES($1, $2, $3) ON CONFLICT (correlation_id, message_type, body_hash) " +
+		"DO UPDATE SET attempts = processed_messages.attempts + 1, claimed_at = strftime('%Y-%m-%d %H:%M:%f', 'now') " +
+		"WHERE processed_messages.status = 'processing' " +
+		"and ($4 or processed_messages.claimed_at < strftime('%Y-%m-%d %H:%M:%f', 'now', $5)) RETURNING attempts;"
+
+	lease := fmt.Sprintf("-%f seconds", claimLease.Seconds())
+
+	return claim(dbs.DB.QueryRow(query, corrID, msgType, messageHash(body), redelivered, lease))
+}
+
+// MarkMessageDone records that the work for a claimed message is finished
+func (dbs *SQLiteDB) MarkMessageDone(corrID, msgType string, body []byte) error {
+	const query = "UPDATE processed_messages SET status = 'done', completed_at = strftime('%Y-%m-%d %H:%M:%f', 'now') " +
+		"WHERE correlation_id = $1 and message_type = $2 and body_hash = $3;"
+
+	result, err := dbs.DB.Exec(query, corrID, msgType, messageHash(body))
+	if err != nil {
+		return err
+	}
+
+	return checkRowsAffected(result)
+}
+
+// ListHeaderFiles returns, ordered by id, the ids of up to limit files
+// after afterID that have a header which is not recorded as encrypted to
+// the key identified by keyID
+func (dbs *SQLiteDB) ListHeaderFiles(keyID string, afterID int64, limit int) ([]int64, error) {
+	const query = "SELECT f.id FROM files f " +
+		"LEFT JOIN file_header_keys k ON k.file_id = f.id " +
+		"WHERE f.header IS NOT NULL and f.id > $1 and (k.key_id IS NULL or k.key_id <> $2) " +
+		"ORDER BY f.id LIMIT $3;"
+
+	rows, err := dbs.DB.Query(query, afterID, keyID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanIDs(rows)
+}
+
+// GetHeaderKeyID returns the identifier of the key the header of a file is
+// encrypted to, an empty string is returned if no key has been recorded
+func (dbs *SQLiteDB) GetHeaderKeyID(fileID int64) (string, error) {
+	const query = "SELECT key_id FROM file_header_keys WHERE file_id = $1;"
+
+	return scanKeyID(dbs.DB.QueryRow(query, fileID))
+}
+
+// GetEditList returns the crypt4gh data edit list recorded for a file, nil
+// is returned for files without one
+func (dbs *SQLiteDB) GetEditList(fileID int64) ([]uint64, error) {
+	const query = "SELECT lengths FROM file_edit_lists WHERE file_id = $1;"
+
+	return scanEditList(dbs.DB.QueryRow(query, fileID))
+}
+
+// UpdateHeader replaces the header of a file and records the identifier of
+// the key the new header is encrypted to
+func (dbs *SQLiteDB) UpdateHeader(fileID int64, header []byte, keyID string) error {
+	transaction, err := dbs.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := storeHeaderKey(transaction, sqliteStoreHeaderQuery, sqliteHeaderKeyQuery, fileID, header, keyID); err != nil {
+		rollback(transaction)
+		return err
+	}
+	return transaction.Commit()
+}
+
+// Close closes the database
+func (dbs *SQLiteDB) Close() {
+	if err := dbs.DB.Close(); err != nil {
+		log.Errorf("failed to close the database: %s", err)
+	}
+}
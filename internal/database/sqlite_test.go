@@ -0,0 +1,320 @@
+package database
+
+import (
+	"crypto/md5" // #nosec
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSQLiteDB opens a fresh SQLite database in a temporary directory
+func newTestSQLiteDB(t *testing.T) *SQLiteDB {
+	sqlOpen = sql.Open
+
+	dir, err := ioutil.TempDir("", "sqlite")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := NewSQLiteDB(filepath.Join(dir, "sda.db"))
+	require.NoError(t, err)
+	t.Cleanup(db.Close)
+
+	return db
+}
+
+func TestNewDatabase(t *testing.T) {
+	sqlOpen = sql.Open
+
+	dir, err := ioutil.TempDir("", "sqlite")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(DBConf{Type: "sqlite", Path: filepath.Join(dir, "sda.db")})
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.IsType(t, &SQLiteDB{}, db)
+}
+
+func TestSQLiteFileLifecycle(t *testing.T) {
+	db := newTestSQLiteDB(t)
+
+	file := FileInfo{sha256.New(), 1000, "archive-uuid", sha256.New(), 900, nil}
+	_, _ = file.Checksum.Write([]byte("encrypted"))
+	_, _ = file.DecryptedChecksum.Write([]byte("decrypted"))
+	inboxChecksum := fmt.Sprintf("%x", file.Checksum.Sum(nil))
+	decryptedChecksum := fmt.Sprintf("%x", file.DecryptedChecksum.Sum(nil))
+
+	fileID, err := db.IngestFile("corr-id", "nobody", "/tmp/file.c4gh", []byte{15, 64}, "", file)
+	require.NoError(t, err)
+
+	header, err := db.GetHeader(int(fileID))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{15, 64}, header)
+
+	checksums, err := db.GetChecksums(fileID, SourceInbox)
+	assert.NoError(t, err)
+	assert.Equal(t, []Checksum{{"sha256", inboxChecksum}}, checksums)
+
+	// Ingesting the same upload again reuses the entry
+	again, err := db.IngestFile("corr-id", "nobody", "/tmp/file.c4gh", []byte{15, 64}, "", file)
+	assert.NoError(t, err)
+	assert.Equal(t, fileID, again)
+
+	// Files can not skip statuses
+	err = db.MarkReady("corr-id", "EGAF00000000001", fileID)
+	assert.True(t, IsTransitionError(err), "file was made ready before being verified")
+
+	md5hash := md5.New() // #nosec
+	_, _ = md5hash.Write([]byte("decrypted"))
+	assert.NoError(t, db.AddChecksums(fileID, SourceDecrypted, []Checksum{
+		{"sha256", decryptedChecksum},
+		{"md5", fmt.Sprintf("%x", md5hash.Sum(nil))},
+	}))
+	assert.NoError(t, db.MarkCompleted("corr-id", file, int(fileID)))
+	// A redelivered message marks the file completed again
+	assert.NoError(t, db.MarkCompleted("corr-id", file, int(fileID)))
+
+	found, err := db.GetFileIDByChecksums("nobody", "/tmp/file.c4gh", []Checksum{{"sha256", decryptedChecksum}})
+	assert.NoError(t, err)
+	assert.Equal(t, fileID, found)
+
+	_, err = db.GetFileIDByChecksums("nobody", "/tmp/file.c4gh", []Checksum{{"sha256", "wrong"}})
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	assert.NoError(t, db.MarkReady("corr-id", "EGAF00000000001", fileID))
+	assert.NoError(t, db.MarkReady("corr-id", "EGAF00000000001", fileID))
+	err = db.MarkReady("corr-id", "EGAF00000000002", fileID)
+	assert.True(t, IsTransitionError(err), "ready file was given another accession id")
+
+	archivePath, archiveSize, err := db.GetArchived(fileID)
+	assert.NoError(t, err)
+	assert.Equal(t, "archive-uuid", archivePath)
+	assert.Equal(t, 1000, archiveSize)
+
+	events, err := db.GetFileEventLog(fileID)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 5) {
+		assert.Equal(t, FileInit, events[0].Event)
+		assert.Equal(t, FileArchived, events[1].Event)
+		assert.Equal(t, FileCompleted, events[3].Event)
+		assert.Equal(t, map[string]string{"decrypted_checksum": decryptedChecksum}, events[3].Details)
+		assert.Equal(t, FileReady, events[4].Event)
+		assert.Equal(t, "finalize", events[4].Service)
+		assert.Equal(t, map[string]string{"accession_id": "EGAF00000000001"}, events[4].Details)
+		assert.WithinDuration(t, time.Now(), events[4].Timestamp, time.Minute)
+	}
+
+	// A verified upload is superseded when ingested again
+	replaced, err := db.IngestFile("corr-id", "nobody", "/tmp/file.c4gh", []byte{15, 64}, "", file)
+	assert.NoError(t, err)
+	assert.NotEqual(t, fileID, replaced)
+
+	files, err := db.ListFiles(FileFilter{User: "nobody", Statuses: []string{FileDisabled}})
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, fileID, files[0].ID)
+		assert.Equal(t, "EGAF00000000001", files[0].AccessionID)
+	}
+
+	stale, err := db.ListStaleFiles([]string{FileArchived}, time.Hour)
+	assert.NoError(t, err)
+	assert.Empty(t, stale)
+
+	recent, err := db.ListFiles(FileFilter{Statuses: []string{FileArchived}, CreatedAfter: time.Now().Add(-time.Hour), Limit: 10})
+	assert.NoError(t, err)
+	assert.Len(t, recent, 1)
+}
+
+func TestSQLiteSetError(t *testing.T) {
+	db := newTestSQLiteDB(t)
+
+	file := FileInfo{sha256.New(), 1000, "archive-uuid", sha256.New(), 900, nil}
+	fileID, err := db.IngestFile("corr-id", "nobody", "/tmp/file.c4gh", []byte{15, 64}, "", file)
+	require.NoError(t, err)
+
+	assert.NoError(t, db.SetError(fileID, "corr-id", "verify", "decryption failed"))
+	// A redelivered message marks the file as errored again
+	assert.NoError(t, db.SetError(fileID, "corr-id", "verify", "decryption failed"))
+
+	files, err := db.ListFiles(FileFilter{User: "nobody"})
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, FileError, files[0].Status)
+	}
+
+	events, err := db.GetFileEventLog(fileID)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, FileError, events[2].Event)
+		assert.Equal(t, "verify", events[2].Service)
+		assert.Equal(t, map[string]string{"reason": "decryption failed"}, events[2].Details)
+	}
+
+	// An errored file can not be completed until it is ingested again
+	err = db.MarkCompleted("corr-id", file, int(fileID))
+	assert.True(t, IsTransitionError(err), "errored file was completed")
+
+	again, err := db.IngestFile("corr-id", "nobody", "/tmp/file.c4gh", []byte{15, 64}, "", file)
+	assert.NoError(t, err)
+	assert.Equal(t, fileID, again)
+	assert.NoError(t, db.MarkCompleted("corr-id", file, int(fileID)))
+	assert.NoError(t, db.MarkReady("corr-id", "EGAF00000000001", fileID))
+
+	err = db.SetError(fileID, "corr-id", "verify", "decryption failed")
+	assert.True(t, IsTransitionError(err), "ready file was marked as errored")
+}
+
+func TestSQLiteDatasets(t *testing.T) {
+	db := newTestSQLiteDB(t)
+
+	ready := func(accessionID, filename string) {
+		file := FileInfo{sha256.New(), 10, filename, sha256.New(), 5, nil}
+		_, _ = file.Checksum.Write([]byte(filename))
+		fileID, err := db.IngestFile("corr-id", "nobody", filename, []byte{1}, "", file)
+		require.NoError(t, err)
+		require.NoError(t, db.MarkCompleted("corr-id", file, int(fileID)))
+		require.NoError(t, db.MarkReady("corr-id", accessionID, fileID))
+	}
+	ready("EGAF00000000001", "/tmp/file1.c4gh")
+	ready("EGAF00000000002", "/tmp/file2.c4gh")
+
+	err := db.MapFilesToDataset("EGAD00000000001", []string{"EGAF00000000001", "EGAF00000000003"})
+	var mappingError *MappingError
+	if assert.True(t, errors.As(err, &mappingError)) {
+		assert.Equal(t, map[string]string{"EGAF00000000003": "not found"}, mappingError.Failed)
+	}
+
+	assert.NoError(t, db.MapFilesToDataset("EGAD00000000001", []string{"EGAF00000000001", "EGAF00000000002"}))
+
+	files, err := db.ListFiles(FileFilter{Dataset: "EGAD00000000001"})
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	assert.NoError(t, db.UnmapFilesFromDataset("EGAD00000000001", []string{"EGAF00000000002"}))
+	assert.True(t, errors.As(db.UnmapFilesFromDataset("EGAD00000000001", []string{"EGAF00000000002"}), &mappingError))
+
+	assert.NoError(t, db.UpdateDatasetStatus("EGAD00000000001", DatasetReleased))
+	status, err := db.GetDatasetStatus("EGAD00000000001")
+	assert.NoError(t, err)
+	assert.Equal(t, DatasetReleased, status)
+	assert.NoError(t, db.UpdateDatasetStatus("EGAD00000000001", DatasetReleased))
+
+	assert.EqualError(t, db.MapFilesToDataset("EGAD00000000001", []string{"EGAF00000000002"}),
+		"dataset EGAD00000000001 can not be mapped: dataset is released")
+	assert.True(t, IsTransitionError(db.UpdateDatasetStatus("EGAD00000000001", DatasetRegistered)))
+	assert.True(t, IsTransitionError(db.UpdateDatasetStatus("EGAD00000000002", DatasetReleased)))
+}
+
+func TestSQLiteClaimMessage(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	body := []byte(`{"type": "mapping"}`)
+
+	claimed, err := db.ClaimMessage("corr-id", "dataset-mapping", body, false)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	// A copy of the message is not claimed while the lease holds
+	claimed, err = db.ClaimMessage("corr-id", "dataset-mapping", body, false)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+
+	// A message that was never marked done can be claimed again when it is
+	// redelivered
+	claimed, err = db.ClaimMessage("corr-id", "dataset-mapping", body, true)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	// or once the lease has expired
+	_, err = db.DB.Exec("UPDATE processed_messages SET claimed_at = strftime('%Y-%m-%d %H:%M:%f', 'now', '-2 hours');")
+	assert.NoError(t, err)
+	claimed, err = db.ClaimMessage("corr-id", "dataset-mapping", body, false)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	assert.NoError(t, db.MarkMessageDone("corr-id", "dataset-mapping", body))
+
+	claimed, err = db.ClaimMessage("corr-id", "dataset-mapping", body, true)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+
+	claimed, err = db.ClaimMessage("corr-id", "dataset-mapping", []byte(`{"type": "release"}`), false)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	assert.Equal(t, sql.ErrNoRows, db.MarkMessageDone("other-id", "dataset-mapping", body))
+}
+
+func TestSQLiteHeaderKeys(t *testing.T) {
+	db := newTestSQLiteDB(t)
+
+	file := FileInfo{sha256.New(), 10, "archive-uuid", sha256.New(), 5, nil}
+	fileID, err := db.IngestFile("corr-id", "nobody", "/tmp/file.c4gh", []byte{1}, "inbox", file)
+	require.NoError(t, err)
+
+	keyID, err := db.GetHeaderKeyID(fileID)
+	assert.NoError(t, err)
+	assert.Equal(t, "inbox", keyID)
+
+	ids, err := db.ListHeaderFiles("key1", 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{fileID}, ids)
+
+	assert.NoError(t, db.UpdateHeader(fileID, []byte{2}, "key1"))
+
+	header, err := db.GetHeader(int(fileID))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{2}, header)
+
+	keyID, err = db.GetHeaderKeyID(fileID)
+	assert.NoError(t, err)
+	assert.Equal(t, "key1", keyID)
+
+	ids, err = db.ListHeaderFiles("key1", 0, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+
+	ids, err = db.ListHeaderFiles("", 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{fileID}, ids)
+
+	// Ingesting the upload again stores the submitted header
+	_, err = db.IngestFile("corr-id", "nobody", "/tmp/file.c4gh", []byte{1}, "", file)
+	require.NoError(t, err)
+
+	keyID, err = db.GetHeaderKeyID(fileID)
+	assert.NoError(t, err)
+	assert.Equal(t, "", keyID)
+
+	assert.Equal(t, sql.ErrNoRows, db.UpdateHeader(fileID+1, []byte{2}, "key1"))
+}
+
+func TestSQLiteEditLists(t *testing.T) {
+	db := newTestSQLiteDB(t)
+
+	file := FileInfo{sha256.New(), 10, "archive-uuid", sha256.New(), 5, []uint64{5, 10}}
+	fileID, err := db.IngestFile("corr-id", "nobody", "/tmp/file.c4gh", []byte{1}, "", file)
+	require.NoError(t, err)
+
+	editList, err := db.GetEditList(fileID)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{5, 10}, editList)
+
+	// Ingesting the upload again without an edit list removes it
+	file.EditList = nil
+	_, err = db.IngestFile("corr-id", "nobody", "/tmp/file.c4gh", []byte{1}, "", file)
+	require.NoError(t, err)
+
+	editList, err = db.GetEditList(fileID)
+	assert.NoError(t, err)
+	assert.Nil(t, editList)
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fileTransitions lists the statuses a file is allowed to move to from
+// each status, anything not listed here is an illegal transition
+var fileTransitions = map[string][]string{
+	FileInit:      {FileArchived, FileError, FileDisabled},
+	FileArchived:  {FileCompleted, FileError, FileDisabled},
+	FileCompleted: {FileReady, FileError, FileDisabled},
+	FileReady:     {FileDisabled},
+	FileError:     {FileArchived, FileDisabled},
+	FileDisabled:  {},
+}
+
+// TransitionError is returned when an update would move a file to a status
+// that is not allowed from its current status
+type TransitionError struct {
+	FileID int64
+	From   string
+	To     string
+}
+
+// Error returns a description of the illegal transition
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("illegal status transition for file %d from %s to %s", e.FileID, e.From, e.To)
+}
+
+// ValidTransition reports whether a file may move from status from to
+// status to
+func ValidTransition(from, to string) bool {
+	for _, s := range fileTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsTransitionError reports whether err, or any error it wraps, is a
+// TransitionError or a DatasetTransitionError
+func IsTransitionError(err error) bool {
+	var transitionError *TransitionError
+	var datasetTransitionError *DatasetTransitionError
+
+	return errors.As(err, &transitionError) || errors.As(err, &datasetTransitionError)
+}
+
+// sameStatus reports whether err is a TransitionError for a file that
+// already has the status it was to be moved to, i.e. the update was done
+// before and is being redone for a redelivered message
+func sameStatus(err error) bool {
+	var transitionError *TransitionError
+
+	return errors.As(err, &transitionError) && transitionError.From == transitionError.To
+}
+
+// lockFileStatus locks the file for the remainder of the transaction and
+// verifies that it may be moved to status to
+func lockFileStatus(transaction *sql.Tx, fileID int64, to string) error {
+	const query = "SELECT status FROM local_ega.main WHERE id = $1 FOR UPDATE;"
+
+	var from string
+	if err := transaction.QueryRow(query, fileID).Scan(&from); err != nil {
+		return err
+	}
+
+	if !ValidTransition(from, to) {
+		return &TransitionError{FileID: fileID, From: from, To: to}
+	}
+
+	return nil
+}
+
+// rollback aborts the transaction, failures are only logged since the
+// transaction is given up anyway
+func rollback(transaction *sql.Tx) {
+	if err := transaction.Rollback(); err != nil {
+		log.Errorf("failed to rollback the transaction: %s", err)
+	}
+}
@@ -0,0 +1,53 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidTransition(t *testing.T) {
+	allowed := [][2]string{
+		{FileInit, FileArchived},
+		{FileArchived, FileCompleted},
+		{FileCompleted, FileReady},
+		{FileError, FileArchived},
+		{FileReady, FileDisabled},
+	}
+	for _, transition := range allowed {
+		assert.Truef(t, ValidTransition(transition[0], transition[1]),
+			"transition from %s to %s should be allowed", transition[0], transition[1])
+	}
+
+	refused := [][2]string{
+		{FileInit, FileCompleted},
+		{FileInit, FileReady},
+		{FileArchived, FileReady},
+		{FileReady, FileArchived},
+		{FileReady, FileReady},
+		{FileDisabled, FileInit},
+		{"", FileArchived},
+	}
+	for _, transition := range refused {
+		assert.Falsef(t, ValidTransition(transition[0], transition[1]),
+			"transition from %s to %s should be refused", transition[0], transition[1])
+	}
+}
+
+func TestIsTransitionError(t *testing.T) {
+	err := &TransitionError{FileID: 1, From: FileReady, To: FileArchived}
+
+	assert.EqualError(t, err, "illegal status transition for file 1 from READY to ARCHIVED")
+	assert.True(t, IsTransitionError(err))
+	assert.True(t, IsTransitionError(fmt.Errorf("wrapped: %w", err)))
+	assert.False(t, IsTransitionError(fmt.Errorf("error for testing")))
+	assert.False(t, IsTransitionError(nil))
+}
+
+func TestSameStatus(t *testing.T) {
+	assert.True(t, sameStatus(&TransitionError{FileID: 1, From: FileReady, To: FileReady}))
+	assert.True(t, sameStatus(fmt.Errorf("wrapped: %w", &TransitionError{FileID: 1, From: FileCompleted, To: FileCompleted})))
+	assert.False(t, sameStatus(&TransitionError{FileID: 1, From: FileReady, To: FileArchived}))
+	assert.False(t, sameStatus(fmt.Errorf("error for testing")))
+}
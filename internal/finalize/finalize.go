@@ -0,0 +1,395 @@
+// Package finalize handles the messages of the finalize service, which
+// registers the accession ids of ingested files in the database.
+package finalize
+
+import (
+	"encoding/json"
+
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/tracing"
+
+	"github.com/streadway/amqp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// finalize struct that holds the json message data
+type finalize struct {
+	Type               string      `json:"type"`
+	User               string      `json:"user"`
+	Filepath           string      `json:"filepath"`
+	AccessionID        string      `json:"accession_id"`
+	DecryptedChecksums []checksums `json:"decrypted_checksums"`
+}
+
+// Checksums is struct for the checksum type and value
+type checksums struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Completed is struct holding the full message data
+type completed struct {
+	User               string      `json:"user"`
+	Filepath           string      `json:"filepath"`
+	AccessionID        string      `json:"accession_id"`
+	DecryptedChecksums []checksums `json:"decrypted_checksums"`
+	EditList           []uint64    `json:"edit_list,omitempty"`
+}
+
+// Handler returns the function that registers the accession ids in the
+// messages
+func Handler(conf *config.Config, mq broker.Broker, db database.Database) func(amqp.Delivery) {
+	return func(delivered amqp.Delivery) {
+		var message finalize
+
+		log.Debugf("Received a message (corr-id: %s, message: %s)",
+			delivered.CorrelationId,
+			delivered.Body)
+
+		err := mq.ValidateJSON(&delivered,
+			"ingestion-accession",
+			delivered.Body,
+			&message)
+
+		if err != nil {
+			log.Errorf("Validation of incoming message failed "+
+				"(corr-id: %s, error: %v)",
+				delivered.CorrelationId,
+				err)
+			return
+		}
+
+		// we unmarshal the message in the validation step so this is safe to do
+		_ = json.Unmarshal(delivered.Body, &message)
+
+		log.Infof("Received work (corr-id: %s, "+
+			"filepath: %s, "+
+			"user: %s, "+
+			"accessionid: %s, "+
+			"decryptedChecksums: %v)",
+			delivered.CorrelationId,
+			message.Filepath,
+			message.User,
+			message.AccessionID,
+			message.DecryptedChecksums)
+
+		// Skip messages that are redelivered after the work was done, or that
+		// are copies of a message that is being worked on
+		span := tracing.Start(delivered, "database ClaimMessage")
+		claimed, err := db.ClaimMessage(delivered.CorrelationId, "finalize", delivered.Body, broker.Redelivered(delivered))
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to claim message "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				err)
+
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (claim failed) "+
+					"(corr-id: %s, "+
+					"filepath: %s, "+
+					"user: %s, "+
+					"accessionid: %s, error: %v)",
+					delivered.CorrelationId,
+					message.Filepath,
+					message.User,
+					message.AccessionID,
+					e)
+			}
+			return
+		}
+		if !claimed {
+			log.Infof("Message already processed or claimed, skipping "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID)
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed to ack processed message "+
+					"(corr-id: %s, "+
+					"filepath: %s, "+
+					"user: %s, "+
+					"accessionid: %s, error: %v)",
+					delivered.CorrelationId,
+					message.Filepath,
+					message.User,
+					message.AccessionID,
+					err)
+			}
+			return
+		}
+
+		var decryptedChecksums []database.Checksum
+		for _, checksum := range message.DecryptedChecksums {
+			decryptedChecksums = append(decryptedChecksums, database.Checksum{Type: checksum.Type, Value: checksum.Value})
+		}
+
+		span = tracing.Start(delivered, "database GetFileIDByChecksums")
+		fileID, err := db.GetFileIDByChecksums(message.User, message.Filepath, decryptedChecksums)
+		span.End(err)
+		if err != nil {
+			log.Errorf("GetFileIDByChecksums failed "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, "+
+				"decryptedChecksums: %v, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				message.DecryptedChecksums,
+				err)
+
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (GetFileIDByChecksums failed) "+
+					"(corr-id: %s, "+
+					"filepath: %s, "+
+					"user: %s, "+
+					"accessionid: %s, "+
+					"decryptedChecksums: %v, error: %v)",
+					delivered.CorrelationId,
+					message.Filepath,
+					message.User,
+					message.AccessionID,
+					message.DecryptedChecksums,
+					e)
+			}
+			return
+		}
+
+		// Files submitted with a data edit list are reported with it since
+		// the checksums are those of the data that the edit list keeps
+		span = tracing.Start(delivered, "database GetEditList")
+		editList, err := db.GetEditList(fileID)
+		span.End(err)
+		if err != nil {
+			log.Errorf("GetEditList failed "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, "+
+				"decryptedChecksums: %v, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				message.DecryptedChecksums,
+				err)
+
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (GetEditList failed) "+
+					"(corr-id: %s, "+
+					"filepath: %s, "+
+					"user: %s, "+
+					"accessionid: %s, "+
+					"decryptedChecksums: %v, error: %v)",
+					delivered.CorrelationId,
+					message.Filepath,
+					message.User,
+					message.AccessionID,
+					message.DecryptedChecksums,
+					e)
+			}
+			return
+		}
+
+		c := completed{
+			User:               message.User,
+			Filepath:           message.Filepath,
+			AccessionID:        message.AccessionID,
+			DecryptedChecksums: message.DecryptedChecksums,
+			EditList:           editList,
+		}
+
+		completeMsg, _ := json.Marshal(&c)
+
+		err = mq.ValidateOutgoing(&delivered,
+			"ingestion-completion",
+			completeMsg,
+			new(completed))
+
+		if err != nil {
+			log.Errorf("Validation of outgoing message failed "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, "+
+				"decryptedChecksums: %v, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				message.DecryptedChecksums,
+				err)
+
+			return
+		}
+
+		span = tracing.Start(delivered, "database MarkReady")
+		err = db.MarkReady(delivered.CorrelationId, message.AccessionID, fileID)
+		span.End(err)
+		if err != nil {
+			log.Errorf("MarkReady failed "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, "+
+				"decryptedChecksums: %v, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				message.DecryptedChecksums,
+				err)
+
+			if database.IsTransitionError(err) {
+				// The file can not be made ready in its current state, retrying will not help
+				if e := delivered.Nack(false, false); e != nil {
+					log.Errorf("Failed to NAck because of illegal status transition "+
+						"(corr-id: %s, "+
+						"filepath: %s, "+
+						"user: %s, "+
+						"accessionid: %s, "+
+						"decryptedChecksums: %v, error: %v)",
+						delivered.CorrelationId,
+						message.Filepath,
+						message.User,
+						message.AccessionID,
+						message.DecryptedChecksums,
+						e)
+				}
+				// Send the message to an error queue so it can be analyzed.
+				fileError := broker.FileError{
+					User:     message.User,
+					FilePath: message.Filepath,
+					Reason:   err.Error(),
+				}
+				body, _ := json.Marshal(fileError)
+				if e := mq.SendMessageFor(delivered, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
+					log.Errorf("Failed to publish illegal status transition error message "+
+						"(corr-id: %s, "+
+						"filepath: %s, "+
+						"user: %s, "+
+						"accessionid: %s, "+
+						"decryptedChecksums: %v, error: %v)",
+						delivered.CorrelationId,
+						message.Filepath,
+						message.User,
+						message.AccessionID,
+						message.DecryptedChecksums,
+						e)
+				}
+				return
+			}
+
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (MarkReady failed) "+
+					"(corr-id: %s, "+
+					"filepath: %s, "+
+					"user: %s, "+
+					"accessionid: %s, "+
+					"decryptedChecksums: %v, error: %v)",
+					delivered.CorrelationId,
+					message.Filepath,
+					message.User,
+					message.AccessionID,
+					message.DecryptedChecksums,
+					e)
+			}
+			return
+		}
+
+		log.Infof("Set accession id for file "+
+			"(corr-id: %s, "+
+			"filepath: %s, "+
+			"user: %s, "+
+			"accessionid: %s, "+
+			"decryptedChecksums: %v)",
+			delivered.CorrelationId,
+			message.Filepath,
+			message.User,
+			message.AccessionID,
+			message.DecryptedChecksums)
+
+		log.Debug("Mark ready")
+
+		if err := mq.SendMessageFor(delivered, conf.Broker.Exchange, conf.Broker.RoutingKey, conf.Broker.Durable, completeMsg); err != nil {
+			log.Errorf("Failed to send message for completed "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, "+
+				"decryptedChecksums: %v, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				message.DecryptedChecksums,
+				err)
+
+			// Retry the message so the work is done again
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (send failed) "+
+					"(corr-id: %s, filepath: %s, user: %s, accessionid: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.Filepath,
+					message.User,
+					message.AccessionID,
+					e)
+			}
+
+			return
+		}
+
+		span = tracing.Start(delivered, "database MarkMessageDone")
+		err = db.MarkMessageDone(delivered.CorrelationId, "finalize", delivered.Body)
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to mark message as processed "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				err)
+		}
+
+		if err := delivered.Ack(false); err != nil {
+
+			log.Errorf("Failed to ack message after work completed "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, "+
+				"decryptedChecksums: %v, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				message.DecryptedChecksums,
+				err)
+
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package finalize
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingBroker fails the first message sent to routingKey
+type failingBroker struct {
+	*broker.MemoryBroker
+	routingKey string
+	mu         sync.Mutex
+	failed     bool
+}
+
+func (b *failingBroker) SendMessageFor(delivered amqp.Delivery, exchange, routingKey string, reliable bool, body []byte) error {
+	b.mu.Lock()
+	fail := routingKey == b.routingKey && !b.failed
+	b.failed = b.failed || fail
+	b.mu.Unlock()
+	if fail {
+		return errors.New("connection lost")
+	}
+
+	return b.MemoryBroker.SendMessageFor(delivered, exchange, routingKey, reliable, body)
+}
+
+// TestHandler_SendFailed redelivers a message after the file was made ready
+// but the completion message could not be sent
+func TestHandler_SendFailed(t *testing.T) {
+	db, err := database.NewSQLiteDB(filepath.Join(t.TempDir(), "sda.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	conf := &config.Config{Broker: broker.MQConf{
+		Queue:        "accessionIDs",
+		Exchange:     "sda",
+		RoutingKey:   "completed",
+		RoutingError: "error",
+		SchemaType:   "federated",
+		MaxAttempts:  3,
+	}}
+	memory, err := broker.NewMemoryBroker(conf.Broker)
+	assert.NoError(t, err)
+	defer memory.Close()
+	memory.Bind("accessionIDs", "sda", "accessionIDs")
+	memory.Bind("completed", "sda", "completed")
+	memory.Bind("error", "sda", "error")
+	mq := &failingBroker{MemoryBroker: memory, routingKey: "completed"}
+
+	file := database.FileInfo{Checksum: sha256.New(), Size: 10, Path: "archived", DecryptedChecksum: sha256.New()}
+	fileID, err := db.IngestFile("corr-id", "test", "file.c4gh", []byte("header"), "", file)
+	assert.NoError(t, err)
+	assert.NoError(t, db.MarkCompleted("corr-id", file, int(fileID)))
+	sums := []checksums{
+		{"sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"md5", "d41d8cd98f00b204e9800998ecf8427e"},
+	}
+	assert.NoError(t, db.AddChecksums(fileID, database.SourceDecrypted, []database.Checksum{
+		{Type: sums[0].Type, Value: sums[0].Value},
+		{Type: sums[1].Type, Value: sums[1].Value},
+	}))
+
+	go func() {
+		_ = mq.Consume("accessionIDs", 1, Handler(conf, mq, db))
+	}()
+
+	body, _ := json.Marshal(finalize{
+		Type:               "accession",
+		User:               "test",
+		Filepath:           "file.c4gh",
+		AccessionID:        "EGAF00000000001",
+		DecryptedChecksums: sums,
+	})
+	assert.NoError(t, mq.SendMessage("corr-id", "sda", "accessionIDs", true, body))
+	assert.Eventually(t, func() bool {
+		return mq.Len("completed") == 1 && mq.Len("accessionIDs") == 0 && mq.Unacked() == 0
+	}, 5*time.Second, time.Millisecond)
+
+	assert.Equal(t, 0, mq.Len("error"))
+	assert.Equal(t, 0, mq.Len("accessionIDs.dead-letter"))
+	files, err := db.ListFiles(database.FileFilter{User: "test"})
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, database.FileReady, files[0].Status)
+		assert.Equal(t, "EGAF00000000001", files[0].AccessionID)
+	}
+
+	// The READY event is logged once, with the file
+	events, err := db.GetFileEventLog(fileID)
+	assert.NoError(t, err)
+	ready := 0
+	for _, e := range events {
+		if e.Event == database.FileReady {
+			ready++
+			assert.Equal(t, map[string]string{"accession_id": "EGAF00000000001"}, e.Details)
+		}
+	}
+	assert.Equal(t, 1, ready)
+}
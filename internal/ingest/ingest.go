@@ -0,0 +1,795 @@
+// Package ingest handles the messages of the ingest service, which
+// registers the files uploaded to the inbox in the database with their
+// headers and stores them header-stripped in the archive storage.
+package ingest
+
+import (
+	"bytes"
+	"crypto/md5" // #nosec
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/c4gh"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/storage"
+	"sda-pipeline/internal/tracing"
+
+	"github.com/elixir-oslo/crypt4gh/model/headers"
+	"github.com/elixir-oslo/crypt4gh/streaming"
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type trigger struct {
+	Type               string      `json:"type"`
+	User               string      `json:"user"`
+	Filepath           string      `json:"filepath"`
+	EncryptedChecksums []checksums `json:"encrypted_checksums"`
+}
+
+// archived holds what should go in an message to inform about
+// archival of files
+type archived struct {
+	User               string      `json:"user"`
+	FilePath           string      `json:"filepath"`
+	FileID             int64       `json:"file_id"`
+	ArchivePath        string      `json:"archive_path"`
+	EncryptedChecksums []checksums `json:"encrypted_checksums"`
+	ReVerify           bool        `json:"re_verify"`
+}
+
+type checksums struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// userError holds what should go in a message to inform the submitter
+// that a file was rejected
+type userError struct {
+	User               string      `json:"user"`
+	FilePath           string      `json:"filepath"`
+	Reason             string      `json:"reason"`
+	EncryptedChecksums []checksums `json:"encrypted_checksums,omitempty"`
+}
+
+// Handler returns the function that ingests the files the messages are
+// about, it is run by the workers of the service
+func Handler(conf *config.Config, mq broker.Broker, db database.Database, keyring c4gh.Keyring, archiveKey *[32]byte, archive, inbox storage.Backend) func(amqp.Delivery) {
+	return func(delivered amqp.Delivery) {
+		var message trigger
+
+		log.Debugf("Received a message: %s", delivered.Body)
+
+		err := mq.ValidateJSON(&delivered,
+			"ingestion-trigger",
+			delivered.Body,
+			&message)
+
+		if err != nil {
+			log.Errorf("Validation of incoming message failed "+
+				"(corr-id: %s, error: %v)",
+				delivered.CorrelationId,
+				err)
+			return
+		}
+
+		// we unmarshal the message in the validation step so this is safe to do
+		_ = json.Unmarshal(delivered.Body, &message)
+
+		log.Infof("Received work (corr-id: %s, "+
+			"filepath: %s, "+
+			"user: %s)",
+			delivered.CorrelationId,
+			message.Filepath,
+			message.User)
+
+		// Skip messages that are redelivered after the work was done, or that
+		// are copies of a message that is being worked on
+		span := tracing.Start(delivered, "database ClaimMessage")
+		claimed, err := db.ClaimMessage(delivered.CorrelationId, "ingest", delivered.Body, broker.Redelivered(delivered))
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to claim message "+
+				"(corr-id: %s, user: %s, filepath: %s, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.Filepath,
+				err)
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (claim failed) "+
+					"(corr-id: %s, user: %s, filepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					e)
+			}
+			return
+		}
+		if !claimed {
+			log.Infof("Message already processed or claimed, skipping "+
+				"(corr-id: %s, user: %s, filepath: %s)",
+				delivered.CorrelationId,
+				message.User,
+				message.Filepath)
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed to ack processed message "+
+					"(corr-id: %s, user: %s, filepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					err)
+			}
+			return
+		}
+
+		span = tracing.Start(delivered, "inbox NewFileReader")
+		span.SetAttribute("file.path", message.Filepath)
+		file, err := inbox.NewFileReader(message.Filepath)
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to open file to ingest "+
+				"(corr-id: %s, user: %s, filepath: %s, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.Filepath,
+				err)
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (failed to open file) "+
+					"(corr-id: %s, user: %s, filepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					e)
+			}
+			return
+		}
+
+		span = tracing.Start(delivered, "inbox GetFileSize")
+		span.SetAttribute("file.path", message.Filepath)
+		fileSize, err := inbox.GetFileSize(message.Filepath)
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to get file size of file to ingest "+
+				"(corr-id: %s, user: %s, filepath: %s, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.Filepath,
+				err)
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (failed get file size) "+
+					"(corr-id: %s, user: %s, filepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					e)
+			}
+			// Send the message to an error queue so it can be analyzed.
+			fileError := broker.FileError{
+				User:     message.User,
+				FilePath: message.Filepath,
+				Reason:   err.Error(),
+			}
+			body, _ := json.Marshal(fileError)
+			if e := mq.SendMessageFor(delivered, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
+				log.Errorf("Failed to publish message (get file size error), to error queue "+
+					"(corr-id: %s, user: %s, filepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					e)
+			}
+			// Restart on new message
+			return
+		}
+
+		log.Infof("Got file size "+
+			"(corr-id: %s, user: %s, filepath: %s, filesize: %d)",
+			delivered.CorrelationId,
+			message.User,
+			message.Filepath,
+			fileSize)
+
+		// Create a random uuid as file name
+		archivedFile := uuid.New().String()
+		span = tracing.Start(delivered, "archive NewFileWriter")
+		span.SetAttribute("file.path", archivedFile)
+		dest, err := archive.NewFileWriter(archivedFile)
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to create archive file "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.Filepath,
+				archivedFile,
+				err)
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (archive file crate error) "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					archivedFile,
+					e)
+			}
+			return
+		}
+
+		// 4MiB readbuffer, this must be large enough that we get the entire header and the first 64KiB datablock
+		// Should be made configurable once we have S3 support
+		var bufSize int
+		if bufSize = 4 * 1024 * 1024; conf.Inbox.S3.Chunksize > 4*1024*1024 {
+			bufSize = conf.Inbox.S3.Chunksize
+		}
+		readBuffer := make([]byte, bufSize)
+		sha256hash := sha256.New()
+		md5hash := md5.New() // #nosec
+		var bytesRead int64
+		var byteBuf bytes.Buffer
+		var header []byte
+		var key c4gh.Key
+		var editList []uint64
+
+		copySpan := tracing.Start(delivered, "archive copy")
+		copySpan.SetAttribute("file.path", archivedFile)
+		defer func() { copySpan.End(err) }()
+		for bytesRead < fileSize {
+			i, readErr := io.ReadFull(file, readBuffer)
+			if i == 0 {
+				err = fmt.Errorf("file ended after %d of %d bytes: %v", bytesRead, fileSize, readErr)
+				log.Errorf("Failed to read file to ingest "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					archivedFile,
+					err)
+				// Retry the message after a delay
+				if e := mq.Retry(delivered, err); e != nil {
+					log.Errorf("Failed to retry message (read failed) "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.Filepath,
+						archivedFile,
+						e)
+				}
+				return
+			}
+			// truncate the readbuffer if the file is smaller than the buffer size
+			if i < len(readBuffer) {
+				readBuffer = readBuffer[:i]
+			}
+
+			bytesRead = bytesRead + int64(i)
+
+			h := bytes.NewReader(readBuffer)
+			if _, err = io.Copy(io.MultiWriter(sha256hash, md5hash), h); err != nil {
+				log.Errorf("Copy to hash failed while reading file "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					archivedFile,
+					err)
+				// Retry the message after a delay
+				if e := mq.Retry(delivered, err); e != nil {
+					log.Errorf("Failed to retry message (hash failed) "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.Filepath,
+						archivedFile,
+						e)
+				}
+				return
+			}
+
+			//nolint:nestif
+			if bytesRead <= int64(len(readBuffer)) {
+				span = tracing.Start(delivered, "crypt4gh decrypt header")
+				header, key, editList, err = tryDecrypt(keyring, readBuffer)
+				span.End(err)
+				if err != nil {
+					log.Errorf("Trying to decrypt start of file failed "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.Filepath,
+						archivedFile,
+						err)
+					// The file is not a Crypt4GH file or is encrypted to a key
+					// we do not have, retrying will not help
+					if e := delivered.Nack(false, false); e != nil {
+						log.Errorf("Failed to Nack message (decryption failed) "+
+							"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+							delivered.CorrelationId,
+							message.User,
+							message.Filepath,
+							archivedFile,
+							e)
+					}
+					// Send the message to an error queue so it can be analyzed.
+					fileError := broker.FileError{
+						User:     message.User,
+						FilePath: message.Filepath,
+						Reason:   err.Error(),
+					}
+					body, _ := json.Marshal(fileError)
+					if e := mq.SendMessageFor(delivered, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
+						log.Errorf("Failed to publish message (decryption failed), to error queue "+
+							"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+							delivered.CorrelationId,
+							message.User,
+							message.Filepath,
+							archivedFile,
+							e)
+					}
+					return
+				}
+				log.Debugf("Header decrypted "+
+					"(corr-id: %s, user: %s, filepath: %s, keyid: %s)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					key.ID)
+				if editList != nil {
+					log.Infof("File has a data edit list "+
+						"(corr-id: %s, user: %s, filepath: %s, editlist: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.Filepath,
+						editList)
+				}
+
+				if _, err = byteBuf.Write(readBuffer); err != nil {
+					log.Errorf("Failed to write to read buffer for header read "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.Filepath,
+						archivedFile,
+						err)
+					// Retry the message after a delay
+					if e := mq.Retry(delivered, err); e != nil {
+						log.Errorf("Failed to retry message (buffer write failed) "+
+							"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+							delivered.CorrelationId,
+							message.User,
+							message.Filepath,
+							archivedFile,
+							e)
+					}
+					return
+				}
+
+				// Strip header from buffer
+				h := make([]byte, len(header))
+				if _, err = byteBuf.Read(h); err != nil {
+					log.Errorf("Failed to read buffer for header skip "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.Filepath,
+						archivedFile,
+						err)
+					// Retry the message after a delay
+					if e := mq.Retry(delivered, err); e != nil {
+						log.Errorf("Failed to retry message (buffer read failed) "+
+							"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+							delivered.CorrelationId,
+							message.User,
+							message.Filepath,
+							archivedFile,
+							e)
+					}
+					return
+				}
+
+			} else {
+				if i < len(readBuffer) {
+					readBuffer = readBuffer[:i]
+				}
+				if _, err = byteBuf.Write(readBuffer); err != nil {
+					log.Errorf("Failed to write to read buffer for full read "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.Filepath,
+						archivedFile,
+						err)
+					// Retry the message after a delay
+					if e := mq.Retry(delivered, err); e != nil {
+						log.Errorf("Failed to retry message (buffer write failed) "+
+							"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+							delivered.CorrelationId,
+							message.User,
+							message.Filepath,
+							archivedFile,
+							e)
+					}
+					return
+				}
+			}
+
+			// Write data to file
+			if _, err = byteBuf.WriteTo(dest); err != nil {
+				log.Errorf("Failed to write to archive file "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					archivedFile,
+					err)
+				// Retry the message after a delay
+				if e := mq.Retry(delivered, err); e != nil {
+					log.Errorf("Failed to retry message (archive write failed) "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.Filepath,
+						archivedFile,
+						e)
+				}
+				return
+			}
+		}
+		copySpan.End(nil)
+
+		file.Close()
+		dest.Close()
+
+		fileInfo := database.FileInfo{}
+		fileInfo.Path = archivedFile
+
+		span = tracing.Start(delivered, "archive GetFileSize")
+		span.SetAttribute("file.path", archivedFile)
+		fileInfo.Size, err = archive.GetFileSize(archivedFile)
+		span.End(err)
+
+		if err != nil {
+			log.Errorf("Couldn't get file size from archive for verification "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.Filepath,
+				archivedFile,
+				err)
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (get archived file size failed) "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					archivedFile,
+					e)
+			}
+			return
+		}
+
+		log.Infof("Wrote archived file "+
+			"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, archivedsize: %d)",
+			delivered.CorrelationId,
+			message.User,
+			message.Filepath,
+			archivedFile,
+			fileInfo.Size)
+
+		// The archived file is only kept if it is the file the submitter
+		// uploaded
+		if err := checkChecksums(message.EncryptedChecksums, map[string]hash.Hash{"sha256": sha256hash, "md5": md5hash}); err != nil {
+			log.Errorf("Checksum validation failed "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.Filepath,
+				archivedFile,
+				err)
+
+			if e := archive.RemoveFile(archivedFile); e != nil {
+				log.Errorf("Failed to remove rejected file from archive "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					archivedFile,
+					e)
+			}
+
+			rejected := userError{
+				User:               message.User,
+				FilePath:           message.Filepath,
+				Reason:             err.Error(),
+				EncryptedChecksums: message.EncryptedChecksums,
+			}
+			body, _ := json.Marshal(&rejected)
+
+			if err := mq.ValidateOutgoing(&delivered, "ingestion-user-error", body, new(userError)); err != nil {
+				log.Errorf("Validation of outgoing (ingestion-user-error) failed "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					archivedFile,
+					err)
+
+				// Logging is in ValidateJSON so just restart on new message
+				return
+			}
+
+			// The upload is broken, retrying will not help
+			if e := delivered.Nack(false, false); e != nil {
+				log.Errorf("Failed to Nack message (checksum mismatch) "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					archivedFile,
+					e)
+			}
+
+			// Tell the submitter that the file was rejected
+			if e := mq.SendMessageFor(delivered, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
+				log.Errorf("Failed to publish message (checksum mismatch), to error queue "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					archivedFile,
+					e)
+			}
+			return
+		}
+
+		fileInfo.Checksum = sha256hash
+		fileInfo.EditList = editList
+
+		// The header is stored encrypted to the archive key so that the
+		// widely distributed inbox key does not give access to archived data
+		keyID := key.ID
+		if archiveKey != nil {
+			span = tracing.Start(delivered, "crypt4gh ReencryptHeader")
+			header, err = c4gh.ReencryptHeader(header, key.PrivateKey, *archiveKey)
+			span.End(err)
+			if err != nil {
+				log.Errorf("Failed to re-encrypt header to the archive key "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					archivedFile,
+					err)
+				// Retry the message after a delay
+				if e := mq.Retry(delivered, err); e != nil {
+					log.Errorf("Failed to retry message (re-encrypt header failed) "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.Filepath,
+						archivedFile,
+						e)
+				}
+				return
+			}
+			keyID = c4gh.KeyID(*archiveKey)
+		}
+
+		// Register the file, its header and the archival in one go
+		span = tracing.Start(delivered, "database IngestFile")
+		fileID, err := db.IngestFile(delivered.CorrelationId, message.User, message.Filepath, header, keyID, fileInfo)
+		span.End(err)
+		if err != nil {
+			log.Errorf("IngestFile failed "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.Filepath,
+				archivedFile,
+				err)
+			if database.IsTransitionError(err) {
+				// The file can not be archived in its current state, retrying will not help
+				if e := delivered.Nack(false, false); e != nil {
+					log.Errorf("Failed to Nack message (illegal status transition) "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.Filepath,
+						archivedFile,
+						e)
+				}
+				// Send the message to an error queue so it can be analyzed.
+				fileError := broker.FileError{
+					User:     message.User,
+					FilePath: message.Filepath,
+					Reason:   err.Error(),
+				}
+				body, _ := json.Marshal(fileError)
+				if e := mq.SendMessageFor(delivered, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
+					log.Errorf("Failed to publish message (illegal status transition), to error queue "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.Filepath,
+						archivedFile,
+						e)
+				}
+			} else {
+				// Nothing was registered, retry the message so the ingestion is redone
+				if e := mq.Retry(delivered, err); e != nil {
+					log.Errorf("Failed to retry message (ingestion failed) "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.Filepath,
+						archivedFile,
+						e)
+				}
+			}
+			return
+		}
+
+		log.Infof("File marked as archived "+
+			"(corr-id: %s, user: %s, filepath: %s, archivepath: %s)",
+			delivered.CorrelationId,
+			message.User,
+			message.Filepath,
+			archivedFile)
+
+		// Send message to archived
+		msg := archived{
+			User:        message.User,
+			FilePath:    message.Filepath,
+			FileID:      fileID,
+			ArchivePath: archivedFile,
+			EncryptedChecksums: []checksums{
+				{"sha256", fmt.Sprintf("%x", sha256hash.Sum(nil))},
+			},
+		}
+
+		archivedMsg, _ := json.Marshal(&msg)
+
+		err = mq.ValidateOutgoing(&delivered,
+			"ingestion-verification",
+			archivedMsg,
+			new(archived))
+
+		if err != nil {
+			log.Errorf("Validation of outgoing (archived) message failed "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.Filepath,
+				archivedFile,
+				err)
+
+			// The message was rejected, so the file will not be verified
+			if e := db.SetError(fileID, delivered.CorrelationId, "ingest", err.Error()); e != nil {
+				log.Errorf("Failed to mark file as errored "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					fileID,
+					e)
+			}
+			return
+		}
+
+		if err := mq.SendMessageFor(delivered, conf.Broker.Exchange, conf.Broker.RoutingKey, conf.Broker.Durable, archivedMsg); err != nil {
+			log.Errorf("Sending outgoing (archived) message failed "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.Filepath,
+				archivedFile,
+				err)
+
+			// Retry the message to make sure we have another go
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (send failed) "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					archivedFile,
+					e)
+			}
+
+			return
+		}
+		span = tracing.Start(delivered, "database MarkMessageDone")
+		err = db.MarkMessageDone(delivered.CorrelationId, "ingest", delivered.Body)
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to mark message as processed "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.Filepath,
+				archivedFile,
+				err)
+		}
+		if err := delivered.Ack(false); err != nil {
+			log.Errorf("Failed to ack message for performed work "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.Filepath,
+				archivedFile,
+				err)
+		}
+	}
+}
+
+// tryDecrypt tries to decrypt the start of buf with the keys in keyring and
+// returns the header together with the key that decrypts it and the data
+// edit list of the header, if any.
+func tryDecrypt(keyring c4gh.Keyring, buf []byte) ([]byte, c4gh.Key, []uint64, error) {
+
+	log.Debugln("Try decrypting the first data block")
+	f := bytes.NewReader(buf)
+	header, err := headers.ReadHeader(f)
+	if err != nil {
+		log.Error(err)
+		return nil, c4gh.Key{}, nil, err
+	}
+
+	h, key, err := keyring.DecryptHeader(header)
+	if err != nil {
+		log.Error(err)
+		return nil, c4gh.Key{}, nil, err
+	}
+
+	// The first byte is read ignoring the edit list of the header, the part
+	// it keeps may start beyond the end of buf
+	a := bytes.NewReader(buf)
+	b, err := streaming.NewCrypt4GHReader(a, key.PrivateKey, &headers.DataEditListHeaderPacket{
+		PacketType:    headers.PacketType{PacketType: headers.DataEditList},
+		NumberLengths: 2,
+		Lengths:       []uint64{0, 1},
+	})
+	if err != nil {
+		log.Error(err)
+		return nil, c4gh.Key{}, nil, err
+
+	}
+	_, err = b.ReadByte()
+	if err != nil {
+		log.Error(err)
+		return nil, c4gh.Key{}, nil, err
+	}
+
+	return header, key, c4gh.EditList(h), nil
+}
+
+// checkChecksums compares the checksums supplied by the submitter with the
+// ones calculated while reading the file, computed is keyed by checksum
+// type as named in the messages.
+func checkChecksums(supplied []checksums, computed map[string]hash.Hash) error {
+	for _, c := range supplied {
+		h, ok := computed[c.Type]
+		if !ok {
+			return fmt.Errorf("unsupported checksum type %s", c.Type)
+		}
+
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, c.Value) {
+			return fmt.Errorf("%s checksum mismatch, expected %s but the file has %s", c.Type, c.Value, sum)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package ingest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/c4gh"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/storage"
+
+	"github.com/elixir-oslo/crypt4gh/keys"
+	"github.com/elixir-oslo/crypt4gh/model/headers"
+	"github.com/elixir-oslo/crypt4gh/streaming"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type TestSuite struct {
+	suite.Suite
+}
+
+func TestConfigTestSuite(t *testing.T) {
+	suite.Run(t, new(TestSuite))
+}
+
+func (suite *TestSuite) SetupTest() {
+	viper.Set("log.level", "debug")
+	viper.Set("archive.location", "../../dev_utils")
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+
+	viper.Set("broker.host", "test")
+	viper.Set("broker.port", 123)
+	viper.Set("broker.user", "test")
+	viper.Set("broker.password", "test")
+	viper.Set("broker.queue", "test")
+	viper.Set("broker.routingkey", "test")
+	viper.Set("db.host", "test")
+	viper.Set("db.port", 123)
+	viper.Set("db.user", "test")
+	viper.Set("db.password", "test")
+	viper.Set("db.database", "test")
+}
+
+func (suite *TestSuite) TestTryDecrypt_wrongFile() {
+
+	buf := make([]byte, 1024)
+	file, err := os.Open("../../dev_utils/README.md")
+	assert.NoError(suite.T(), err)
+
+	_, err = io.ReadFull(file, buf)
+	assert.NoError(suite.T(), err)
+
+	keyring, err := config.GetC4GHKeyring()
+	assert.Nil(suite.T(), err)
+
+	b, key, editList, err := tryDecrypt(keyring, buf)
+	assert.Nil(suite.T(), b)
+	assert.Nil(suite.T(), editList)
+	assert.Empty(suite.T(), key.ID)
+	assert.EqualError(suite.T(), err, "not a Crypt4GH file")
+}
+
+func (suite *TestSuite) TestTryDecrypt() {
+
+	buf := make([]byte, 65*1024)
+
+	file, err := os.Open("../../dev_utils/dummy_data.c4gh")
+	assert.NoError(suite.T(), err)
+
+	_, err = io.ReadFull(file, buf)
+	assert.NoError(suite.T(), err)
+
+	keyring, err := config.GetC4GHKeyring()
+	assert.Nil(suite.T(), err)
+
+	data := []byte{99, 114, 121, 112, 116, 52, 103, 104, 1, 0, 0, 0, 1, 0, 0, 0, 108, 0, 0, 0, 0, 0, 0, 0, 106, 241, 64, 122, 188, 116, 101, 107, 137, 19, 167, 211, 35, 196, 191, 211, 11, 247, 200, 202, 53, 159, 116, 174, 53, 53, 122, 206, 242, 157, 197, 7, 55, 153, 226, 7, 236, 93, 2, 43, 38, 1, 52, 5, 133, 255, 8, 37, 101, 229, 95, 191, 245, 182, 205, 187, 190, 107, 18, 160, 208, 161, 158, 243, 37, 162, 25, 248, 182, 35, 68, 50, 94, 34, 200, 210, 106, 142, 130, 228, 95, 5, 63, 77, 206, 225, 12, 14, 196, 187, 158, 70, 109, 82, 83, 241, 57, 220, 212, 190}
+
+	b, key, editList, err := tryDecrypt(keyring, buf)
+	assert.Equal(suite.T(), b, data)
+	assert.Nil(suite.T(), editList)
+	assert.Equal(suite.T(), keyring[0], key)
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *TestSuite) TestTryDecrypt_otherKey() {
+
+	buf := make([]byte, 65*1024)
+
+	file, err := os.Open("../../dev_utils/dummy_data.c4gh")
+	assert.NoError(suite.T(), err)
+
+	_, err = io.ReadFull(file, buf)
+	assert.NoError(suite.T(), err)
+
+	nodeKey, err := config.GetC4GHKey()
+	assert.Nil(suite.T(), err)
+	_, otherKey, err := keys.GenerateKeyPair()
+	assert.Nil(suite.T(), err)
+
+	// The key that decrypts the header is found among the others
+	b, key, _, err := tryDecrypt(c4gh.Keyring{c4gh.NewKey(otherKey, "other"), c4gh.NewKey(*nodeKey, "node")}, buf)
+	assert.NotNil(suite.T(), b)
+	assert.Equal(suite.T(), "node", key.ID)
+	assert.NoError(suite.T(), err)
+
+	b, key, _, err = tryDecrypt(c4gh.Keyring{c4gh.NewKey(otherKey, "other")}, buf)
+	assert.Nil(suite.T(), b)
+	assert.Empty(suite.T(), key.ID)
+	assert.Equal(suite.T(), c4gh.ErrNoMatchingKey, err)
+}
+
+func (suite *TestSuite) TestTryDecrypt_editList() {
+
+	publicKeyFile, err := os.Open("../../dev_utils/c4gh.pub.pem")
+	assert.NoError(suite.T(), err)
+	publicKey, err := keys.ReadPublicKey(publicKeyFile)
+	assert.NoError(suite.T(), err)
+	_, writerKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+
+	// The part of the file that is kept starts beyond the first buffer
+	var file bytes.Buffer
+	w, err := streaming.NewCrypt4GHWriter(&file, writerKey, publicKey, &headers.DataEditListHeaderPacket{
+		PacketType:    headers.PacketType{PacketType: headers.DataEditList},
+		NumberLengths: 2,
+		Lengths:       []uint64{100 * 1024, 10},
+	})
+	assert.NoError(suite.T(), err)
+	_, err = w.Write(make([]byte, 200*1024))
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), w.Close())
+
+	keyring, err := config.GetC4GHKeyring()
+	assert.Nil(suite.T(), err)
+
+	b, _, editList, err := tryDecrypt(keyring, file.Bytes()[:65*1024])
+	assert.NotNil(suite.T(), b)
+	assert.Equal(suite.T(), []uint64{100 * 1024, 10}, editList)
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *TestSuite) TestCheckChecksums() {
+	sha256hash := sha256.New()
+	md5hash := md5.New()
+	for _, h := range []hash.Hash{sha256hash, md5hash} {
+		_, err := h.Write([]byte("data"))
+		assert.NoError(suite.T(), err)
+	}
+	computed := map[string]hash.Hash{"sha256": sha256hash, "md5": md5hash}
+
+	const sha256sum = "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7"
+	const md5sum = "8d777f385d3dfec8815d20f7496026dc"
+
+	assert.NoError(suite.T(), checkChecksums(nil, computed))
+	assert.NoError(suite.T(), checkChecksums([]checksums{{"sha256", sha256sum}, {"md5", strings.ToUpper(md5sum)}}, computed))
+
+	err := checkChecksums([]checksums{{"sha256", sha256sum}, {"md5", "00000000000000000000000000000000"}}, computed)
+	assert.EqualError(suite.T(), err, "md5 checksum mismatch, expected 00000000000000000000000000000000 but the file has "+md5sum)
+
+	err = checkChecksums([]checksums{{"sha1", "abc"}}, computed)
+	assert.EqualError(suite.T(), err, "unsupported checksum type sha1")
+}
+
+// TestHandler_Failed settles the messages that can not be handled, the
+// worker is free for the next message
+func (suite *TestSuite) TestHandler_Failed() {
+	dir := suite.T().TempDir()
+	db, err := database.NewSQLiteDB(filepath.Join(dir, "sda.db"))
+	suite.Require().NoError(err)
+	defer db.Close()
+	backends := make(map[string]storage.Backend)
+	for _, name := range []string{"inbox", "archive"} {
+		var conf storage.Conf
+		conf.Posix.Location = filepath.Join(dir, name)
+		suite.Require().NoError(os.Mkdir(conf.Posix.Location, 0750))
+		backends[name], err = storage.NewBackend(conf)
+		suite.Require().NoError(err)
+	}
+	keyring, err := config.GetC4GHKeyring()
+	suite.Require().NoError(err)
+
+	conf := &config.Config{Broker: broker.MQConf{
+		Queue:        "ingest",
+		Exchange:     "sda",
+		RoutingKey:   "archived",
+		RoutingError: "error",
+		SchemaType:   "federated",
+		MaxAttempts:  3,
+	}}
+	mq, err := broker.NewMemoryBroker(conf.Broker)
+	suite.Require().NoError(err)
+	defer mq.Close()
+	mq.Bind("ingest", "sda", "ingest")
+	mq.Bind("archived", "sda", "archived")
+	mq.Bind("error", "sda", "error")
+	go func() {
+		_ = mq.Consume("ingest", 1, Handler(conf, mq, db, keyring, nil, backends["archive"], backends["inbox"]))
+	}()
+
+	send := func(name string) {
+		body := []byte(`{"type": "ingest", "user": "test", "filepath": "` + name + `"}`)
+		suite.Require().NoError(mq.SendMessage("corr-id-"+name, "sda", "ingest", true, body))
+		suite.Eventually(func() bool {
+			return mq.Len("ingest") == 0 && mq.Unacked() == 0
+		}, 5*time.Second, time.Millisecond)
+	}
+
+	// A missing file is retried until the message is dead-lettered
+	send("missing.c4gh")
+	assert.Equal(suite.T(), 1, mq.Len("ingest.dead-letter"))
+
+	// A file that is not a Crypt4GH file is rejected
+	plain, err := backends["inbox"].NewFileWriter("plain.c4gh")
+	suite.Require().NoError(err)
+	_, err = plain.Write(bytes.Repeat([]byte("data"), 1024))
+	suite.Require().NoError(err)
+	suite.Require().NoError(plain.Close())
+	send("plain.c4gh")
+	assert.Equal(suite.T(), 1, mq.Len("error"))
+	assert.Equal(suite.T(), 0, mq.Len("archived"))
+
+	publicKeyFile, err := os.Open("../../dev_utils/c4gh.pub.pem")
+	suite.Require().NoError(err)
+	publicKey, err := keys.ReadPublicKey(publicKeyFile)
+	suite.Require().NoError(err)
+	_, writerKey, err := keys.GenerateKeyPair()
+	suite.Require().NoError(err)
+	uploaded, err := backends["inbox"].NewFileWriter("file.c4gh")
+	suite.Require().NoError(err)
+	w, err := streaming.NewCrypt4GHWriter(uploaded, writerKey, publicKey, nil)
+	suite.Require().NoError(err)
+	_, err = w.Write([]byte("data"))
+	suite.Require().NoError(err)
+	suite.Require().NoError(w.Close())
+	suite.Require().NoError(uploaded.Close())
+	send("file.c4gh")
+	assert.Equal(suite.T(), 1, mq.Len("archived"))
+}
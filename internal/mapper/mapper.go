@@ -0,0 +1,273 @@
+// Package mapper handles the messages of the mapper service, which maps
+// files to datasets and releases, deprecates and unmaps datasets.
+package mapper
+
+import (
+	"encoding/json"
+	"errors"
+
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/tracing"
+
+	"github.com/streadway/amqp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	msgMapping   string = "mapping"
+	msgUnmapping string = "unmapping"
+	msgRelease   string = "release"
+	msgDeprecate string = "deprecate"
+)
+
+type message struct {
+	Type         string   `json:"type"`
+	DatasetID    string   `json:"dataset_id"`
+	AccessionIDs []string `json:"accession_ids"`
+}
+
+// Handler returns the function that applies the dataset changes in the
+// messages to the database
+func Handler(conf *config.Config, mq broker.Broker, db database.Database) func(amqp.Delivery) {
+	return func(d amqp.Delivery) {
+		log.Debugf("received a message: %s", d.Body)
+
+		// The message type decides the schema, unknown types fail
+		// validation against the mapping schema.
+		var mappings message
+		_ = json.Unmarshal(d.Body, &mappings)
+
+		err := mq.ValidateJSON(&d, schemaFromType(mappings.Type), d.Body, &mappings)
+		if err != nil {
+			log.Errorf("Failed to validate message for work "+
+				"(corr-id: %s, "+
+				"message: %s, "+
+				"error: %v)",
+				d.CorrelationId,
+				d.Body,
+				err)
+
+			return
+		}
+
+		if err := json.Unmarshal(d.Body, &mappings); err != nil {
+			log.Errorf("Failed to unmarshal message for work "+
+				"(corr-id: %s, "+
+				"message: %s, "+
+				"error: %v)",
+				d.CorrelationId,
+				d.Body,
+				err)
+
+			// Nack message so the server gets notified that something is wrong but don't requeue the message
+			if e := d.Nack(false, false); e != nil {
+				log.Errorf("Failed to nack message "+
+					"(corr-id: %s, error: %v)",
+					d.CorrelationId,
+					e)
+			}
+
+			return
+		}
+
+		// Skip messages that are redelivered after the work was done, or that
+		// are copies of a message that is being worked on
+		span := tracing.Start(d, "database ClaimMessage")
+		claimed, err := db.ClaimMessage(d.CorrelationId, "mapper", d.Body, broker.Redelivered(d))
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to claim message "+
+				"(corr-id: %s, "+
+				"datasetid: %s, "+
+				"error: %v)",
+				d.CorrelationId,
+				mappings.DatasetID,
+				err)
+
+			// Retry the message after a delay
+			if e := mq.Retry(d, err); e != nil {
+				log.Errorf("Failed to retry message for work "+
+					"(corr-id: %s, "+
+					"datasetid: %s, "+
+					"error: %v)",
+					d.CorrelationId,
+					mappings.DatasetID,
+					e)
+			}
+
+			return
+		}
+		if !claimed {
+			log.Infof("Message already processed or claimed, skipping "+
+				"(corr-id: %s, "+
+				"datasetid: %s, "+
+				"type: %s)",
+				d.CorrelationId,
+				mappings.DatasetID,
+				mappings.Type)
+			if err := d.Ack(false); err != nil {
+				log.Errorf("Failed to ack processed message "+
+					"(corr-id: %s, "+
+					"datasetid: %s, "+
+					"error: %v)",
+					d.CorrelationId,
+					mappings.DatasetID,
+					err)
+			}
+
+			return
+		}
+
+		span = tracing.Start(d, "database "+mappings.Type)
+		span.SetAttribute("dataset.id", mappings.DatasetID)
+		err = processMessage(db, mappings)
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to process %s message "+
+				"(corr-id: %s, "+
+				"datasetid: %s, "+
+				"accessionids: %v, "+
+				"error: %v)",
+				mappings.Type,
+				d.CorrelationId,
+				mappings.DatasetID,
+				mappings.AccessionIDs,
+				err)
+
+			var mappingError *database.MappingError
+			isMappingError := errors.As(err, &mappingError)
+			if !isMappingError && !database.IsTransitionError(err) {
+				// Retry the message after a delay
+				if e := mq.Retry(d, err); e != nil {
+					log.Errorf("Failed to retry message for work "+
+						"(corr-id: %s, "+
+						"datasetid: %s, "+
+						"accessionids: %v, "+
+						"error: %v)",
+						d.CorrelationId,
+						mappings.DatasetID,
+						mappings.AccessionIDs,
+						e)
+				}
+
+				return
+			}
+
+			// The change is refused, tell why and do not retry.
+			datasetError := broker.DatasetError{
+				DatasetID: mappings.DatasetID,
+				Reason:    err.Error(),
+			}
+			if isMappingError {
+				datasetError.AccessionIDs = mappingError.Failed
+			}
+			body, _ := json.Marshal(datasetError)
+			if e := mq.SendMessageFor(d, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
+				log.Errorf("Failed to publish dataset error message "+
+					"(corr-id: %s, "+
+					"datasetid: %s, "+
+					"accessionids: %v, "+
+					"error: %v)",
+					d.CorrelationId,
+					mappings.DatasetID,
+					mappings.AccessionIDs,
+					e)
+			}
+			if e := d.Nack(false, false); e != nil {
+				log.Errorf("Failed to nack message for work "+
+					"(corr-id: %s, "+
+					"datasetid: %s, "+
+					"accessionids: %v, "+
+					"error: %v)",
+					d.CorrelationId,
+					mappings.DatasetID,
+					mappings.AccessionIDs,
+					e)
+			}
+
+			return
+		}
+
+		switch mappings.Type {
+		case msgRelease, msgDeprecate:
+			log.Infof("Changed dataset status "+
+				"(corr-id: %s, "+
+				"datasetid: %s, "+
+				"type: %s)",
+				d.CorrelationId,
+				mappings.DatasetID,
+				mappings.Type)
+		default:
+			for _, aId := range mappings.AccessionIDs {
+				log.Infof("Changed file mapping "+
+					"(corr-id: %s, "+
+					"datasetid: %s, "+
+					"accessionid: %s, "+
+					"type: %s)",
+					d.CorrelationId,
+					mappings.DatasetID,
+					aId,
+					mappings.Type)
+			}
+		}
+
+		span = tracing.Start(d, "database MarkMessageDone")
+		err = db.MarkMessageDone(d.CorrelationId, "mapper", d.Body)
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to mark message as processed "+
+				"(corr-id: %s, "+
+				"datasetid: %s, "+
+				"error: %v)",
+				d.CorrelationId,
+				mappings.DatasetID,
+				err)
+		}
+
+		if err := d.Ack(false); err != nil {
+			log.Errorf("Failed to ack message for work "+
+				"(corr-id: %s, "+
+				"datasetid: %s, "+
+				"accessionids: %v, "+
+				"error: %v)",
+				d.CorrelationId,
+				mappings.DatasetID,
+				mappings.AccessionIDs,
+				err)
+
+		}
+	}
+}
+
+// schemaFromType returns the schema to use for messages of type msgType
+func schemaFromType(msgType string) string {
+	m := map[string]string{
+		msgMapping:   "dataset-mapping",
+		msgUnmapping: "dataset-unmapping",
+		msgRelease:   "dataset-release",
+		msgDeprecate: "dataset-deprecate",
+	}
+
+	if m[msgType] != "" {
+		return m[msgType]
+	}
+
+	return "dataset-mapping"
+}
+
+// processMessage applies the change requested in m to the database
+func processMessage(db database.Database, m message) error {
+	switch m.Type {
+	case msgUnmapping:
+		return db.UnmapFilesFromDataset(m.DatasetID, m.AccessionIDs)
+	case msgRelease:
+		return db.UpdateDatasetStatus(m.DatasetID, database.DatasetReleased)
+	case msgDeprecate:
+		return db.UpdateDatasetStatus(m.DatasetID, database.DatasetDeprecated)
+	default:
+		return db.MapFilesToDataset(m.DatasetID, m.AccessionIDs)
+	}
+}
@@ -0,0 +1,125 @@
+package mapper
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type TestSuite struct {
+	suite.Suite
+	dir  string
+	db   *database.SQLiteDB
+	mq   *broker.MemoryBroker
+	conf *config.Config
+}
+
+func TestConfigTestSuite(t *testing.T) {
+	suite.Run(t, new(TestSuite))
+}
+
+func (suite *TestSuite) SetupTest() {
+	viper.Set("log.level", "debug")
+
+	var err error
+	suite.dir, err = ioutil.TempDir("", "mapper")
+	suite.Require().NoError(err)
+	suite.db, err = database.NewSQLiteDB(filepath.Join(suite.dir, "sda.db"))
+	suite.Require().NoError(err)
+
+	suite.conf = &config.Config{Broker: broker.MQConf{
+		Queue:        "mappings",
+		Exchange:     "sda",
+		RoutingError: "error",
+		SchemaType:   "federated",
+		MaxAttempts:  3,
+	}}
+	suite.mq, err = broker.NewMemoryBroker(suite.conf.Broker)
+	suite.Require().NoError(err)
+	suite.mq.Bind("mappings", "sda", "mappings")
+	suite.mq.Bind("error", "sda", "error")
+
+	go func() {
+		_ = suite.mq.Consume("mappings", 1, Handler(suite.conf, suite.mq, suite.db))
+	}()
+}
+
+func (suite *TestSuite) TearDownTest() {
+	suite.mq.Close()
+	suite.db.Close()
+	os.RemoveAll(suite.dir)
+}
+
+// ready registers a file that is ready to be mapped with accessionID
+func (suite *TestSuite) ready(accessionID string) {
+	file := database.FileInfo{Checksum: sha256.New(), Size: 10, Path: accessionID, DecryptedChecksum: sha256.New()}
+	fileID, err := suite.db.IngestFile("corr-id", "dummy", accessionID, []byte("header"), "", file)
+	suite.Require().NoError(err)
+	suite.Require().NoError(suite.db.MarkCompleted("corr-id", file, int(fileID)))
+	suite.Require().NoError(suite.db.MarkReady("corr-id", accessionID, fileID))
+}
+
+// send publishes m to the mapper and waits for it to be handled
+func (suite *TestSuite) send(corrID string, m message) {
+	body, _ := json.Marshal(m)
+	suite.Require().NoError(suite.mq.SendMessage(corrID, "sda", "mappings", true, body))
+	suite.Eventually(func() bool {
+		return suite.mq.Len("mappings") == 0 && suite.mq.Unacked() == 0
+	}, 5*time.Second, time.Millisecond)
+}
+
+func (suite *TestSuite) TestSchemaFromType() {
+	assert.Equal(suite.T(), "dataset-mapping", schemaFromType(msgMapping))
+	assert.Equal(suite.T(), "dataset-unmapping", schemaFromType(msgUnmapping))
+	assert.Equal(suite.T(), "dataset-release", schemaFromType(msgRelease))
+	assert.Equal(suite.T(), "dataset-deprecate", schemaFromType(msgDeprecate))
+	assert.Equal(suite.T(), "dataset-mapping", schemaFromType("unknown"))
+}
+
+func (suite *TestSuite) TestHandler() {
+	suite.ready("EGAF00000000001")
+
+	suite.send("corr-id-1", message{Type: msgMapping, DatasetID: "EGAD00000000001", AccessionIDs: []string{"EGAF00000000001"}})
+	status, err := suite.db.GetDatasetStatus("EGAD00000000001")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), database.DatasetRegistered, status)
+
+	suite.send("corr-id-2", message{Type: msgRelease, DatasetID: "EGAD00000000001"})
+	status, err = suite.db.GetDatasetStatus("EGAD00000000001")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), database.DatasetReleased, status)
+	assert.Equal(suite.T(), 0, suite.mq.Len("error"))
+}
+
+func (suite *TestSuite) TestHandler_Refused() {
+	suite.send("corr-id-1", message{Type: msgMapping, DatasetID: "EGAD00000000001", AccessionIDs: []string{"EGAF00000000002"}})
+
+	refused, ok := suite.mq.Get("error")
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), "corr-id-1", refused.CorrelationId)
+
+	var datasetError broker.DatasetError
+	assert.NoError(suite.T(), json.Unmarshal(refused.Body, &datasetError))
+	assert.Equal(suite.T(), "EGAD00000000001", datasetError.DatasetID)
+	assert.Contains(suite.T(), datasetError.AccessionIDs, "EGAF00000000002")
+}
+
+func (suite *TestSuite) TestHandler_Invalid() {
+	suite.send("corr-id-1", message{Type: msgMapping, DatasetID: "dataset"})
+
+	refused, ok := suite.mq.Get("error")
+	assert.True(suite.T(), ok)
+	assert.Contains(suite.T(), string(refused.Body), "Validation of JSON message failed")
+}
@@ -0,0 +1,3 @@
+// Package pipeline holds the tests that run the message handlers of the
+// services together, from a file in the inbox to a file in a dataset.
+package pipeline
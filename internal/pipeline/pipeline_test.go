@@ -0,0 +1,144 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/finalize"
+	"sda-pipeline/internal/ingest"
+	"sda-pipeline/internal/mapper"
+	"sda-pipeline/internal/storage"
+	"sda-pipeline/internal/sync"
+	"sda-pipeline/internal/verify"
+
+	"github.com/elixir-oslo/crypt4gh/keys"
+	"github.com/elixir-oslo/crypt4gh/streaming"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// serviceConf is the configuration of a service that consumes queue and
+// publishes to routingKey
+func serviceConf(queue, routingKey string) *config.Config {
+	return &config.Config{Broker: broker.MQConf{
+		Queue:        queue,
+		Exchange:     "sda",
+		RoutingKey:   routingKey,
+		RoutingError: "error",
+		SchemaType:   "federated",
+		MaxAttempts:  3,
+	}}
+}
+
+// posixBackend creates a posix storage backend in a directory of its own
+func posixBackend(t *testing.T, dir string) storage.Backend {
+	var conf storage.Conf
+	conf.Posix.Location = dir
+	assert.NoError(t, os.MkdirAll(dir, 0750))
+	backend, err := storage.NewBackend(conf)
+	assert.NoError(t, err)
+
+	return backend
+}
+
+// TestPipeline follows a file from the inbox through ingest, verify, sync,
+// finalize and mapper, with the message from the central archive that
+// assigns the accession id sent by the test
+func TestPipeline(t *testing.T) {
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+	defer viper.Reset()
+
+	dir := t.TempDir()
+	db, err := database.NewSQLiteDB(filepath.Join(dir, "sda.db"))
+	assert.NoError(t, err)
+	defer db.Close()
+	inbox := posixBackend(t, filepath.Join(dir, "inbox"))
+	archive := posixBackend(t, filepath.Join(dir, "archive"))
+	backup := posixBackend(t, filepath.Join(dir, "backup"))
+
+	keyring, err := config.GetC4GHKeyring()
+	assert.NoError(t, err)
+
+	// Upload a file encrypted to the key of the node
+	publicKeyFile, err := os.Open("../../dev_utils/c4gh.pub.pem")
+	assert.NoError(t, err)
+	publicKey, err := keys.ReadPublicKey(publicKeyFile)
+	assert.NoError(t, err)
+	_, writerKey, err := keys.GenerateKeyPair()
+	assert.NoError(t, err)
+	uploaded, err := inbox.NewFileWriter("file.c4gh")
+	assert.NoError(t, err)
+	w, err := streaming.NewCrypt4GHWriter(uploaded, writerKey, publicKey, nil)
+	assert.NoError(t, err)
+	_, err = w.Write(bytes.Repeat([]byte("data"), 50*1024))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.NoError(t, uploaded.Close())
+
+	mq, err := broker.NewMemoryBroker(serviceConf("", "").Broker)
+	assert.NoError(t, err)
+	defer mq.Close()
+	for _, queue := range []string{"ingest", "archived", "verified", "backup", "accessionIDs", "completed", "mappings", "error"} {
+		mq.Bind(queue, "sda", queue)
+	}
+
+	go func() {
+		_ = mq.Consume("ingest", 1, ingest.Handler(serviceConf("ingest", "archived"), mq, db, keyring, nil, archive, inbox))
+	}()
+	go func() {
+		_ = mq.Consume("archived", 1, verify.Handler(serviceConf("archived", "verified"), mq, db, archive, keyring))
+	}()
+	go func() {
+		_ = mq.Consume("backup", 1, sync.Handler(serviceConf("backup", "accessionIDs"), mq, db, archive, backup))
+	}()
+	go func() {
+		_ = mq.Consume("accessionIDs", 1, finalize.Handler(serviceConf("accessionIDs", "completed"), mq, db))
+	}()
+	go func() {
+		_ = mq.Consume("mappings", 1, mapper.Handler(serviceConf("mappings", ""), mq, db))
+	}()
+
+	assert.NoError(t, mq.SendMessage("corr-id-1", "sda", "ingest", true, []byte(`{"type": "ingest", "user": "test", "filepath": "file.c4gh"}`)))
+	assert.Eventually(t, func() bool { return mq.Len("verified") == 1 }, 10*time.Second, time.Millisecond)
+
+	verified, _ := mq.Get("verified")
+	assert.Equal(t, "corr-id-1", verified.CorrelationId)
+	var accession map[string]interface{}
+	assert.NoError(t, json.Unmarshal(verified.Body, &accession))
+	accession["type"] = "accession"
+	accession["accession_id"] = "EGAF00000000001"
+	body, _ := json.Marshal(accession)
+	assert.NoError(t, mq.SendMessage("corr-id-1", "sda", "backup", true, body))
+	assert.Eventually(t, func() bool { return mq.Len("completed") == 1 }, 10*time.Second, time.Millisecond)
+
+	assert.NoError(t, mq.SendMessage("corr-id-1", "sda", "mappings", true, []byte(`{"type": "mapping", "dataset_id": "EGAD00000000001", "accession_ids": ["EGAF00000000001"]}`)))
+	assert.Eventually(t, func() bool {
+		return mq.Len("mappings") == 0 && mq.Unacked() == 0
+	}, 10*time.Second, time.Millisecond)
+
+	assert.Equal(t, 0, mq.Len("error"))
+	files, err := db.ListFiles(database.FileFilter{Dataset: "EGAD00000000001"})
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, database.FileReady, files[0].Status)
+		assert.Equal(t, "EGAF00000000001", files[0].AccessionID)
+		assert.Equal(t, "file.c4gh", files[0].InboxPath)
+
+		archived, err := archive.GetFileSize(files[0].ArchivePath)
+		assert.NoError(t, err)
+		backedUp, err := backup.GetFileSize(files[0].ArchivePath)
+		assert.NoError(t, err)
+		assert.Equal(t, archived, backedUp)
+	}
+	status, err := db.GetDatasetStatus("EGAD00000000001")
+	assert.NoError(t, err)
+	assert.Equal(t, database.DatasetRegistered, status)
+}
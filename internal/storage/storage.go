@@ -29,6 +29,7 @@ type Backend interface {
 	GetFileSize(filePath string) (int64, error)
 	NewFileReader(filePath string) (io.ReadCloser, error)
 	NewFileWriter(filePath string) (io.WriteCloser, error)
+	RemoveFile(filePath string) error
 }
 
 // Conf is a wrapper for the storage config
@@ -117,6 +118,21 @@ func (pb *posixBackend) GetFileSize(filePath string) (int64, error) {
 	return stat.Size(), nil
 }
 
+// RemoveFile removes a file
+func (pb *posixBackend) RemoveFile(filePath string) error {
+	if pb == nil {
+		return fmt.Errorf("Invalid posixBackend")
+	}
+
+	err := os.Remove(filepath.Join(filepath.Clean(pb.Location), filePath))
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	return nil
+}
+
 type s3Backend struct {
 	Client   *s3.S3
 	Uploader *s3manager.Uploader
@@ -279,6 +295,23 @@ func (sb *s3Backend) GetFileSize(filePath string) (int64, error) {
 	return *r.ContentLength, nil
 }
 
+// RemoveFile removes a specific object
+func (sb *s3Backend) RemoveFile(filePath string) error {
+	if sb == nil {
+		return fmt.Errorf("Invalid s3Backend")
+	}
+
+	_, err := sb.Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(sb.Bucket),
+		Key:    aws.String(filePath)})
+	if err != nil {
+		log.Errorln(err)
+		return err
+	}
+
+	return nil
+}
+
 // transportConfigS3 is a helper method to setup TLS for the S3 client.
 func transportConfigS3(config S3Conf) http.RoundTripper {
 	cfg := new(tls.Config)
@@ -186,6 +186,17 @@ func TestPosixBackend(t *testing.T) {
 
 	buf.Reset()
 
+	err = backend.RemoveFile(writable)
+	assert.Nil(t, err, "posix RemoveFile failed when it should work")
+	_, err = os.Stat(writable)
+	assert.True(t, os.IsNotExist(err), "posix RemoveFile did not remove the file")
+
+	err = backend.RemoveFile(posixDoesNotExist)
+	assert.NotNil(t, err, "posix RemoveFile worked when it should not")
+	assert.NotZero(t, buf.Len(), "Expected warning missing")
+
+	buf.Reset()
+
 }
 
 func setupFakeS3() (err error) {
@@ -259,6 +270,9 @@ func TestS3Fail(t *testing.T) {
 
 	_, err = dummyBackend.GetFileSize("/")
 	assert.NotNil(t, err, "GetFileSize worked when it should not")
+
+	err = dummyBackend.RemoveFile("/")
+	assert.NotNil(t, err, "RemoveFile worked when it should not")
 }
 
 func TestPOSIXFail(t *testing.T) {
@@ -290,6 +304,9 @@ func TestPOSIXFail(t *testing.T) {
 
 	_, err = dummyBackend.GetFileSize("/")
 	assert.NotNil(t, err, "GetFileSize worked when it should not")
+
+	err = dummyBackend.RemoveFile("/")
+	assert.NotNil(t, err, "RemoveFile worked when it should not")
 }
 
 func TestS3Backend(t *testing.T) {
@@ -338,6 +355,13 @@ func TestS3Backend(t *testing.T) {
 		assert.Nil(t, err, "unexpected error when reading back data")
 	}
 
+	err = s3back.RemoveFile(s3Creatable)
+	assert.Nil(t, err, "s3 RemoveFile failed when it should work")
+	_, err = s3back.Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3back.Bucket),
+		Key:    aws.String(s3Creatable)})
+	assert.NotNil(t, err, "s3 RemoveFile did not remove the object")
+
 	buf.Reset()
 
 	log.SetOutput(&buf)
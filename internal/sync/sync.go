@@ -0,0 +1,396 @@
+// Package sync handles the messages of the sync service, which copies
+// ingested files to the backup storage before they are finalized.
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/storage"
+	"sda-pipeline/internal/tracing"
+
+	"github.com/streadway/amqp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Sync struct that holds the json message data
+type sync struct {
+	Type               string      `json:"type"`
+	User               string      `json:"user"`
+	Filepath           string      `json:"filepath"`
+	AccessionID        string      `json:"accession_id"`
+	DecryptedChecksums []checksums `json:"decrypted_checksums"`
+}
+
+// Checksums is struct for the checksum type and value
+type checksums struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Handler returns the function that copies the files the messages are
+// about to the backup storage
+func Handler(conf *config.Config, mq broker.Broker, db database.Database, archive, backup storage.Backend) func(amqp.Delivery) {
+	return func(delivered amqp.Delivery) {
+		var message sync
+
+		log.Debugf("Received a message (corr-id: %s, message: %s)",
+			delivered.CorrelationId,
+			delivered.Body)
+
+		err := mq.ValidateJSON(&delivered,
+			"ingestion-accession",
+			delivered.Body,
+			&message)
+
+		if err != nil {
+			log.Errorf("Validation of incoming message failed "+
+				"(corr-id: %s, error: %v)",
+				delivered.CorrelationId,
+				err)
+			return
+		}
+
+		// we unmarshal the message in the validation step so this is safe to do
+		_ = json.Unmarshal(delivered.Body, &message)
+
+		log.Infof("Received work (corr-id: %s, "+
+			"filepath: %s, "+
+			"user: %s, "+
+			"accessionid: %s, "+
+			"decryptedChecksums: %v)",
+			delivered.CorrelationId,
+			message.Filepath,
+			message.User,
+			message.AccessionID,
+			message.DecryptedChecksums)
+
+		// Skip messages that are redelivered after the work was done, or that
+		// are copies of a message that is being worked on
+		span := tracing.Start(delivered, "database ClaimMessage")
+		claimed, err := db.ClaimMessage(delivered.CorrelationId, "sync", delivered.Body, broker.Redelivered(delivered))
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to claim message "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				err)
+
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (claim failed) "+
+					"(corr-id: %s, "+
+					"filepath: %s, "+
+					"user: %s, "+
+					"accessionid: %s, error: %v)",
+					delivered.CorrelationId,
+					message.Filepath,
+					message.User,
+					message.AccessionID,
+					e)
+			}
+			return
+		}
+		if !claimed {
+			log.Infof("Message already processed or claimed, skipping "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID)
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed to ack processed message "+
+					"(corr-id: %s, "+
+					"filepath: %s, "+
+					"user: %s, "+
+					"accessionid: %s, error: %v)",
+					delivered.CorrelationId,
+					message.Filepath,
+					message.User,
+					message.AccessionID,
+					err)
+			}
+			return
+		}
+
+		var decryptedChecksums []database.Checksum
+		for _, checksum := range message.DecryptedChecksums {
+			decryptedChecksums = append(decryptedChecksums, database.Checksum{Type: checksum.Type, Value: checksum.Value})
+		}
+
+		span = tracing.Start(delivered, "database GetFileIDByChecksums")
+		fileID, err := db.GetFileIDByChecksums(message.User, message.Filepath, decryptedChecksums)
+		span.End(err)
+		if err != nil {
+			log.Errorf("GetFileIDByChecksums failed "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, "+
+				"decryptedChecksums: %v, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				message.DecryptedChecksums,
+				err)
+
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (GetFileIDByChecksums failed) "+
+					"(corr-id: %s, "+
+					"filepath: %s, "+
+					"user: %s, "+
+					"accessionid: %s, "+
+					"decryptedChecksums: %v, error: %v)",
+					delivered.CorrelationId,
+					message.Filepath,
+					message.User,
+					message.AccessionID,
+					message.DecryptedChecksums,
+					e)
+			}
+			return
+		}
+
+		var filePath string
+		var fileSize int
+		span = tracing.Start(delivered, "database GetArchived")
+		filePath, fileSize, err = db.GetArchived(fileID)
+		span.End(err)
+		if err != nil {
+			log.Errorf("GetArchived failed "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, "+
+				"decryptedChecksums: %v, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				message.DecryptedChecksums,
+				err)
+
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (GetArchived failed) "+
+					"(corr-id: %s, "+
+					"filepath: %s, "+
+					"user: %s, "+
+					"accessionid: %s, "+
+					"decryptedChecksums: %v, error: %v)",
+					delivered.CorrelationId,
+					message.Filepath,
+					message.User,
+					message.AccessionID,
+					message.DecryptedChecksums,
+					e)
+			}
+			return
+		}
+
+		log.Info("Sync initiated")
+		span = tracing.Start(delivered, "archive NewFileReader")
+		span.SetAttribute("file.path", filePath)
+		file, err := archive.NewFileReader(filePath)
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to open archived file "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, "+
+				"decryptedChecksums: %v, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				message.DecryptedChecksums,
+				err)
+
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (NewFileReader failed) "+
+					"(corr-id: %s, "+
+					"filepath: %s, "+
+					"user: %s, "+
+					"accessionid: %s, "+
+					"decryptedChecksums: %v, error: %v)",
+					delivered.CorrelationId,
+					message.Filepath,
+					message.User,
+					message.AccessionID,
+					message.DecryptedChecksums,
+					e)
+			}
+			return
+		}
+
+		span = tracing.Start(delivered, "backup NewFileWriter")
+		span.SetAttribute("file.path", filePath)
+		dest, err := backup.NewFileWriter(filePath)
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to write archived file "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, "+
+				"decryptedChecksums: %v, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				message.DecryptedChecksums,
+				err)
+
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (NewFileWriter failed) "+
+					"(corr-id: %s, "+
+					"filepath: %s, "+
+					"user: %s, "+
+					"accessionid: %s, "+
+					"decryptedChecksums: %v, error: %v)",
+					delivered.CorrelationId,
+					message.Filepath,
+					message.User,
+					message.AccessionID,
+					message.DecryptedChecksums,
+					e)
+			}
+			return
+		}
+
+		// Copy the file and check is sizes match
+		span = tracing.Start(delivered, "backup copy")
+		span.SetAttribute("file.path", filePath)
+		copiedSize, err := io.Copy(dest, file)
+		if err == nil && copiedSize != int64(fileSize) {
+			err = fmt.Errorf("size mismatch: %d != %d", copiedSize, fileSize)
+		}
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to copy file "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, "+
+				"decryptedChecksums: %v, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				message.DecryptedChecksums,
+				err)
+
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (Copy failed) "+
+					"(corr-id: %s, "+
+					"filepath: %s, "+
+					"user: %s, "+
+					"accessionid: %s, "+
+					"decryptedChecksums: %v, error: %v)",
+					delivered.CorrelationId,
+					message.Filepath,
+					message.User,
+					message.AccessionID,
+					message.DecryptedChecksums,
+					e)
+			}
+			return
+		}
+
+		file.Close()
+		dest.Close()
+
+		log.Infof("Synced file "+
+			"(corr-id: %s, "+
+			"filepath: %s, "+
+			"user: %s, "+
+			"accessionid: %s, "+
+			"decryptedChecksums: %v)",
+			delivered.CorrelationId,
+			message.Filepath,
+			message.User,
+			message.AccessionID,
+			message.DecryptedChecksums)
+
+		if err := mq.RelayMessage(delivered, conf.Broker.Exchange, conf.Broker.RoutingKey, conf.Broker.Durable); err != nil {
+			log.Errorf("Failed to send message for completed "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, "+
+				"decryptedChecksums: %v, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				message.DecryptedChecksums,
+				err)
+
+			// Retry the message so the work is done again
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (send failed) "+
+					"(corr-id: %s, filepath: %s, user: %s, accessionid: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.Filepath,
+					message.User,
+					message.AccessionID,
+					e)
+			}
+
+			return
+		}
+
+		span = tracing.Start(delivered, "database MarkMessageDone")
+		err = db.MarkMessageDone(delivered.CorrelationId, "sync", delivered.Body)
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to mark message as processed "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				err)
+		}
+
+		if err := delivered.Ack(false); err != nil {
+
+			log.Errorf("Failed to ack message after work completed "+
+				"(corr-id: %s, "+
+				"filepath: %s, "+
+				"user: %s, "+
+				"accessionid: %s, "+
+				"decryptedChecksums: %v, error: %v)",
+				delivered.CorrelationId,
+				message.Filepath,
+				message.User,
+				message.AccessionID,
+				message.DecryptedChecksums,
+				err)
+
+		}
+	}
+}
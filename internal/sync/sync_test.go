@@ -0,0 +1,142 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/storage"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// testHandler is the handler consuming the backup queue, with a file of
+// size bytes in the database that is archived as "archived"
+type testHandler struct {
+	db     *database.SQLiteDB
+	backup storage.Backend
+	mq     *broker.MemoryBroker
+	sums   []checksums
+}
+
+// newTestHandler starts a handler that sends v1 messages, but also knows
+// the v2 schemas. The archived file has data, which is size bytes long
+// according to the database.
+func newTestHandler(t *testing.T, data []byte, size int64) *testHandler {
+	dir := t.TempDir()
+	db, err := database.NewSQLiteDB(filepath.Join(dir, "sda.db"))
+	assert.NoError(t, err)
+	t.Cleanup(db.Close)
+	backends := make(map[string]storage.Backend)
+	for _, name := range []string{"archive", "backup"} {
+		var conf storage.Conf
+		conf.Posix.Location = filepath.Join(dir, name)
+		assert.NoError(t, os.Mkdir(conf.Posix.Location, 0750))
+		backends[name], err = storage.NewBackend(conf)
+		assert.NoError(t, err)
+	}
+
+	archived, err := backends["archive"].NewFileWriter("archived")
+	assert.NoError(t, err)
+	_, err = archived.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, archived.Close())
+	file := database.FileInfo{Checksum: sha256.New(), Size: size, Path: "archived", DecryptedChecksum: sha256.New()}
+	fileID, err := db.IngestFile("corr-id", "test", "file.c4gh", []byte("header"), "", file)
+	assert.NoError(t, err)
+	assert.NoError(t, db.MarkCompleted("corr-id", file, int(fileID)))
+	sums := []checksums{
+		{"sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"md5", "d41d8cd98f00b204e9800998ecf8427e"},
+	}
+	assert.NoError(t, db.AddChecksums(fileID, database.SourceDecrypted, []database.Checksum{
+		{Type: sums[0].Type, Value: sums[0].Value},
+		{Type: sums[1].Type, Value: sums[1].Value},
+	}))
+
+	schemas := filepath.Join(dir, "schemas")
+	for _, version := range []string{"v1", "v2"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(schemas, version), 0750))
+		files, err := filepath.Glob("../../schemas/federated/v1/*.json")
+		assert.NoError(t, err)
+		for _, file := range files {
+			content, err := ioutil.ReadFile(file)
+			assert.NoError(t, err)
+			assert.NoError(t, ioutil.WriteFile(filepath.Join(schemas, version, filepath.Base(file)), content, 0600))
+		}
+	}
+
+	conf := &config.Config{Broker: broker.MQConf{
+		Queue:         "backup",
+		Exchange:      "sda",
+		RoutingKey:    "accessionIDs",
+		RoutingError:  "error",
+		SchemasPath:   schemas,
+		SchemaVersion: "v1",
+		MaxAttempts:   3,
+	}}
+	mq, err := broker.NewMemoryBroker(conf.Broker)
+	assert.NoError(t, err)
+	t.Cleanup(mq.Close)
+	mq.Bind("backup", "sda", "backup")
+	mq.Bind("accessionIDs", "sda", "accessionIDs")
+	mq.Bind("error", "sda", "error")
+
+	go func() {
+		_ = mq.Consume("backup", 1, Handler(conf, mq, db, backends["archive"], backends["backup"]))
+	}()
+
+	return &testHandler{db: db, backup: backends["backup"], mq: mq, sums: sums}
+}
+
+// send publishes a v2 accession message for the archived file and waits
+// until it is settled
+func (h *testHandler) send(t *testing.T) {
+	body, _ := json.Marshal(sync{
+		Type:               "accession",
+		User:               "test",
+		Filepath:           "file.c4gh",
+		AccessionID:        "EGAF00000000001",
+		DecryptedChecksums: h.sums,
+	})
+	delivered := amqp.Delivery{CorrelationId: "corr-id", Headers: amqp.Table{broker.SchemaVersionHeader: "v2"}, Body: body}
+	assert.NoError(t, h.mq.RelayMessage(delivered, "sda", "backup", true))
+	assert.Eventually(t, func() bool {
+		return h.mq.Len("backup") == 0 && h.mq.Unacked() == 0
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestHandler(t *testing.T) {
+	h := newTestHandler(t, []byte("data"), 4)
+	h.send(t)
+
+	size, err := h.backup.GetFileSize("archived")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), size)
+
+	// The message is passed on as it was sent
+	relayed, ok := h.mq.Get("accessionIDs")
+	assert.True(t, ok)
+	assert.Equal(t, "corr-id", relayed.CorrelationId)
+	assert.Equal(t, "v2", broker.MessageVersion(relayed))
+	assert.Equal(t, 0, h.mq.Len("error"))
+}
+
+func TestHandler_SizeMismatch(t *testing.T) {
+	h := newTestHandler(t, []byte("data"), 10)
+	h.send(t)
+
+	assert.Equal(t, 0, h.mq.Len("accessionIDs"))
+	dead, ok := h.mq.Get("backup.dead-letter")
+	assert.True(t, ok)
+	assert.Equal(t, 3, broker.Attempts(dead))
+	assert.Equal(t, "size mismatch: 4 != 10", dead.Headers[broker.LastErrorHeader])
+}
@@ -0,0 +1,290 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Conf stores the tracing configuration
+type Conf struct {
+	// Exporter is where the finished spans go, otlp or file. Without one
+	// the trace context is still passed on, but no spans are kept.
+	Exporter string
+	// Endpoint is the OTLP/HTTP traces endpoint for the otlp exporter
+	Endpoint string
+	// File is the file the file exporter appends the spans to
+	File string
+	// Service is the name the spans are reported under
+	Service string
+}
+
+const (
+	// batchSize is the number of spans that are exported together
+	batchSize = 512
+	// flushInterval is how long finished spans wait to be exported at most
+	flushInterval = 5 * time.Second
+)
+
+// exporter sends a batch of spans in the OTLP JSON format somewhere
+type exporter interface {
+	export(body []byte) error
+	close() error
+}
+
+// batcher collects the finished spans and exports them in batches
+type batcher struct {
+	service  string
+	exporter exporter
+	spans    chan *Span
+	done     chan struct{}
+}
+
+var (
+	setupMu sync.Mutex
+	current *batcher
+)
+
+// Setup starts exporting the spans as configured, an earlier configuration
+// is shut down first
+func Setup(conf Conf) error {
+	var exp exporter
+	switch conf.Exporter {
+	case "":
+	case "otlp":
+		if conf.Endpoint == "" {
+			return fmt.Errorf("tracing endpoint not set")
+		}
+		exp = &otlpExporter{endpoint: conf.Endpoint, client: &http.Client{Timeout: 10 * time.Second}}
+	case "file":
+		if conf.File == "" {
+			return fmt.Errorf("tracing file not set")
+		}
+		file, err := os.OpenFile(conf.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			return fmt.Errorf("failed to open tracing file: %v", err)
+		}
+		exp = &fileExporter{file: file}
+	default:
+		return fmt.Errorf("unknown tracing exporter %s", conf.Exporter)
+	}
+
+	Shutdown()
+	if exp == nil {
+		return nil
+	}
+
+	b := &batcher{
+		service:  conf.Service,
+		exporter: exp,
+		spans:    make(chan *Span, 4*batchSize),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+
+	setupMu.Lock()
+	current = b
+	setupMu.Unlock()
+
+	return nil
+}
+
+// Shutdown exports the spans that are left and stops exporting
+func Shutdown() {
+	setupMu.Lock()
+	b := current
+	current = nil
+	setupMu.Unlock()
+
+	if b == nil {
+		return
+	}
+	close(b.spans)
+	<-b.done
+	if err := b.exporter.close(); err != nil {
+		log.Errorf("Failed to close the tracing exporter, reason: %v", err)
+	}
+}
+
+// export hands a finished span to the batcher, spans are dropped when there
+// is nowhere to export them or the exporter cannot keep up
+func export(span *Span) {
+	setupMu.Lock()
+	defer setupMu.Unlock()
+
+	if current == nil {
+		return
+	}
+	select {
+	case current.spans <- span:
+	default:
+		log.Warnf("Dropped span %s, the tracing exporter is falling behind", span.name)
+	}
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case span, ok := <-b.spans:
+			if !ok {
+				b.flush(batch)
+
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				b.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			b.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+func (b *batcher) flush(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(encode(b.service, batch))
+	if err != nil {
+		log.Errorf("Failed to encode %d spans, reason: %v", len(batch), err)
+
+		return
+	}
+	if err := b.exporter.export(body); err != nil {
+		log.Errorf("Failed to export %d spans, reason: %v", len(batch), err)
+	}
+}
+
+// otlpExporter posts the spans to an OTLP/HTTP endpoint
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (exp *otlpExporter) export(body []byte) error {
+	res, err := exp.client.Post(exp.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s responded with %s", exp.endpoint, res.Status)
+	}
+
+	return nil
+}
+
+func (exp *otlpExporter) close() error {
+	return nil
+}
+
+// fileExporter writes each batch of spans on a line of its own, the format
+// read by the OpenTelemetry collector's otlpjsonfile receiver
+type fileExporter struct {
+	file *os.File
+}
+
+func (exp *fileExporter) export(body []byte) error {
+	_, err := exp.file.Write(append(body, '\n'))
+
+	return err
+}
+
+func (exp *fileExporter) close() error {
+	return exp.file.Close()
+}
+
+// The OTLP JSON encoding of spans, only the parts that are used
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// encode converts the spans to an OTLP trace export request
+func encode(service string, batch []*Span) otlpTraces {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, span := range batch {
+		span.mu.Lock()
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(span.traceID[:]),
+			SpanID:            hex.EncodeToString(span.spanID[:]),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: 1},
+		}
+		if span.parentID != [8]byte{} {
+			s.ParentSpanID = hex.EncodeToString(span.parentID[:])
+		}
+		for key, value := range span.attributes {
+			s.Attributes = append(s.Attributes, otlpAttribute{key, otlpValue{value}})
+		}
+		if span.err != nil {
+			s.Status = otlpStatus{Code: 2, Message: span.err.Error()}
+		}
+		span.mu.Unlock()
+		spans = append(spans, s)
+	}
+
+	return otlpTraces{[]otlpResourceSpans{{
+		Resource:   otlpResource{[]otlpAttribute{{"service.name", otlpValue{service}}}},
+		ScopeSpans: []otlpScopeSpans{{otlpScope{"sda-pipeline"}, spans}},
+	}}}
+}
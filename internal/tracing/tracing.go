@@ -0,0 +1,183 @@
+// Package tracing follows the messages through the pipeline services. The
+// trace context travels in the W3C traceparent header of the AMQP messages,
+// and finished spans are exported in the OTLP JSON format, over OTLP/HTTP
+// or to a file.
+//
+// Every message that is handled gets a span, whose trace context replaces
+// the traceparent header of the delivery while it is handled. The spans of
+// the work done for the delivery and the messages sent on for it are linked
+// to it through the delivery alone, also when deliveries that share a
+// correlation id are handled at the same time.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/streadway/amqp"
+)
+
+// TraceParentHeader carries the trace context of a message
+const TraceParentHeader = "traceparent"
+
+// Span kinds, as numbered by OTLP
+const (
+	kindInternal = 1
+	kindConsumer = 5
+)
+
+// Span is a timed operation in a trace
+type Span struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	err        error
+	mu         sync.Mutex
+	attributes map[string]string
+}
+
+// StartDelivery starts the span of a received message, continuing the trace
+// in the traceparent header if there is one. The headers of delivered are
+// replaced by a copy whose traceparent names the new span, so that it is the
+// parent of the spans started for delivered.
+func StartDelivery(name string, delivered *amqp.Delivery) *Span {
+	span := newSpan(name, delivered.CorrelationId, kindConsumer)
+	if value, ok := delivered.Headers[TraceParentHeader].(string); ok {
+		if traceID, parentID, err := parseTraceParent(value); err == nil {
+			span.traceID, span.parentID = traceID, parentID
+		} else {
+			log.Debugf("Ignoring traceparent header (corr-id: %s, reason: %v)", delivered.CorrelationId, err)
+		}
+	}
+	if span.traceID == [16]byte{} {
+		span.traceID = newTraceID()
+	}
+
+	headers := amqp.Table{}
+	for k, v := range delivered.Headers {
+		headers[k] = v
+	}
+	headers[TraceParentHeader] = formatTraceParent(span.traceID, span.spanID)
+	delivered.Headers = headers
+
+	return span
+}
+
+// Start starts a span for work done for delivered, as part of the trace in
+// its traceparent header. A new trace is started if there is none.
+func Start(delivered amqp.Delivery, name string) *Span {
+	span := newSpan(name, delivered.CorrelationId, kindInternal)
+	if value, ok := delivered.Headers[TraceParentHeader].(string); ok {
+		if traceID, parentID, err := parseTraceParent(value); err == nil {
+			span.traceID, span.parentID = traceID, parentID
+		}
+	}
+	if span.traceID == [16]byte{} {
+		span.traceID = newTraceID()
+	}
+
+	return span
+}
+
+// Inject sets the traceparent header for a message sent for delivered,
+// nothing is set if delivered is not traced
+func Inject(delivered amqp.Delivery, headers amqp.Table) {
+	if value, ok := delivered.Headers[TraceParentHeader].(string); ok {
+		if _, _, err := parseTraceParent(value); err == nil {
+			headers[TraceParentHeader] = value
+		}
+	}
+}
+
+// SetAttribute records a detail about the operation
+func (span *Span) SetAttribute(key, value string) {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+
+	span.attributes[key] = value
+}
+
+// End ends the span, the operation failed if err is not nil. Only the first
+// call ends the span, so a deferred End can cover the early returns.
+func (span *Span) End(err error) {
+	span.mu.Lock()
+	if !span.end.IsZero() {
+		span.mu.Unlock()
+
+		return
+	}
+	span.end = time.Now()
+	span.err = err
+	span.mu.Unlock()
+
+	export(span)
+}
+
+// TraceID returns the id of the trace the span is part of, in hex
+func (span *Span) TraceID() string {
+	return hex.EncodeToString(span.traceID[:])
+}
+
+func newSpan(name, corrID string, kind int) *Span {
+	span := &Span{
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]string),
+	}
+	_, _ = rand.Read(span.spanID[:])
+	if corrID != "" {
+		span.attributes["messaging.message.conversation_id"] = corrID
+	}
+
+	return span
+}
+
+func newTraceID() [16]byte {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+
+	return id
+}
+
+// formatTraceParent formats a version 00 traceparent of a sampled span
+func formatTraceParent(traceID [16]byte, spanID [8]byte) string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(traceID[:]), hex.EncodeToString(spanID[:]))
+}
+
+// parseTraceParent returns the trace id and the parent span id of a
+// traceparent header value
+func parseTraceParent(value string) ([16]byte, [8]byte, error) {
+	var traceID [16]byte
+	var spanID [8]byte
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return traceID, spanID, fmt.Errorf("malformed traceparent %q", value)
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, spanID, fmt.Errorf("malformed traceparent %q", value)
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, spanID, fmt.Errorf("malformed traceparent %q", value)
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil {
+		return traceID, spanID, fmt.Errorf("malformed traceparent %q", value)
+	}
+	if traceID == [16]byte{} || spanID == [8]byte{} {
+		return traceID, spanID, errors.New("traceparent with an invalid id")
+	}
+
+	return traceID, spanID, nil
+}
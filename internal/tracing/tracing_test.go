@@ -0,0 +1,150 @@
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	traceID, spanID, err := parseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.NoError(t, err)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", formatTraceParent(traceID, spanID))
+
+	// Later versions may add fields
+	_, _, err = parseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	assert.NoError(t, err)
+
+	for _, value := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+	} {
+		_, _, err = parseTraceParent(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestStartDelivery(t *testing.T) {
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	headers := amqp.Table{TraceParentHeader: traceParent}
+	delivered := amqp.Delivery{CorrelationId: "corrID1", Headers: headers}
+	span := StartDelivery("process archived", &delivered)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID())
+	assert.Equal(t, traceParent, headers[TraceParentHeader], "headers of the message were changed")
+
+	child := Start(delivered, "database GetHeader")
+	assert.Equal(t, span.traceID, child.traceID)
+	assert.Equal(t, span.spanID, child.parentID)
+	child.End(nil)
+
+	sent := amqp.Table{}
+	Inject(delivered, sent)
+	assert.Equal(t, formatTraceParent(span.traceID, span.spanID), sent[TraceParentHeader])
+	span.End(nil)
+
+	// Without a traceparent a new trace is started
+	other := amqp.Delivery{CorrelationId: "corrID2", Headers: amqp.Table{TraceParentHeader: "garbage"}}
+	otherSpan := StartDelivery("process archived", &other)
+	assert.NotEqual(t, span.traceID, otherSpan.traceID)
+	assert.Equal(t, [8]byte{}, otherSpan.parentID)
+	otherSpan.End(nil)
+
+	orphan := Start(amqp.Delivery{CorrelationId: "corrID3"}, "database GetHeader")
+	assert.NotEqual(t, [16]byte{}, orphan.traceID)
+	orphan.End(nil)
+
+	sent = amqp.Table{}
+	Inject(amqp.Delivery{CorrelationId: "corrID3"}, sent)
+	assert.Empty(t, sent)
+}
+
+// TestStartDelivery_SameCorrelationID handles two deliveries with the same
+// correlation id at once, each keeps its own span
+func TestStartDelivery_SameCorrelationID(t *testing.T) {
+	first := amqp.Delivery{CorrelationId: "corrID1"}
+	firstSpan := StartDelivery("process archived", &first)
+	second := amqp.Delivery{CorrelationId: "corrID1"}
+	secondSpan := StartDelivery("process archived", &second)
+
+	assert.Equal(t, firstSpan.spanID, Start(first, "database GetHeader").parentID)
+	assert.Equal(t, secondSpan.spanID, Start(second, "database GetHeader").parentID)
+
+	secondSpan.End(nil)
+	sent := amqp.Table{}
+	Inject(first, sent)
+	assert.Equal(t, formatTraceParent(firstSpan.traceID, firstSpan.spanID), sent[TraceParentHeader])
+	firstSpan.End(nil)
+}
+
+func TestSetup(t *testing.T) {
+	assert.EqualError(t, Setup(Conf{Exporter: "zipkin"}), "unknown tracing exporter zipkin")
+	assert.EqualError(t, Setup(Conf{Exporter: "otlp"}), "tracing endpoint not set")
+	assert.EqualError(t, Setup(Conf{Exporter: "file"}), "tracing file not set")
+	assert.NoError(t, Setup(Conf{}))
+	Shutdown()
+}
+
+func TestExport_File(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "traces.json")
+	assert.NoError(t, Setup(Conf{Exporter: "file", File: file, Service: "verify"}))
+
+	delivered := amqp.Delivery{CorrelationId: "corrID1"}
+	span := StartDelivery("process archived", &delivered)
+	child := Start(delivered, "database GetHeader")
+	child.SetAttribute("file.id", "1")
+	child.End(errors.New("no such file"))
+	child.End(nil)
+	span.End(nil)
+	Shutdown()
+
+	content, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Len(t, lines, 1)
+
+	var traces otlpTraces
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &traces))
+	assert.Equal(t, "verify", traces.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+	spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "database GetHeader", spans[0].Name)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	assert.Equal(t, spans[1].TraceID, spans[0].TraceID)
+	assert.Equal(t, otlpStatus{Code: 2, Message: "no such file"}, spans[0].Status)
+	assert.Contains(t, spans[0].Attributes, otlpAttribute{"file.id", otlpValue{"1"}})
+	assert.Equal(t, "", spans[1].ParentSpanID)
+	assert.Equal(t, kindConsumer, spans[1].Kind)
+	assert.Equal(t, otlpStatus{Code: 1}, spans[1].Status)
+}
+
+func TestExport_OTLP(t *testing.T) {
+	received := make(chan otlpTraces, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var traces otlpTraces
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&traces))
+		received <- traces
+	}))
+	defer server.Close()
+
+	assert.NoError(t, Setup(Conf{Exporter: "otlp", Endpoint: server.URL + "/v1/traces", Service: "ingest"}))
+	StartDelivery("process inbox", &amqp.Delivery{CorrelationId: "corrID1"}).End(nil)
+	Shutdown()
+
+	traces := <-received
+	assert.Equal(t, "process inbox", traces.ResourceSpans[0].ScopeSpans[0].Spans[0].Name)
+}
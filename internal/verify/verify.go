@@ -0,0 +1,713 @@
+// Package verify handles the messages of the verify service, which reads
+// and decrypts ingested files from the archive storage and sends accession
+// requests.
+package verify
+
+import (
+	"bytes"
+	"crypto/md5" // #nosec
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/c4gh"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/storage"
+	"sda-pipeline/internal/tracing"
+
+	"github.com/elixir-oslo/crypt4gh/streaming"
+	"github.com/streadway/amqp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Message struct that holds the json message data
+type message struct {
+	FilePath           string      `json:"filepath"`
+	User               string      `json:"user"`
+	FileID             int         `json:"file_id"`
+	ArchivePath        string      `json:"archive_path"`
+	EncryptedChecksums []checksums `json:"encrypted_checksums"`
+	ReVerify           bool        `json:"re_verify"`
+}
+
+// Verified is struct holding the full message data
+type verified struct {
+	User               string      `json:"user"`
+	FilePath           string      `json:"filepath"`
+	DecryptedChecksums []checksums `json:"decrypted_checksums"`
+}
+
+// Checksums is struct for the checksum type and value
+type checksums struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Handler returns the function that verifies the archived files the
+// messages are about
+func Handler(conf *config.Config, mq broker.Broker, db database.Database, backend storage.Backend, keyring c4gh.Keyring) func(amqp.Delivery) {
+	return func(delivered amqp.Delivery) {
+		var message message
+		log.Debugf("Received a message (corr-id: %s, message: %s)",
+			delivered.CorrelationId,
+			delivered.Body)
+
+		err := mq.ValidateJSON(&delivered, "ingestion-verification", delivered.Body, &message)
+
+		if err != nil {
+			log.Errorf("Validation (ingestion-verifiation) of incoming message failed "+
+				"(corr-id: %s, error: %v, message: %s)",
+				delivered.CorrelationId,
+				err,
+				delivered.Body)
+
+			// Restart on new message
+			return
+		}
+
+		// we unmarshal the message in the validation step so this is safe to do
+		_ = json.Unmarshal(delivered.Body, &message)
+
+		log.Infof("Received work "+
+			"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t)",
+			delivered.CorrelationId,
+			message.User,
+			message.FilePath,
+			message.FileID,
+			message.ArchivePath,
+			message.EncryptedChecksums,
+			message.ReVerify)
+
+		// Skip messages that are redelivered after the work was done, or that
+		// are copies of a message that is being worked on
+		span := tracing.Start(delivered, "database ClaimMessage")
+		claimed, err := db.ClaimMessage(delivered.CorrelationId, "verify", delivered.Body, broker.Redelivered(delivered))
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to claim message "+
+				"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.FilePath,
+				message.FileID,
+				err)
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (claim failed) "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.FileID,
+					e)
+			}
+			return
+		}
+		if !claimed {
+			log.Infof("Message already processed or claimed, skipping "+
+				"(corr-id: %s, user: %s, filepath: %s, fileid: %d)",
+				delivered.CorrelationId,
+				message.User,
+				message.FilePath,
+				message.FileID)
+			if err := delivered.Ack(false); err != nil {
+				log.Errorf("Failed to ack processed message "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.FileID,
+					err)
+			}
+			return
+		}
+
+		span = tracing.Start(delivered, "database GetHeader")
+		header, err := db.GetHeader(message.FileID)
+		span.End(err)
+		if err != nil {
+			log.Errorf("GetHeader failed "+
+				"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.FilePath,
+				message.FileID,
+				message.ArchivePath,
+				message.EncryptedChecksums,
+				message.ReVerify,
+				err)
+
+			// Nack message so the server gets notified that something is wrong but don't requeue the message
+			if e := delivered.Nack(false, false); e != nil {
+				log.Errorf("Failed to nack following getheader error message "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.FileID,
+					message.ArchivePath,
+					message.EncryptedChecksums,
+					message.ReVerify,
+					err)
+
+			}
+			// Send the message to an error queue so it can be analyzed.
+			if e := mq.SendMessageFor(delivered, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, delivered.Body); e != nil {
+				log.Errorf("Failed to publish getheader error message "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.FileID,
+					message.ArchivePath,
+					message.EncryptedChecksums,
+					message.ReVerify,
+					e)
+			}
+			return
+		}
+
+		span = tracing.Start(delivered, "crypt4gh DecryptHeader")
+		h, key, err := keyring.DecryptHeader(header)
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to decrypt header "+
+				"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.FilePath,
+				message.FileID,
+				message.ArchivePath,
+				err)
+
+			if e := db.SetError(int64(message.FileID), delivered.CorrelationId, "verify", err.Error()); e != nil {
+				log.Errorf("Failed to mark file as errored "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.FileID,
+					e)
+			}
+
+			// Nack message so the server gets notified that something is wrong but don't requeue the message
+			if e := delivered.Nack(false, false); e != nil {
+				log.Errorf("Failed to nack following header decryption error message "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.FileID,
+					e)
+			}
+
+			// Send the message to an error queue so it can be analyzed.
+			fileError := broker.FileError{
+				User:     message.User,
+				FilePath: message.FilePath,
+				Reason:   err.Error(),
+			}
+			body, _ := json.Marshal(fileError)
+			if e := mq.SendMessageFor(delivered, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
+				log.Errorf("Failed to publish header decryption error message "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.FileID,
+					e)
+			}
+			return
+		}
+
+		log.Debugf("Header decrypted "+
+			"(corr-id: %s, user: %s, filepath: %s, fileid: %d, keyid: %s)",
+			delivered.CorrelationId,
+			message.User,
+			message.FilePath,
+			message.FileID,
+			key.ID)
+		if editList := c4gh.EditList(h); editList != nil {
+			log.Infof("File has a data edit list, checksums are calculated over the kept data "+
+				"(corr-id: %s, user: %s, filepath: %s, fileid: %d, editlist: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.FilePath,
+				message.FileID,
+				editList)
+		}
+
+		var file database.FileInfo
+
+		span = tracing.Start(delivered, "archive GetFileSize")
+		span.SetAttribute("file.path", message.ArchivePath)
+		file.Size, err = backend.GetFileSize(message.ArchivePath)
+		span.End(err)
+
+		if err != nil {
+			log.Errorf("Failed to get archvied file size "+
+				"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.FilePath,
+				message.FileID,
+				message.ArchivePath,
+				message.EncryptedChecksums,
+				message.ReVerify,
+				err)
+
+			// Retry the message after a delay
+			if e := mq.Retry(delivered, err); e != nil {
+				log.Errorf("Failed to retry message (get archived file size failed) "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.ArchivePath,
+					e)
+			}
+			return
+		}
+
+		log.Infof("Got archived file size "+
+			"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, archivedsize: %d)",
+			delivered.CorrelationId,
+			message.User,
+			message.FilePath,
+			message.ArchivePath,
+			message.EncryptedChecksums,
+			message.ReVerify,
+			file.Size)
+
+		archiveFileHash := sha256.New()
+
+		span = tracing.Start(delivered, "archive NewFileReader")
+		span.SetAttribute("file.path", message.ArchivePath)
+		f, err := backend.NewFileReader(message.ArchivePath)
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to open archvied file "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.FilePath,
+				message.ArchivePath,
+				message.EncryptedChecksums,
+				message.ReVerify,
+				err)
+
+			if e := db.SetError(int64(message.FileID), delivered.CorrelationId, "verify", err.Error()); e != nil {
+				log.Errorf("Failed to mark file as errored "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.FileID,
+					e)
+			}
+
+			// Nack message so the server gets notified that something is wrong but don't requeue the message
+			if e := delivered.Nack(false, false); e != nil {
+				log.Errorf("Failed to nack following file open error message "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.FileID,
+					e)
+			}
+
+			// Send the message to an error queue so it can be analyzed.
+			fileError := broker.FileError{
+				User:     message.User,
+				FilePath: message.FilePath,
+				Reason:   err.Error(),
+			}
+			body, _ := json.Marshal(fileError)
+			if e := mq.SendMessageFor(delivered, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
+
+				log.Errorf("Failed to publish file open error message "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.ArchivePath,
+					message.EncryptedChecksums,
+					message.ReVerify,
+					e)
+
+			}
+			// Restart on new message
+			return
+		}
+
+		hr := bytes.NewReader(header)
+		// Feed everything read from the archive file to archiveFileHash
+		mr := io.MultiReader(hr, io.TeeReader(f, archiveFileHash))
+
+		// The reader applies the data edit list of the header, if any
+		c4ghr, err := streaming.NewCrypt4GHReader(mr, key.PrivateKey, nil)
+		if err != nil {
+			log.Errorf("Failed to open c4gh decryptor stream "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.FilePath,
+				message.ArchivePath,
+				message.EncryptedChecksums,
+				message.ReVerify,
+				err)
+
+			if e := db.SetError(int64(message.FileID), delivered.CorrelationId, "verify", err.Error()); e != nil {
+				log.Errorf("Failed to mark file as errored "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.FileID,
+					e)
+			}
+
+			// Nack message so the server gets notified that something is wrong but don't requeue the message
+			if e := delivered.Nack(false, false); e != nil {
+				log.Errorf("Failed to nack following decryptor stream error message "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.FileID,
+					e)
+			}
+
+			// Send the message to an error queue so it can be analyzed.
+			fileError := broker.FileError{
+				User:     message.User,
+				FilePath: message.FilePath,
+				Reason:   err.Error(),
+			}
+			body, _ := json.Marshal(fileError)
+			if e := mq.SendMessageFor(delivered, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
+				log.Errorf("Failed to publish decryptor stream error message "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.FileID,
+					e)
+			}
+			return
+		}
+
+		md5hash := md5.New() // #nosec
+		sha256hash := sha256.New()
+
+		stream := io.TeeReader(c4ghr, md5hash)
+
+		span = tracing.Start(delivered, "crypt4gh decrypt")
+		span.SetAttribute("file.path", message.ArchivePath)
+		file.DecryptedSize, err = io.Copy(sha256hash, stream)
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to copy decrypted data to hash stream "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.FilePath,
+				message.ArchivePath,
+				message.EncryptedChecksums,
+				message.ReVerify,
+				err)
+
+			if e := db.SetError(int64(message.FileID), delivered.CorrelationId, "verify", err.Error()); e != nil {
+				log.Errorf("Failed to mark file as errored "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.FileID,
+					e)
+			}
+
+			// Nack message so the server gets notified that something is wrong but don't requeue the message
+			if e := delivered.Nack(false, false); e != nil {
+				log.Errorf("Failed to nack following decryption error message "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.FileID,
+					e)
+			}
+
+			// Send the message to an error queue so it can be analyzed.
+			fileError := broker.FileError{
+				User:     message.User,
+				FilePath: message.FilePath,
+				Reason:   err.Error(),
+			}
+			body, _ := json.Marshal(fileError)
+			if e := mq.SendMessageFor(delivered, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
+				log.Errorf("Failed to publish decryption error message "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.FileID,
+					e)
+			}
+			return
+		}
+
+		file.Checksum = archiveFileHash
+		file.DecryptedChecksum = sha256hash
+
+		log.Infof("Calculated decrypted hash "+
+			"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, "+
+			"encryptedchecksums: %v, reverify: %t, decryptedsize: %d, "+
+			"decryptedchecksum: %x)",
+			delivered.CorrelationId,
+			message.User,
+			message.FilePath,
+			message.ArchivePath,
+			message.EncryptedChecksums,
+			message.ReVerify,
+			file.DecryptedSize,
+			file.DecryptedChecksum.Sum(nil))
+
+		// A file that is re-verified only has to decrypt, it is neither
+		// updated in the database nor sent for an accession id again
+		//nolint:nestif
+		if !message.ReVerify {
+
+			c := verified{
+				User:     message.User,
+				FilePath: message.FilePath,
+				DecryptedChecksums: []checksums{
+					{"sha256", fmt.Sprintf("%x", sha256hash.Sum(nil))},
+					{"md5", fmt.Sprintf("%x", md5hash.Sum(nil))},
+				},
+			}
+
+			verifiedMessage, _ := json.Marshal(&c)
+
+			err = mq.ValidateOutgoing(&delivered,
+				"ingestion-accession-request",
+				verifiedMessage,
+				new(verified))
+
+			if err != nil {
+				log.Errorf("Validation (ingestion-accession-request) of outgoing message failed "+
+					"(corr-id: %s, error: %v, message: %s)",
+					delivered.CorrelationId,
+					err,
+					verifiedMessage)
+
+				// The message was rejected, so the file will not be completed
+				if e := db.SetError(int64(message.FileID), delivered.CorrelationId, "verify", err.Error()); e != nil {
+					log.Errorf("Failed to mark file as errored "+
+						"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.FilePath,
+						message.FileID,
+						e)
+				}
+
+				// Logging is in ValidateJSON so just restart on new message
+				return
+			}
+
+			// Store the checksums of the archived and the decrypted file
+			span = tracing.Start(delivered, "database AddChecksums")
+			err = db.AddChecksums(int64(message.FileID), database.SourceArchive, []database.Checksum{
+				{Type: "sha256", Value: fmt.Sprintf("%x", archiveFileHash.Sum(nil))},
+			})
+			span.End(err)
+			if err != nil {
+				log.Errorf("AddChecksums failed "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.ArchivePath,
+					message.EncryptedChecksums,
+					message.ReVerify,
+					err)
+
+				// Retry the message after a delay
+				if e := mq.Retry(delivered, err); e != nil {
+					log.Errorf("Failed to retry message (AddChecksums failed) "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.FilePath,
+						message.ArchivePath,
+						e)
+				}
+				return
+			}
+			span = tracing.Start(delivered, "database AddChecksums")
+			err = db.AddChecksums(int64(message.FileID), database.SourceDecrypted, []database.Checksum{
+				{Type: "sha256", Value: fmt.Sprintf("%x", sha256hash.Sum(nil))},
+				{Type: "md5", Value: fmt.Sprintf("%x", md5hash.Sum(nil))},
+			})
+			span.End(err)
+			if err != nil {
+				log.Errorf("AddChecksums failed "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.ArchivePath,
+					message.EncryptedChecksums,
+					message.ReVerify,
+					err)
+
+				// Retry the message after a delay
+				if e := mq.Retry(delivered, err); e != nil {
+					log.Errorf("Failed to retry message (AddChecksums failed) "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.FilePath,
+						message.ArchivePath,
+						e)
+				}
+				return
+			}
+
+			// Mark file as "COMPLETED"
+			span = tracing.Start(delivered, "database MarkCompleted")
+			err = db.MarkCompleted(delivered.CorrelationId, file, message.FileID)
+			span.End(err)
+			if err != nil {
+				log.Errorf("MarkCompleted failed "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.ArchivePath,
+					message.EncryptedChecksums,
+					message.ReVerify,
+					err)
+
+				if database.IsTransitionError(err) {
+					// The file can not be completed in its current state, retrying will not help
+					if e := delivered.Nack(false, false); e != nil {
+						log.Errorf("Failed to nack following illegal status transition "+
+							"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+							delivered.CorrelationId,
+							message.User,
+							message.FilePath,
+							message.ArchivePath,
+							message.EncryptedChecksums,
+							message.ReVerify,
+							e)
+					}
+					// Send the message to an error queue so it can be analyzed.
+					fileError := broker.FileError{
+						User:     message.User,
+						FilePath: message.FilePath,
+						Reason:   err.Error(),
+					}
+					body, _ := json.Marshal(fileError)
+					if e := mq.SendMessageFor(delivered, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
+						log.Errorf("Failed to publish illegal status transition error message "+
+							"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+							delivered.CorrelationId,
+							message.User,
+							message.FilePath,
+							message.ArchivePath,
+							message.EncryptedChecksums,
+							message.ReVerify,
+							e)
+					}
+
+					return
+				}
+
+				// Retry the message after a delay
+				if e := mq.Retry(delivered, err); e != nil {
+					log.Errorf("Failed to retry message (MarkCompleted failed) "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.FilePath,
+						message.ArchivePath,
+						e)
+				}
+				return
+			}
+
+			log.Infof("File marked completed "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, decryptedchecksum: %x)",
+				delivered.CorrelationId,
+				message.User,
+				message.FilePath,
+				message.ArchivePath,
+				message.EncryptedChecksums,
+				message.ReVerify,
+				file.DecryptedChecksum.Sum(nil))
+
+			// Send message to verified queue
+
+			if err := mq.SendMessageFor(delivered,
+				conf.Broker.Exchange,
+				conf.Broker.RoutingKey,
+				conf.Broker.Durable,
+				verifiedMessage); err != nil {
+				log.Errorf("Sending of message failed "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.ArchivePath,
+					message.EncryptedChecksums,
+					message.ReVerify,
+					err)
+
+				// Retry the message so the file is verified again
+				if e := mq.Retry(delivered, err); e != nil {
+					log.Errorf("Failed to retry message (send failed) "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.FilePath,
+						message.ArchivePath,
+						e)
+				}
+
+				return
+			}
+		}
+
+		span = tracing.Start(delivered, "database MarkMessageDone")
+		err = db.MarkMessageDone(delivered.CorrelationId, "verify", delivered.Body)
+		span.End(err)
+		if err != nil {
+			log.Errorf("Failed to mark message as processed "+
+				"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.FilePath,
+				message.FileID,
+				err)
+		}
+
+		if err := delivered.Ack(false); err != nil {
+			log.Errorf("Failed acking completed work"+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+				delivered.CorrelationId,
+				message.User,
+				message.FilePath,
+				message.ArchivePath,
+				message.EncryptedChecksums,
+				message.ReVerify,
+				err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/storage"
+
+	"github.com/elixir-oslo/crypt4gh/keys"
+	"github.com/elixir-oslo/crypt4gh/model/headers"
+	"github.com/elixir-oslo/crypt4gh/streaming"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingBroker fails the first message sent to routingKey
+type failingBroker struct {
+	*broker.MemoryBroker
+	routingKey string
+	mu         sync.Mutex
+	failed     bool
+}
+
+func (b *failingBroker) SendMessageFor(delivered amqp.Delivery, exchange, routingKey string, reliable bool, body []byte) error {
+	b.mu.Lock()
+	fail := routingKey == b.routingKey && !b.failed
+	b.failed = b.failed || fail
+	b.mu.Unlock()
+	if fail {
+		return errors.New("connection lost")
+	}
+
+	return b.MemoryBroker.SendMessageFor(delivered, exchange, routingKey, reliable, body)
+}
+
+// testHandler is the handler consuming the archived queue, with a file
+// archived as "archived" in the database and archive storage
+type testHandler struct {
+	db      *database.SQLiteDB
+	archive storage.Backend
+	mq      *failingBroker
+	fileID  int64
+}
+
+// newTestHandler starts a handler whose first message to failRoutingKey
+// fails, the database and archive are removed when t ends
+func newTestHandler(t *testing.T, failRoutingKey string) *testHandler {
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+	defer viper.Reset()
+	keyring, err := config.GetC4GHKeyring()
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	db, err := database.NewSQLiteDB(filepath.Join(dir, "sda.db"))
+	assert.NoError(t, err)
+	t.Cleanup(db.Close)
+	var storageConf storage.Conf
+	storageConf.Posix.Location = dir
+	archive, err := storage.NewBackend(storageConf)
+	assert.NoError(t, err)
+
+	// Archive a file, with its header in the database
+	publicKeyFile, err := os.Open("../../dev_utils/c4gh.pub.pem")
+	assert.NoError(t, err)
+	publicKey, err := keys.ReadPublicKey(publicKeyFile)
+	assert.NoError(t, err)
+	_, writerKey, err := keys.GenerateKeyPair()
+	assert.NoError(t, err)
+	var encrypted bytes.Buffer
+	w, err := streaming.NewCrypt4GHWriter(&encrypted, writerKey, publicKey, nil)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("data"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	header, err := headers.ReadHeader(&encrypted)
+	assert.NoError(t, err)
+	dest, err := archive.NewFileWriter("archived")
+	assert.NoError(t, err)
+	_, err = io.Copy(dest, &encrypted)
+	assert.NoError(t, err)
+	assert.NoError(t, dest.Close())
+
+	file := database.FileInfo{Checksum: sha256.New(), Path: "archived", DecryptedChecksum: sha256.New()}
+	fileID, err := db.IngestFile("corr-id", "test", "file.c4gh", header, "", file)
+	assert.NoError(t, err)
+
+	conf := &config.Config{Broker: broker.MQConf{
+		Queue:        "archived",
+		Exchange:     "sda",
+		RoutingKey:   "verified",
+		RoutingError: "error",
+		SchemaType:   "federated",
+		MaxAttempts:  3,
+	}}
+	memory, err := broker.NewMemoryBroker(conf.Broker)
+	assert.NoError(t, err)
+	t.Cleanup(memory.Close)
+	memory.Bind("archived", "sda", "archived")
+	memory.Bind("verified", "sda", "verified")
+	memory.Bind("error", "sda", "error")
+	mq := &failingBroker{MemoryBroker: memory, routingKey: failRoutingKey}
+
+	go func() {
+		_ = mq.Consume("archived", 1, Handler(conf, mq, db, archive, keyring))
+	}()
+
+	return &testHandler{db: db, archive: archive, mq: mq, fileID: fileID}
+}
+
+// send publishes a message about the archived file and waits until it is
+// settled
+func (h *testHandler) send(t *testing.T, archivePath string, reVerify bool) {
+	body, _ := json.Marshal(message{
+		User:               "test",
+		FilePath:           "file.c4gh",
+		FileID:             int(h.fileID),
+		ArchivePath:        archivePath,
+		EncryptedChecksums: []checksums{{"sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}},
+		ReVerify:           reVerify,
+	})
+	assert.NoError(t, h.mq.SendMessage("corr-id", "sda", "archived", true, body))
+	assert.Eventually(t, func() bool {
+		return h.mq.Len("archived") == 0 && h.mq.Unacked() == 0
+	}, 5*time.Second, time.Millisecond)
+}
+
+// status returns the status of the archived file
+func (h *testHandler) status(t *testing.T) string {
+	files, err := h.db.ListFiles(database.FileFilter{User: "test"})
+	assert.NoError(t, err)
+	if !assert.Len(t, files, 1) {
+		return ""
+	}
+
+	return files[0].Status
+}
+
+// TestHandler_SendFailed redelivers a message after the file was marked
+// completed but the accession request could not be sent
+func TestHandler_SendFailed(t *testing.T) {
+	h := newTestHandler(t, "verified")
+	h.send(t, "archived", false)
+
+	assert.Equal(t, 1, h.mq.Len("verified"))
+	assert.Equal(t, 0, h.mq.Len("error"))
+	assert.Equal(t, 0, h.mq.Len("archived.dead-letter"))
+	assert.Equal(t, database.FileCompleted, h.status(t))
+}
+
+// TestHandler_ReVerify reads the file through without completing it again
+func TestHandler_ReVerify(t *testing.T) {
+	h := newTestHandler(t, "")
+	h.send(t, "archived", true)
+
+	assert.Equal(t, 0, h.mq.Len("verified"))
+	assert.Equal(t, 0, h.mq.Len("error"))
+	assert.Equal(t, database.FileArchived, h.status(t))
+}
+
+// TestHandler_Failed settles the messages that can not be handled, the
+// worker is free for the next message
+func TestHandler_Failed(t *testing.T) {
+	h := newTestHandler(t, "")
+
+	// A missing file is retried until the message is dead-lettered
+	h.send(t, "missing", false)
+	assert.Equal(t, 1, h.mq.Len("archived.dead-letter"))
+
+	// A file that does not decrypt is rejected
+	dest, err := h.archive.NewFileWriter("corrupt")
+	assert.NoError(t, err)
+	_, err = dest.Write(bytes.Repeat([]byte{1}, 1024))
+	assert.NoError(t, err)
+	assert.NoError(t, dest.Close())
+	h.send(t, "corrupt", false)
+	assert.Equal(t, 1, h.mq.Len("error"))
+
+	assert.Equal(t, 0, h.mq.Len("verified"))
+	assert.Equal(t, database.FileError, h.status(t))
+
+	events, err := h.db.GetFileEventLog(h.fileID)
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, events) {
+		assert.Equal(t, database.FileError, events[len(events)-1].Event)
+		assert.Equal(t, "verify", events[len(events)-1].Service)
+	}
+
+	h.send(t, "gone", false)
+	assert.Equal(t, 2, h.mq.Len("archived.dead-letter"))
+}
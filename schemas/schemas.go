@@ -0,0 +1,29 @@
+// Package schemas embeds the JSON schemas of the messages exchanged with the
+// message broker, so the services do not depend on schema files being
+// present next to the binaries. The schemas of each type are kept in one
+// directory for each message version, v1, v2 and so on.
+package schemas
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+)
+
+// Types lists the schema sets, one for each type of deployment
+var Types = []string{"federated", "isolated"}
+
+//go:embed federated/*/*.json isolated/*/*.json
+var files embed.FS
+
+// Embedded returns the embedded schemas of the set named schemaType, with
+// the version directories at its root
+func Embedded(schemaType string) (fs.FS, error) {
+	for _, t := range Types {
+		if t == schemaType {
+			return fs.Sub(files, schemaType)
+		}
+	}
+
+	return nil, fmt.Errorf("unknown schema type %s", schemaType)
+}